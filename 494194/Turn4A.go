@@ -1,13 +1,25 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/websocket"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"sync"
+	"time"
+)
+
+// Bus topics used by the hub
+const (
+	broadcastTopic  = "broadcast"
+	roomTopicPrefix = "room."
 )
 
 // WsMessageHandler interface for handling different types of messages
@@ -19,35 +31,161 @@ type WsMessageHandler interface {
 
 // Client struct represents a WebSocket client
 type Client struct {
-	conn   *websocket.Conn
-	send   chan []byte
-	state  map[string]interface{}
-	server *WsServer
+	conn     *websocket.Conn
+	send     chan []byte
+	state    map[string]interface{}
+	session  *Session
+	resumeID string
+	lastSeq  uint64
+	ip       string
+	// counted is set when the connection holds a MaxConnections slot
+	counted bool
+	limits  *clientLimits
+	server  *WsServer
+	// closeMessage is written by writePump after the hub closes send; it is
+	// set under WsServer.mu before that happens
+	closeMessage []byte
+}
+
+// roomMembership is a request to add or remove a client from a room
+type roomMembership struct {
+	client *Client
+	room   string
+	done   chan struct{}
+}
+
+// roomMessage is a room publish received from the bus
+type roomMessage struct {
+	room    string
+	message []byte
+}
+
+// Defaults applied to zero ServerConfig fields
+const (
+	defaultSessionBufferSize = 256
+	defaultSessionTTL        = 2 * time.Minute
+	defaultMaxMessageSize    = 64 * 1024
+	defaultMaxViolations     = 5
+	defaultBanAfter          = 3
+	defaultBanDuration       = 10 * time.Minute
+	clientSendBuffer         = 256
+	closeGracePeriod         = time.Second
+)
+
+var defaultMessageRate = RateLimit{PerSecond: 20, Burst: 40}
+
+// ServerConfig tunes a WsServer. Zero values fall back to the defaults.
+type ServerConfig struct {
+	// SessionBufferSize is how many outbound messages each session keeps for replay
+	SessionBufferSize int
+	// SessionTTL is how long a disconnected session waits to be resumed
+	SessionTTL time.Duration
+	// MaxConnections caps concurrent connections across every instance sharing
+	// Connections; 0 means no cap
+	MaxConnections int
+	// Connections counts open connections for MaxConnections. Replicas must
+	// share one, such as a RedisConnectionCounter, for the cap to be global;
+	// nil gives each instance its own in-memory counter
+	Connections ConnectionCounter
+	// MaxMessageSize is the largest frame a client may send; bigger frames close the connection
+	MaxMessageSize int64
+	// MessageRate limits each connection across all message types
+	MessageRate RateLimit
+	// MaxViolations is how many rejected messages a connection may send before it is dropped
+	MaxViolations int
+	// BanAfter is how many abuse disconnects within BanDuration get an IP banned for BanDuration
+	BanAfter    int
+	BanDuration time.Duration
 }
 
-// WsServer struct manages the WebSocket connections and dynamic handler registration
+func (c ServerConfig) withDefaults() ServerConfig {
+	if c.SessionBufferSize <= 0 {
+		c.SessionBufferSize = defaultSessionBufferSize
+	}
+	if c.SessionTTL <= 0 {
+		c.SessionTTL = defaultSessionTTL
+	}
+	if c.MaxMessageSize <= 0 {
+		c.MaxMessageSize = defaultMaxMessageSize
+	}
+	if c.MessageRate.PerSecond <= 0 || c.MessageRate.Burst <= 0 {
+		c.MessageRate = defaultMessageRate
+	}
+	if c.MaxViolations <= 0 {
+		c.MaxViolations = defaultMaxViolations
+	}
+	if c.BanAfter <= 0 {
+		c.BanAfter = defaultBanAfter
+	}
+	if c.BanDuration <= 0 {
+		c.BanDuration = defaultBanDuration
+	}
+	if c.Connections == nil {
+		c.Connections = NewMemoryConnectionCounter()
+	}
+	return c
+}
+
+// WsServer struct manages the WebSocket connections and dynamic handler registration.
+// Broadcasts and room publishes go through the bus, so they reach clients
+// connected to every server instance sharing it. Each connection is attached
+// to a Session that buffers its outbound messages for replay after a reconnect.
 type WsServer struct {
-	clients    map[*Client]bool
-	handlers   map[string]WsMessageHandler
-	register   chan *Client
-	unregister chan *Client
-	broadcast  chan []byte
-	mu         sync.Mutex
-	upgrader   websocket.Upgrader
-}
-
-// NewWsServer creates a new WebSocket server
-func NewWsServer() *WsServer {
-	return &WsServer{
-		clients:    make(map[*Client]bool),
+	config       ServerConfig
+	sessions     map[string]*Session
+	rooms        map[string]map[*Session]bool
+	roomSubs     map[string]Subscription
+	handlers     map[string]WsMessageHandler
+	policies     map[string]MessagePolicy
+	abuse        *abuseTracker
+	register     chan *Client
+	unregister   chan *Client
+	join         chan roomMembership
+	leave        chan roomMembership
+	broadcast    chan []byte
+	roomcast     chan roomMessage
+	bus          Bus
+	broadcastSub Subscription
+	quit         chan struct{}
+	mu           sync.Mutex
+	upgrader     websocket.Upgrader
+}
+
+// NewWsServer creates a new WebSocket server that fans out through bus
+func NewWsServer(bus Bus, config ServerConfig) (*WsServer, error) {
+	config = config.withDefaults()
+	s := &WsServer{
+		config:     config,
+		sessions:   make(map[string]*Session),
+		rooms:      make(map[string]map[*Session]bool),
+		roomSubs:   make(map[string]Subscription),
 		handlers:   make(map[string]WsMessageHandler),
+		policies:   make(map[string]MessagePolicy),
+		abuse:      newAbuseTracker(config.BanAfter, config.BanDuration),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		join:       make(chan roomMembership),
+		leave:      make(chan roomMembership),
 		broadcast:  make(chan []byte),
+		roomcast:   make(chan roomMessage),
+		bus:        bus,
+		quit:       make(chan struct{}),
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool { return true },
 		},
 	}
+
+	sub, err := bus.Subscribe(broadcastTopic, func(message []byte) {
+		select {
+		case s.broadcast <- message:
+		case <-s.quit:
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to broadcasts: %v", err)
+	}
+	s.broadcastSub = sub
+	return s, nil
 }
 
 // RegisterHandler registers a handler dynamically
@@ -55,59 +193,400 @@ func (s *WsServer) RegisterHandler(messageType string, handler WsMessageHandler)
 	s.handlers[messageType] = handler
 }
 
+// SetMessagePolicy sets the rate limit and validation rules for a message type
+func (s *WsServer) SetMessagePolicy(messageType string, policy MessagePolicy) {
+	s.policies[messageType] = policy
+}
+
+// Broadcast publishes a message to every client on every server instance
+func (s *WsServer) Broadcast(ctx context.Context, message []byte) error {
+	return s.bus.Publish(ctx, broadcastTopic, message)
+}
+
+// PublishToRoom publishes a message to the members of a room on every server instance
+func (s *WsServer) PublishToRoom(ctx context.Context, room string, message []byte) error {
+	return s.bus.Publish(ctx, roomTopicPrefix+room, message)
+}
+
+// JoinRoom adds a local client's session to a room. Once it returns the
+// session receives every later room publish. It must not be called from
+// OnOpen or OnClose, which run on the hub goroutine.
+func (s *WsServer) JoinRoom(client *Client, room string) {
+	s.changeMembership(s.join, client, room)
+}
+
+// LeaveRoom removes a local client's session from a room
+func (s *WsServer) LeaveRoom(client *Client, room string) {
+	s.changeMembership(s.leave, client, room)
+}
+
+// changeMembership hands a membership change to the hub and waits until it is applied
+func (s *WsServer) changeMembership(ch chan roomMembership, client *Client, room string) {
+	m := roomMembership{client: client, room: room, done: make(chan struct{})}
+	select {
+	case ch <- m:
+		<-m.done
+	case <-s.quit:
+	}
+}
+
+// Close stops the hub and drops its bus subscriptions
+func (s *WsServer) Close() error {
+	close(s.quit)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for room, sub := range s.roomSubs {
+		sub.Unsubscribe()
+		delete(s.roomSubs, room)
+	}
+	return s.broadcastSub.Unsubscribe()
+}
+
 // Run the server
 func (s *WsServer) run() {
+	sweep := time.NewTicker(s.config.SessionTTL / 2)
+	defer sweep.Stop()
+
 	for {
 		select {
 		case client := <-s.register:
 			s.mu.Lock()
-			s.clients[client] = true
+			s.attach(client)
 			s.mu.Unlock()
 			for _, handler := range s.handlers {
 				handler.OnOpen(client)
 			}
 		case client := <-s.unregister:
 			s.mu.Lock()
-			delete(s.clients, client)
-			close(client.send)
+			if client.session != nil && client.session.client == client {
+				s.detach(client.session)
+			}
 			for _, handler := range s.handlers {
 				handler.OnClose(client)
 			}
 			s.mu.Unlock()
+		case m := <-s.join:
+			s.mu.Lock()
+			if m.client.session != nil {
+				s.addToRoom(m.client.session, m.room)
+			}
+			s.mu.Unlock()
+			close(m.done)
+		case m := <-s.leave:
+			s.mu.Lock()
+			if m.client.session != nil {
+				s.removeFromRoom(m.client.session, m.room)
+			}
+			s.mu.Unlock()
+			close(m.done)
 		case message := <-s.broadcast:
 			s.mu.Lock()
-			for client := range s.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(s.clients, client)
-				}
+			for _, session := range s.sessions {
+				s.deliver(session, message)
+			}
+			s.mu.Unlock()
+		case m := <-s.roomcast:
+			s.mu.Lock()
+			for session := range s.rooms[m.room] {
+				s.deliver(session, m.message)
 			}
 			s.mu.Unlock()
+		case now := <-sweep.C:
+			s.mu.Lock()
+			s.expireSessions(now)
+			s.mu.Unlock()
+		case <-s.quit:
+			return
 		}
 	}
 }
 
-// ServeHTTP is the WebSocket handler
+// attach binds a new connection to its session. A client that presents a
+// known session ID gets the messages it missed replayed ahead of any live
+// traffic; if they are gone, or the session itself has expired, the welcome
+// frame tells the client to resync. Callers must hold s.mu.
+func (s *WsServer) attach(client *Client) {
+	session, resumed := s.sessions[client.resumeID]
+	resync := client.resumeID != "" && !resumed
+
+	var missed []sequencedMessage
+	if resumed {
+		if session.client != nil {
+			// The previous connection hasn't noticed it is dead yet
+			s.detach(session)
+		}
+		var ok bool
+		missed, ok = session.since(client.lastSeq)
+		resync = !ok
+	} else {
+		session = newSession(s.config.SessionBufferSize)
+		s.sessions[session.id] = session
+	}
+
+	session.client = client
+	client.session = session
+
+	// client.send is sized to hold the welcome frame and a full replay
+	client.send <- encodeFrame(sessionFrame{
+		Type:      sessionFrameType,
+		SessionID: session.id,
+		Seq:       session.lastSeq,
+		Resync:    resync,
+	})
+	for _, msg := range missed {
+		client.send <- encodeMessage(msg)
+	}
+}
+
+// detach disconnects a session from its client and starts its expiry clock.
+// Callers must hold s.mu.
+func (s *WsServer) detach(session *Session) {
+	close(session.client.send)
+	session.client = nil
+	session.detachedAt = time.Now()
+}
+
+// deliver records a message in the session buffer and queues it for the
+// attached client. A client that can't keep up is detached; it can resume
+// and have the backlog replayed. Callers must hold s.mu.
+func (s *WsServer) deliver(session *Session, message []byte) {
+	msg := session.append(message)
+	if session.client == nil {
+		return
+	}
+	select {
+	case session.client.send <- encodeMessage(msg):
+	default:
+		s.detach(session)
+	}
+}
+
+// expireSessions forgets sessions that have been detached for longer than
+// the session TTL. Callers must hold s.mu.
+func (s *WsServer) expireSessions(now time.Time) {
+	for _, session := range s.sessions {
+		if session.client != nil || now.Sub(session.detachedAt) < s.config.SessionTTL {
+			continue
+		}
+		s.forget(session)
+	}
+}
+
+// forget drops a detached session and its room memberships, so it can no
+// longer be resumed. Callers must hold s.mu.
+func (s *WsServer) forget(session *Session) {
+	for room := range session.rooms {
+		s.removeFromRoom(session, room)
+	}
+	delete(s.sessions, session.id)
+}
+
+// addToRoom subscribes to the room topic when its first local member joins.
+// Callers must hold s.mu.
+func (s *WsServer) addToRoom(session *Session, room string) {
+	if _, ok := s.roomSubs[room]; !ok {
+		sub, err := s.bus.Subscribe(roomTopicPrefix+room, func(message []byte) {
+			select {
+			case s.roomcast <- roomMessage{room: room, message: message}:
+			case <-s.quit:
+			}
+		})
+		if err != nil {
+			log.Printf("Failed to subscribe to room %s: %v", room, err)
+			return
+		}
+		s.roomSubs[room] = sub
+		s.rooms[room] = make(map[*Session]bool)
+	}
+	s.rooms[room][session] = true
+	session.rooms[room] = true
+}
+
+// removeFromRoom unsubscribes from the room topic when its last local member leaves.
+// Callers must hold s.mu.
+func (s *WsServer) removeFromRoom(session *Session, room string) {
+	members, ok := s.rooms[room]
+	if !ok {
+		return
+	}
+	delete(members, session)
+	delete(session.rooms, room)
+	if len(members) > 0 {
+		return
+	}
+	delete(s.rooms, room)
+	if sub, ok := s.roomSubs[room]; ok {
+		if err := sub.Unsubscribe(); err != nil {
+			log.Printf("Failed to unsubscribe from room %s: %v", room, err)
+		}
+		delete(s.roomSubs, room)
+	}
+}
+
+// ServeHTTP is the WebSocket handler. Clients resume a session by passing
+// the session ID from their welcome frame and the last sequence number they
+// processed as the "session" and "last_seq" query parameters.
 func (s *WsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ip := remoteIP(r)
+	if s.abuse.banned(ip, time.Now()) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	var lastSeq uint64
+	if v := query.Get("last_seq"); v != "" {
+		var err error
+		if lastSeq, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "invalid last_seq", http.StatusBadRequest)
+			return
+		}
+	}
+
+	counted, ok := s.acquireConnection(r.Context())
+	if !ok {
+		http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+		return
+	}
+
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		s.releaseConnection(counted)
 		log.Println("Failed to upgrade connection:", err)
 		return
 	}
-	client := &Client{conn: conn, send: make(chan []byte), server: s, state: make(map[string]interface{})}
-	s.register <- client
+	conn.SetReadLimit(s.config.MaxMessageSize)
+	client := &Client{
+		conn:     conn,
+		send:     make(chan []byte, s.config.SessionBufferSize+clientSendBuffer),
+		server:   s,
+		state:    make(map[string]interface{}),
+		resumeID: query.Get("session"),
+		lastSeq:  lastSeq,
+		ip:       ip,
+		counted:  counted,
+		limits:   newClientLimits(s.config),
+	}
+	select {
+	case s.register <- client:
+	case <-s.quit:
+		s.releaseConnection(counted)
+		conn.Close()
+		return
+	}
 
 	go client.readPump(s.handlers)
 	go client.writePump()
 }
 
+// acquireConnection takes a slot under MaxConnections. It reports whether a
+// slot was taken, to be released when the connection ends, and whether the
+// connection may proceed. If the counter fails the connection is admitted
+// uncounted, so a Redis outage does not lock every client out.
+func (s *WsServer) acquireConnection(ctx context.Context) (counted, ok bool) {
+	max := s.config.MaxConnections
+	if max <= 0 {
+		return false, true
+	}
+	acquired, err := s.config.Connections.Acquire(ctx, max)
+	if err != nil {
+		log.Println("Connection counter error, admitting connection:", err)
+		return false, true
+	}
+	return acquired, acquired
+}
+
+// releaseConnection returns a slot taken by acquireConnection
+func (s *WsServer) releaseConnection(counted bool) {
+	if !counted {
+		return
+	}
+	if err := s.config.Connections.Release(context.Background()); err != nil {
+		log.Println("Failed to release connection slot:", err)
+	}
+}
+
+// remoteIP returns the host part of the request's remote address
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Send queues a message for this client through its session, so it is
+// sequenced and replayable like hub traffic
+func (c *Client) Send(message []byte) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	if c.session == nil || c.session.client != c {
+		return
+	}
+	c.server.deliver(c.session, message)
+}
+
+// sendError reports a rejected message to this client. Error frames skip the
+// session buffer and are dropped if the client is not keeping up.
+func (c *Client) sendError(v *violation) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	if c.session == nil || c.session.client != c {
+		return
+	}
+	select {
+	case c.send <- encodeFrame(sessionFrame{Type: errorFrameType, Error: v.code, Detail: v.detail}):
+	default:
+	}
+}
+
+// reportViolation sends an error frame and reports whether the client has
+// now misbehaved often enough to be disconnected. Each abuse disconnect
+// counts against the client's IP and can get it banned, and ends its session.
+func (c *Client) reportViolation(v *violation) bool {
+	c.sendError(v)
+	c.limits.violations++
+	if c.limits.violations < c.server.config.MaxViolations {
+		return false
+	}
+
+	if c.server.abuse.strike(c.ip, time.Now()) {
+		log.Printf("Banning %s for %v after repeated abuse", c.ip, c.server.config.BanDuration)
+	}
+
+	// Detaching closes send, so writePump flushes the error frames queued
+	// so far before writing the close frame. The session is dropped too, so
+	// the client cannot resume it from another IP and get its rooms back.
+	c.server.mu.Lock()
+	c.closeMessage = websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too many invalid messages")
+	if c.session != nil && c.session.client == c {
+		c.server.detach(c.session)
+		c.server.forget(c.session)
+	}
+	c.server.mu.Unlock()
+	return true
+}
+
+// discardUntilClosed ignores further input until writePump has closed the
+// connection or the grace period runs out
+func (c *Client) discardUntilClosed() {
+	c.conn.SetReadDeadline(time.Now().Add(closeGracePeriod))
+	for {
+		if _, _, err := c.conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
+
 // Client readPump to read messages from WebSocket
 func (c *Client) readPump(handlers map[string]WsMessageHandler) {
 	defer func() {
-		c.server.unregister <- c
+		select {
+		case c.server.unregister <- c:
+		case <-c.server.quit:
+		}
 		c.conn.Close()
+		c.server.releaseConnection(c.counted)
 	}()
 	for {
 		messageType, message, err := c.conn.ReadMessage()
@@ -119,6 +598,14 @@ func (c *Client) readPump(handlers map[string]WsMessageHandler) {
 		// Convert messageType to string for map key
 		messageTypeStr := fmt.Sprintf("%d", messageType)
 
+		if v := c.limits.check(messageTypeStr, c.server.policies[messageTypeStr], message); v != nil {
+			if c.reportViolation(v) {
+				c.discardUntilClosed()
+				break
+			}
+			continue
+		}
+
 		handler, exists := handlers[messageTypeStr]
 		if exists {
 			handler.OnMessage(c, message)
@@ -130,13 +617,17 @@ func (c *Client) readPump(handlers map[string]WsMessageHandler) {
 
 // Client writePump to send messages to WebSocket
 func (c *Client) writePump() {
+	defer c.conn.Close()
 	for message := range c.send {
 		err := c.conn.WriteMessage(websocket.TextMessage, message)
 		if err != nil {
 			log.Println("writePump error:", err)
-			break
+			return
 		}
 	}
+	if c.closeMessage != nil {
+		c.conn.WriteControl(websocket.CloseMessage, c.closeMessage, time.Now().Add(closeGracePeriod))
+	}
 }
 
 // TextMessageHandler handles text messages
@@ -148,7 +639,7 @@ func (h *TextMessageHandler) OnOpen(client *Client) {
 
 func (h *TextMessageHandler) OnMessage(client *Client, message []byte) {
 	log.Printf("TextMessageHandler: Received message: %s", string(message))
-	client.send <- message
+	client.Send(message)
 }
 
 func (h *TextMessageHandler) OnClose(client *Client) {
@@ -179,9 +670,10 @@ func loadHandlersFromConfig(configPath string, server *WsServer) error {
 
 	var config struct {
 		Handlers []struct {
-			Name        string `json:"name"`
-			Type        string `json:"type"`
-			MessageType string `json:"message_type"`
+			Name        string          `json:"name"`
+			Type        string          `json:"type"`
+			MessageType string          `json:"message_type"`
+			Policy      json.RawMessage `json:"policy"`
 		} `json:"handlers"`
 	}
 
@@ -201,13 +693,35 @@ func loadHandlersFromConfig(configPath string, server *WsServer) error {
 			return fmt.Errorf("unknown handler type: %s", handlerConfig.Type)
 		}
 		server.RegisterHandler(handlerConfig.MessageType, handler)
+
+		policy, err := parsePolicy(handlerConfig.Policy)
+		if err != nil {
+			return fmt.Errorf("invalid policy for handler %s: %v", handlerConfig.Name, err)
+		}
+		server.SetMessagePolicy(handlerConfig.MessageType, policy)
 	}
 
 	return nil
 }
 
+// newBusFromEnv uses Redis when REDIS_ADDR is set so replicas share broadcasts
+// and the connection cap, and falls back to in-memory state for a single
+// instance
+func newBusFromEnv() (Bus, ConnectionCounter) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		return NewMemoryBus(), NewMemoryConnectionCounter()
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	return NewRedisBus(client, "ws:"), NewRedisConnectionCounter(client, "ws:")
+}
+
 func main() {
-	server := NewWsServer()
+	bus, connections := newBusFromEnv()
+	server, err := NewWsServer(bus, ServerConfig{Connections: connections})
+	if err != nil {
+		log.Fatalf("Error creating server: %v", err)
+	}
 
 	// Load handlers dynamically
 	if err := loadHandlersFromConfig("handlers_config.json", server); err != nil {
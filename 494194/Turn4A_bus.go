@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Bus carries hub messages between server instances. A message published on
+// a topic is delivered once to every subscription on that topic, including
+// subscriptions held by the publishing instance itself.
+type Bus interface {
+	Publish(ctx context.Context, topic string, payload []byte) error
+	Subscribe(topic string, handler func(payload []byte)) (Subscription, error)
+	Close() error
+}
+
+// Subscription is a live registration on a Bus topic
+type Subscription interface {
+	Unsubscribe() error
+}
+
+// MemoryBus is an in-process Bus, used for tests and single-instance setups
+type MemoryBus struct {
+	mu     sync.RWMutex
+	subs   map[string]map[*memorySubscription]bool
+	closed bool
+}
+
+// NewMemoryBus creates a new in-memory bus
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{
+		subs: make(map[string]map[*memorySubscription]bool),
+	}
+}
+
+type memorySubscription struct {
+	bus      *MemoryBus
+	topic    string
+	queue    chan []byte
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// Publish delivers payload to every current subscriber of topic
+func (b *MemoryBus) Publish(ctx context.Context, topic string, payload []byte) error {
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return fmt.Errorf("bus is closed")
+	}
+	subs := make([]*memorySubscription, 0, len(b.subs[topic]))
+	for sub := range b.subs[topic] {
+		subs = append(subs, sub)
+	}
+	b.mu.RUnlock()
+
+	for _, sub := range subs {
+		select {
+		case sub.queue <- payload:
+		case <-sub.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Subscribe registers handler for topic. Handlers run on a dedicated goroutine
+// per subscription, so a slow handler never blocks publishers of other topics.
+func (b *MemoryBus) Subscribe(topic string, handler func(payload []byte)) (Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, fmt.Errorf("bus is closed")
+	}
+
+	sub := &memorySubscription{
+		bus:   b,
+		topic: topic,
+		queue: make(chan []byte, 256),
+		done:  make(chan struct{}),
+	}
+	if b.subs[topic] == nil {
+		b.subs[topic] = make(map[*memorySubscription]bool)
+	}
+	b.subs[topic][sub] = true
+
+	go func() {
+		for {
+			select {
+			case payload := <-sub.queue:
+				handler(payload)
+			case <-sub.done:
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+// Close drops all subscriptions and rejects further use of the bus
+func (b *MemoryBus) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	var subs []*memorySubscription
+	for _, topicSubs := range b.subs {
+		for sub := range topicSubs {
+			subs = append(subs, sub)
+		}
+	}
+	b.subs = make(map[string]map[*memorySubscription]bool)
+	b.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.stop()
+	}
+	return nil
+}
+
+func (s *memorySubscription) Unsubscribe() error {
+	s.bus.mu.Lock()
+	delete(s.bus.subs[s.topic], s)
+	if len(s.bus.subs[s.topic]) == 0 {
+		delete(s.bus.subs, s.topic)
+	}
+	s.bus.mu.Unlock()
+	s.stop()
+	return nil
+}
+
+func (s *memorySubscription) stop() {
+	s.stopOnce.Do(func() { close(s.done) })
+}
+
+// RedisBus is a Bus backed by Redis pub/sub, so every server instance
+// connected to the same Redis sees messages published by any other instance
+type RedisBus struct {
+	client *redis.Client
+	prefix string
+	mu     sync.Mutex
+	subs   map[*redisSubscription]bool
+}
+
+// NewRedisBus creates a bus on top of client. Topics are namespaced with
+// prefix so several applications can share one Redis.
+func NewRedisBus(client *redis.Client, prefix string) *RedisBus {
+	return &RedisBus{
+		client: client,
+		prefix: prefix,
+		subs:   make(map[*redisSubscription]bool),
+	}
+}
+
+type redisSubscription struct {
+	bus    *RedisBus
+	pubsub *redis.PubSub
+}
+
+// Publish sends payload to all instances subscribed to topic
+func (b *RedisBus) Publish(ctx context.Context, topic string, payload []byte) error {
+	return b.client.Publish(ctx, b.prefix+topic, payload).Err()
+}
+
+// Subscribe registers handler for topic and waits until Redis has confirmed
+// the subscription, so messages published after it returns are not missed
+func (b *RedisBus) Subscribe(topic string, handler func(payload []byte)) (Subscription, error) {
+	ctx := context.Background()
+	pubsub := b.client.Subscribe(ctx, b.prefix+topic)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, fmt.Errorf("failed to subscribe to %s: %v", topic, err)
+	}
+
+	sub := &redisSubscription{bus: b, pubsub: pubsub}
+	b.mu.Lock()
+	b.subs[sub] = true
+	b.mu.Unlock()
+
+	go func() {
+		for msg := range pubsub.Channel() {
+			handler([]byte(msg.Payload))
+		}
+	}()
+	return sub, nil
+}
+
+// Close drops all subscriptions. The underlying Redis client is owned by the
+// caller and is left open.
+func (b *RedisBus) Close() error {
+	b.mu.Lock()
+	subs := b.subs
+	b.subs = make(map[*redisSubscription]bool)
+	b.mu.Unlock()
+
+	for sub := range subs {
+		if err := sub.pubsub.Close(); err != nil {
+			log.Println("RedisBus: failed to close subscription:", err)
+		}
+	}
+	return nil
+}
+
+func (s *redisSubscription) Unsubscribe() error {
+	s.bus.mu.Lock()
+	delete(s.bus.subs, s)
+	s.bus.mu.Unlock()
+
+	return s.pubsub.Close()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ConnectionCounter counts open connections across every server instance
+// sharing it, so ServerConfig.MaxConnections caps the whole deployment
+// rather than each replica
+type ConnectionCounter interface {
+	// Acquire takes a connection slot, reporting false if limit slots are already taken
+	Acquire(ctx context.Context, limit int) (bool, error)
+	// Release returns a slot taken by Acquire
+	Release(ctx context.Context) error
+}
+
+// MemoryConnectionCounter is an in-process ConnectionCounter, used for tests
+// and single-instance setups
+type MemoryConnectionCounter struct {
+	mu   sync.Mutex
+	open int
+}
+
+// NewMemoryConnectionCounter creates a counter with no open connections
+func NewMemoryConnectionCounter() *MemoryConnectionCounter {
+	return &MemoryConnectionCounter{}
+}
+
+func (c *MemoryConnectionCounter) Acquire(ctx context.Context, limit int) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.open >= limit {
+		return false, nil
+	}
+	c.open++
+	return true, nil
+}
+
+func (c *MemoryConnectionCounter) Release(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.open > 0 {
+		c.open--
+	}
+	return nil
+}
+
+// Heartbeats keep a RedisConnectionCounter's slots alive. Slots of an
+// instance that stops heartbeating, because it crashed, are freed once its
+// heartbeat expires.
+const (
+	connectionHeartbeatTTL      = 30 * time.Second
+	connectionHeartbeatInterval = 10 * time.Second
+)
+
+// acquireScript counts the slots of every instance with a live heartbeat,
+// dropping the others, and takes one for this instance if any are free.
+// KEYS[1] is the hash of slots by instance and KEYS[2] this instance's
+// heartbeat; ARGV holds the instance ID, the limit, the heartbeat TTL in
+// milliseconds and the heartbeat key prefix.
+var acquireScript = redis.NewScript(`
+redis.call('SET', KEYS[2], 1, 'PX', ARGV[3])
+local total = 0
+local slots = redis.call('HGETALL', KEYS[1])
+for i = 1, #slots, 2 do
+  if slots[i] ~= ARGV[1] and redis.call('EXISTS', ARGV[4] .. slots[i]) == 0 then
+    redis.call('HDEL', KEYS[1], slots[i])
+  else
+    total = total + tonumber(slots[i + 1])
+  end
+end
+if total >= tonumber(ARGV[2]) then
+  return 0
+end
+redis.call('HINCRBY', KEYS[1], ARGV[1], 1)
+return 1
+`)
+
+// releaseScript returns one of this instance's slots
+var releaseScript = redis.NewScript(`
+if redis.call('HINCRBY', KEYS[1], ARGV[1], -1) <= 0 then
+  redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// RedisConnectionCounter is a ConnectionCounter shared through Redis by every
+// server instance using the same prefix
+type RedisConnectionCounter struct {
+	client   *redis.Client
+	prefix   string
+	instance string
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewRedisConnectionCounter creates a counter for this instance on top of
+// client and starts heartbeating for its slots. Keys are namespaced with
+// prefix so several applications can share one Redis.
+func NewRedisConnectionCounter(client *redis.Client, prefix string) *RedisConnectionCounter {
+	c := &RedisConnectionCounter{
+		client:   client,
+		prefix:   prefix,
+		instance: newSessionID(),
+		stop:     make(chan struct{}),
+	}
+	go c.heartbeat()
+	return c
+}
+
+func (c *RedisConnectionCounter) slotsKey() string {
+	return c.prefix + "connections"
+}
+
+func (c *RedisConnectionCounter) heartbeatPrefix() string {
+	return c.prefix + "instance:"
+}
+
+func (c *RedisConnectionCounter) heartbeatKey() string {
+	return c.heartbeatPrefix() + c.instance
+}
+
+func (c *RedisConnectionCounter) Acquire(ctx context.Context, limit int) (bool, error) {
+	ok, err := acquireScript.Run(ctx, c.client, []string{c.slotsKey(), c.heartbeatKey()},
+		c.instance, limit, connectionHeartbeatTTL.Milliseconds(), c.heartbeatPrefix()).Int()
+	return ok == 1, err
+}
+
+func (c *RedisConnectionCounter) Release(ctx context.Context) error {
+	return releaseScript.Run(ctx, c.client, []string{c.slotsKey()}, c.instance).Err()
+}
+
+// heartbeat refreshes this instance's heartbeat until Close
+func (c *RedisConnectionCounter) heartbeat() {
+	ticker := time.NewTicker(connectionHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.client.Set(context.Background(), c.heartbeatKey(), 1, connectionHeartbeatTTL).Err(); err != nil {
+				log.Println("RedisConnectionCounter: failed to refresh heartbeat:", err)
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Close stops heartbeating and frees this instance's slots. The underlying
+// Redis client is owned by the caller and is left open.
+func (c *RedisConnectionCounter) Close() error {
+	c.stopOnce.Do(func() { close(c.stop) })
+	ctx := context.Background()
+	if err := c.client.HDel(ctx, c.slotsKey(), c.instance).Err(); err != nil {
+		return err
+	}
+	return c.client.Del(ctx, c.heartbeatKey()).Err()
+}
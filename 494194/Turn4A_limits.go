@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Error codes sent to clients in "error" frames
+const (
+	errRateLimited    = "rate_limited"
+	errMessageTooBig  = "message_too_large"
+	errInvalidMessage = "invalid_message"
+)
+
+// RateLimit configures a token bucket: PerSecond tokens are added each
+// second, up to Burst
+type RateLimit struct {
+	PerSecond float64 `json:"per_second"`
+	Burst     int     `json:"burst"`
+}
+
+func (r RateLimit) newLimiter() *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(r.PerSecond), r.Burst)
+}
+
+// MessagePolicy holds the limits and validation rules for one registered
+// message type. Zero fields are not enforced.
+type MessagePolicy struct {
+	RateLimit *RateLimit     `json:"rate_limit,omitempty"`
+	MaxBytes  int            `json:"max_bytes,omitempty"`
+	Schema    *MessageSchema `json:"schema,omitempty"`
+}
+
+// MessageSchema is a JSON-schema-style description of a message payload. It
+// supports the subset of keywords we need to reject malformed traffic early.
+type MessageSchema struct {
+	Type                 string                    `json:"type,omitempty"`
+	Properties           map[string]*MessageSchema `json:"properties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+	AdditionalProperties *bool                     `json:"additionalProperties,omitempty"`
+	Items                *MessageSchema            `json:"items,omitempty"`
+	Enum                 []interface{}             `json:"enum,omitempty"`
+	MinLength            *int                      `json:"minLength,omitempty"`
+	MaxLength            *int                      `json:"maxLength,omitempty"`
+	Minimum              *float64                  `json:"minimum,omitempty"`
+	Maximum              *float64                  `json:"maximum,omitempty"`
+	MaxItems             *int                      `json:"maxItems,omitempty"`
+}
+
+// ValidateJSON decodes payload and validates it against the schema
+func (s *MessageSchema) ValidateJSON(payload []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return fmt.Errorf("payload is not valid JSON: %v", err)
+	}
+	return s.validate("$", value)
+}
+
+func (s *MessageSchema) validate(path string, value interface{}) error {
+	if s.Type != "" && !schemaTypeMatches(s.Type, value) {
+		return fmt.Errorf("%s: expected %s, got %s", path, s.Type, jsonTypeName(value))
+	}
+	if len(s.Enum) > 0 && !enumContains(s.Enum, value) {
+		return fmt.Errorf("%s: value is not one of the allowed values", path)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required field %q", path, name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s: unexpected field %q", path, name)
+				}
+				continue
+			}
+			if err := prop.validate(path+"."+name, v[name]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fmt.Errorf("%s: has %d items, at most %d allowed", path, len(v), *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		n := len([]rune(v))
+		if s.MinLength != nil && n < *s.MinLength {
+			return fmt.Errorf("%s: shorter than %d characters", path, *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fmt.Errorf("%s: longer than %d characters", path, *s.MaxLength)
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			return fmt.Errorf("%s: %v is below the minimum %v", path, v, *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			return fmt.Errorf("%s: %v is above the maximum %v", path, v, *s.Maximum)
+		}
+	}
+	return nil
+}
+
+func schemaTypeMatches(schemaType string, value interface{}) bool {
+	if schemaType == "integer" {
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	}
+	return schemaType == jsonTypeName(value)
+}
+
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// enumContains compares deeply, since decoded arrays and objects are slices
+// and maps, which == cannot compare
+func enumContains(enum []interface{}, value interface{}) bool {
+	for _, allowed := range enum {
+		if reflect.DeepEqual(allowed, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// violation is a rejected inbound message
+type violation struct {
+	code   string
+	detail string
+}
+
+// clientLimits tracks one connection's token buckets and violations. It is
+// only touched from the connection's readPump goroutine.
+type clientLimits struct {
+	message    *rate.Limiter
+	perType    map[string]*rate.Limiter
+	violations int
+}
+
+func newClientLimits(config ServerConfig) *clientLimits {
+	return &clientLimits{
+		message: config.MessageRate.newLimiter(),
+		perType: make(map[string]*rate.Limiter),
+	}
+}
+
+// check applies the connection limit, then the message type's policy
+func (l *clientLimits) check(messageType string, policy MessagePolicy, message []byte) *violation {
+	if !l.message.Allow() {
+		return &violation{code: errRateLimited, detail: "too many messages"}
+	}
+	if policy.RateLimit != nil {
+		limiter, ok := l.perType[messageType]
+		if !ok {
+			limiter = policy.RateLimit.newLimiter()
+			l.perType[messageType] = limiter
+		}
+		if !limiter.Allow() {
+			return &violation{code: errRateLimited, detail: fmt.Sprintf("too many messages of type %s", messageType)}
+		}
+	}
+	if policy.MaxBytes > 0 && len(message) > policy.MaxBytes {
+		return &violation{code: errMessageTooBig, detail: fmt.Sprintf("message exceeds %d bytes", policy.MaxBytes)}
+	}
+	if policy.Schema != nil {
+		if err := policy.Schema.ValidateJSON(message); err != nil {
+			return &violation{code: errInvalidMessage, detail: err.Error()}
+		}
+	}
+	return nil
+}
+
+// abuseTracker remembers which IPs were disconnected for abuse and bans
+// those that keep coming back
+type abuseTracker struct {
+	mu          sync.Mutex
+	banAfter    int
+	banDuration time.Duration
+	strikes     map[string][]time.Time
+	bannedUntil map[string]time.Time
+}
+
+func newAbuseTracker(banAfter int, banDuration time.Duration) *abuseTracker {
+	return &abuseTracker{
+		banAfter:    banAfter,
+		banDuration: banDuration,
+		strikes:     make(map[string][]time.Time),
+		bannedUntil: make(map[string]time.Time),
+	}
+}
+
+// strike records an abuse disconnect and reports whether the IP is now banned.
+// Strikes older than the ban duration are forgotten.
+func (a *abuseTracker) strike(ip string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	recent := a.strikes[ip][:0]
+	for _, at := range a.strikes[ip] {
+		if now.Sub(at) < a.banDuration {
+			recent = append(recent, at)
+		}
+	}
+	recent = append(recent, now)
+
+	if len(recent) >= a.banAfter {
+		a.bannedUntil[ip] = now.Add(a.banDuration)
+		delete(a.strikes, ip)
+		return true
+	}
+	a.strikes[ip] = recent
+	return false
+}
+
+// banned reports whether ip is currently banned
+func (a *abuseTracker) banned(ip string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	until, ok := a.bannedUntil[ip]
+	if !ok {
+		return false
+	}
+	if now.After(until) {
+		delete(a.bannedUntil, ip)
+		return false
+	}
+	return true
+}
+
+// parsePolicy decodes and validates the policy section of a handler config entry
+func parsePolicy(raw json.RawMessage) (MessagePolicy, error) {
+	var policy MessagePolicy
+	if len(raw) == 0 {
+		return policy, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&policy); err != nil {
+		return policy, err
+	}
+	if policy.RateLimit != nil && (policy.RateLimit.PerSecond <= 0 || policy.RateLimit.Burst <= 0) {
+		return policy, fmt.Errorf("rate_limit needs a positive per_second and burst")
+	}
+	return policy, nil
+}
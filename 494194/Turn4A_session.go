@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Frame types sent to clients
+const (
+	sessionFrameType = "session"
+	messageFrameType = "message"
+	errorFrameType   = "error"
+)
+
+// sessionFrame is the envelope for everything written to a client, as one
+// JSON object per text message:
+//
+//	{"type":"session","session_id":"9f86d081...","seq":41,"resync":true}
+//	{"type":"message","seq":42,"data":"aGVsbG8="}
+//	{"type":"error","seq":0,"error":"invalid_message","detail":"..."}
+//
+// A "session" frame is sent first on every connection and tells the client
+// which session ID to present when reconnecting. Resync is set when the client
+// asked to resume but its missed messages are no longer available, so it must
+// reload its state from scratch. "message" frames carry hub traffic in
+// sequence order; data is the published payload, base64 encoded so arbitrary
+// bytes survive live delivery and replay unchanged. "error" frames report a
+// rejected inbound message; they are not sequenced.
+type sessionFrame struct {
+	Type      string `json:"type"`
+	SessionID string `json:"session_id,omitempty"`
+	Seq       uint64 `json:"seq"`
+	Resync    bool   `json:"resync,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+	Data      []byte `json:"data,omitempty"`
+}
+
+// sequencedMessage is an outbound message with its per-session sequence number
+type sequencedMessage struct {
+	seq     uint64
+	payload []byte
+}
+
+// Session outlives a single connection so a reconnecting client can pick up
+// where it left off. It keeps room memberships and the most recent outbound
+// messages while the client is away. Sessions are owned by the hub and all
+// fields are guarded by WsServer.mu.
+type Session struct {
+	id         string
+	client     *Client
+	rooms      map[string]bool
+	buffer     []sequencedMessage
+	start      int
+	lastSeq    uint64
+	detachedAt time.Time
+}
+
+func newSession(bufferSize int) *Session {
+	return &Session{
+		id:     newSessionID(),
+		rooms:  make(map[string]bool),
+		buffer: make([]sequencedMessage, 0, bufferSize),
+	}
+}
+
+// newSessionID returns a random, unguessable session identifier
+func newSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// append assigns the next sequence number to payload and records it,
+// overwriting the oldest message once the buffer is full
+func (s *Session) append(payload []byte) sequencedMessage {
+	s.lastSeq++
+	msg := sequencedMessage{seq: s.lastSeq, payload: payload}
+	if len(s.buffer) < cap(s.buffer) {
+		s.buffer = append(s.buffer, msg)
+	} else {
+		s.buffer[s.start] = msg
+		s.start = (s.start + 1) % len(s.buffer)
+	}
+	return msg
+}
+
+// since returns the buffered messages after lastSeen in order. It reports
+// false when some of them have already rolled out of the buffer, or when
+// lastSeen is ahead of anything this session has sent.
+func (s *Session) since(lastSeen uint64) ([]sequencedMessage, bool) {
+	if lastSeen > s.lastSeq {
+		return nil, false
+	}
+	missed := int(s.lastSeq - lastSeen)
+	if missed > len(s.buffer) {
+		return nil, false
+	}
+	messages := make([]sequencedMessage, 0, missed)
+	for i := len(s.buffer) - missed; i < len(s.buffer); i++ {
+		messages = append(messages, s.buffer[(s.start+i)%len(s.buffer)])
+	}
+	return messages, true
+}
+
+func encodeFrame(frame sessionFrame) []byte {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		// sessionFrame only holds strings, byte slices and integers
+		panic(err)
+	}
+	return data
+}
+
+func encodeMessage(msg sequencedMessage) []byte {
+	return encodeFrame(sessionFrame{Type: messageFrameType, Seq: msg.seq, Data: msg.payload})
+}
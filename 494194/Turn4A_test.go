@@ -0,0 +1,632 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+)
+
+// openRecorder reports every client the server opens and every message it dispatches
+type openRecorder struct {
+	opened   chan *Client
+	messages chan []byte
+}
+
+func (h *openRecorder) OnOpen(client *Client)                    { h.opened <- client }
+func (h *openRecorder) OnMessage(client *Client, message []byte) { h.messages <- message }
+func (h *openRecorder) OnClose(client *Client)                   {}
+
+type testInstance struct {
+	server   *WsServer
+	http     *httptest.Server
+	opened   chan *Client
+	messages chan []byte
+}
+
+func startInstance(t *testing.T, bus Bus) *testInstance {
+	return startInstanceWithConfig(t, bus, ServerConfig{})
+}
+
+func startInstanceWithConfig(t *testing.T, bus Bus, config ServerConfig) *testInstance {
+	t.Helper()
+	server, err := NewWsServer(bus, config)
+	if err != nil {
+		t.Fatalf("NewWsServer: %v", err)
+	}
+	recorder := &openRecorder{opened: make(chan *Client, 8), messages: make(chan []byte, 64)}
+	server.RegisterHandler("1", recorder)
+	go server.run()
+
+	inst := &testInstance{
+		server:   server,
+		http:     httptest.NewServer(server),
+		opened:   recorder.opened,
+		messages: recorder.messages,
+	}
+	t.Cleanup(func() {
+		inst.http.Close()
+		server.Close()
+	})
+	return inst
+}
+
+// connect dials the instance and returns the client side connection along
+// with the server side Client once the hub has registered it
+func (inst *testInstance) connect(t *testing.T) (*websocket.Conn, *Client) {
+	t.Helper()
+	conn, client, _ := inst.dial(t, "")
+	return conn, client
+}
+
+func (inst *testInstance) url(query string) string {
+	return "ws" + strings.TrimPrefix(inst.http.URL, "http") + query
+}
+
+// dial connects with the given query string and consumes the welcome frame
+func (inst *testInstance) dial(t *testing.T, query string) (*websocket.Conn, *Client, sessionFrame) {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(inst.url(query), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var client *Client
+	select {
+	case client = <-inst.opened:
+	case <-time.After(2 * time.Second):
+		t.Fatal("client was not registered")
+	}
+
+	welcome := readFrame(t, conn)
+	if welcome.Type != sessionFrameType || welcome.SessionID == "" {
+		t.Fatalf("expected a session frame, got %+v", welcome)
+	}
+	return conn, client, welcome
+}
+
+func readFrame(t *testing.T, conn *websocket.Conn) sessionFrame {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("expected a frame, got error: %v", err)
+	}
+	var frame sessionFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		t.Fatalf("invalid frame %q: %v", data, err)
+	}
+	return frame
+}
+
+func expectMessage(t *testing.T, conn *websocket.Conn, want string) sessionFrame {
+	t.Helper()
+	frame := readFrame(t, conn)
+	if frame.Type != messageFrameType || string(frame.Data) != want {
+		t.Fatalf("expected message %q, got %+v", want, frame)
+	}
+	return frame
+}
+
+func expectNoMessage(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, got, err := conn.ReadMessage(); err == nil {
+		t.Fatalf("expected no message, got %q", got)
+	}
+}
+
+func TestBroadcastReachesEveryInstanceOnce(t *testing.T) {
+	bus := NewMemoryBus()
+	defer bus.Close()
+	a := startInstance(t, bus)
+	b := startInstance(t, bus)
+
+	connA, _ := a.connect(t)
+	connB, _ := b.connect(t)
+
+	if err := a.server.Broadcast(context.Background(), []byte("hello")); err != nil {
+		t.Fatalf("Broadcast: %v", err)
+	}
+
+	expectMessage(t, connA, "hello")
+	expectMessage(t, connB, "hello")
+	expectNoMessage(t, connA)
+	expectNoMessage(t, connB)
+}
+
+func TestRoomPublishReachesOnlyMembers(t *testing.T) {
+	bus := NewMemoryBus()
+	defer bus.Close()
+	a := startInstance(t, bus)
+	b := startInstance(t, bus)
+
+	connA, _ := a.connect(t)
+	connB, clientB := b.connect(t)
+	b.server.JoinRoom(clientB, "lobby")
+
+	if err := a.server.PublishToRoom(context.Background(), "lobby", []byte("hi lobby")); err != nil {
+		t.Fatalf("PublishToRoom: %v", err)
+	}
+
+	expectMessage(t, connB, "hi lobby")
+	expectNoMessage(t, connB)
+	expectNoMessage(t, connA)
+
+	b.server.LeaveRoom(clientB, "lobby")
+	if err := a.server.PublishToRoom(context.Background(), "lobby", []byte("gone")); err != nil {
+		t.Fatalf("PublishToRoom: %v", err)
+	}
+	expectNoMessage(t, connB)
+}
+
+func TestMemoryBusUnsubscribe(t *testing.T) {
+	bus := NewMemoryBus()
+	defer bus.Close()
+
+	received := make(chan []byte, 1)
+	sub, err := bus.Subscribe("topic", func(payload []byte) { received <- payload })
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	sub.Unsubscribe()
+
+	if err := bus.Publish(context.Background(), "topic", []byte("late")); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	select {
+	case payload := <-received:
+		t.Fatalf("unsubscribed handler received %q", payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestRedisBusFanOut runs against a real Redis when REDIS_ADDR is set
+func TestRedisBusFanOut(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR not set")
+	}
+	clientA := redis.NewClient(&redis.Options{Addr: addr})
+	clientB := redis.NewClient(&redis.Options{Addr: addr})
+	defer clientA.Close()
+	defer clientB.Close()
+
+	prefix := "ws-test-" + time.Now().Format("150405.000000") + ":"
+	busA := NewRedisBus(clientA, prefix)
+	busB := NewRedisBus(clientB, prefix)
+	defer busA.Close()
+	defer busB.Close()
+
+	a := startInstance(t, busA)
+	b := startInstance(t, busB)
+	connA, _ := a.connect(t)
+	connB, _ := b.connect(t)
+
+	if err := b.server.Broadcast(context.Background(), []byte("from b")); err != nil {
+		t.Fatalf("Broadcast: %v", err)
+	}
+	expectMessage(t, connA, "from b")
+	expectMessage(t, connB, "from b")
+	expectNoMessage(t, connA)
+	expectNoMessage(t, connB)
+}
+
+func TestSessionResumeReplaysMissedMessages(t *testing.T) {
+	bus := NewMemoryBus()
+	defer bus.Close()
+	inst := startInstance(t, bus)
+	ctx := context.Background()
+
+	conn, _, welcome := inst.dial(t, "")
+	inst.server.Broadcast(ctx, []byte("m1"))
+	seen := expectMessage(t, conn, "m1")
+	conn.Close()
+
+	inst.server.Broadcast(ctx, []byte("m2"))
+	inst.server.Broadcast(ctx, []byte("m3"))
+
+	query := fmt.Sprintf("?session=%s&last_seq=%d", welcome.SessionID, seen.Seq)
+	conn, _, resumed := inst.dial(t, query)
+	if resumed.SessionID != welcome.SessionID || resumed.Resync {
+		t.Fatalf("expected to resume %s without resync, got %+v", welcome.SessionID, resumed)
+	}
+
+	if frame := expectMessage(t, conn, "m2"); frame.Seq != seen.Seq+1 {
+		t.Fatalf("expected seq %d, got %d", seen.Seq+1, frame.Seq)
+	}
+	expectMessage(t, conn, "m3")
+
+	inst.server.Broadcast(ctx, []byte("m4"))
+	if frame := expectMessage(t, conn, "m4"); frame.Seq != seen.Seq+3 {
+		t.Fatalf("expected seq %d, got %d", seen.Seq+3, frame.Seq)
+	}
+	expectNoMessage(t, conn)
+}
+
+func TestSessionReplayKeepsBinaryPayloads(t *testing.T) {
+	bus := NewMemoryBus()
+	defer bus.Close()
+	inst := startInstance(t, bus)
+	ctx := context.Background()
+	payload := []byte{0xff, 0xfe, 0x00, 'h', 'i', 0x80}
+
+	conn, _, welcome := inst.dial(t, "")
+	inst.server.Broadcast(ctx, payload)
+	expectMessage(t, conn, string(payload))
+	conn.Close()
+
+	inst.server.Broadcast(ctx, payload)
+	conn, _, _ = inst.dial(t, fmt.Sprintf("?session=%s&last_seq=1", welcome.SessionID))
+	if frame := expectMessage(t, conn, string(payload)); frame.Seq != 2 {
+		t.Fatalf("expected the replayed payload at seq 2, got %d", frame.Seq)
+	}
+}
+
+func TestSessionResumeKeepsRooms(t *testing.T) {
+	bus := NewMemoryBus()
+	defer bus.Close()
+	inst := startInstance(t, bus)
+	ctx := context.Background()
+
+	conn, client, welcome := inst.dial(t, "")
+	inst.server.JoinRoom(client, "lobby")
+	conn.Close()
+
+	inst.server.PublishToRoom(ctx, "lobby", []byte("while away"))
+
+	conn, _, _ = inst.dial(t, "?last_seq=0&session="+welcome.SessionID)
+	expectMessage(t, conn, "while away")
+
+	inst.server.PublishToRoom(ctx, "lobby", []byte("back"))
+	expectMessage(t, conn, "back")
+}
+
+func TestSessionResumeAfterRolloverRequiresResync(t *testing.T) {
+	bus := NewMemoryBus()
+	defer bus.Close()
+	inst := startInstanceWithConfig(t, bus, ServerConfig{SessionBufferSize: 2})
+	ctx := context.Background()
+
+	conn, _, welcome := inst.dial(t, "")
+	conn.Close()
+	for i := 1; i <= 3; i++ {
+		inst.server.Broadcast(ctx, []byte(fmt.Sprintf("m%d", i)))
+	}
+
+	// Wait until all three are sequenced so the buffer has rolled over
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		inst.server.mu.Lock()
+		lastSeq := inst.server.sessions[welcome.SessionID].lastSeq
+		inst.server.mu.Unlock()
+		if lastSeq == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 buffered messages, got %d", lastSeq)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, _, resumed := inst.dial(t, "?last_seq=0&session="+welcome.SessionID)
+	if !resumed.Resync || resumed.Seq != 3 {
+		t.Fatalf("expected resync at seq 3, got %+v", resumed)
+	}
+
+	// Nothing is replayed, so the next frame is live traffic
+	inst.server.Broadcast(ctx, []byte("live"))
+	if frame := expectMessage(t, conn, "live"); frame.Seq != 4 {
+		t.Fatalf("expected seq 4, got %d", frame.Seq)
+	}
+}
+
+func TestUnknownSessionRequiresResync(t *testing.T) {
+	bus := NewMemoryBus()
+	defer bus.Close()
+	inst := startInstance(t, bus)
+
+	_, _, welcome := inst.dial(t, "?session=expired&last_seq=7")
+	if !welcome.Resync || welcome.SessionID == "expired" {
+		t.Fatalf("expected a fresh session with resync, got %+v", welcome)
+	}
+}
+
+func TestSessionBufferSince(t *testing.T) {
+	session := newSession(3)
+	for i := 0; i < 5; i++ {
+		session.append([]byte(fmt.Sprintf("m%d", i+1)))
+	}
+
+	messages, ok := session.since(3)
+	if !ok || len(messages) != 2 || messages[0].seq != 4 || messages[1].seq != 5 {
+		t.Fatalf("expected seqs 4 and 5, got %v (ok=%v)", messages, ok)
+	}
+	if messages, ok := session.since(5); !ok || len(messages) != 0 {
+		t.Fatalf("expected nothing missed, got %v (ok=%v)", messages, ok)
+	}
+	if _, ok := session.since(1); ok {
+		t.Fatal("expected seq 2 to have rolled out of the buffer")
+	}
+	if _, ok := session.since(6); ok {
+		t.Fatal("expected a future seq to require resync")
+	}
+}
+
+func expectError(t *testing.T, conn *websocket.Conn, code string) sessionFrame {
+	t.Helper()
+	frame := readFrame(t, conn)
+	if frame.Type != errorFrameType || frame.Error != code {
+		t.Fatalf("expected %s error, got %+v", code, frame)
+	}
+	return frame
+}
+
+func expectDispatched(t *testing.T, inst *testInstance, want string) {
+	t.Helper()
+	select {
+	case got := <-inst.messages:
+		if string(got) != want {
+			t.Fatalf("expected %q to be dispatched, got %q", want, got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected %q to be dispatched", want)
+	}
+}
+
+func intPtr(v int) *int { return &v }
+
+func TestConnectionRateLimit(t *testing.T) {
+	bus := NewMemoryBus()
+	defer bus.Close()
+	inst := startInstanceWithConfig(t, bus, ServerConfig{
+		MessageRate:   RateLimit{PerSecond: 0.001, Burst: 2},
+		MaxViolations: 10,
+	})
+
+	conn, _ := inst.connect(t)
+	for i := 0; i < 3; i++ {
+		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("m%d", i)))
+	}
+
+	expectDispatched(t, inst, "m0")
+	expectDispatched(t, inst, "m1")
+	expectError(t, conn, errRateLimited)
+}
+
+func TestMessageTypeRateLimit(t *testing.T) {
+	bus := NewMemoryBus()
+	defer bus.Close()
+	inst := startInstance(t, bus)
+	inst.server.SetMessagePolicy("1", MessagePolicy{RateLimit: &RateLimit{PerSecond: 0.001, Burst: 1}})
+
+	conn, _ := inst.connect(t)
+	conn.WriteMessage(websocket.TextMessage, []byte("first"))
+	conn.WriteMessage(websocket.TextMessage, []byte("second"))
+
+	expectDispatched(t, inst, "first")
+	frame := expectError(t, conn, errRateLimited)
+	if !strings.Contains(frame.Detail, "type 1") {
+		t.Fatalf("expected the message type in the detail, got %q", frame.Detail)
+	}
+}
+
+func TestMessageValidation(t *testing.T) {
+	bus := NewMemoryBus()
+	defer bus.Close()
+	inst := startInstance(t, bus)
+	inst.server.SetMessagePolicy("1", MessagePolicy{
+		MaxBytes: 64,
+		Schema: &MessageSchema{
+			Type:     "object",
+			Required: []string{"action"},
+			Properties: map[string]*MessageSchema{
+				"action": {Type: "string", Enum: []interface{}{"join", "leave"}},
+				"room":   {Type: "string", MaxLength: intPtr(8)},
+			},
+		},
+	})
+
+	conn, _ := inst.connect(t)
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"room": "lobby"}`))
+	if frame := expectError(t, conn, errInvalidMessage); !strings.Contains(frame.Detail, `"action"`) {
+		t.Fatalf("expected the missing field in the detail, got %q", frame.Detail)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"action": "join", "room": "a-very-long-room"}`))
+	if frame := expectError(t, conn, errInvalidMessage); !strings.Contains(frame.Detail, "$.room") {
+		t.Fatalf("expected the field path in the detail, got %q", frame.Detail)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"action": "join", "room": "`+strings.Repeat("x", 64)+`"}`))
+	expectError(t, conn, errMessageTooBig)
+
+	valid := `{"action": "join", "room": "lobby"}`
+	conn.WriteMessage(websocket.TextMessage, []byte(valid))
+	expectDispatched(t, inst, valid)
+}
+
+func TestMessageValidationEnumOfArrays(t *testing.T) {
+	bus := NewMemoryBus()
+	defer bus.Close()
+	inst := startInstance(t, bus)
+	var policy MessagePolicy
+	if err := json.Unmarshal([]byte(`{"schema": {"type": "object", "properties": {"tags": {"enum": [["a", "b"], {"k": 1}]}}}}`), &policy); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	inst.server.SetMessagePolicy("1", policy)
+
+	conn, _ := inst.connect(t)
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"tags": ["a", "c"]}`))
+	expectError(t, conn, errInvalidMessage)
+
+	for _, valid := range []string{`{"tags": ["a", "b"]}`, `{"tags": {"k": 1}}`} {
+		conn.WriteMessage(websocket.TextMessage, []byte(valid))
+		expectDispatched(t, inst, valid)
+	}
+}
+
+func TestRepeatedAbuseDisconnectsAndBans(t *testing.T) {
+	bus := NewMemoryBus()
+	defer bus.Close()
+	inst := startInstanceWithConfig(t, bus, ServerConfig{MaxViolations: 2, BanAfter: 1, BanDuration: time.Minute})
+	inst.server.SetMessagePolicy("1", MessagePolicy{Schema: &MessageSchema{Type: "object"}})
+
+	conn, _ := inst.connect(t)
+	conn.WriteMessage(websocket.TextMessage, []byte("not json"))
+	conn.WriteMessage(websocket.TextMessage, []byte("still not json"))
+	expectError(t, conn, errInvalidMessage)
+	expectError(t, conn, errInvalidMessage)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expected a policy violation close, got %v", err)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(inst.url(""), nil)
+	if err == nil || resp == nil || resp.StatusCode != 403 {
+		t.Fatalf("expected the banned IP to be refused with 403, got %v", err)
+	}
+}
+
+func TestAbuseDisconnectEndsSession(t *testing.T) {
+	bus := NewMemoryBus()
+	defer bus.Close()
+	// A high ban threshold, so the client is disconnected but its IP is not banned
+	inst := startInstanceWithConfig(t, bus, ServerConfig{MaxViolations: 1, BanAfter: 10})
+	inst.server.SetMessagePolicy("1", MessagePolicy{Schema: &MessageSchema{Type: "object"}})
+	ctx := context.Background()
+
+	conn, client, welcome := inst.dial(t, "")
+	inst.server.JoinRoom(client, "lobby")
+	inst.server.PublishToRoom(ctx, "lobby", []byte("before"))
+	seen := expectMessage(t, conn, "before")
+	conn.WriteMessage(websocket.TextMessage, []byte("not json"))
+	expectError(t, conn, errInvalidMessage)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expected a policy violation close, got %v", err)
+	}
+
+	inst.server.PublishToRoom(ctx, "lobby", []byte("after"))
+	conn, _, resumed := inst.dial(t, fmt.Sprintf("?session=%s&last_seq=%d", welcome.SessionID, seen.Seq))
+	if resumed.SessionID == welcome.SessionID || !resumed.Resync {
+		t.Fatalf("expected a fresh session requiring resync, got %+v", resumed)
+	}
+	expectNoMessage(t, conn)
+}
+
+func TestConnectionCap(t *testing.T) {
+	bus := NewMemoryBus()
+	defer bus.Close()
+	inst := startInstanceWithConfig(t, bus, ServerConfig{MaxConnections: 1})
+
+	conn, _ := inst.connect(t)
+	_, resp, err := websocket.DefaultDialer.Dial(inst.url(""), nil)
+	if err == nil || resp == nil || resp.StatusCode != 503 {
+		t.Fatalf("expected the second connection to be refused with 503, got %v", err)
+	}
+
+	// Closing the first connection frees its slot
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		second, _, err := websocket.DefaultDialer.Dial(inst.url(""), nil)
+		if err == nil {
+			second.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a slot to free up: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnectionCapSpansInstances(t *testing.T) {
+	bus := NewMemoryBus()
+	defer bus.Close()
+	config := ServerConfig{MaxConnections: 1, Connections: NewMemoryConnectionCounter()}
+	a := startInstanceWithConfig(t, bus, config)
+	b := startInstanceWithConfig(t, bus, config)
+
+	a.connect(t)
+	_, resp, err := websocket.DefaultDialer.Dial(b.url(""), nil)
+	if err == nil || resp == nil || resp.StatusCode != 503 {
+		t.Fatalf("expected the other instance to refuse a connection over the global cap with 503, got %v", err)
+	}
+}
+
+func TestRedisConnectionCounter(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR not set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	defer client.Close()
+	ctx := context.Background()
+
+	prefix := "ws-test-" + time.Now().Format("150405.000000") + ":"
+	a := NewRedisConnectionCounter(client, prefix)
+	b := NewRedisConnectionCounter(client, prefix)
+	defer b.Close()
+
+	acquire := func(c *RedisConnectionCounter) bool {
+		t.Helper()
+		ok, err := c.Acquire(ctx, 2)
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		return ok
+	}
+	if !acquire(a) || !acquire(b) {
+		t.Fatal("expected two slots to be free")
+	}
+	if acquire(b) {
+		t.Fatal("expected the cap to count both instances")
+	}
+	if err := b.Release(ctx); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if !acquire(b) {
+		t.Fatal("expected a released slot to be free")
+	}
+
+	// An instance whose heartbeat has expired no longer holds slots
+	a.stopOnce.Do(func() { close(a.stop) })
+	client.Del(ctx, a.heartbeatKey())
+	if !acquire(b) {
+		t.Fatal("expected the dead instance's slot to be freed")
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	policy, err := parsePolicy([]byte(`{"rate_limit": {"per_second": 2, "burst": 4}, "max_bytes": 128,
+		"schema": {"type": "object", "required": ["id"], "properties": {"id": {"type": "integer"}}}}`))
+	if err != nil {
+		t.Fatalf("parsePolicy: %v", err)
+	}
+	if policy.RateLimit.Burst != 4 || policy.MaxBytes != 128 {
+		t.Fatalf("unexpected policy %+v", policy)
+	}
+	if err := policy.Schema.ValidateJSON([]byte(`{"id": 1.5}`)); err == nil {
+		t.Fatal("expected 1.5 to be rejected as an integer")
+	}
+
+	if _, err := parsePolicy([]byte(`{"rate_limit": {"per_second": 0, "burst": 1}}`)); err == nil {
+		t.Fatal("expected a zero rate to be rejected")
+	}
+	if _, err := parsePolicy([]byte(`{"max_size": 10}`)); err == nil {
+		t.Fatal("expected an unknown field to be rejected")
+	}
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
@@ -13,77 +14,43 @@ type Event struct {
 	Value string
 }
 
-// Define the TokenBucket struct to implement rate limiting
-type TokenBucket struct {
-	capacity       int32
-	current        int32
-	replenishRate  int
-	lastRefillTime int64
-}
-
-// NewTokenBucket creates a new token bucket
-func NewTokenBucket(capacity int, replenishRate int) *TokenBucket {
-	return &TokenBucket{
-		capacity:       int32(capacity),
-		current:        int32(capacity),
-		replenishRate:  replenishRate,
-		lastRefillTime: time.Now().UnixNano(),
-	}
-}
-
-// CanConsume checks if a token is available
-func (tb *TokenBucket) CanConsume() bool {
-	return atomic.LoadInt32(&tb.current) > 0
-}
-
-// Consume consumes a token
-func (tb *TokenBucket) Consume() {
-	if !tb.CanConsume() {
-		tb.refill()
-	}
-	atomic.SubtractInt32(&tb.current, 1)
-}
-
-// refill replenishes tokens
-func (tb *TokenBucket) refill() {
-	now := time.Now().UnixNano()
-	elapsed := now - tb.lastRefillTime
-	replenishment := int(elapsed) / int(time.Second/time.Nanosecond) * tb.replenishRate
-
-	if replenishment > 0 {
-		newCurrent := atomic.AddInt32(&tb.current, int32(replenishment))
-		if newCurrent > tb.capacity {
-			atomic.StoreInt32(&tb.current, tb.capacity)
-		}
-		tb.lastRefillTime = now
-	}
-}
+// virtualNodes is the number of points each node has on the hash ring
+const virtualNodes = 64
 
-// Define the ReplicatedShardedMap struct with rate limiting
+// Define the ReplicatedShardedMap struct with rate limiting. Each node holds
+// its own partition: a key is stored on the first node at or after its hash
+// on the ring and on the next replicas distinct nodes clockwise, N nodes in
+// all. Nodes reach each other over network, which can inject faults
 type ReplicatedShardedMap struct {
 	chr       *ConsistentHashRing
-	shards    map[string]map[string]string
+	nodes     map[string]*StorageNode
+	network   *Network
 	numShards int
-	numNodes  int
 	replicas  int
+	quorum    Quorum
 	rateLimit map[string]*TokenBucket
+	tenants   map[string]*TokenBucket // quotas by key prefix
 	mu        sync.RWMutex
 }
 
-// NewReplicatedShardedMap creates a new replicated sharded map with rate limiting
+// NewReplicatedShardedMap creates a new replicated sharded map with rate
+// limiting. Keys are stored on replicas nodes besides their primary node,
+// and rate limited per shard, one of numShards slices of the key space.
+// Reads and writes wait for a majority of a key's nodes by default
 func NewReplicatedShardedMap(numShards int, replicas int, rateLimitCapacity int, rateLimitRefillRate int) *ReplicatedShardedMap {
-	shards := make(map[string]map[string]string, numShards)
 	rateLimit := make(map[string]*TokenBucket, numShards)
 	for i := 0; i < numShards; i++ {
-		shards[fmt.Sprintf("%d", i)] = make(map[string]string)
-		rateLimit[fmt.Sprintf("%d", i)] = NewTokenBucket(rateLimitCapacity, rateLimitRefillRate)
+		rateLimit[fmt.Sprintf("%d", i)] = NewTokenBucket(rateLimitCapacity, float64(rateLimitRefillRate))
 	}
 	return &ReplicatedShardedMap{
-		chr:       NewConsistentHashRing(replicas),
-		shards:    shards,
+		chr:       NewConsistentHashRing(virtualNodes),
+		nodes:     make(map[string]*StorageNode),
+		network:   NewNetwork(),
 		numShards: numShards,
 		replicas:  replicas,
+		quorum:    Quorum{R: (replicas+1)/2 + 1, W: (replicas+1)/2 + 1},
 		rateLimit: rateLimit,
+		tenants:   make(map[string]*TokenBucket),
 	}
 }
 
@@ -92,134 +59,152 @@ func (rsm *ReplicatedShardedMap) hashKey(key string) uint32 {
 	return rsm.chr.hashKey(key)
 }
 
-// Add a node to the ring and update replica logic
-func (rsm *ReplicatedShardedMap) AddNode(node string) {
-	rsm.mu.Lock()
-	defer rsm.mu.Unlock()
-
-	rsm.chr.AddNode(node)
-	rsm.numNodes++
-
-	// Update replica assignment
-	for _, nodeId := range rsm.chr.nodes {
-		index := rsm.hashKey(nodeId) % uint32(rsm.numShards)
-		replicas := rsm.getReplicas(nodeId, index)
-		rsm.reassignReplicas(index, replicas)
-	}
+// shardKey names the rate-limited shard of a key
+func (rsm *ReplicatedShardedMap) shardKey(key string) string {
+	return fmt.Sprintf("%d", rsm.hashKey(key)%uint32(rsm.numShards))
 }
 
-// Remove a node from the ring and update replica logic
-func (rsm *ReplicatedShardedMap) RemoveNode(node string) {
+// Add a node to the ring and copy it the key ranges it is now a replica of.
+// Nodes pushed out of those ranges' preference lists drop them
+func (rsm *ReplicatedShardedMap) AddNode(node string) MigrationStats {
 	rsm.mu.Lock()
 	defer rsm.mu.Unlock()
 
-	rsm.chr.RemoveNode(node)
-	rsm.numNodes--
-
-	// Update replica assignment
-	for _, nodeId := range rsm.chr.nodes {
-		index := rsm.hashKey(nodeId) % uint32(rsm.numShards)
-		replicas := rsm.getReplicas(nodeId, index)
-		rsm.reassignReplicas(index, replicas)
+	if _, ok := rsm.nodes[node]; ok {
+		return MigrationStats{}
 	}
+	before := rsm.chr.clone()
+	rsm.nodes[node] = NewStorageNode(node)
+	rsm.chr.AddNode(node)
+	return rsm.migrate(before, rsm.chr)
 }
 
-// Get replica nodes for a specific shard index
-func (rsm *ReplicatedShardedMap) getReplicas(primaryNode string, index uint32) []string {
-	replicas := make([]string, rsm.replicas)
-	count := 0
-	for _, nodeId := range rsm.chr.nodes {
-		if nodeId == primaryNode {
-			continue
-		}
-		replicaIndex := rsm.hashKey(nodeId) % uint32(rsm.numShards)
-		if replicaIndex == index {
-			replicas[count] = nodeId
-			count++
-			if count == rsm.replicas {
-				break
-			}
-		}
-	}
-	return replicas
-}
-
-// Reassign replicas for a shard
-func (rsm *ReplicatedShardedMap) reassignReplicas(index uint32, replicas []string) {
+// Remove a failed node, with its data, from the ring. The key ranges it held
+// are copied from surviving replicas to the nodes that replace it
+func (rsm *ReplicatedShardedMap) RemoveNode(node string) MigrationStats {
 	rsm.mu.Lock()
 	defer rsm.mu.Unlock()
 
-	shardKey := fmt.Sprintf("%d", index)
-	for _, nodeId := range replicas {
-		rsm.syncData(shardKey, nodeId)
+	if _, ok := rsm.nodes[node]; !ok {
+		return MigrationStats{}
 	}
+	before := rsm.chr.clone()
+	delete(rsm.nodes, node)
+	rsm.chr.RemoveNode(node)
+	return rsm.migrate(before, rsm.chr)
 }
 
-// Put adds or updates a key-value pair and syncs with replicas
-func (rsm *ReplicatedShardedMap) Put(event Event) {
-	primaryNode := rsm.chr.GetNode(event.Key)
-	index := rsm.hashKey(primaryNode) % uint32(rsm.numShards)
-	rsm.mu.Lock()
-	defer rsm.mu.Unlock()
+// Node returns a node of the map, or nil if there is none by that name
+func (rsm *ReplicatedShardedMap) Node(name string) *StorageNode {
+	rsm.mu.RLock()
+	defer rsm.mu.RUnlock()
+	return rsm.nodes[name]
+}
 
-	tb := rsm.rateLimit[fmt.Sprintf("%d", index)]
-	tb.Consume()
+// Network returns the network between the map's nodes, to inject faults
+func (rsm *ReplicatedShardedMap) Network() *Network {
+	return rsm.network
+}
 
-	rsm.shards[fmt.Sprintf("%d", index)][event.Key] = event.Value
+// Put adds or updates a key-value pair on its node and replicas, waiting for
+// the map's write quorum
+func (rsm *ReplicatedShardedMap) Put(event Event) error {
+	return rsm.PutWithQuorum(event, 0)
+}
 
-	// Sync data with replicas
-	replicas := rsm.getReplicas(primaryNode, index)
-	for _, replicaNode := range replicas {
-		rsm.syncData(fmt.Sprintf("%d", index), replicaNode)
+// PutWithQuorum adds or updates a key-value pair, waiting for w nodes to
+// store it, or the map's write quorum if w is 0. It fails with a *QuotaError
+// if the key's tenant quota or shard limit has no token left
+func (rsm *ReplicatedShardedMap) PutWithQuorum(event Event, w int) error {
+	if err := rsm.admit(context.Background(), event.Key, false); err != nil {
+		return err
 	}
+	rsm.mu.RLock()
+	defer rsm.mu.RUnlock()
+	return rsm.write(event.Key, Versioned{Value: event.Value}, w)
 }
 
-// Get retrieves the value for a given key
-func (rsm *ReplicatedShardedMap) Get(key string) (string, bool) {
-	primaryNode := rsm.chr.GetNode(key)
-	index := rsm.hashKey(primaryNode) % uint32(rsm.numShards)
+// PutContext adds or updates a key-value pair like Put, but waits for a
+// token from the key's tenant quota and shard limit until ctx ends
+func (rsm *ReplicatedShardedMap) PutContext(ctx context.Context, event Event) error {
+	if err := rsm.admit(ctx, event.Key, true); err != nil {
+		return err
+	}
 	rsm.mu.RLock()
 	defer rsm.mu.RUnlock()
-
-	value, ok := rsm.shards[fmt.Sprintf("%d", index)][key]
-	return value, ok
+	return rsm.write(event.Key, Versioned{Value: event.Value}, 0)
+}
+
+// Get retrieves the value for a given key, reading the map's read quorum
+func (rsm *ReplicatedShardedMap) Get(key string) (string, bool, error) {
+	return rsm.GetWithQuorum(key, 0)
+}
+
+// GetWithQuorum retrieves the value for a given key from r nodes, or the
+// map's read quorum if r is 0. It returns a *ConflictError if the key has
+// concurrent versions
+func (rsm *ReplicatedShardedMap) GetWithQuorum(key string, r int) (string, bool, error) {
+	versions, err := rsm.GetVersions(key, r)
+	switch {
+	case err != nil:
+		return "", false, err
+	case len(versions) > 1:
+		return "", false, &ConflictError{Key: key, Versions: versions}
+	case len(versions) == 0 || versions[0].Deleted:
+		return "", false, nil
+	}
+	return versions[0].Value, true, nil
 }
 
-// Remove deletes a key-value pair and syncs with replicas
-func (rsm *ReplicatedShardedMap) Remove(key string) {
-	primaryNode := rsm.chr.GetNode(key)
-	index := rsm.hashKey(primaryNode) % uint32(rsm.numShards)
-	rsm.mu.Lock()
-	defer rsm.mu.Unlock()
-
-	tb := rsm.rateLimit[fmt.Sprintf("%d", index)]
-	tb.Consume()
-
-	delete(rsm.shards[fmt.Sprintf("%d", index)], key)
+// Remove deletes a key-value pair from its node and replicas, waiting for
+// the map's write quorum
+func (rsm *ReplicatedShardedMap) Remove(key string) error {
+	return rsm.RemoveWithQuorum(key, 0)
+}
 
-	// Sync data with replicas
-	replicas := rsm.getReplicas(primaryNode, index)
-	for _, replicaNode := range replicas {
-		rsm.syncData(fmt.Sprintf("%d", index), replicaNode)
+// RemoveWithQuorum deletes a key-value pair, waiting for w nodes to store
+// its tombstone, or the map's write quorum if w is 0. Removals count
+// against the same limits as puts
+func (rsm *ReplicatedShardedMap) RemoveWithQuorum(key string, w int) error {
+	if err := rsm.admit(context.Background(), key, false); err != nil {
+		return err
 	}
+	rsm.mu.RLock()
+	defer rsm.mu.RUnlock()
+	return rsm.write(key, Versioned{Deleted: true}, w)
 }
 
 // Simulate event traffic
 func simulateEventTraffic(replicatedMap *ReplicatedShardedMap) {
+	rejected := 0
 	for i := 0; i < 10000; i++ {
 		event := Event{
 			Key:   fmt.Sprintf("key_%d", i),
 			Value: fmt.Sprintf("value_%d", i),
 		}
-		replicatedMap.Put(event)
+		err := replicatedMap.Put(event)
+		if errors.Is(err, ErrQuotaExceeded) {
+			rejected++
+		} else if err != nil {
+			fmt.Println("Error putting event:", err)
+		}
 	}
-	fmt.Println("Event traffic simulated successfully")
+	fmt.Printf("Event traffic simulated successfully, %d events over quota\n", rejected)
 }
 
-// Simulate node failure
+// Simulate node failure: crash the node and wait for the failure detector
+// to declare it dead and remove it from the ring
 func simulateNodeFailure(replicatedMap *ReplicatedShardedMap, node string) {
-	replicatedMap.RemoveNode(node)
-	fmt.Printf("Node %s failed\n", node)
+	replicatedMap.Network().Crash(node)
+	fmt.Printf("Node %s crashed\n", node)
+	deadline := time.Now().Add(10 * time.Second)
+	for replicatedMap.Node(node) != nil {
+		if time.Now().After(deadline) {
+			fmt.Println("Error detecting the failure of node", node)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
 }
 
 func main() {
@@ -230,10 +215,18 @@ func main() {
 	replicatedMap := NewReplicatedShardedMap(numShards, replicas, rateLimitCapacity, rateLimitRefillRate)
 
 	// Add nodes to the consistent hash ring
-	replicatedMap.chr.AddNode("node1")
-	replicatedMap.chr.AddNode("node2")
-	replicatedMap.chr.AddNode("node3")
-	replicatedMap.chr.AddNode("node4")
+	replicatedMap.AddNode("node1")
+	replicatedMap.AddNode("node2")
+	replicatedMap.AddNode("node3")
+	replicatedMap.AddNode("node4")
+
+	// Hand off writes to nodes that were unreachable and reconcile replicas
+	stopRepair := replicatedMap.StartRepair(time.Second)
+	defer stopRepair()
+
+	// Detect node failures and update the ring
+	membership := replicatedMap.StartMembership(MembershipConfig{})
+	defer membership.Stop()
 
 	simulateEventTraffic(replicatedMap)
 
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// addHint stores a write meant for target, to hand off once target is reachable
+func (n *StorageNode) addHint(target, key string, version Versioned) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	hints, ok := n.hints[target]
+	if !ok {
+		hints = make(map[string][]Versioned)
+		n.hints[target] = hints
+	}
+	hints[key] = reconcile(hints[key], version)
+}
+
+// takeHints removes and returns the hints the node holds for target
+func (n *StorageNode) takeHints(target string) map[string][]Versioned {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	hints := n.hints[target]
+	delete(n.hints, target)
+	return hints
+}
+
+// hintTargets returns the nodes the node holds hints for
+func (n *StorageNode) hintTargets() []string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	targets := make([]string, 0, len(n.hints))
+	for target := range n.hints {
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// Hints returns the number of keys the node holds writes for on behalf of other nodes
+func (n *StorageNode) Hints() int {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	count := 0
+	for _, hints := range n.hints {
+		count += len(hints)
+	}
+	return count
+}
+
+// handOff leaves a write for each unreachable node of a key's preference
+// list with a stand-in: the next node clockwise after the preference list
+// that the coordinator reaches, or the coordinator if there is none. Hints do
+// not count toward the write quorum. Callers hold rsm.mu
+func (rsm *ReplicatedShardedMap) handOff(coordinator, key string, version Versioned, preference, unreachable []string) {
+	candidates := slices.DeleteFunc(rsm.chr.GetNodes(key, len(rsm.nodes)), func(name string) bool {
+		return slices.Contains(preference, name)
+	})
+	for _, target := range unreachable {
+		standIn := coordinator
+		for len(candidates) > 0 {
+			candidate := candidates[0]
+			candidates = candidates[1:]
+			if rsm.network.deliver(coordinator, candidate) == nil {
+				standIn = candidate
+				break
+			}
+		}
+		rsm.nodes[standIn].addHint(target, key, version)
+	}
+}
+
+// ReplayHints hands the writes stand-ins hold off to their nodes, where the
+// stand-in reaches them, and returns the number of keys handed off. Hints for
+// nodes removed from the map are dropped, their ranges having been migrated
+func (rsm *ReplicatedShardedMap) ReplayHints() int {
+	rsm.mu.RLock()
+	defer rsm.mu.RUnlock()
+
+	delivered := 0
+	for name, holder := range rsm.nodes {
+		for _, target := range holder.hintTargets() {
+			owner, ok := rsm.nodes[target]
+			if ok && rsm.network.deliver(name, target) != nil {
+				continue
+			}
+			hints := holder.takeHints(target)
+			if !ok {
+				continue
+			}
+			for key, versions := range hints {
+				owner.put(key, versions...)
+				delivered++
+			}
+		}
+	}
+	return delivered
+}
+
+// StartRepair replays hints and runs anti-entropy every interval in the
+// background, until the returned function is called
+func (rsm *ReplicatedShardedMap) StartRepair(interval time.Duration) (stop func()) {
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rsm.ReplayHints()
+				rsm.AntiEntropy()
+			case <-quit:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(quit)
+			<-done
+		})
+	}
+}
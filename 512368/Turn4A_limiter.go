@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded reports an event refused by a rate limit
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Define the TokenBucket struct to implement rate limiting. It holds up to
+// capacity tokens and refills continuously at replenishRate tokens per
+// second, so time between calls counts however short it is
+type TokenBucket struct {
+	capacity      float64
+	replenishRate float64
+	now           func() time.Time
+
+	mu     sync.Mutex
+	tokens float64 // negative while reservations wait for tokens
+	last   time.Time
+}
+
+// NewTokenBucket creates a new token bucket, starting full
+func NewTokenBucket(capacity int, replenishRate float64) *TokenBucket {
+	tb := &TokenBucket{
+		capacity:      float64(capacity),
+		replenishRate: replenishRate,
+		now:           time.Now,
+		tokens:        float64(capacity),
+	}
+	tb.last = tb.now()
+	return tb
+}
+
+// refill adds the tokens replenished since the last call. Callers hold tb.mu
+func (tb *TokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(tb.last); elapsed > 0 {
+		tb.tokens = math.Min(tb.capacity, tb.tokens+elapsed.Seconds()*tb.replenishRate)
+		tb.last = now
+	}
+}
+
+// Allow takes a token if one is available now
+func (tb *TokenBucket) Allow() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill(tb.now())
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// Reservation is a token taken from a bucket, usable once its delay passes
+type Reservation struct {
+	tb    *TokenBucket
+	ok    bool
+	ready time.Time
+}
+
+// Reserve takes a token now, to be used after the reservation's delay once
+// the bucket has refilled it. It is not OK if the bucket can never hold a
+// token
+func (tb *TokenBucket) Reserve() *Reservation {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := tb.now()
+	tb.refill(now)
+	if tb.capacity < 1 || (tb.tokens < 1 && tb.replenishRate <= 0) {
+		return &Reservation{tb: tb}
+	}
+	tb.tokens--
+	ready := now
+	if tb.tokens < 0 {
+		ready = now.Add(time.Duration(-tb.tokens / tb.replenishRate * float64(time.Second)))
+	}
+	return &Reservation{tb: tb, ok: true, ready: ready}
+}
+
+// OK reports whether the reservation holds a token
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Delay returns how long to wait before using the token
+func (r *Reservation) Delay() time.Duration {
+	if !r.ok {
+		return time.Duration(math.MaxInt64)
+	}
+	return max(0, r.ready.Sub(r.tb.now()))
+}
+
+// Cancel returns an unused token to its bucket
+func (r *Reservation) Cancel() {
+	if !r.ok {
+		return
+	}
+	r.ok = false
+	r.tb.mu.Lock()
+	defer r.tb.mu.Unlock()
+	r.tb.refill(r.tb.now())
+	r.tb.tokens = math.Min(r.tb.capacity, r.tb.tokens+1)
+}
+
+// Wait takes a token, waiting for one to be replenished if the bucket is
+// empty. It fails without taking a token if ctx ends first
+func (tb *TokenBucket) Wait(ctx context.Context) error {
+	return waitAll(ctx, tb.Reserve())
+}
+
+// waitAll waits until every reservation can be used, cancelling them all if
+// one never can or ctx ends first
+func waitAll(ctx context.Context, reservations ...*Reservation) error {
+	cancel := func() {
+		for _, r := range reservations {
+			r.Cancel()
+		}
+	}
+	var delay time.Duration
+	for _, r := range reservations {
+		delay = max(delay, r.Delay())
+	}
+	if delay == 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); delay == time.Duration(math.MaxInt64) || ok && time.Until(deadline) < delay {
+		cancel()
+		return fmt.Errorf("waiting %v for a token: %w", delay, ErrQuotaExceeded)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		cancel()
+		return ctx.Err()
+	}
+}
+
+// QuotaError reports an event refused by its tenant's quota or its shard's
+// rate limit
+type QuotaError struct {
+	Key string
+	// Tenant is the key prefix whose quota was exceeded, or "" if the shard's limit was
+	Tenant string
+	Shard  string
+}
+
+func (e *QuotaError) Error() string {
+	if e.Tenant != "" {
+		return fmt.Sprintf("key %s: tenant %q: %v", e.Key, e.Tenant, ErrQuotaExceeded)
+	}
+	return fmt.Sprintf("key %s: shard %s: %v", e.Key, e.Shard, ErrQuotaExceeded)
+}
+
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// SetTenantQuota limits the events of the keys starting with prefix, on top
+// of their shards' limits. Keys take the quota of the longest prefix they
+// start with. A rate of 0 refills nothing, capping the tenant at burst events
+func (rsm *ReplicatedShardedMap) SetTenantQuota(prefix string, rate float64, burst int) {
+	rsm.mu.Lock()
+	defer rsm.mu.Unlock()
+	rsm.tenants[prefix] = NewTokenBucket(burst, rate)
+}
+
+// limiters returns the quota of a key's tenant, if it has one, and its
+// shard's limit. Callers hold rsm.mu
+func (rsm *ReplicatedShardedMap) limiters(key string) (tenant string, tenantLimit, shardLimit *TokenBucket) {
+	found := false
+	for prefix, tb := range rsm.tenants {
+		if strings.HasPrefix(key, prefix) && (!found || len(prefix) > len(tenant)) {
+			tenant, tenantLimit, found = prefix, tb, true
+		}
+	}
+	return tenant, tenantLimit, rsm.rateLimit[rsm.shardKey(key)]
+}
+
+// admit takes a token from a key's tenant quota and shard limit, waiting
+// until ctx ends if wait is set. An event refused by one limit does not use
+// up the other
+func (rsm *ReplicatedShardedMap) admit(ctx context.Context, key string, wait bool) error {
+	rsm.mu.RLock()
+	tenant, tenantLimit, shardLimit := rsm.limiters(key)
+	rsm.mu.RUnlock()
+
+	var reservations []*Reservation
+	if tenantLimit != nil {
+		reservations = append(reservations, tenantLimit.Reserve())
+	}
+	reservations = append(reservations, shardLimit.Reserve())
+	if wait {
+		return waitAll(ctx, reservations...)
+	}
+	for i, r := range reservations {
+		if r.Delay() == 0 {
+			continue
+		}
+		for _, r := range reservations {
+			r.Cancel()
+		}
+		err := &QuotaError{Key: key, Shard: rsm.shardKey(key)}
+		if tenantLimit != nil && i == 0 {
+			err.Tenant = tenant
+		}
+		return err
+	}
+	return nil
+}
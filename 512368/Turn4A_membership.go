@@ -0,0 +1,571 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Failure detector defaults, used where MembershipConfig leaves a field zero
+const (
+	defaultProbeInterval    = 200 * time.Millisecond
+	defaultProbeTimeout     = 50 * time.Millisecond
+	defaultIndirectProbes   = 3
+	defaultSuspicionTimeout = time.Second
+
+	// maxPiggyback is the most membership updates carried on one message
+	maxPiggyback = 8
+	// retransmitMult scales how many messages carry each update, times the
+	// log of the cluster size
+	retransmitMult = 3
+)
+
+// MemberState is what a node's failure detector believes about another node
+type MemberState int
+
+const (
+	MemberAlive MemberState = iota
+	MemberSuspect
+	MemberDead
+)
+
+func (s MemberState) String() string {
+	switch s {
+	case MemberAlive:
+		return "alive"
+	case MemberSuspect:
+		return "suspect"
+	case MemberDead:
+		return "dead"
+	}
+	return fmt.Sprintf("MemberState(%d)", int(s))
+}
+
+// Member is a node as a failure detector sees it. Only the node itself raises
+// its incarnation, to refute claims that it is suspect or dead
+type Member struct {
+	Name        string
+	State       MemberState
+	Incarnation uint64
+}
+
+// supersedes reports whether news about a member overrides what is known of
+// it: a higher incarnation wins, and within one incarnation dead overrides
+// suspect, which overrides alive
+func (m Member) supersedes(known Member) bool {
+	if m.Incarnation != known.Incarnation {
+		return m.Incarnation > known.Incarnation
+	}
+	return m.State > known.State
+}
+
+// MembershipConfig configures the failure detector
+type MembershipConfig struct {
+	// ProbeInterval is how often each node probes another (200 milliseconds by default)
+	ProbeInterval time.Duration
+	// ProbeTimeout is how long a probe waits for its ack (50 milliseconds by default)
+	ProbeTimeout time.Duration
+	// IndirectProbes is how many nodes are asked to probe a node that did not
+	// ack, before it is suspected (3 by default)
+	IndirectProbes int
+	// SuspicionTimeout is how long a node stays suspect without refuting it
+	// before it is declared dead (1 second by default)
+	SuspicionTimeout time.Duration
+}
+
+// Membership runs a SWIM failure detector on each node of a map. Every
+// period each node probes another over the map's network, directly and then
+// through other nodes, and suspects it if no ack comes back. Suspicions
+// that the node does not refute in time become deaths. Changes spread by
+// gossip, piggybacked on the probes. Deaths remove nodes from the ring,
+// re-placing their replicas, and nodes that come back are added again
+type Membership struct {
+	rsm    *ReplicatedShardedMap
+	config MembershipConfig
+
+	mu     sync.Mutex
+	agents map[string]*agent
+	ring   map[string]Member // the news last applied to the ring for each node
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// StartMembership starts the failure detector on every node of the map
+func (rsm *ReplicatedShardedMap) StartMembership(config MembershipConfig) *Membership {
+	if config.ProbeInterval <= 0 {
+		config.ProbeInterval = defaultProbeInterval
+	}
+	if config.ProbeTimeout <= 0 {
+		config.ProbeTimeout = defaultProbeTimeout
+	}
+	if config.IndirectProbes <= 0 {
+		config.IndirectProbes = defaultIndirectProbes
+	}
+	if config.SuspicionTimeout <= 0 {
+		config.SuspicionTimeout = defaultSuspicionTimeout
+	}
+	m := &Membership{
+		rsm:    rsm,
+		config: config,
+		agents: make(map[string]*agent),
+		ring:   make(map[string]Member),
+		quit:   make(chan struct{}),
+	}
+	names := rsm.chr.Nodes()
+	members := make([]Member, len(names))
+	for i, name := range names {
+		members[i] = Member{Name: name}
+		m.ring[name] = members[i]
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, name := range names {
+		m.startAgent(name, members)
+	}
+	return m
+}
+
+// startAgent starts the failure detector of a node. Callers hold m.mu
+func (m *Membership) startAgent(name string, members []Member) *agent {
+	a := &agent{
+		m:         m,
+		name:      name,
+		members:   make(map[string]Member),
+		suspected: make(map[string]time.Time),
+	}
+	for _, member := range members {
+		if member.Name != name {
+			a.members[member.Name] = member
+		}
+	}
+	m.agents[name] = a
+	m.wg.Add(1)
+	go a.run()
+	return a
+}
+
+// Join adds a node to the map and starts its failure detector, which learns
+// the membership from seed and announces itself by gossip
+func (m *Membership) Join(name, seed string) error {
+	m.mu.Lock()
+	_, exists := m.agents[name]
+	m.mu.Unlock()
+	if exists {
+		return fmt.Errorf("node %s already a member", name)
+	}
+	members, ok := m.call(name, seed, m.config.ProbeTimeout, func(s *agent) ([]Member, bool) {
+		return s.view(), true
+	})
+	if !ok {
+		return fmt.Errorf("joining through %s: %w", seed, ErrUnreachable)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ring[name] = Member{Name: name}
+	m.rsm.AddNode(name)
+	a := m.startAgent(name, members)
+	a.mu.Lock()
+	a.enqueue(Member{Name: name})
+	a.mu.Unlock()
+	return nil
+}
+
+// Stop stops the failure detector on every node
+func (m *Membership) Stop() {
+	close(m.quit)
+	m.wg.Wait()
+}
+
+// View returns the members as a node's failure detector sees them, itself
+// included, sorted by name
+func (m *Membership) View(node string) []Member {
+	m.mu.Lock()
+	a := m.agents[node]
+	m.mu.Unlock()
+	if a == nil {
+		return nil
+	}
+	return a.view()
+}
+
+// call sends a message from one node to another, which handles it and
+// replies, and reports whether the reply came back within timeout
+func (m *Membership) call(from, to string, timeout time.Duration, handle func(*agent) ([]Member, bool)) ([]Member, bool) {
+	m.mu.Lock()
+	target := m.agents[to]
+	m.mu.Unlock()
+	if target == nil {
+		return nil, false
+	}
+
+	replies := make(chan []Member, 1)
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		if m.rsm.network.deliver(from, to) != nil {
+			return
+		}
+		reply, ok := handle(target)
+		if !ok || m.rsm.network.deliver(to, from) != nil {
+			return
+		}
+		replies <- reply
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case reply := <-replies:
+		return reply, true
+	case <-timer.C:
+	case <-m.quit:
+	}
+	return nil, false
+}
+
+// observe applies news a node accepted to the ring: nodes declared dead are
+// removed and dead nodes back alive are added again. Either change is only
+// made by a node that reaches a majority of the cluster, and the node back
+// alive, so the minority side of a partition cannot change the ring
+func (m *Membership) observe(observer *agent, news Member) {
+	changes := func() (died, rejoined bool) {
+		if !news.supersedes(m.ring[news.Name]) {
+			return false, false
+		}
+		inRing := m.rsm.Node(news.Name) != nil
+		return news.State == MemberDead && inRing, news.State == MemberAlive && !inRing
+	}
+	m.mu.Lock()
+	died, rejoined := changes()
+	m.mu.Unlock()
+	if (died || rejoined) && !observer.reachesMajority(news.Name, rejoined) {
+		return
+	}
+
+	// The ring may have changed while the majority was pinged
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if stillDied, stillRejoined := changes(); stillDied != died || stillRejoined != rejoined || !news.supersedes(m.ring[news.Name]) {
+		return
+	}
+	m.ring[news.Name] = news
+	switch {
+	case died:
+		stats := m.rsm.RemoveNode(news.Name)
+		fmt.Printf("Node %s declared dead by %s, %d key copies re-replicated\n", news.Name, observer.name, stats.Copied)
+	case rejoined:
+		stats := m.rsm.AddNode(news.Name)
+		fmt.Printf("Node %s alive again, %d key copies moved to it\n", news.Name, stats.Copied)
+	}
+}
+
+// agent is the failure detector of one node
+type agent struct {
+	m    *Membership
+	name string
+
+	mu          sync.Mutex
+	incarnation uint64
+	members     map[string]Member    // every other node
+	suspected   map[string]time.Time // when each suspect was suspected
+	broadcasts  []broadcast          // news to piggyback on messages
+	probeOrder  []string
+}
+
+// broadcast is news being gossiped, with how many more messages carry it
+type broadcast struct {
+	member    Member
+	transmits int
+}
+
+// run probes a member every period, unless the node is crashed
+func (a *agent) run() {
+	defer a.m.wg.Done()
+	ticker := time.NewTicker(a.m.config.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.m.quit:
+			return
+		}
+		if a.m.rsm.network.Crashed(a.name) {
+			continue
+		}
+		a.probe()
+		a.expireSuspicions()
+		a.syncRing()
+	}
+}
+
+// probe pings the next member, and if it does not ack, asks other members
+// to ping it; the member is suspected if none of them gets an ack either.
+// Dead members are pinged too, so they learn they were declared dead once
+// they are reachable again, but nothing more is done if they do not ack
+func (a *agent) probe() {
+	target, dead, ok := a.nextTarget()
+	if !ok {
+		return
+	}
+	timeout := a.m.config.ProbeTimeout
+	if reply, ok := a.m.call(a.name, target, timeout, func(t *agent) ([]Member, bool) {
+		return t.handlePing(a.name, a.piggyback(target))
+	}); ok || dead {
+		a.merge(reply)
+		return
+	}
+
+	helpers := a.randomMembers(a.m.config.IndirectProbes, target)
+	acks := make(chan []Member, len(helpers))
+	for _, helper := range helpers {
+		a.m.wg.Add(1)
+		go func() {
+			defer a.m.wg.Done()
+			reply, ok := a.m.call(a.name, helper, 2*timeout, func(h *agent) ([]Member, bool) {
+				return h.handlePingReq(a.name, target, a.piggyback(helper))
+			})
+			if !ok {
+				reply = nil
+			}
+			acks <- reply
+		}()
+	}
+	for range helpers {
+		if reply := <-acks; reply != nil {
+			a.merge(reply)
+			return
+		}
+	}
+	a.suspect(target)
+}
+
+// handlePing merges the news on a ping and returns the ack
+func (a *agent) handlePing(from string, news []Member) ([]Member, bool) {
+	a.merge(news)
+	return a.piggyback(from), true
+}
+
+// handlePingReq pings target for another node, acking only if target acked
+func (a *agent) handlePingReq(from, target string, news []Member) ([]Member, bool) {
+	a.merge(news)
+	reply, ok := a.m.call(a.name, target, a.m.config.ProbeTimeout, func(t *agent) ([]Member, bool) {
+		return t.handlePing(a.name, a.piggyback(target))
+	})
+	if !ok {
+		return nil, false
+	}
+	a.merge(reply)
+	return a.handlePing(from, nil)
+}
+
+// merge applies gossiped news, refuting news that this node is suspect or dead
+func (a *agent) merge(news []Member) {
+	var accepted []Member
+	a.mu.Lock()
+	for _, member := range news {
+		if member.Name == a.name {
+			if member.State != MemberAlive && member.Incarnation >= a.incarnation {
+				a.incarnation = member.Incarnation + 1
+				a.enqueue(Member{Name: a.name, Incarnation: a.incarnation})
+			}
+			continue
+		}
+		if known, ok := a.members[member.Name]; ok && !member.supersedes(known) {
+			continue
+		}
+		a.learn(member)
+		accepted = append(accepted, member)
+	}
+	a.mu.Unlock()
+
+	for _, member := range accepted {
+		a.m.observe(a, member)
+	}
+}
+
+// suspect marks a member that did not ack a probe as suspect
+func (a *agent) suspect(name string) {
+	a.mu.Lock()
+	known, ok := a.members[name]
+	if !ok || known.State != MemberAlive {
+		a.mu.Unlock()
+		return
+	}
+	news := Member{Name: name, State: MemberSuspect, Incarnation: known.Incarnation}
+	a.learn(news)
+	a.mu.Unlock()
+	a.m.observe(a, news)
+}
+
+// expireSuspicions declares dead the suspects that did not refute in time
+func (a *agent) expireSuspicions() {
+	var dead []Member
+	a.mu.Lock()
+	for name, since := range a.suspected {
+		if time.Since(since) < a.m.config.SuspicionTimeout {
+			continue
+		}
+		news := Member{Name: name, State: MemberDead, Incarnation: a.members[name].Incarnation}
+		a.learn(news)
+		dead = append(dead, news)
+	}
+	a.mu.Unlock()
+
+	for _, news := range dead {
+		a.m.observe(a, news)
+	}
+}
+
+// syncRing offers the ring what the node knows again, in case applying it
+// failed when the node first learned it
+func (a *agent) syncRing() {
+	a.mu.Lock()
+	members := make([]Member, 0, len(a.members))
+	for _, member := range a.members {
+		members = append(members, member)
+	}
+	a.mu.Unlock()
+
+	for _, member := range members {
+		a.m.observe(a, member)
+	}
+}
+
+// learn records news about another member and gossips it. Callers hold a.mu
+func (a *agent) learn(news Member) {
+	a.members[news.Name] = news
+	if news.State == MemberSuspect {
+		if _, ok := a.suspected[news.Name]; !ok {
+			a.suspected[news.Name] = time.Now()
+		}
+	} else {
+		delete(a.suspected, news.Name)
+	}
+	a.enqueue(news)
+}
+
+// enqueue queues news to gossip, replacing older news of the same member.
+// Callers hold a.mu
+func (a *agent) enqueue(news Member) {
+	a.broadcasts = slices.DeleteFunc(a.broadcasts, func(b broadcast) bool {
+		return b.member.Name == news.Name
+	})
+	transmits := retransmitMult * int(math.Ceil(math.Log2(float64(len(a.members)+2))))
+	a.broadcasts = append(a.broadcasts, broadcast{member: news, transmits: transmits})
+}
+
+// piggyback returns the news to carry on a message to a member, counting it
+// as transmitted. A member believed suspect or dead is always told so, to
+// let it refute it
+func (a *agent) piggyback(to string) []Member {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	news := []Member{}
+	if known, ok := a.members[to]; ok && known.State != MemberAlive {
+		news = append(news, known)
+	}
+	for i := range a.broadcasts {
+		if len(news) == maxPiggyback {
+			break
+		}
+		if a.broadcasts[i].member.Name == to {
+			continue
+		}
+		news = append(news, a.broadcasts[i].member)
+		a.broadcasts[i].transmits--
+	}
+	a.broadcasts = slices.DeleteFunc(a.broadcasts, func(b broadcast) bool { return b.transmits <= 0 })
+	return news
+}
+
+// nextTarget returns the next member to probe, going round the members in a
+// random order, and whether it is believed dead
+func (a *agent) nextTarget() (string, bool, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.probeOrder) == 0 {
+		for name := range a.members {
+			a.probeOrder = append(a.probeOrder, name)
+		}
+		if len(a.probeOrder) == 0 {
+			return "", false, false
+		}
+		rand.Shuffle(len(a.probeOrder), func(i, j int) {
+			a.probeOrder[i], a.probeOrder[j] = a.probeOrder[j], a.probeOrder[i]
+		})
+	}
+	target := a.probeOrder[0]
+	a.probeOrder = a.probeOrder[1:]
+	return target, a.members[target].State == MemberDead, true
+}
+
+// randomMembers returns up to n random alive members other than exclude
+func (a *agent) randomMembers(n int, exclude string) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var names []string
+	for name, member := range a.members {
+		if name != exclude && member.State == MemberAlive {
+			names = append(names, name)
+		}
+	}
+	rand.Shuffle(len(names), func(i, j int) { names[i], names[j] = names[j], names[i] })
+	return names[:min(n, len(names))]
+}
+
+// reachesMajority pings every other member and reports whether most of the
+// cluster, the node itself included, acked. If subject must ack too, it is
+// counted only if it does; otherwise it is not pinged
+func (a *agent) reachesMajority(subject string, subjectMustAck bool) bool {
+	a.mu.Lock()
+	size := len(a.members) + 1
+	var names []string
+	for name := range a.members {
+		if name != subject || subjectMustAck {
+			names = append(names, name)
+		}
+	}
+	a.mu.Unlock()
+
+	acked := make(chan string, len(names))
+	for _, name := range names {
+		a.m.wg.Add(1)
+		go func() {
+			defer a.m.wg.Done()
+			reply, ok := a.m.call(a.name, name, a.m.config.ProbeTimeout, func(t *agent) ([]Member, bool) {
+				return t.handlePing(a.name, a.piggyback(name))
+			})
+			if !ok {
+				acked <- ""
+				return
+			}
+			a.merge(reply)
+			acked <- name
+		}()
+	}
+	acks, subjectAcked := 1, false
+	for range names {
+		if name := <-acked; name != "" {
+			acks++
+			subjectAcked = subjectAcked || name == subject
+		}
+	}
+	return acks > size/2 && (subjectAcked || !subjectMustAck)
+}
+
+// view returns the members as the node sees them, itself included
+func (a *agent) view() []Member {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	members := []Member{{Name: a.name, Incarnation: a.incarnation}}
+	for _, member := range a.members {
+		members = append(members, member)
+	}
+	slices.SortFunc(members, func(x, y Member) int { return cmp.Compare(x.Name, y.Name) })
+	return members
+}
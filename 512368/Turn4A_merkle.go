@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"maps"
+	"slices"
+	"sort"
+)
+
+// merkleLeaves is the number of key buckets hashed in each range's tree
+const merkleLeaves = 64
+
+// merkleTree hashes the keys one node holds in one range, so two replicas of
+// the range find the keys they differ on by descending only into subtrees
+// whose hashes differ. It is heap-ordered, with the leaves last
+type merkleTree []uint64
+
+// newMerkleTree builds the tree of a range from the digests of its keys
+func newMerkleTree(digests map[string]uint64) merkleTree {
+	tree := make(merkleTree, 2*merkleLeaves-1)
+	for key, digest := range digests {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write(binary.LittleEndian.AppendUint64(nil, digest))
+		tree[merkleLeaves-1+merkleLeaf(key)] ^= h.Sum64()
+	}
+	for i := merkleLeaves - 2; i >= 0; i-- {
+		h := fnv.New64a()
+		h.Write(binary.LittleEndian.AppendUint64(nil, tree[2*i+1]))
+		h.Write(binary.LittleEndian.AppendUint64(nil, tree[2*i+2]))
+		tree[i] = h.Sum64()
+	}
+	return tree
+}
+
+// diff returns the leaves whose hashes differ between two trees
+func (t merkleTree) diff(other merkleTree) []int {
+	var leaves []int
+	var walk func(i int)
+	walk = func(i int) {
+		if t[i] == other[i] {
+			return
+		}
+		if i >= merkleLeaves-1 {
+			leaves = append(leaves, i-(merkleLeaves-1))
+			return
+		}
+		walk(2*i + 1)
+		walk(2*i + 2)
+	}
+	walk(0)
+	return leaves
+}
+
+// merkleLeaf returns the leaf a key is hashed into
+func merkleLeaf(key string) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int(h.Sum64() % merkleLeaves)
+}
+
+// versionsDigest hashes a key's versions, regardless of their order
+func versionsDigest(versions []Versioned) uint64 {
+	var digest uint64
+	for _, version := range versions {
+		h := fnv.New64a()
+		h.Write([]byte(version.Value))
+		if version.Deleted {
+			h.Write([]byte{1})
+		}
+		for _, node := range slices.Sorted(maps.Keys(version.Clock)) {
+			h.Write([]byte(node))
+			h.Write(binary.LittleEndian.AppendUint64(nil, version.Clock[node]))
+		}
+		digest ^= h.Sum64()
+	}
+	return digest
+}
+
+// AntiEntropyStats describes one anti-entropy round
+type AntiEntropyStats struct {
+	// Compared is the number of pairs of replicas of a range compared
+	Compared int
+	// Differing is the number of those pairs whose trees differed
+	Differing int
+	// Transferred is the number of keys sent from one replica to another
+	Transferred int
+}
+
+// AntiEntropy compares the Merkle trees of every pair of reachable replicas
+// of each range of the ring, and exchanges the keys they differ on until
+// both hold the same versions
+func (rsm *ReplicatedShardedMap) AntiEntropy() AntiEntropyStats {
+	rsm.mu.RLock()
+	defer rsm.mu.RUnlock()
+
+	var stats AntiEntropyStats
+	ranges := rsm.chr.positions()
+	if len(ranges) == 0 {
+		return stats
+	}
+
+	// The digests of each node's keys by range, built in one scan of the node
+	// and kept current as keys are exchanged
+	digests := make(map[string]map[uint32]map[string]uint64, len(rsm.nodes))
+	rangeDigests := func(node string, end uint32) map[string]uint64 {
+		byRange, ok := digests[node]
+		if !ok {
+			byRange = make(map[uint32]map[string]uint64)
+			for key, versions := range rsm.nodes[node].snapshot() {
+				hash := rsm.hashKey(key)
+				i := sort.Search(len(ranges), func(i int) bool { return ranges[i] >= hash })
+				keyEnd := ranges[i%len(ranges)]
+				if byRange[keyEnd] == nil {
+					byRange[keyEnd] = make(map[string]uint64)
+				}
+				byRange[keyEnd][key] = versionsDigest(versions)
+			}
+			digests[node] = byRange
+		}
+		if byRange[end] == nil {
+			byRange[end] = make(map[string]uint64)
+		}
+		return byRange[end]
+	}
+
+	for _, end := range ranges {
+		replicas := rsm.chr.successors(end, rsm.replicas+1)
+		for i, a := range replicas {
+			for _, b := range replicas[i+1:] {
+				if rsm.network.deliver(a, b) != nil {
+					continue
+				}
+				stats.Compared++
+				digestsA, digestsB := rangeDigests(a, end), rangeDigests(b, end)
+				leaves := newMerkleTree(digestsA).diff(newMerkleTree(digestsB))
+				if len(leaves) == 0 {
+					continue
+				}
+				stats.Differing++
+				stats.Transferred += rsm.exchange(a, b, digestsA, digestsB, leaves)
+			}
+		}
+	}
+	return stats
+}
+
+// exchange sends each key in the given leaves whose digests differ between
+// two nodes to the node missing versions of it, and returns the number of
+// keys sent. Callers hold rsm.mu
+func (rsm *ReplicatedShardedMap) exchange(a, b string, digestsA, digestsB map[string]uint64, leaves []int) int {
+	differing := make(map[string]bool)
+	for _, digests := range []map[string]uint64{digestsA, digestsB} {
+		for key := range digests {
+			if slices.Contains(leaves, merkleLeaf(key)) {
+				digestA, okA := digestsA[key]
+				digestB, okB := digestsB[key]
+				if okA != okB || digestA != digestB {
+					differing[key] = true
+				}
+			}
+		}
+	}
+
+	transferred := 0
+	nodeA, nodeB := rsm.nodes[a], rsm.nodes[b]
+	for key := range differing {
+		versionsA, versionsB := nodeA.get(key), nodeB.get(key)
+		nodeA.put(key, versionsB...)
+		nodeB.put(key, versionsA...)
+		mergedA, mergedB := nodeA.get(key), nodeB.get(key)
+		if !sameVersions(versionsA, mergedA) {
+			transferred++
+		}
+		if !sameVersions(versionsB, mergedB) {
+			transferred++
+		}
+		digestsA[key], digestsB[key] = versionsDigest(mergedA), versionsDigest(mergedB)
+	}
+	return transferred
+}
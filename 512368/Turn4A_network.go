@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// ErrUnreachable reports a node that is crashed or partitioned from the sender
+var ErrUnreachable = errors.New("node unreachable")
+
+// Network carries requests between the map's nodes and injects faults into
+// them: crashed nodes answer nothing, partitioned nodes cannot reach each
+// other, and messages are delayed or lost. Crashed nodes keep their data, as
+// after a restart from disk
+type Network struct {
+	mu      sync.RWMutex
+	crashed map[string]bool
+	// group numbers nodes by partition; nodes in different groups are cut off.
+	// Nodes not in a group are in group 0
+	group   map[string]int
+	latency time.Duration
+	jitter  time.Duration
+	loss    float64
+}
+
+// NewNetwork creates a network without faults
+func NewNetwork() *Network {
+	return &Network{crashed: make(map[string]bool), group: make(map[string]int)}
+}
+
+// Crash stops a node answering requests
+func (n *Network) Crash(node string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.crashed[node] = true
+}
+
+// Restart brings a crashed node back with the data it had
+func (n *Network) Restart(node string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.crashed, node)
+}
+
+// Partition cuts the network between the given groups of nodes. Nodes in no
+// group stay reachable from the first group only
+func (n *Network) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.group = make(map[string]int)
+	for i, group := range groups {
+		for _, node := range group {
+			n.group[node] = i
+		}
+	}
+}
+
+// Heal removes all partitions
+func (n *Network) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.group = make(map[string]int)
+}
+
+// SetLatency delays every message by latency plus up to jitter more
+func (n *Network) SetLatency(latency, jitter time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.latency, n.jitter = latency, jitter
+}
+
+// SetLoss drops each message with probability rate
+func (n *Network) SetLoss(rate float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.loss = rate
+}
+
+// Crashed reports whether a node is crashed
+func (n *Network) Crashed(node string) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.crashed[node]
+}
+
+// deliver carries a message from one node to another, taking the network's
+// latency, and returns an error if it cannot reach the node or is lost
+func (n *Network) deliver(from, to string) error {
+	n.mu.RLock()
+	cut := n.crashed[from] || n.crashed[to] || n.group[from] != n.group[to]
+	lost := n.loss > 0 && rand.Float64() < n.loss
+	delay := n.latency
+	if n.jitter > 0 {
+		delay += rand.N(n.jitter)
+	}
+	n.mu.RUnlock()
+
+	if cut {
+		return fmt.Errorf("%s to %s: %w", from, to, ErrUnreachable)
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if lost {
+		return fmt.Errorf("%s to %s: message lost: %w", from, to, ErrUnreachable)
+	}
+	return nil
+}
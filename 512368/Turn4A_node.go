@@ -0,0 +1,165 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"sync"
+)
+
+// StorageNode is a simulated node holding its own partition of the map: the
+// keys whose preference list includes it, each with its sibling versions,
+// and hints: writes it stands in for while their own node is unreachable
+type StorageNode struct {
+	name  string
+	data  map[string][]Versioned
+	hints map[string]map[string][]Versioned // by node, then key
+	mu    sync.RWMutex
+}
+
+// NewStorageNode creates an empty node
+func NewStorageNode(name string) *StorageNode {
+	return &StorageNode{
+		name:  name,
+		data:  make(map[string][]Versioned),
+		hints: make(map[string]map[string][]Versioned),
+	}
+}
+
+// get returns the versions of a key the node holds
+func (n *StorageNode) get(key string) []Versioned {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return slices.Clone(n.data[key])
+}
+
+// coordinate stores a new version of a key, descending from every version
+// the node holds, and returns it to be sent to the key's other nodes
+func (n *StorageNode) coordinate(key string, version Versioned) Versioned {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	clock := VectorClock{}
+	for _, sibling := range n.data[key] {
+		clock = clock.Merge(sibling.Clock)
+	}
+	version.Clock = clock.Increment(n.name)
+	n.data[key] = []Versioned{version}
+	return version
+}
+
+// put reconciles versions of a key with those the node holds
+func (n *StorageNode) put(key string, versions ...Versioned) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	siblings := n.data[key]
+	for _, version := range versions {
+		siblings = reconcile(siblings, version)
+	}
+	n.data[key] = siblings
+}
+
+func (n *StorageNode) remove(key string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.data, key)
+}
+
+// Len returns the number of keys the node holds
+func (n *StorageNode) Len() int {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return len(n.data)
+}
+
+// snapshot returns a copy of the node's keys and versions
+func (n *StorageNode) snapshot() map[string][]Versioned {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	data := make(map[string][]Versioned, len(n.data))
+	for key, versions := range n.data {
+		data[key] = slices.Clone(versions)
+	}
+	return data
+}
+
+// MigrationStats counts the key copies moved by a membership change
+type MigrationStats struct {
+	// Copied is the number of keys copied to nodes newly responsible for them
+	Copied int
+	// Dropped is the number of keys removed from nodes no longer responsible for them
+	Dropped int
+	// Lost is the number of key ranges with no surviving copy to migrate from
+	Lost int
+}
+
+// rangeMove is the change to one key range: the node its keys are read from,
+// the nodes that must now hold them and the nodes that must drop them
+type rangeMove struct {
+	source  string
+	targets []string
+	stale   []string
+}
+
+// migrate moves keys between nodes after the ring changed from before to
+// after. The ring is split at every point of either ring, so each range has
+// the same preference list throughout; only ranges whose preference list
+// changed are moved, each read from one surviving node that held it.
+// Callers hold rsm.mu
+func (rsm *ReplicatedShardedMap) migrate(before, after *ConsistentHashRing) MigrationStats {
+	var stats MigrationStats
+	boundaries := slices.Compact(slices.Sorted(slices.Values(append(before.positions(), after.positions()...))))
+	moves := make(map[uint32]*rangeMove)
+	bySource := make(map[string]bool)
+	n := rsm.replicas + 1
+	for _, boundary := range boundaries {
+		was, is := before.successors(boundary, n), after.successors(boundary, n)
+		if slices.Equal(was, is) {
+			continue
+		}
+		move := &rangeMove{}
+		for _, node := range was {
+			if _, alive := rsm.nodes[node]; !alive {
+				continue
+			}
+			if move.source == "" {
+				move.source = node
+			}
+			if !slices.Contains(is, node) {
+				move.stale = append(move.stale, node)
+			}
+		}
+		for _, node := range is {
+			if !slices.Contains(was, node) {
+				move.targets = append(move.targets, node)
+			}
+		}
+		if move.source == "" {
+			if len(was) > 0 {
+				stats.Lost++
+			}
+			continue
+		}
+		moves[boundary] = move
+		bySource[move.source] = true
+	}
+
+	// Scan each source once, moving the keys of the ranges it is the source for
+	for source := range bySource {
+		for key, versions := range rsm.nodes[source].snapshot() {
+			hash := rsm.hashKey(key)
+			i := sort.Search(len(boundaries), func(i int) bool { return boundaries[i] >= hash })
+			move := moves[boundaries[i%len(boundaries)]]
+			if move == nil || move.source != source {
+				continue
+			}
+			for _, target := range move.targets {
+				rsm.nodes[target].put(key, versions...)
+				stats.Copied++
+			}
+			for _, stale := range move.stale {
+				rsm.nodes[stale].remove(key)
+				stats.Dropped++
+			}
+		}
+	}
+	return stats
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Quorum is how many of a key's N nodes must answer an operation: R for
+// reads and W for writes. With R+W > N every read sees the latest
+// acknowledged write
+type Quorum struct {
+	R int
+	W int
+}
+
+// ErrQuorum reports an operation fewer nodes answered than its quorum needs.
+// A write failing it may still have been stored by the nodes that answered
+var ErrQuorum = errors.New("quorum not reached")
+
+// ConflictError reports a key with concurrent versions, written through
+// nodes that had not seen each other's writes. A read repairs every node it
+// reached to hold all of them, so writing the key again supersedes them
+type ConflictError struct {
+	Key      string
+	Versions []Versioned
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("key %s has %d conflicting versions", e.Key, len(e.Versions))
+}
+
+// SetQuorum sets the quorums used by operations that do not give their own
+func (rsm *ReplicatedShardedMap) SetQuorum(quorum Quorum) error {
+	rsm.mu.Lock()
+	defer rsm.mu.Unlock()
+
+	n := rsm.replicas + 1
+	if quorum.R < 1 || quorum.R > n || quorum.W < 1 || quorum.W > n {
+		return fmt.Errorf("quorum R=%d W=%d outside 1 to N=%d", quorum.R, quorum.W, n)
+	}
+	rsm.quorum = quorum
+	return nil
+}
+
+// coordinator returns the node that handles an operation on key, the first
+// of its preference list that is not crashed, and the preference list.
+// Callers hold rsm.mu
+func (rsm *ReplicatedShardedMap) coordinator(key string) (string, []string, error) {
+	names := rsm.chr.GetNodes(key, rsm.replicas+1)
+	for _, name := range names {
+		if !rsm.network.Crashed(name) {
+			return name, names, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no node for key %s: %w", key, ErrUnreachable)
+}
+
+// write stores a new version of key on the coordinator, descending from the
+// versions it holds, and sends it to the other nodes of the key, leaving it
+// with stand-ins for those unreachable. It fails unless w nodes, or the
+// map's write quorum if w is 0, stored it. Callers hold rsm.mu
+func (rsm *ReplicatedShardedMap) write(key string, version Versioned, w int) error {
+	if w == 0 {
+		w = rsm.quorum.W
+	}
+	coordinator, names, err := rsm.coordinator(key)
+	if err != nil {
+		return err
+	}
+	version = rsm.nodes[coordinator].coordinate(key, version)
+	acks := 1
+	var unreachable []string
+	for _, name := range names {
+		if name == coordinator {
+			continue
+		}
+		if rsm.network.deliver(coordinator, name) != nil {
+			unreachable = append(unreachable, name)
+			continue
+		}
+		rsm.nodes[name].put(key, version)
+		acks++
+	}
+	if len(unreachable) > 0 {
+		rsm.handOff(coordinator, key, version, names, unreachable)
+	}
+	if acks < w {
+		return fmt.Errorf("writing key %s: %d of %d nodes stored it, want %d: %w", key, acks, len(names), w, ErrQuorum)
+	}
+	return nil
+}
+
+// GetVersions returns the current versions of key, read from r nodes or the
+// map's read quorum if r is 0. More than one version means the key was
+// written concurrently. Nodes found holding stale versions are repaired
+func (rsm *ReplicatedShardedMap) GetVersions(key string, r int) ([]Versioned, error) {
+	rsm.mu.RLock()
+	defer rsm.mu.RUnlock()
+
+	if r == 0 {
+		r = rsm.quorum.R
+	}
+	coordinator, names, err := rsm.coordinator(key)
+	if err != nil {
+		return nil, err
+	}
+	replies := make(map[string][]Versioned, len(names))
+	var current []Versioned
+	for _, name := range names {
+		if rsm.network.deliver(coordinator, name) != nil {
+			continue
+		}
+		versions := rsm.nodes[name].get(key)
+		replies[name] = versions
+		for _, version := range versions {
+			current = reconcile(current, version)
+		}
+	}
+	if len(replies) < r {
+		return nil, fmt.Errorf("reading key %s: %d of %d nodes answered, want %d: %w", key, len(replies), len(names), r, ErrQuorum)
+	}
+
+	// Read repair
+	for name, versions := range replies {
+		if !sameVersions(versions, current) {
+			rsm.nodes[name].put(key, current...)
+		}
+	}
+	return current, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// Define the ConsistentHashRing struct. Each node is placed on the ring at
+// vnodes points; a key belongs to the node of the first point at or after
+// its hash, and its replicas to the next distinct nodes clockwise
+type ConsistentHashRing struct {
+	points []uint32          // sorted positions of the virtual nodes
+	owners map[uint32]string // node at each position
+	vnodes int
+	nodes  []string
+	mu     sync.RWMutex
+}
+
+// NewConsistentHashRing creates a new hash ring placing each node at vnodes points
+func NewConsistentHashRing(vnodes int) *ConsistentHashRing {
+	return &ConsistentHashRing{
+		owners: make(map[uint32]string),
+		vnodes: vnodes,
+		nodes:  []string{},
+	}
+}
+
+// Get the hash value for a key
+func (chr *ConsistentHashRing) hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// Add a node to the ring
+func (chr *ConsistentHashRing) AddNode(node string) {
+	chr.mu.Lock()
+	defer chr.mu.Unlock()
+
+	if slices.Contains(chr.nodes, node) {
+		return
+	}
+	chr.nodes = append(chr.nodes, node)
+	chr.place(node)
+	slices.Sort(chr.points)
+}
+
+// Remove a node from the ring
+func (chr *ConsistentHashRing) RemoveNode(node string) {
+	chr.mu.Lock()
+	defer chr.mu.Unlock()
+
+	chr.nodes = slices.DeleteFunc(chr.nodes, func(n string) bool { return n == node })
+	// Place the remaining nodes again, so positions the node had taken
+	// from another node's virtual node go back to it
+	chr.points = chr.points[:0]
+	chr.owners = make(map[uint32]string)
+	for _, n := range chr.nodes {
+		chr.place(n)
+	}
+	slices.Sort(chr.points)
+}
+
+// place adds the virtual nodes of a node. A position two virtual nodes hash
+// to goes to the node that sorts first, so rings with the same nodes agree
+func (chr *ConsistentHashRing) place(node string) {
+	for i := 0; i < chr.vnodes; i++ {
+		hash := chr.hashKey(fmt.Sprintf("%s-%d", node, i))
+		owner, taken := chr.owners[hash]
+		if taken && owner < node {
+			continue
+		}
+		if !taken {
+			chr.points = append(chr.points, hash)
+		}
+		chr.owners[hash] = node
+	}
+}
+
+// Nodes returns the nodes on the ring
+func (chr *ConsistentHashRing) Nodes() []string {
+	chr.mu.RLock()
+	defer chr.mu.RUnlock()
+	return append([]string(nil), chr.nodes...)
+}
+
+// GetNode retrieves the node responsible for a given key, or "" if the ring is empty
+func (chr *ConsistentHashRing) GetNode(key string) string {
+	nodes := chr.GetNodes(key, 1)
+	if len(nodes) == 0 {
+		return ""
+	}
+	return nodes[0]
+}
+
+// GetNodes returns the preference list of a key: its node followed by the
+// next distinct nodes clockwise, up to n nodes in all
+func (chr *ConsistentHashRing) GetNodes(key string, n int) []string {
+	return chr.successors(chr.hashKey(key), n)
+}
+
+// successors returns up to n distinct nodes from the first point at or after hash
+func (chr *ConsistentHashRing) successors(hash uint32, n int) []string {
+	chr.mu.RLock()
+	defer chr.mu.RUnlock()
+
+	n = min(n, len(chr.nodes))
+	nodes := make([]string, 0, n)
+	start := sort.Search(len(chr.points), func(i int) bool { return chr.points[i] >= hash })
+	for i := 0; i < len(chr.points) && len(nodes) < n; i++ {
+		node := chr.owners[chr.points[(start+i)%len(chr.points)]]
+		if !slices.Contains(nodes, node) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// clone returns a copy of the ring, so changes can be compared with it
+func (chr *ConsistentHashRing) clone() *ConsistentHashRing {
+	chr.mu.RLock()
+	defer chr.mu.RUnlock()
+
+	owners := make(map[uint32]string, len(chr.owners))
+	for hash, node := range chr.owners {
+		owners[hash] = node
+	}
+	return &ConsistentHashRing{
+		points: append([]uint32(nil), chr.points...),
+		owners: owners,
+		vnodes: chr.vnodes,
+		nodes:  append([]string(nil), chr.nodes...),
+	}
+}
+
+// positions returns the sorted points of the ring
+func (chr *ConsistentHashRing) positions() []uint32 {
+	chr.mu.RLock()
+	defer chr.mu.RUnlock()
+	return append([]uint32(nil), chr.points...)
+}
@@ -0,0 +1,734 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestMap returns a map over the given nodes holding keys key-0 to key-(keys-1)
+func newTestMap(t *testing.T, replicas, keys int, nodes ...string) *ReplicatedShardedMap {
+	t.Helper()
+	rsm := NewReplicatedShardedMap(4, replicas, 1000000, 1000000)
+	for _, node := range nodes {
+		rsm.AddNode(node)
+	}
+	for i := 0; i < keys; i++ {
+		if err := rsm.Put(Event{Key: fmt.Sprintf("key-%d", i), Value: fmt.Sprintf("value-%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rsm
+}
+
+// checkPlacement fails unless every key is stored on exactly the nodes of its preference list
+func checkPlacement(t *testing.T, rsm *ReplicatedShardedMap, keys int) {
+	t.Helper()
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		want := rsm.chr.GetNodes(key, rsm.replicas+1)
+		var got []string
+		for _, node := range rsm.chr.Nodes() {
+			versions := rsm.Node(node).get(key)
+			if len(versions) == 0 {
+				continue
+			}
+			if len(versions) != 1 || versions[0].Value != fmt.Sprintf("value-%d", i) {
+				t.Fatalf("%s on %s = %+v, want value-%d", key, node, versions, i)
+			}
+			got = append(got, node)
+		}
+		slices.Sort(got)
+		slices.Sort(want)
+		if !slices.Equal(got, want) {
+			t.Fatalf("%s stored on %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestRingSuccessorsAreDistinct(t *testing.T) {
+	chr := NewConsistentHashRing(virtualNodes)
+	for _, node := range []string{"node1", "node2", "node3", "node4"} {
+		chr.AddNode(node)
+	}
+	for i := 0; i < 1000; i++ {
+		nodes := chr.GetNodes(fmt.Sprintf("key-%d", i), 3)
+		if len(nodes) != 3 {
+			t.Fatalf("GetNodes returned %v, want 3 nodes", nodes)
+		}
+		if nodes[0] != chr.GetNode(fmt.Sprintf("key-%d", i)) {
+			t.Fatalf("preference list %v does not start with the key's node", nodes)
+		}
+		if len(slices.Compact(slices.Sorted(slices.Values(nodes)))) != 3 {
+			t.Fatalf("GetNodes returned %v, want distinct nodes", nodes)
+		}
+	}
+	if nodes := chr.GetNodes("key", 10); len(nodes) != 4 {
+		t.Fatalf("GetNodes asked for more nodes than the ring has returned %v", nodes)
+	}
+}
+
+func TestKeysStoredOnPreferenceList(t *testing.T) {
+	const keys = 2000
+	rsm := newTestMap(t, 2, keys, "node1", "node2", "node3", "node4", "node5")
+	checkPlacement(t, rsm, keys)
+
+	total := 0
+	for _, node := range rsm.chr.Nodes() {
+		total += rsm.Node(node).Len()
+	}
+	if total != keys*3 {
+		t.Fatalf("nodes hold %d copies, want %d", total, keys*3)
+	}
+
+	if err := rsm.Remove("key-0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := rsm.Get("key-0"); ok || err != nil {
+		t.Fatalf("Get of a removed key = %v, %v", ok, err)
+	}
+	for _, node := range rsm.chr.GetNodes("key-0", 3) {
+		if versions := rsm.Node(node).get("key-0"); len(versions) != 1 || !versions[0].Deleted {
+			t.Fatalf("removed key stored on %s as %+v, want a tombstone", node, versions)
+		}
+	}
+}
+
+func TestAddNodeMovesOnlyAffectedRanges(t *testing.T) {
+	const keys = 5000
+	rsm := newTestMap(t, 2, keys, "node1", "node2", "node3", "node4")
+	stats := rsm.AddNode("node5")
+	checkPlacement(t, rsm, keys)
+
+	held := rsm.Node("node5").Len()
+	if stats.Copied != held {
+		t.Fatalf("copied %d keys, but the new node holds %d", stats.Copied, held)
+	}
+	if stats.Dropped != stats.Copied {
+		t.Fatalf("copied %d keys but dropped %d, want every copy to replace one", stats.Copied, stats.Dropped)
+	}
+	// The new node takes about 3/5 of the keys as a primary or replica;
+	// moving much more means ranges it did not take were moved too
+	if stats.Copied > keys*3/4 {
+		t.Fatalf("copied %d of %d keys to the new node", stats.Copied, keys)
+	}
+	if stats.Copied == 0 {
+		t.Fatal("no keys copied to the new node")
+	}
+
+	if stats := rsm.AddNode("node5"); stats != (MigrationStats{}) {
+		t.Fatalf("adding a node twice moved keys: %+v", stats)
+	}
+}
+
+func TestNoDataLossOnNodeFailure(t *testing.T) {
+	const keys = 3000
+	rsm := newTestMap(t, 2, keys, "node1", "node2", "node3", "node4", "node5")
+
+	for _, failed := range []string{"node2", "node4"} {
+		held := rsm.Node(failed).Len()
+		stats := rsm.RemoveNode(failed)
+		if stats.Lost != 0 {
+			t.Fatalf("removing %s lost %d ranges", failed, stats.Lost)
+		}
+		if stats.Copied != held {
+			t.Fatalf("removing %s re-replicated %d keys, want the %d it held", failed, stats.Copied, held)
+		}
+		if rsm.Node(failed) != nil {
+			t.Fatalf("%s still in the map", failed)
+		}
+		checkPlacement(t, rsm, keys)
+	}
+	for i := 0; i < keys; i++ {
+		value, ok, err := rsm.Get(fmt.Sprintf("key-%d", i))
+		if !ok || err != nil || value != fmt.Sprintf("value-%d", i) {
+			t.Fatalf("Get(key-%d) = %q, %v, %v after node failures", i, value, ok, err)
+		}
+	}
+}
+
+func TestDataLostWhenEveryReplicaFails(t *testing.T) {
+	rsm := newTestMap(t, 0, 1000, "node1", "node2")
+	stats := rsm.RemoveNode("node1")
+	if stats.Lost == 0 {
+		t.Fatal("removing the only copy of keys reported no lost ranges")
+	}
+	if got := rsm.Node("node2").Len(); got >= 1000 {
+		t.Fatalf("node2 holds %d keys after node1 failed without replicas", got)
+	}
+}
+
+func TestVectorClockCompare(t *testing.T) {
+	a := VectorClock{}.Increment("node1")
+	b := a.Increment("node2")
+	c := a.Increment("node3")
+	tests := []struct {
+		x, y VectorClock
+		want Ordering
+	}{
+		{a, a, Equal},
+		{a, b, Before},
+		{b, a, After},
+		{b, c, Concurrent},
+		{b.Merge(c), c, After},
+		{VectorClock{}, a, Before},
+	}
+	for _, tt := range tests {
+		if got := tt.x.Compare(tt.y); got != tt.want {
+			t.Errorf("%v.Compare(%v) = %v, want %v", tt.x, tt.y, got, tt.want)
+		}
+	}
+	if a["node1"] != 1 || len(a) != 1 {
+		t.Fatalf("Increment changed the clock it was called on: %v", a)
+	}
+}
+
+func TestQuorumNeedsEnoughNodes(t *testing.T) {
+	rsm := newTestMap(t, 2, 0, "node1", "node2", "node3", "node4")
+	nodes := rsm.chr.GetNodes("key", 3)
+	rsm.Network().Crash(nodes[0])
+	rsm.Network().Crash(nodes[1])
+
+	if err := rsm.Put(Event{Key: "key", Value: "value"}); !errors.Is(err, ErrQuorum) {
+		t.Fatalf("Put with one of three nodes up = %v, want ErrQuorum", err)
+	}
+	if err := rsm.PutWithQuorum(Event{Key: "key", Value: "value"}, 1); err != nil {
+		t.Fatalf("Put with W=1 = %v", err)
+	}
+	if _, _, err := rsm.Get("key"); !errors.Is(err, ErrQuorum) {
+		t.Fatalf("Get with one of three nodes up = %v, want ErrQuorum", err)
+	}
+	if value, ok, err := rsm.GetWithQuorum("key", 1); value != "value" || !ok || err != nil {
+		t.Fatalf("Get with R=1 = %q, %v, %v", value, ok, err)
+	}
+
+	rsm.Network().Crash(nodes[2])
+	if err := rsm.PutWithQuorum(Event{Key: "key", Value: "value"}, 1); !errors.Is(err, ErrUnreachable) {
+		t.Fatalf("Put with every node of the key down = %v, want ErrUnreachable", err)
+	}
+
+	if err := rsm.SetQuorum(Quorum{R: 1, W: 4}); err == nil {
+		t.Fatal("SetQuorum accepted W greater than N")
+	}
+	if err := rsm.SetQuorum(Quorum{R: 1, W: 3}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadRepairUpdatesStaleReplicas(t *testing.T) {
+	rsm := newTestMap(t, 2, 0, "node1", "node2", "node3", "node4")
+	nodes := rsm.chr.GetNodes("key", 3)
+	if err := rsm.Put(Event{Key: "key", Value: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	rsm.Network().Crash(nodes[2])
+	if err := rsm.Put(Event{Key: "key", Value: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	rsm.Network().Restart(nodes[2])
+	if versions := rsm.Node(nodes[2]).get("key"); versions[0].Value != "old" {
+		t.Fatalf("restarted node holds %+v, want the old value", versions)
+	}
+
+	// A read of every node sees the stale copy and repairs it
+	if value, _, err := rsm.GetWithQuorum("key", 3); value != "new" || err != nil {
+		t.Fatalf("Get = %q, %v, want new", value, err)
+	}
+	if versions := rsm.Node(nodes[2]).get("key"); len(versions) != 1 || versions[0].Value != "new" {
+		t.Fatalf("restarted node holds %+v after read repair, want the new value", versions)
+	}
+}
+
+func TestDivergentWritesConflict(t *testing.T) {
+	rsm := newTestMap(t, 2, 0, "node1", "node2", "node3", "node4")
+	nodes := rsm.chr.GetNodes("key", 3)
+	if err := rsm.Put(Event{Key: "key", Value: "base"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key's primary is cut off and takes a write alone, then crashes and
+	// the others take a write it never sees
+	rsm.Network().Partition([]string{nodes[0]}, nodes[1:])
+	if err := rsm.PutWithQuorum(Event{Key: "key", Value: "left"}, 1); err != nil {
+		t.Fatal(err)
+	}
+	rsm.Network().Crash(nodes[0])
+	if err := rsm.Put(Event{Key: "key", Value: "right"}); err != nil {
+		t.Fatal(err)
+	}
+	rsm.Network().Restart(nodes[0])
+	rsm.Network().Heal()
+
+	_, _, err := rsm.GetWithQuorum("key", 3)
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("Get after divergent writes = %v, want a conflict", err)
+	}
+	var values []string
+	for _, version := range conflict.Versions {
+		values = append(values, version.Value)
+	}
+	slices.Sort(values)
+	if !slices.Equal(values, []string{"left", "right"}) {
+		t.Fatalf("conflicting versions %+v, want left and right", conflict.Versions)
+	}
+	for _, node := range nodes {
+		if versions := rsm.Node(node).get("key"); len(versions) != 2 {
+			t.Fatalf("%s holds %+v after read repair, want both versions", node, versions)
+		}
+	}
+
+	// Writing again supersedes both versions
+	if err := rsm.Put(Event{Key: "key", Value: "resolved"}); err != nil {
+		t.Fatal(err)
+	}
+	if value, _, err := rsm.GetWithQuorum("key", 3); value != "resolved" || err != nil {
+		t.Fatalf("Get after resolving = %q, %v", value, err)
+	}
+}
+
+// divergence describes a key whose replicas hold different versions, or
+// returns "" if every replica of each key holds the same versions
+func divergence(rsm *ReplicatedShardedMap, keys int) string {
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		nodes := rsm.chr.GetNodes(key, rsm.replicas+1)
+		want := rsm.Node(nodes[0]).get(key)
+		for _, node := range nodes[1:] {
+			if got := rsm.Node(node).get(key); !sameVersions(got, want) {
+				return fmt.Sprintf("%s on %s = %+v, on %s = %+v", key, node, got, nodes[0], want)
+			}
+		}
+	}
+	return ""
+}
+
+func checkConverged(t *testing.T, rsm *ReplicatedShardedMap, keys int) {
+	t.Helper()
+	if diverged := divergence(rsm, keys); diverged != "" {
+		t.Fatal(diverged)
+	}
+}
+
+func TestHintedHandoff(t *testing.T) {
+	rsm := newTestMap(t, 2, 0, "node1", "node2", "node3", "node4", "node5")
+	nodes := rsm.chr.GetNodes("key", 5)
+	rsm.Network().Crash(nodes[2])
+	if err := rsm.Put(Event{Key: "key", Value: "value"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := rsm.Node(nodes[3]).Hints(); got != 1 {
+		t.Fatalf("stand-in %s holds %d hints, want 1", nodes[3], got)
+	}
+	if versions := rsm.Node(nodes[2]).get("key"); len(versions) != 0 {
+		t.Fatalf("crashed node got the write: %+v", versions)
+	}
+
+	if delivered := rsm.ReplayHints(); delivered != 0 {
+		t.Fatalf("handed off %d hints to a crashed node", delivered)
+	}
+	rsm.Network().Restart(nodes[2])
+	if delivered := rsm.ReplayHints(); delivered != 1 {
+		t.Fatalf("handed off %d hints, want 1", delivered)
+	}
+	if versions := rsm.Node(nodes[2]).get("key"); len(versions) != 1 || versions[0].Value != "value" {
+		t.Fatalf("restarted node holds %+v after hinted handoff", versions)
+	}
+	if got := rsm.Node(nodes[3]).Hints(); got != 0 {
+		t.Fatalf("stand-in still holds %d hints after handing them off", got)
+	}
+}
+
+func TestMerkleTreeDiff(t *testing.T) {
+	digests := make(map[string]uint64)
+	for i := 0; i < 500; i++ {
+		digests[fmt.Sprintf("key-%d", i)] = uint64(i)
+	}
+	tree := newMerkleTree(digests)
+	if leaves := tree.diff(newMerkleTree(digests)); len(leaves) != 0 {
+		t.Fatalf("identical trees differ in leaves %v", leaves)
+	}
+	digests["key-7"] = 1000
+	delete(digests, "key-8")
+	leaves := tree.diff(newMerkleTree(digests))
+	want := slices.Compact(slices.Sorted(slices.Values([]int{merkleLeaf("key-7"), merkleLeaf("key-8")})))
+	if !slices.Equal(leaves, want) {
+		t.Fatalf("trees differ in leaves %v, want %v", leaves, want)
+	}
+}
+
+func TestAntiEntropyConvergesAfterPartitionHeals(t *testing.T) {
+	const keys = 2000
+	rsm := newTestMap(t, 2, keys, "node1", "node2", "node3", "node4", "node5")
+	if stats := rsm.AntiEntropy(); stats.Differing != 0 || stats.Compared == 0 {
+		t.Fatalf("anti-entropy of converged replicas = %+v", stats)
+	}
+
+	// Writes during the partition reach only the coordinator's side
+	rsm.Network().Partition([]string{"node1", "node2"}, []string{"node3", "node4", "node5"})
+	const updated = 100
+	for i := 0; i < updated; i++ {
+		event := Event{Key: fmt.Sprintf("key-%d", i), Value: fmt.Sprintf("updated-%d", i)}
+		if err := rsm.PutWithQuorum(event, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rsm.Network().Heal()
+
+	stats := rsm.AntiEntropy()
+	if stats.Transferred == 0 || stats.Transferred > updated*2 {
+		t.Fatalf("anti-entropy transferred %d keys, want at most the %d stale copies", stats.Transferred, updated*2)
+	}
+	if stats.Differing >= stats.Compared {
+		t.Fatalf("every compared range differed: %+v", stats)
+	}
+	checkConverged(t, rsm, keys)
+	for i := 0; i < updated; i++ {
+		if value, _, err := rsm.GetWithQuorum(fmt.Sprintf("key-%d", i), 3); value != fmt.Sprintf("updated-%d", i) || err != nil {
+			t.Fatalf("Get(key-%d) = %q, %v after the partition healed", i, value, err)
+		}
+	}
+	if stats := rsm.AntiEntropy(); stats.Differing != 0 {
+		t.Fatalf("anti-entropy after convergence = %+v", stats)
+	}
+	// Hints left from the partition are older than what anti-entropy copied
+	rsm.ReplayHints()
+	checkConverged(t, rsm, keys)
+}
+
+func TestBackgroundRepairConverges(t *testing.T) {
+	const keys = 500
+	rsm := newTestMap(t, 2, keys, "node1", "node2", "node3", "node4")
+	stop := rsm.StartRepair(10 * time.Millisecond)
+	defer stop()
+
+	rsm.Network().Crash("node2")
+	for i := 0; i < keys; i++ {
+		if err := rsm.PutWithQuorum(Event{Key: fmt.Sprintf("key-%d", i), Value: fmt.Sprintf("value-%d", i)}, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rsm.Network().Partition([]string{"node1"}, []string{"node2", "node3", "node4"})
+	rsm.Network().Restart("node2")
+	time.Sleep(50 * time.Millisecond)
+	rsm.Network().Heal()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for divergence(rsm, keys) != "" {
+		if time.Now().After(deadline) {
+			t.Fatal("replicas did not converge:", divergence(rsm, keys))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// fakeClock is a time source tests advance by hand
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newFakeBucket(capacity int, rate float64) (*TokenBucket, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	tb := NewTokenBucket(capacity, rate)
+	tb.now, tb.last = clock.Now, clock.now
+	return tb, clock
+}
+
+func TestTokenBucketRefillsFractions(t *testing.T) {
+	tb, clock := newFakeBucket(2, 2.5)
+	if !tb.Allow() || !tb.Allow() {
+		t.Fatal("full bucket refused a token")
+	}
+	if tb.Allow() {
+		t.Fatal("empty bucket allowed a token")
+	}
+	// 0.3s refills 0.75 tokens, not enough for one; the rest comes 0.1s later
+	clock.now = clock.now.Add(300 * time.Millisecond)
+	if tb.Allow() {
+		t.Fatal("allowed a token with 0.75 refilled")
+	}
+	clock.now = clock.now.Add(100 * time.Millisecond)
+	if !tb.Allow() {
+		t.Fatal("refused a token with 1 refilled over two sub-second gaps")
+	}
+	clock.now = clock.now.Add(time.Hour)
+	if !tb.Allow() || !tb.Allow() || tb.Allow() {
+		t.Fatal("bucket refilled past its capacity")
+	}
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	tb, clock := newFakeBucket(1, 10)
+	if r := tb.Reserve(); !r.OK() || r.Delay() != 0 {
+		t.Fatalf("reservation from a full bucket delayed %v", r.Delay())
+	}
+	first, second := tb.Reserve(), tb.Reserve()
+	if first.Delay() != 100*time.Millisecond || second.Delay() != 200*time.Millisecond {
+		t.Fatalf("reservations delayed %v and %v, want 100ms and 200ms", first.Delay(), second.Delay())
+	}
+	second.Cancel()
+	first.Cancel()
+	clock.now = clock.now.Add(100 * time.Millisecond)
+	if !tb.Allow() {
+		t.Fatal("cancelled reservations kept their tokens")
+	}
+
+	never, _ := newFakeBucket(1, 0)
+	never.Allow()
+	if r := never.Reserve(); r.OK() {
+		t.Fatal("reserved a token from a bucket that never refills")
+	}
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	tb := NewTokenBucket(1, 50)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := tb.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("three tokens at 50 per second took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if err := tb.Wait(ctx); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Wait past the deadline = %v, want ErrQuotaExceeded", err)
+	}
+	// The refused wait took no token
+	time.Sleep(20 * time.Millisecond)
+	if !tb.Allow() {
+		t.Fatal("Wait past the deadline kept its token")
+	}
+}
+
+func TestTokenBucketConcurrentUse(t *testing.T) {
+	tb := NewTokenBucket(100, 0)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	count := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if tb.Allow() {
+					mu.Lock()
+					count++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if count != 100 {
+		t.Fatalf("allowed %d events from a bucket of 100", count)
+	}
+}
+
+func TestPutQuotas(t *testing.T) {
+	rsm := NewReplicatedShardedMap(1, 0, 5, 0)
+	rsm.AddNode("node1")
+	rsm.SetTenantQuota("tenantA/", 0, 2)
+	for i := 0; i < 2; i++ {
+		if err := rsm.Put(Event{Key: fmt.Sprintf("tenantA/%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := rsm.Put(Event{Key: "tenantA/2"})
+	var quota *QuotaError
+	if !errors.As(err, &quota) || quota.Tenant != "tenantA/" || !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Put over the tenant quota = %v", err)
+	}
+	if _, ok, _ := rsm.Get("tenantA/2"); ok {
+		t.Fatal("Put over quota stored its event")
+	}
+
+	// The refused put left the shard's tokens for other tenants
+	for i := 0; i < 3; i++ {
+		if err := rsm.Put(Event{Key: fmt.Sprintf("tenantB/%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = rsm.Put(Event{Key: "tenantB/3"})
+	if !errors.As(err, &quota) || quota.Tenant != "" || quota.Shard != "0" {
+		t.Fatalf("Put over the shard limit = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := rsm.PutContext(ctx, Event{Key: "tenantB/3"}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("PutContext with no token ever coming = %v", err)
+	}
+}
+
+func TestPutContextWaitsForTokens(t *testing.T) {
+	rsm := NewReplicatedShardedMap(1, 0, 1000, 1000)
+	rsm.AddNode("node1")
+	rsm.SetTenantQuota("tenant/", 100, 1)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := rsm.PutContext(context.Background(), Event{Key: fmt.Sprintf("tenant/%d", i), Value: "v"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Fatalf("five puts at 100 per second took %v", elapsed)
+	}
+	if value, ok, err := rsm.Get("tenant/4"); value != "v" || !ok || err != nil {
+		t.Fatalf("Get = %q, %v, %v", value, ok, err)
+	}
+}
+
+// testMembership is a failure detector configuration fast enough for tests
+var testMembership = MembershipConfig{
+	ProbeInterval:    20 * time.Millisecond,
+	ProbeTimeout:     10 * time.Millisecond,
+	SuspicionTimeout: 150 * time.Millisecond,
+}
+
+// waitFor fails unless cond becomes true within timeout
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// memberState returns the state of a member in an observer's view
+func memberState(m *Membership, observer, member string) MemberState {
+	for _, seen := range m.View(observer) {
+		if seen.Name == member {
+			return seen.State
+		}
+	}
+	return -1
+}
+
+func TestMemberSupersedes(t *testing.T) {
+	tests := []struct {
+		news, known Member
+		want        bool
+	}{
+		{Member{State: MemberSuspect}, Member{State: MemberAlive}, true},
+		{Member{State: MemberDead}, Member{State: MemberSuspect}, true},
+		{Member{State: MemberAlive}, Member{State: MemberSuspect}, false},
+		{Member{State: MemberAlive, Incarnation: 1}, Member{State: MemberDead}, true},
+		{Member{State: MemberDead}, Member{State: MemberAlive, Incarnation: 1}, false},
+		{Member{State: MemberSuspect}, Member{State: MemberSuspect}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.news.supersedes(tt.known); got != tt.want {
+			t.Errorf("%+v supersedes %+v = %v, want %v", tt.news, tt.known, got, tt.want)
+		}
+	}
+}
+
+func TestFailureDetectorRemovesCrashedNode(t *testing.T) {
+	const keys = 1000
+	rsm := newTestMap(t, 2, keys, "node1", "node2", "node3", "node4", "node5")
+	m := rsm.StartMembership(testMembership)
+	defer m.Stop()
+
+	rsm.Network().Crash("node3")
+	waitFor(t, 5*time.Second, "node3 to leave the ring", func() bool { return rsm.Node("node3") == nil })
+	waitFor(t, 5*time.Second, "every node to see node3 dead", func() bool {
+		for _, observer := range []string{"node1", "node2", "node4", "node5"} {
+			if memberState(m, observer, "node3") != MemberDead {
+				return false
+			}
+		}
+		return true
+	})
+	checkPlacement(t, rsm, keys)
+
+	// The restarted node learns it was declared dead, refutes it and rejoins
+	rsm.Network().Restart("node3")
+	waitFor(t, 5*time.Second, "node3 to rejoin the ring", func() bool { return rsm.Node("node3") != nil })
+	waitFor(t, 5*time.Second, "every node to see node3 alive", func() bool {
+		for _, observer := range []string{"node1", "node2", "node4", "node5"} {
+			if memberState(m, observer, "node3") != MemberAlive {
+				return false
+			}
+		}
+		return true
+	})
+	checkPlacement(t, rsm, keys)
+}
+
+func TestFailureDetectorToleratesLossAndLatency(t *testing.T) {
+	rsm := newTestMap(t, 2, 0, "node1", "node2", "node3", "node4", "node5")
+	rsm.Network().SetLatency(time.Millisecond, 2*time.Millisecond)
+	rsm.Network().SetLoss(0.05)
+	m := rsm.StartMembership(testMembership)
+	defer m.Stop()
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if nodes := rsm.chr.Nodes(); len(nodes) != 5 {
+			t.Fatalf("ring changed to %v with every node up", nodes)
+		}
+	}
+}
+
+func TestFailureDetectorPartitionHeals(t *testing.T) {
+	const keys = 1000
+	rsm := newTestMap(t, 2, keys, "node1", "node2", "node3", "node4", "node5")
+	m := rsm.StartMembership(testMembership)
+	defer m.Stop()
+
+	// Only the majority side removes the other
+	rsm.Network().Partition([]string{"node1", "node2"}, []string{"node3", "node4", "node5"})
+	waitFor(t, 5*time.Second, "the minority to leave the ring", func() bool {
+		return rsm.Node("node1") == nil && rsm.Node("node2") == nil
+	})
+	time.Sleep(300 * time.Millisecond)
+	if nodes := rsm.chr.Nodes(); len(nodes) != 3 {
+		t.Fatalf("ring is %v during the partition, want the majority side", nodes)
+	}
+	checkPlacement(t, rsm, keys)
+
+	rsm.Network().Heal()
+	waitFor(t, 5*time.Second, "the minority to rejoin the ring", func() bool {
+		return len(rsm.chr.Nodes()) == 5
+	})
+	checkPlacement(t, rsm, keys)
+}
+
+func TestMembershipJoinSpreadsByGossip(t *testing.T) {
+	rsm := newTestMap(t, 2, 100, "node1", "node2", "node3", "node4")
+	m := rsm.StartMembership(testMembership)
+	defer m.Stop()
+
+	if err := m.Join("node5", "node1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Join("node5", "node1"); err == nil {
+		t.Fatal("joined the same node twice")
+	}
+	waitFor(t, 5*time.Second, "every node to learn of node5", func() bool {
+		for _, observer := range []string{"node2", "node3", "node4"} {
+			if memberState(m, observer, "node5") != MemberAlive {
+				return false
+			}
+		}
+		return true
+	})
+	if rsm.Node("node5") == nil {
+		t.Fatal("joined node not in the ring")
+	}
+	checkPlacement(t, rsm, 100)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"maps"
+	"slices"
+)
+
+// VectorClock counts the writes each node coordinated to a value's history
+type VectorClock map[string]uint64
+
+// Ordering is how two vector clocks relate
+type Ordering int
+
+const (
+	Equal Ordering = iota
+	Before
+	After
+	Concurrent
+)
+
+// Increment returns a copy of the clock with the node's counter incremented
+func (vc VectorClock) Increment(node string) VectorClock {
+	next := maps.Clone(vc)
+	if next == nil {
+		next = make(VectorClock)
+	}
+	next[node]++
+	return next
+}
+
+// Merge returns the smallest clock descending from both clocks
+func (vc VectorClock) Merge(other VectorClock) VectorClock {
+	merged := maps.Clone(vc)
+	if merged == nil {
+		merged = make(VectorClock)
+	}
+	for node, count := range other {
+		merged[node] = max(merged[node], count)
+	}
+	return merged
+}
+
+// Compare reports whether vc happened before, after or concurrently with other
+func (vc VectorClock) Compare(other VectorClock) Ordering {
+	less, greater := false, false
+	for node, count := range vc {
+		if count > other[node] {
+			greater = true
+		}
+	}
+	for node, count := range other {
+		if count > vc[node] {
+			less = true
+		}
+	}
+	switch {
+	case less && greater:
+		return Concurrent
+	case less:
+		return Before
+	case greater:
+		return After
+	}
+	return Equal
+}
+
+// Versioned is one version of a key's value. Deleted versions are tombstones,
+// kept so a delete supersedes the writes it saw
+type Versioned struct {
+	Value   string
+	Deleted bool
+	Clock   VectorClock
+}
+
+// reconcile adds a version to a key's siblings, the versions none of which
+// happened before another. Versions it supersedes are dropped, and it is
+// ignored if a sibling already descends from it
+func reconcile(siblings []Versioned, version Versioned) []Versioned {
+	for _, sibling := range siblings {
+		if order := sibling.Clock.Compare(version.Clock); order == Equal || order == After {
+			return siblings
+		}
+	}
+	siblings = slices.DeleteFunc(slices.Clone(siblings), func(sibling Versioned) bool {
+		return sibling.Clock.Compare(version.Clock) == Before
+	})
+	return append(siblings, version)
+}
+
+// sameVersions reports whether two sets of siblings hold the same versions
+func sameVersions(a, b []Versioned) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, version := range a {
+		if !slices.ContainsFunc(b, func(other Versioned) bool { return other.Clock.Compare(version.Clock) == Equal }) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,150 +1,331 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"log"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/go-redis/redis/v8"
 )
 
 // Middleware represents a function that takes an http.Handler and returns an http.Handler.
 type Middleware func(http.Handler) http.Handler
 
 // RoutingPolicy defines a set of conditions and middleware for a given route.
+// Upstream names the pool that matching requests are proxied to.
+//
+// Methods, Host, Headers and Query narrow which requests the route matches;
+// a request failing them falls through to the next route. A header or query
+// predicate with an empty value only requires the parameter to be present.
+// PathPrefix makes the route match any path below its pattern. Condition is
+// checked after matching and rejects the request with 403.
+//
+// Authenticate requires a verified bearer token. Scopes lists scopes the
+// token must all carry and Roles lists roles of which it needs at least one;
+// either implies Authenticate.
+//
+// Timeout bounds the whole upstream call including retries, which Retry
+// configures; without it failed calls are not retried.
 type RoutingPolicy struct {
 	Condition    func(*http.Request) bool
 	Middleware   []string
 	RateLimit    *RateLimitConfig
 	Authenticate bool
+	Upstream     string
+	Methods      []string
+	Host         string
+	Headers      map[string]string
+	Query        map[string]string
+	PathPrefix   bool
+	Scopes       []string
+	Roles        []string
+	Timeout      time.Duration
+	Retry        *RetryConfig
 }
 
 // RateLimitConfig represents a configuration for rate-limiting a specific route.
+// Key selects who the quota applies to: "route" (everyone), "ip", "api-key",
+// "jwt-sub" or "header:<name>". Algorithm is "sliding-window" (the default)
+// or "token-bucket", which allows bursts of up to Burst requests and refills
+// at MaxRequests per WindowPeriod.
 type RateLimitConfig struct {
-	MaxRequests  int
-	WindowPeriod time.Duration
+	MaxRequests  int           `yaml:"max_requests"`
+	WindowPeriod time.Duration `yaml:"window"`
+	Algorithm    string        `yaml:"algorithm"`
+	Burst        int           `yaml:"burst"`
+	Key          string        `yaml:"key"`
 }
 
-// RateLimit is a struct that manages request rates.
-type RateLimit struct {
-	lastRequest time.Time
-	mu          sync.Mutex
-	maxRequests int
-	window      time.Duration
-	count       int
+// Gateway serves requests from an immutable Snapshot of its routes, middleware
+// and upstream pools. Every change builds a new snapshot and swaps it in
+// atomically, so a request keeps the configuration it started with.
+type Gateway struct {
+	mu              sync.Mutex // serialises snapshot updates
+	snapshot        atomic.Pointer[Snapshot]
+	middlewares     map[string]Middleware // registered in code, kept across config reloads
+	factories       map[string]MiddlewareFactory
+	upstreamConfigs map[string]UpstreamConfig
+	healthChecks    bool
+	rateLimits      atomic.Value // RateLimitStore
+	metrics         *Metrics
 }
 
-// NewRateLimit creates a new RateLimit instance with the specified configuration.
-func NewRateLimit(maxRequests int, window time.Duration) *RateLimit {
-	return &RateLimit{
-		lastRequest: time.Now(),
-		mu:          sync.Mutex{},
-		maxRequests: maxRequests,
-		window:      window,
-		count:       0,
-	}
+// Snapshot is one version of the gateway's configuration. It must not be
+// modified once the gateway serves from it.
+type Snapshot struct {
+	Router      *Router
+	Middlewares map[string]Middleware
+	Upstreams   map[string]*UpstreamPool
+	Auth        *Authenticator
 }
 
-// IsAllowed checks if a request can be processed within the rate limit.
-func (r *RateLimit) IsAllowed() bool {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	if time.Now().Sub(r.lastRequest) >= r.window {
-		r.count = 0
+// NewGateway creates a new Gateway instance with an empty route table.
+func NewGateway() *Gateway {
+	g := &Gateway{
+		middlewares: make(map[string]Middleware),
+		factories:   make(map[string]MiddlewareFactory),
+		metrics:     NewMetrics(),
 	}
+	g.snapshot.Store(&Snapshot{
+		Router:      NewRouter(),
+		Middlewares: make(map[string]Middleware),
+		Upstreams:   make(map[string]*UpstreamPool),
+	})
+	g.AddMiddlewareFactory("logger", newLoggerMiddleware)
+	g.AddMiddlewareFactory("headers", newHeadersMiddleware)
+	g.AddMiddlewareFactory("path-rewrite", newPathRewriteMiddleware)
+	g.AddMiddlewareFactory("query-map", newQueryMapMiddleware)
+	g.AddMiddlewareFactory("json-body", newJSONBodyMiddleware)
+	g.SetRateLimitStore(NewMemoryRateLimitStore())
+	return g
+}
 
-	if r.count >= r.maxRequests {
-		return false
-	}
+// SetRateLimitStore replaces the store that rate limit state is kept in.
+func (g *Gateway) SetRateLimitStore(store RateLimitStore) {
+	g.rateLimits.Store(&store)
+}
 
-	r.count++
-	r.lastRequest = time.Now()
-	return true
+// RateLimitStore returns the store that rate limit state is kept in.
+func (g *Gateway) RateLimitStore() RateLimitStore {
+	return *g.rateLimits.Load().(*RateLimitStore)
 }
 
-// Gateway is a struct that holds a map of routing policies and middleware functions.
-type Gateway struct {
-	RoutingPolicies map[string]RoutingPolicy
-	Middlewares     map[string]Middleware
-	RateLimits      map[string]*RateLimit
+// Snapshot returns the configuration currently being served.
+func (g *Gateway) Snapshot() *Snapshot {
+	return g.snapshot.Load()
 }
 
-// NewGateway creates a new Gateway instance with an empty map of routing policies.
-func NewGateway() *Gateway {
-	return &Gateway{
-		RoutingPolicies: make(map[string]RoutingPolicy),
-		Middlewares:     make(map[string]Middleware),
-		RateLimits:      make(map[string]*RateLimit),
+// clone copies the snapshot so it can be changed without affecting requests being served.
+func (s *Snapshot) clone() *Snapshot {
+	next := &Snapshot{
+		Router:      &Router{routes: append([]*Route(nil), s.Router.routes...), added: s.Router.added},
+		Middlewares: make(map[string]Middleware, len(s.Middlewares)),
+		Upstreams:   make(map[string]*UpstreamPool, len(s.Upstreams)),
+		Auth:        s.Auth,
+	}
+	for name, m := range s.Middlewares {
+		next.Middlewares[name] = m
+	}
+	for name, pool := range s.Upstreams {
+		next.Upstreams[name] = pool
 	}
+	return next
 }
 
-// AddRoutingPolicy adds or updates a routing policy for the gateway.
-func (g *Gateway) AddRoutingPolicy(path string, policy RoutingPolicy) {
-	g.RoutingPolicies[path] = policy
-	if policy.RateLimit != nil {
-		g.RateLimits[path] = NewRateLimit(policy.RateLimit.MaxRequests, policy.RateLimit.WindowPeriod)
+// update applies change to a copy of the current snapshot and swaps it in.
+func (g *Gateway) update(change func(*Snapshot) error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	next := g.snapshot.Load().clone()
+	if err := change(next); err != nil {
+		return err
 	}
+	g.swap(next)
+	return nil
 }
 
-// GetRoutingPolicy retrieves a routing policy from the gateway by path.
-func (g *Gateway) GetRoutingPolicy(path string) (RoutingPolicy, bool) {
-	policy, ok := g.RoutingPolicies[path]
-	return policy, ok
+// swap makes next the live snapshot. Pools that are no longer referenced stop
+// their health checks; requests already proxying through them still finish.
+func (g *Gateway) swap(next *Snapshot) {
+	prev := g.snapshot.Swap(next)
+	for name, pool := range prev.Upstreams {
+		if next.Upstreams[name] != pool {
+			pool.StopHealthChecks()
+		}
+	}
+	if g.healthChecks {
+		for _, pool := range next.Upstreams {
+			pool.StartHealthChecks()
+		}
+	}
+	if prev.Auth != next.Auth {
+		if prev.Auth != nil {
+			prev.Auth.Stop()
+		}
+		if next.Auth != nil {
+			next.Auth.Start()
+		}
+	}
+}
+
+// SetAuthenticator sets how bearer tokens are verified. Applying a config
+// replaces it with the config's auth section.
+func (g *Gateway) SetAuthenticator(auth *Authenticator) {
+	g.update(func(s *Snapshot) error {
+		s.Auth = auth
+		return nil
+	})
+}
+
+// AddRoutingPolicy adds or updates a routing policy for a path pattern such
+// as "/api/users/{id}" or "/static/{path...}". It returns an error if the
+// pattern is malformed or conflicts with an existing route.
+func (g *Gateway) AddRoutingPolicy(pattern string, policy RoutingPolicy) error {
+	return g.update(func(s *Snapshot) error {
+		_, err := s.Router.Add(pattern, policy)
+		return err
+	})
+}
+
+// GetRoutingPolicy finds the route matching the request. Captured path
+// parameters are available through RouteParams.
+func (g *Gateway) GetRoutingPolicy(r *http.Request) (*Route, map[string]string, bool) {
+	route, params, _ := g.Snapshot().Router.Match(r)
+	return route, params, route != nil
 }
 
-// AddMiddleware adds a middleware function to the gateway.
+// AddMiddleware adds a middleware function to the gateway. Middleware added
+// in code stays available to routes across config reloads.
 func (g *Gateway) AddMiddleware(name string, middleware Middleware) {
-	g.Middlewares[name] = middleware
+	g.update(func(s *Snapshot) error {
+		g.middlewares[name] = middleware
+		s.Middlewares[name] = middleware
+		return nil
+	})
 }
 
 // GetMiddleware retrieves a middleware function by name.
 func (g *Gateway) GetMiddleware(name string) (Middleware, bool) {
-	middleware, ok := g.Middlewares[name]
+	middleware, ok := g.Snapshot().Middlewares[name]
 	return middleware, ok
 }
 
+// AddMiddlewareFactory registers a middleware type that config files can
+// instantiate with parameters.
+func (g *Gateway) AddMiddlewareFactory(kind string, factory MiddlewareFactory) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.factories[kind] = factory
+}
+
+// AddUpstream adds or replaces an upstream pool that routes can proxy to.
+func (g *Gateway) AddUpstream(pool *UpstreamPool) {
+	g.update(func(s *Snapshot) error {
+		s.Upstreams[pool.Name] = pool
+		// The pool no longer matches the config it may have been built from
+		delete(g.upstreamConfigs, pool.Name)
+		return nil
+	})
+}
+
+// GetUpstream retrieves an upstream pool by name.
+func (g *Gateway) GetUpstream(name string) (*UpstreamPool, bool) {
+	pool, ok := g.Snapshot().Upstreams[name]
+	return pool, ok
+}
+
 // HandleRequest processes a request using the specified middleware components for the matching route.
 func (g *Gateway) HandleRequest(w http.ResponseWriter, r *http.Request) {
-	policy, ok := g.GetRoutingPolicy(r.URL.Path)
-	if !ok {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	label := unmatchedRoute
+	if route := g.handle(rec, r); route != nil {
+		label = route.String()
+	}
+	g.metrics.observeRequest(label, r.Method, rec.status, time.Since(start))
+}
+
+// handle serves the request and returns the route it matched, if any.
+func (g *Gateway) handle(w http.ResponseWriter, r *http.Request) *Route {
+	// Use one snapshot for the whole request, even if the config is reloaded meanwhile
+	snapshot := g.Snapshot()
+	route, params, allowed := snapshot.Router.Match(r)
+	if route == nil {
+		if len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return nil
+		}
 		http.Error(w, "No matching route found", http.StatusNotFound)
-		return
+		return nil
 	}
+	r = withRouteParams(r, params)
+	policy := route.Policy
 
-	if !policy.Condition(r) {
+	if policy.Condition != nil && !policy.Condition(r) {
 		http.Error(w, "Request does not match condition", http.StatusForbidden)
-		return
+		return route
 	}
 
-	// Check authentication if required
-	if policy.Authenticate && !isTokenValid(r) {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
+	// Check authentication and authorization if required. Claim headers are
+	// only ever set by the gateway, never passed through from the client.
+	stripClaimHeaders(r, snapshot.Auth)
+	if policy.requiresAuth() {
+		if snapshot.Auth == nil {
+			log.Printf("Route %s requires authentication but none is configured", route)
+			http.Error(w, "Authentication is not configured", http.StatusInternalServerError)
+			return route
+		}
+		claims, authErr := snapshot.Auth.Authenticate(r)
+		if authErr == nil {
+			authErr = Authorize(claims, policy)
+		}
+		if authErr != nil {
+			writeAuthError(w, authErr)
+			return route
+		}
+		r = withClaims(r, claims)
+		snapshot.Auth.forwardClaims(r, claims)
 	}
 
 	// Check rate limit
-	if policy.RateLimit != nil && !g.RateLimits[r.URL.Path].IsAllowed() {
-		http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
-		return
+	if route.limiter != nil {
+		decision := route.limiter.Allow(r.Context(), g.RateLimitStore(), r)
+		route.limiter.WriteHeaders(w.Header(), decision)
+		if !decision.Allowed {
+			g.metrics.observeRateLimited(route.String())
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return route
+		}
 	}
 
-	// Initialize the handler as an http.HandlerFunc
-	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "Handling path: %s", r.URL.Path)
-	})
+	// The innermost handler proxies to the route's upstream pool
+	pool, ok := snapshot.Upstreams[policy.Upstream]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Upstream '%s' not found", policy.Upstream), http.StatusBadGateway)
+		return route
+	}
+	var handler http.Handler = route.routeHandler(pool, g.metrics)
 
 	// Apply the middleware to the handler iteratively
 	for _, name := range policy.Middleware {
-		middleware, ok := g.GetMiddleware(name)
+		middleware, ok := snapshot.Middlewares[name]
 		if !ok {
 			http.Error(w, fmt.Sprintf("Middleware '%s' not found", name), http.StatusInternalServerError)
-			return
+			return route
 		}
 		handler = middleware(handler)
 	}
 
 	// Serve the request using the final handler
 	handler.ServeHTTP(w, r)
+	return route
 }
 
 // Example Middleware Functions
@@ -155,24 +336,67 @@ func loggerMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func isTokenValid(r *http.Request) bool {
-	_, present := r.Header["Authorization"]
-	return present
+// newLoggerMiddleware builds the "logger" middleware type. An optional
+// "prefix" parameter is printed before each logged request.
+func newLoggerMiddleware(params map[string]interface{}) (Middleware, error) {
+	prefix, err := stringParam(params, "prefix")
+	if err != nil {
+		return nil, err
+	}
+	if prefix == "" {
+		return loggerMiddleware, nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Printf("%s: %s %s\n", prefix, r.Method, r.URL.Path)
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// newRateLimitStoreFromEnv shares rate limits through Redis when REDIS_ADDR is
+// set, so several gateway instances enforce one quota.
+func newRateLimitStoreFromEnv() RateLimitStore {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		return NewMemoryRateLimitStore()
+	}
+	return NewRedisRateLimitStore(redis.NewClient(&redis.Options{Addr: addr}), "gateway:ratelimit:")
 }
 
 func main() {
+	configPath := flag.String("config", "gateway.yaml", "path to the YAML or JSON gateway config")
+	adminAddr := flag.String("admin", "127.0.0.1:9090", "address of the admin API and metrics listener")
+	flag.Parse()
+
 	gateway := NewGateway()
+	gateway.SetRateLimitStore(newRateLimitStoreFromEnv())
 
 	// Add or update middleware components dynamically
 	gateway.AddMiddleware("logger", loggerMiddleware)
 
-	// Define routing policies with conditions, authentication, and rate limits
-	gateway.AddRoutingPolicy("/api/users", RoutingPolicy{
-		Condition:    func(r *http.Request) bool { return true },
-		Middleware:   []string{"logger"},
-		RateLimit:    &RateLimitConfig{MaxRequests: 5, WindowPeriod: time.Second * 10},
-		Authenticate: true,
-	})
+	// Routes, upstreams and rate limits come from the config file, which is
+	// reloaded when it changes or on SIGHUP
+	reloader := NewConfigReloader(gateway, *configPath)
+	if err := reloader.Reload(); err != nil {
+		fmt.Println("Error loading config:", err)
+		return
+	}
+	if err := reloader.Start(); err != nil {
+		fmt.Println("Error watching config:", err)
+		return
+	}
+	defer reloader.Close()
+	gateway.StartHealthChecks()
+	defer gateway.Close()
+
+	// The admin API can change routes, so it is kept off the public listener
+	go func() {
+		fmt.Println("Admin API is running on http://" + *adminAddr)
+		if err := http.ListenAndServe(*adminAddr, gateway.AdminHandler()); err != nil {
+			fmt.Println("Error serving admin API:", err)
+		}
+	}()
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		gateway.HandleRequest(w, r)
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxAdminBodyBytes bounds the size of route definitions sent to the admin API.
+const maxAdminBodyBytes = 1 << 20
+
+// AdminHandler serves the admin API. It is meant for a separate listener
+// that only operators can reach:
+//
+//	GET    /admin/health          upstream target health
+//	GET    /admin/routes          routes, their middleware chains and counters
+//	POST   /admin/routes          add a route, given as a YAML or JSON route config
+//	PUT    /admin/routes          replace the route with the same path, host, methods and predicates
+//	DELETE /admin/routes?path=... remove every route with the given path
+//	GET    /admin/ratelimits      live rate limit counters per route and consumer
+//	GET    /metrics               Prometheus metrics
+//
+// Routes changed through the API last until the config file is next reloaded.
+func (g *Gateway) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /admin/health", g.HealthHandler())
+	mux.Handle("GET /admin/routes", g.RoutesHandler())
+	mux.HandleFunc("POST /admin/routes", func(w http.ResponseWriter, r *http.Request) {
+		g.putRoute(w, r, false)
+	})
+	mux.HandleFunc("PUT /admin/routes", func(w http.ResponseWriter, r *http.Request) {
+		g.putRoute(w, r, true)
+	})
+	mux.HandleFunc("DELETE /admin/routes", g.deleteRoute)
+	mux.Handle("GET /admin/ratelimits", g.RateLimitsHandler())
+	mux.Handle("GET /metrics", g.metrics.Handler())
+	return mux
+}
+
+// RouteStatus describes a route, its middleware chain, its counters and its
+// upstream's breaker state.
+type RouteStatus struct {
+	Route      string   `json:"route"`
+	Path       string   `json:"path"`
+	Host       string   `json:"host,omitempty"`
+	Methods    []string `json:"methods,omitempty"`
+	Prefix     bool     `json:"prefix,omitempty"`
+	Upstream   string   `json:"upstream"`
+	Middleware []string `json:"middleware"`
+	Breaker    string   `json:"breaker"`
+	RouteStats
+}
+
+// RoutesHandler is the admin endpoint listing routes in precedence order.
+func (g *Gateway) RoutesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snapshot := g.Snapshot()
+		statuses := make([]RouteStatus, 0, len(snapshot.Router.routes))
+		for _, route := range snapshot.Router.Routes() {
+			status := RouteStatus{
+				Route:      route.String(),
+				Path:       route.Pattern,
+				Host:       route.Policy.Host,
+				Methods:    route.Policy.Methods,
+				Prefix:     route.Policy.PathPrefix,
+				Upstream:   route.Policy.Upstream,
+				Middleware: append([]string{}, route.Policy.Middleware...),
+				Breaker:    "unknown",
+				RouteStats: route.stats.snapshot(),
+			}
+			if pool, ok := snapshot.Upstreams[route.Policy.Upstream]; ok {
+				status.Breaker = pool.BreakerState()
+			}
+			statuses = append(statuses, status)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"routes": statuses})
+	})
+}
+
+// putRoute adds a route, or with replace set updates an existing one.
+func (g *Gateway) putRoute(w http.ResponseWriter, r *http.Request, replace bool) {
+	var rc RouteConfig
+	decoder := yaml.NewDecoder(io.LimitReader(r.Body, maxAdminBodyBytes))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&rc); err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid route: %v", err))
+		return
+	}
+
+	var status int
+	err := g.update(func(s *Snapshot) error {
+		if err := checkAdminRoute(rc, s); err != nil {
+			status = http.StatusBadRequest
+			return err
+		}
+		candidate, err := compileRoute(rc.Path, rc.policy())
+		if err != nil {
+			status = http.StatusBadRequest
+			return err
+		}
+		exists := false
+		for _, existing := range s.Router.routes {
+			exists = exists || (existing.Pattern == candidate.Pattern && existing.ambiguousWith(candidate))
+		}
+		if replace && !exists {
+			status = http.StatusNotFound
+			return fmt.Errorf("no route %s to replace", candidate)
+		}
+		add := s.Router.AddNew
+		if replace {
+			add = s.Router.Add
+		}
+		if _, err := add(rc.Path, rc.policy()); err != nil {
+			status = http.StatusConflict
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		writeAdminError(w, status, err)
+		return
+	}
+	if replace {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// checkAdminRoute checks the references a route makes to the live configuration.
+func checkAdminRoute(rc RouteConfig, s *Snapshot) error {
+	if rc.Path == "" {
+		return errors.New("path is required")
+	}
+	if _, ok := s.Upstreams[rc.Upstream]; !ok {
+		return fmt.Errorf("unknown upstream %q", rc.Upstream)
+	}
+	for _, name := range rc.Middleware {
+		if _, ok := s.Middlewares[name]; !ok {
+			return fmt.Errorf("unknown middleware %q", name)
+		}
+	}
+	if rc.policy().requiresAuth() && s.Auth == nil {
+		return errors.New("route requires authentication but none is configured")
+	}
+	return nil
+}
+
+func (g *Gateway) deleteRoute(w http.ResponseWriter, r *http.Request) {
+	pattern := r.URL.Query().Get("path")
+	if pattern == "" {
+		writeAdminError(w, http.StatusBadRequest, errors.New("the path query parameter is required"))
+		return
+	}
+	err := g.update(func(s *Snapshot) error {
+		if !s.Router.Remove(pattern) {
+			return fmt.Errorf("no route with path %q", pattern)
+		}
+		return nil
+	})
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RateLimitStatus reports a route's rate limit and its consumers' counters.
+type RateLimitStatus struct {
+	Route     string                   `json:"route"`
+	Algorithm string                   `json:"algorithm"`
+	Key       string                   `json:"key"`
+	Limit     int                      `json:"limit"`
+	Window    string                   `json:"window"`
+	Counters  []RateLimitCounterStatus `json:"counters"`
+}
+
+// RateLimitCounterStatus is one consumer's counter. Key is the consumer's
+// identity, such as "ip:10.0.0.1" or "jwt-sub:alice".
+type RateLimitCounterStatus struct {
+	Key          string `json:"key"`
+	Limit        int    `json:"limit"`
+	Remaining    int    `json:"remaining"`
+	ResetSeconds int    `json:"reset_seconds"`
+}
+
+// RateLimitsHandler is the admin endpoint listing live rate limit counters.
+// It answers 501 if the rate limit store cannot list its counters.
+func (g *Gateway) RateLimitsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		store := g.RateLimitStore()
+		now := time.Now()
+		statuses := []RateLimitStatus{}
+		for _, route := range g.Snapshot().Router.Routes() {
+			if route.limiter == nil {
+				continue
+			}
+			counters, ok := route.limiter.Counters(store, now)
+			if !ok {
+				writeAdminError(w, http.StatusNotImplemented, fmt.Errorf("rate limit store %T cannot list its counters", store))
+				return
+			}
+			config := route.limiter.config
+			status := RateLimitStatus{
+				Route:     route.String(),
+				Algorithm: config.Algorithm,
+				Key:       config.Key,
+				Limit:     config.MaxRequests,
+				Window:    config.WindowPeriod.String(),
+				Counters:  make([]RateLimitCounterStatus, 0, len(counters)),
+			}
+			for _, c := range counters {
+				status.Counters = append(status.Counters, RateLimitCounterStatus{
+					Key:          c.Key,
+					Limit:        c.Limit,
+					Remaining:    c.Remaining,
+					ResetSeconds: ceilSeconds(c.Reset),
+				})
+			}
+			statuses = append(statuses, status)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"routes": statuses})
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
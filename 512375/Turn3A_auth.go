@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// AuthConfig configures JWT verification. Tokens are signed with HS256 or
+// RS256 using static keys, keys from a JWKS file that is re-read every
+// JWKSRefresh, or both. Issuer and Audience are enforced when set.
+//
+// Verified claims are forwarded to upstreams: "sub" as X-Auth-Subject, scopes
+// as X-Auth-Scopes, roles as X-Auth-Roles, and any claim listed in
+// ForwardClaims as the header it maps to. Clients cannot set these headers
+// themselves; they are removed from every incoming request.
+type AuthConfig struct {
+	Issuer        string            `yaml:"issuer"`
+	Audience      string            `yaml:"audience"`
+	Leeway        time.Duration     `yaml:"leeway"`
+	Keys          []KeyConfig       `yaml:"keys"`
+	JWKSFile      string            `yaml:"jwks_file"`
+	JWKSRefresh   time.Duration     `yaml:"jwks_refresh"`
+	ForwardClaims map[string]string `yaml:"forward_claims"`
+}
+
+// KeyConfig is a static verification key. HS256 keys take a Secret or the
+// name of an environment variable holding it; RS256 keys take a PEM file.
+type KeyConfig struct {
+	ID            string `yaml:"kid"`
+	Algorithm     string `yaml:"alg"`
+	Secret        string `yaml:"secret"`
+	SecretEnv     string `yaml:"secret_env"`
+	PublicKeyFile string `yaml:"public_key_file"`
+}
+
+// Headers that carry verified claims to upstreams
+const (
+	subjectHeader = "X-Auth-Subject"
+	scopesHeader  = "X-Auth-Scopes"
+	rolesHeader   = "X-Auth-Roles"
+)
+
+const defaultJWKSRefresh = 5 * time.Minute
+
+// AuthError is an authentication or authorization failure. Status is 401 for
+// a missing or invalid token and 403 for a valid token lacking permissions.
+type AuthError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *AuthError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func authFailure(code, format string, args ...interface{}) *AuthError {
+	return &AuthError{Status: http.StatusUnauthorized, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func forbidden(code, format string, args ...interface{}) *AuthError {
+	return &AuthError{Status: http.StatusForbidden, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// writeAuthError answers with a JSON body naming the failure and the matching
+// WWW-Authenticate challenge from RFC 6750.
+func writeAuthError(w http.ResponseWriter, err *AuthError) {
+	challenge := `Bearer error="invalid_token"`
+	switch {
+	case err.Code == "missing_token":
+		challenge = "Bearer"
+	case err.Status == http.StatusForbidden:
+		challenge = `Bearer error="insufficient_scope"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.Status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Code, "message": err.Message})
+}
+
+// verificationKey is a key a token may be verified with.
+type verificationKey struct {
+	id        string
+	algorithm string
+	key       interface{} // []byte for HS256, *rsa.PublicKey for RS256
+}
+
+// Authenticator verifies bearer tokens against its configuration.
+type Authenticator struct {
+	config    AuthConfig
+	static    []verificationKey
+	mu        sync.RWMutex
+	jwks      []verificationKey
+	forwarded []string // every header that carries claims, stripped from incoming requests
+	parser    *jwt.Parser
+	quit      chan struct{}
+	wg        sync.WaitGroup
+	now       func() time.Time
+}
+
+// NewAuthenticator loads the configured keys. The JWKS file, if any, must be
+// readable now; later reload failures keep the last good keys.
+func NewAuthenticator(config AuthConfig) (*Authenticator, error) {
+	if config.JWKSRefresh <= 0 {
+		config.JWKSRefresh = defaultJWKSRefresh
+	}
+	a := &Authenticator{
+		config: config,
+		parser: &jwt.Parser{
+			ValidMethods: []string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodRS256.Alg()},
+			// Claims are checked by verifyClaims, which reports each failure separately
+			SkipClaimsValidation: true,
+		},
+		now: time.Now,
+	}
+
+	for i, kc := range config.Keys {
+		key, err := loadStaticKey(kc)
+		if err != nil {
+			return nil, fmt.Errorf("keys[%d]: %v", i, err)
+		}
+		a.static = append(a.static, key)
+	}
+	if config.JWKSFile != "" {
+		if err := a.loadJWKS(); err != nil {
+			return nil, err
+		}
+	}
+	if len(a.static) == 0 && config.JWKSFile == "" {
+		return nil, fmt.Errorf("at least one key or a jwks_file is required")
+	}
+
+	headers := map[string]bool{subjectHeader: true, scopesHeader: true, rolesHeader: true}
+	for _, header := range config.ForwardClaims {
+		headers[http.CanonicalHeaderKey(header)] = true
+	}
+	for header := range headers {
+		a.forwarded = append(a.forwarded, header)
+	}
+	sort.Strings(a.forwarded)
+	return a, nil
+}
+
+func loadStaticKey(kc KeyConfig) (verificationKey, error) {
+	key := verificationKey{id: kc.ID, algorithm: kc.Algorithm}
+	switch kc.Algorithm {
+	case "HS256":
+		secret := kc.Secret
+		if kc.SecretEnv != "" {
+			if secret != "" {
+				return key, fmt.Errorf("set either secret or secret_env, not both")
+			}
+			secret = os.Getenv(kc.SecretEnv)
+			if secret == "" {
+				return key, fmt.Errorf("environment variable %s is empty", kc.SecretEnv)
+			}
+		}
+		if secret == "" {
+			return key, fmt.Errorf("HS256 keys need a secret or secret_env")
+		}
+		key.key = []byte(secret)
+	case "RS256":
+		if kc.PublicKeyFile == "" {
+			return key, fmt.Errorf("RS256 keys need a public_key_file")
+		}
+		pem, err := os.ReadFile(kc.PublicKeyFile)
+		if err != nil {
+			return key, err
+		}
+		if key.key, err = jwt.ParseRSAPublicKeyFromPEM(pem); err != nil {
+			return key, fmt.Errorf("%s: %v", kc.PublicKeyFile, err)
+		}
+	default:
+		return key, fmt.Errorf("unsupported algorithm %q, expected HS256 or RS256", kc.Algorithm)
+	}
+	return key, nil
+}
+
+// jwk is the subset of RFC 7517 keys the gateway understands.
+type jwk struct {
+	KeyType   string `json:"kty"`
+	ID        string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+	K         string `json:"k"`
+}
+
+// loadJWKS reads the JWKS file and replaces the keys loaded from it.
+func (a *Authenticator) loadJWKS() error {
+	data, err := os.ReadFile(a.config.JWKSFile)
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("%s: %v", a.config.JWKSFile, err)
+	}
+
+	var keys []verificationKey
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := parseJWK(k)
+		if err != nil {
+			return fmt.Errorf("%s: keys[%d]: %v", a.config.JWKSFile, i, err)
+		}
+		keys = append(keys, key)
+	}
+
+	a.mu.Lock()
+	a.jwks = keys
+	a.mu.Unlock()
+	return nil
+}
+
+func parseJWK(k jwk) (verificationKey, error) {
+	key := verificationKey{id: k.ID, algorithm: k.Algorithm}
+	switch k.KeyType {
+	case "RSA":
+		if key.algorithm == "" {
+			key.algorithm = "RS256"
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil || len(n) == 0 {
+			return key, fmt.Errorf("invalid modulus")
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 {
+			return key, fmt.Errorf("invalid exponent")
+		}
+		key.key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case "oct":
+		if key.algorithm == "" {
+			key.algorithm = "HS256"
+		}
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil || len(secret) == 0 {
+			return key, fmt.Errorf("invalid symmetric key")
+		}
+		key.key = secret
+	default:
+		return key, fmt.Errorf("unsupported key type %q", k.KeyType)
+	}
+	if key.algorithm != "RS256" && key.algorithm != "HS256" {
+		return key, fmt.Errorf("unsupported algorithm %q", key.algorithm)
+	}
+	return key, nil
+}
+
+// Start re-reads the JWKS file periodically. It does nothing without a JWKS file.
+func (a *Authenticator) Start() {
+	if a.config.JWKSFile == "" || a.quit != nil {
+		return
+	}
+	a.quit = make(chan struct{})
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		ticker := time.NewTicker(a.config.JWKSRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := a.loadJWKS(); err != nil {
+					log.Printf("JWKS reload failed, keeping current keys: %v", err)
+				}
+			case <-a.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends periodic JWKS reloading.
+func (a *Authenticator) Stop() {
+	if a.quit == nil {
+		return
+	}
+	close(a.quit)
+	a.wg.Wait()
+	a.quit = nil
+}
+
+// keyFor picks the key for a token. The key's algorithm must match the
+// token's, so an RS256 public key can never be used as an HS256 secret.
+func (a *Authenticator) keyFor(token *jwt.Token) (interface{}, error) {
+	alg := token.Method.Alg()
+	kid, _ := token.Header["kid"].(string)
+
+	a.mu.RLock()
+	candidates := append(append([]verificationKey(nil), a.static...), a.jwks...)
+	a.mu.RUnlock()
+
+	var match *verificationKey
+	for i := range candidates {
+		k := &candidates[i]
+		if k.algorithm != alg || (kid != "" && k.id != kid) {
+			continue
+		}
+		if match != nil {
+			return nil, authFailure("unknown_key", "token has no kid and several %s keys are configured", alg)
+		}
+		match = k
+	}
+	if match == nil {
+		if kid != "" {
+			return nil, authFailure("unknown_key", "no %s key with kid %q", alg, kid)
+		}
+		return nil, authFailure("unknown_key", "no %s key configured", alg)
+	}
+	return match.key, nil
+}
+
+// Authenticate verifies the request's bearer token and returns its claims.
+func (a *Authenticator) Authenticate(r *http.Request) (jwt.MapClaims, *AuthError) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return nil, authFailure("missing_token", "an Authorization bearer token is required")
+	}
+	raw := strings.TrimPrefix(header, "Bearer ")
+	if raw == header || raw == "" {
+		return nil, authFailure("malformed_token", "the Authorization header must use the Bearer scheme")
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := a.parser.ParseWithClaims(raw, claims, a.keyFor)
+	if err != nil {
+		var authErr *AuthError
+		var ve *jwt.ValidationError
+		switch {
+		case errors.As(err, &ve) && errors.As(ve.Inner, &authErr):
+			return nil, authErr
+		case ve != nil && ve.Errors&jwt.ValidationErrorMalformed != 0:
+			return nil, authFailure("malformed_token", "the token is not a well-formed JWT")
+		case ve != nil && ve.Errors&jwt.ValidationErrorUnverifiable != 0:
+			return nil, authFailure("unsupported_algorithm", "the token's signing algorithm is not supported")
+		case ve != nil && ve.Inner == nil:
+			// Only the ValidMethods check fails without an inner error
+			return nil, authFailure("unsupported_algorithm", "only HS256 and RS256 tokens are accepted")
+		default:
+			return nil, authFailure("invalid_signature", "the token signature is invalid")
+		}
+	}
+	if authErr := a.verifyClaims(claims); authErr != nil {
+		return nil, authErr
+	}
+	return claims, nil
+}
+
+// verifyClaims checks exp, nbf, iss and aud, allowing Leeway for clock skew.
+// Tokens must expire.
+func (a *Authenticator) verifyClaims(claims jwt.MapClaims) *AuthError {
+	now := a.now()
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return authFailure("token_expired", "the token has no valid exp claim")
+	}
+	if now.After(exp.Add(a.config.Leeway)) {
+		return authFailure("token_expired", "the token expired at %s", exp.UTC().Format(time.RFC3339))
+	}
+	if _, present := claims["nbf"]; present {
+		nbf, ok := numericClaim(claims, "nbf")
+		if !ok {
+			return authFailure("token_not_yet_valid", "the token has an invalid nbf claim")
+		}
+		if now.Add(a.config.Leeway).Before(nbf) {
+			return authFailure("token_not_yet_valid", "the token is not valid before %s", nbf.UTC().Format(time.RFC3339))
+		}
+	}
+	if a.config.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != a.config.Issuer {
+			return authFailure("invalid_issuer", "the token was not issued by %s", a.config.Issuer)
+		}
+	}
+	if a.config.Audience != "" && !contains(stringListClaim(claims, "aud", " "), a.config.Audience) {
+		return authFailure("invalid_audience", "the token is not intended for %s", a.config.Audience)
+	}
+	return nil
+}
+
+func numericClaim(claims jwt.MapClaims, name string) (time.Time, bool) {
+	switch v := claims[name].(type) {
+	case float64:
+		return time.Unix(0, int64(v*float64(time.Second))), true
+	case json.Number:
+		f, err := v.Float64()
+		return time.Unix(0, int64(f*float64(time.Second))), err == nil
+	default:
+		return time.Time{}, false
+	}
+}
+
+// stringListClaim reads a claim that is either a list of strings or a single
+// string of values separated by sep.
+func stringListClaim(claims jwt.MapClaims, name, sep string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return strings.FieldsFunc(v, func(r rune) bool { return strings.ContainsRune(sep, r) })
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// tokenScopes reads OAuth scopes from "scope" (space separated) or "scp" (a list).
+func tokenScopes(claims jwt.MapClaims) []string {
+	if scopes := stringListClaim(claims, "scope", " "); len(scopes) > 0 {
+		return scopes
+	}
+	return stringListClaim(claims, "scp", " ")
+}
+
+// Authorize checks the claims against the route: every scope in Scopes and,
+// if Roles is set, at least one of its roles.
+func Authorize(claims jwt.MapClaims, policy RoutingPolicy) *AuthError {
+	scopes := tokenScopes(claims)
+	var missing []string
+	for _, scope := range policy.Scopes {
+		if !contains(scopes, scope) {
+			missing = append(missing, scope)
+		}
+	}
+	if len(missing) > 0 {
+		return forbidden("insufficient_scope", "the token lacks the required scopes: %s", strings.Join(missing, " "))
+	}
+	if len(policy.Roles) == 0 {
+		return nil
+	}
+	roles := stringListClaim(claims, "roles", ",")
+	for _, role := range policy.Roles {
+		if contains(roles, role) {
+			return nil
+		}
+	}
+	return forbidden("insufficient_role", "the token needs one of the roles: %s", strings.Join(policy.Roles, ", "))
+}
+
+// stripClaimHeaders removes claim headers a client may have set itself. a may be nil.
+func stripClaimHeaders(r *http.Request, a *Authenticator) {
+	headers := []string{subjectHeader, scopesHeader, rolesHeader}
+	if a != nil {
+		headers = a.forwarded
+	}
+	for _, header := range headers {
+		r.Header.Del(header)
+	}
+}
+
+// forwardClaims sets the claim headers on a request about to be proxied.
+func (a *Authenticator) forwardClaims(r *http.Request, claims jwt.MapClaims) {
+	if sub, ok := claims["sub"].(string); ok {
+		r.Header.Set(subjectHeader, sub)
+	}
+	if scopes := tokenScopes(claims); len(scopes) > 0 {
+		r.Header.Set(scopesHeader, strings.Join(scopes, " "))
+	}
+	if roles := stringListClaim(claims, "roles", ","); len(roles) > 0 {
+		r.Header.Set(rolesHeader, strings.Join(roles, ","))
+	}
+	for claim, header := range a.config.ForwardClaims {
+		if value, ok := claimString(claims[claim]); ok {
+			r.Header.Set(header, value)
+		}
+	}
+}
+
+func claimString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := claimString(item); ok {
+				values = append(values, s)
+			}
+		}
+		return strings.Join(values, ","), true
+	default:
+		return "", false
+	}
+}
+
+type claimsKey struct{}
+
+// Claims returns the verified claims of an authenticated request.
+func Claims(r *http.Request) (jwt.MapClaims, bool) {
+	claims, ok := r.Context().Value(claimsKey{}).(jwt.MapClaims)
+	return claims, ok
+}
+
+func withClaims(r *http.Request, claims jwt.MapClaims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims))
+}
+
+// requiresAuth reports whether the route needs a verified token.
+func (p RoutingPolicy) requiresAuth() bool {
+	return p.Authenticate || len(p.Scopes) > 0 || len(p.Roles) > 0
+}
@@ -0,0 +1,630 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the declarative gateway configuration. It is read from YAML or
+// JSON (which the YAML parser also accepts) and replaces every route and
+// upstream when applied. Middleware registered in code stays available.
+//
+//	upstreams:
+//	  users:
+//	    strategy: least-connections
+//	    targets:
+//	      - url: http://localhost:9001
+//	    health_check: {interval: 5s, path: /health}
+//	middleware:
+//	  audit:
+//	    type: logger
+//	    params: {prefix: audit}
+//	routes:
+//	  - path: /api/users/{id}
+//	    methods: [GET]
+//	    upstream: users
+//	    middleware: [audit]
+//	    scopes: [users:read]
+//	    rate_limit: {max_requests: 5, window: 10s}
+//	auth:
+//	  issuer: https://auth.example.com
+//	  audience: gateway
+//	  jwks_file: /etc/gateway/jwks.json
+type Config struct {
+	Upstreams  map[string]UpstreamConfig   `yaml:"upstreams"`
+	Middleware map[string]MiddlewareConfig `yaml:"middleware"`
+	Routes     []RouteConfig               `yaml:"routes"`
+	Auth       *AuthConfig                 `yaml:"auth"`
+
+	file  string
+	lines map[string]int // config path, e.g. "routes[1].upstream", to source line
+}
+
+// UpstreamConfig describes an upstream pool.
+type UpstreamConfig struct {
+	Strategy    string             `yaml:"strategy"`
+	HashHeader  string             `yaml:"hash_header"`
+	Targets     []TargetConfig     `yaml:"targets"`
+	HealthCheck *HealthCheckConfig `yaml:"health_check"`
+	Outlier     *OutlierConfig     `yaml:"outlier_detection"`
+	Breaker     *BreakerConfig     `yaml:"circuit_breaker"`
+}
+
+// TargetConfig describes one backend of an upstream pool.
+type TargetConfig struct {
+	URL    string `yaml:"url"`
+	Weight int    `yaml:"weight"`
+}
+
+// MiddlewareConfig instantiates a registered middleware type with parameters.
+type MiddlewareConfig struct {
+	Type   string                 `yaml:"type"`
+	Params map[string]interface{} `yaml:"params"`
+}
+
+// RouteConfig is the config file form of a RoutingPolicy.
+type RouteConfig struct {
+	Path         string            `yaml:"path"`
+	Prefix       bool              `yaml:"prefix"`
+	Methods      []string          `yaml:"methods"`
+	Host         string            `yaml:"host"`
+	Headers      map[string]string `yaml:"headers"`
+	Query        map[string]string `yaml:"query"`
+	Upstream     string            `yaml:"upstream"`
+	Middleware   []string          `yaml:"middleware"`
+	Authenticate bool              `yaml:"authenticate"`
+	Scopes       []string          `yaml:"scopes"`
+	Roles        []string          `yaml:"roles"`
+	RateLimit    *RateLimitConfig  `yaml:"rate_limit"`
+	Timeout      time.Duration     `yaml:"timeout"`
+	Retry        *RetryConfig      `yaml:"retry"`
+}
+
+// MiddlewareFactory builds a middleware from the parameters given in the config file.
+type MiddlewareFactory func(params map[string]interface{}) (Middleware, error)
+
+// ConfigProblem is a single validation failure.
+type ConfigProblem struct {
+	Line    int
+	Path    string
+	Message string
+}
+
+// ConfigError lists every problem found in a config file.
+type ConfigError struct {
+	File     string
+	Problems []ConfigProblem
+}
+
+func (e *ConfigError) Error() string {
+	lines := make([]string, 0, len(e.Problems)+1)
+	lines = append(lines, fmt.Sprintf("invalid gateway config %s:", e.File))
+	for _, p := range e.Problems {
+		location := e.File
+		if p.Line > 0 {
+			location += ":" + strconv.Itoa(p.Line)
+		}
+		if p.Path != "" {
+			location += ": " + p.Path
+		}
+		lines = append(lines, fmt.Sprintf("  %s: %s", location, p.Message))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// LoadConfigFile reads and parses a config file.
+func LoadConfigFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(filepath.Base(path), data)
+}
+
+var yamlLinePattern = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// ParseConfig parses YAML or JSON config data. Syntax errors, unknown fields
+// and mistyped values are reported with their line numbers; everything else
+// is checked when the config is applied.
+func ParseConfig(name string, data []byte) (*Config, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, &ConfigError{File: name, Problems: yamlProblems(err)}
+	}
+
+	config := &Config{file: name, lines: make(map[string]int)}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, &ConfigError{File: name, Problems: yamlProblems(err)}
+	}
+	recordLines(&root, "", config.lines)
+	return config, nil
+}
+
+// yamlProblems turns the "line N: message" errors from the YAML package into problems.
+func yamlProblems(err error) []ConfigProblem {
+	var messages []string
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		messages = typeErr.Errors
+	} else {
+		messages = []string{err.Error()}
+	}
+
+	problems := make([]ConfigProblem, 0, len(messages))
+	for _, msg := range messages {
+		problem := ConfigProblem{Message: strings.TrimPrefix(msg, "yaml: ")}
+		if m := yamlLinePattern.FindStringSubmatch(msg); m != nil {
+			problem.Line, _ = strconv.Atoi(m[1])
+			problem.Message = m[2]
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+// recordLines maps each config path below node to the line it starts on.
+func recordLines(node *yaml.Node, path string, lines map[string]int) {
+	lines[path] = node.Line
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			recordLines(child, path, lines)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			child := key.Value
+			if path != "" {
+				child = path + "." + key.Value
+			}
+			recordLines(node.Content[i+1], child, lines)
+			lines[child] = key.Line
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			recordLines(item, fmt.Sprintf("%s[%d]", path, i), lines)
+		}
+	}
+}
+
+// configValidator collects problems against the config's line map.
+type configValidator struct {
+	config   *Config
+	problems []ConfigProblem
+	routes   map[*Route]string // config path of each route added to the new router
+}
+
+// line returns the source line of a config path, falling back to the nearest
+// enclosing path that has one, e.g. a missing field's parent.
+func (v *configValidator) line(path string) int {
+	line := 0
+	for p := path; p != "" && line == 0; {
+		line = v.config.lines[p]
+		if i := strings.LastIndexAny(p, ".["); i >= 0 {
+			p = p[:i]
+		} else {
+			p = ""
+		}
+	}
+	return line
+}
+
+func (v *configValidator) errorf(path, format string, args ...interface{}) {
+	v.problems = append(v.problems, ConfigProblem{Line: v.line(path), Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *configValidator) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	sort.SliceStable(v.problems, func(i, j int) bool { return v.problems[i].Line < v.problems[j].Line })
+	return &ConfigError{File: v.config.file, Problems: v.problems}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ApplyConfig validates the config and, if it is valid, atomically replaces
+// the gateway's routes and upstreams with it. Upstream pools whose config is
+// unchanged are kept along with their health state, and rate limit quotas
+// carry over for routes that keep their pattern, host and methods. On error
+// the running configuration is left untouched.
+func (g *Gateway) ApplyConfig(config *Config) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	next, err := g.buildSnapshot(config, g.snapshot.Load())
+	if err != nil {
+		return err
+	}
+	g.swap(next)
+	g.upstreamConfigs = config.Upstreams
+	return nil
+}
+
+func (g *Gateway) buildSnapshot(config *Config, current *Snapshot) (*Snapshot, error) {
+	v := &configValidator{config: config, routes: make(map[*Route]string)}
+	next := &Snapshot{
+		Router:      NewRouter(),
+		Middlewares: make(map[string]Middleware, len(g.middlewares)+len(config.Middleware)),
+		Upstreams:   make(map[string]*UpstreamPool, len(config.Upstreams)),
+	}
+
+	for _, name := range sortedKeys(config.Upstreams) {
+		upstream := config.Upstreams[name]
+		path := "upstreams." + name
+		if prev, ok := g.upstreamConfigs[name]; ok && current.Upstreams[name] != nil && reflect.DeepEqual(prev, upstream) {
+			next.Upstreams[name] = current.Upstreams[name]
+			continue
+		}
+		if pool := v.buildUpstream(path, name, upstream); pool != nil {
+			next.Upstreams[name] = pool
+		}
+	}
+
+	for name, m := range g.middlewares {
+		next.Middlewares[name] = m
+	}
+	for _, name := range sortedKeys(config.Middleware) {
+		path := "middleware." + name
+		if _, ok := g.middlewares[name]; ok {
+			v.errorf(path, "name is already used by middleware registered in code")
+			continue
+		}
+		mc := config.Middleware[name]
+		factory, ok := g.factories[mc.Type]
+		switch {
+		case mc.Type == "":
+			v.errorf(path+".type", "middleware type is required")
+		case !ok:
+			v.errorf(path+".type", "unknown middleware type %q", mc.Type)
+		default:
+			m, err := factory(mc.Params)
+			if err != nil {
+				v.errorf(path+".params", "%v", err)
+				continue
+			}
+			next.Middlewares[name] = m
+		}
+	}
+
+	if config.Auth != nil {
+		// Always rebuilt, so changed key files and secrets are picked up on reload
+		auth, err := NewAuthenticator(*config.Auth)
+		if err != nil {
+			v.errorf("auth", "%v", err)
+		}
+		next.Auth = auth
+	}
+
+	for i, rc := range config.Routes {
+		path := fmt.Sprintf("routes[%d]", i)
+		v.checkRoute(path, rc, next)
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+func (v *configValidator) buildUpstream(path, name string, upstream UpstreamConfig) *UpstreamPool {
+	valid := true
+	balancer, err := NewBalancer(upstream.Strategy, upstream.HashHeader)
+	if err != nil {
+		v.errorf(path+".strategy", "%v", err)
+		valid = false
+	}
+	if len(upstream.Targets) == 0 {
+		v.errorf(path+".targets", "at least one target is required")
+		valid = false
+	}
+	var targets []*Target
+	for i, tc := range upstream.Targets {
+		if tc.Weight < 0 {
+			v.errorf(fmt.Sprintf("%s.targets[%d].weight", path, i), "weight must not be negative")
+			valid = false
+		}
+		target, err := NewTarget(tc.URL, tc.Weight)
+		if err != nil {
+			v.errorf(fmt.Sprintf("%s.targets[%d].url", path, i), "%v", err)
+			valid = false
+			continue
+		}
+		targets = append(targets, target)
+	}
+	if hc := upstream.HealthCheck; hc != nil && (hc.Interval < 0 || hc.Timeout < 0 || hc.HealthyThreshold < 0 || hc.UnhealthyThreshold < 0) {
+		v.errorf(path+".health_check", "durations and thresholds must not be negative")
+		valid = false
+	}
+	if oc := upstream.Outlier; oc != nil && (oc.ConsecutiveFailures < 0 || oc.BaseEjection < 0 || oc.MaxEjection < 0) {
+		v.errorf(path+".outlier_detection", "durations and thresholds must not be negative")
+		valid = false
+	}
+	if bc := upstream.Breaker; bc != nil && bc.OpenTimeout < 0 {
+		v.errorf(path+".circuit_breaker.open_timeout", "open_timeout must not be negative")
+		valid = false
+	}
+	if !valid {
+		return nil
+	}
+
+	pool := NewUpstreamPool(name, balancer, targets...)
+	if upstream.HealthCheck != nil {
+		pool.EnableHealthChecks(*upstream.HealthCheck)
+	}
+	if upstream.Outlier != nil {
+		pool.EnableOutlierDetection(*upstream.Outlier)
+	}
+	if upstream.Breaker != nil {
+		pool.EnableCircuitBreaker(*upstream.Breaker)
+	}
+	return pool
+}
+
+// checkRoute validates a route and adds it to the new router, so that later
+// routes are checked for conflicts with it. Duplicate and overlapping routes
+// are reported with the line of the route they clash with.
+func (v *configValidator) checkRoute(path string, rc RouteConfig, next *Snapshot) {
+	if rc.Upstream == "" {
+		v.errorf(path+".upstream", "upstream is required")
+	} else if _, ok := v.config.Upstreams[rc.Upstream]; !ok {
+		v.errorf(path+".upstream", "unknown upstream %q", rc.Upstream)
+	}
+	for i, name := range rc.Middleware {
+		// Middleware that failed to build has already been reported
+		_, built := next.Middlewares[name]
+		_, defined := v.config.Middleware[name]
+		if !built && !defined {
+			v.errorf(fmt.Sprintf("%s.middleware[%d]", path, i), "unknown middleware %q", name)
+		}
+	}
+	rateLimit := rc.RateLimit
+	if rateLimit != nil {
+		if _, err := NewRateLimiter(*rateLimit); err != nil {
+			v.errorf(path+".rate_limit", "%v", err)
+			// Still add the route below so later routes are checked against it
+			rateLimit = nil
+		}
+	}
+	timeout := rc.Timeout
+	if timeout < 0 {
+		v.errorf(path+".timeout", "timeout must not be negative")
+		timeout = 0
+	}
+	retry := rc.Retry
+	if retry != nil {
+		if _, err := newRetryPolicy(*retry); err != nil {
+			v.errorf(path+".retry", "%v", err)
+			retry = nil
+		}
+	}
+	if rc.Path == "" {
+		v.errorf(path+".path", "path is required")
+		return
+	}
+
+	policy := rc.policy()
+	policy.RateLimit, policy.Timeout, policy.Retry = rateLimit, timeout, retry
+	if policy.requiresAuth() && v.config.Auth == nil {
+		v.errorf(path, "route requires authentication but the config has no auth section")
+	}
+	route, err := next.Router.AddNew(rc.Path, policy)
+	var conflict *RouteConflictError
+	switch {
+	case errors.As(err, &conflict):
+		other := v.routes[conflict.Existing]
+		clash := "overlaps"
+		if conflict.Duplicate {
+			clash = "duplicates"
+		}
+		v.errorf(path+".path", "route %s %s route %s at %s (line %d)", conflict.Route, clash, conflict.Existing, other, v.line(other+".path"))
+	case err != nil:
+		v.errorf(path+".path", "%v", err)
+	default:
+		v.routes[route] = path
+	}
+}
+
+// policy converts the route config to a routing policy without validating it.
+func (rc RouteConfig) policy() RoutingPolicy {
+	return RoutingPolicy{
+		Middleware:   rc.Middleware,
+		RateLimit:    rc.RateLimit,
+		Authenticate: rc.Authenticate,
+		Upstream:     rc.Upstream,
+		Methods:      rc.Methods,
+		Host:         rc.Host,
+		Headers:      rc.Headers,
+		Query:        rc.Query,
+		PathPrefix:   rc.Prefix,
+		Scopes:       rc.Scopes,
+		Roles:        rc.Roles,
+		Timeout:      rc.Timeout,
+		Retry:        rc.Retry,
+	}
+}
+
+// stringParam reads an optional string parameter of a middleware factory.
+func stringParam(params map[string]interface{}, name string) (string, error) {
+	value, ok := params[name]
+	if !ok {
+		return "", nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("parameter %q must be a string", name)
+	}
+	return s, nil
+}
+
+// stringListParam reads an optional list of strings parameter of a middleware factory.
+func stringListParam(params map[string]interface{}, name string) ([]string, error) {
+	value, ok := params[name]
+	if !ok {
+		return nil, nil
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("parameter %q must be a list of strings", name)
+	}
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("parameter %q must be a list of strings", name)
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+// stringMapParam reads an optional string to string map parameter of a middleware factory.
+func stringMapParam(params map[string]interface{}, name string) (map[string]string, error) {
+	value, ok := params[name]
+	if !ok {
+		return nil, nil
+	}
+	entries, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("parameter %q must be a map of strings", name)
+	}
+	m := make(map[string]string, len(entries))
+	for k, v := range entries {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("parameter %q must be a map of strings", name)
+		}
+		m[k] = s
+	}
+	return m, nil
+}
+
+// ConfigReloader reapplies a config file whenever it changes or the process
+// receives SIGHUP. A config that fails validation is logged and ignored, so
+// the gateway keeps serving its last good configuration.
+type ConfigReloader struct {
+	gateway *Gateway
+	path    string
+	// OnReload, if set, is called after every reload attempt with its result.
+	OnReload func(error)
+	watcher  *fsnotify.Watcher
+	signals  chan os.Signal
+	quit     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// configReloadDelay lets a burst of file events from one save settle before reloading.
+const configReloadDelay = 100 * time.Millisecond
+
+// NewConfigReloader creates a reloader for the config file at path.
+func NewConfigReloader(gateway *Gateway, path string) *ConfigReloader {
+	return &ConfigReloader{gateway: gateway, path: path}
+}
+
+// Reload reads the config file and applies it.
+func (r *ConfigReloader) Reload() error {
+	config, err := LoadConfigFile(r.path)
+	if err != nil {
+		return err
+	}
+	return r.gateway.ApplyConfig(config)
+}
+
+// Start watches the config file and SIGHUP. The file's directory is watched
+// so that editors which save by renaming a new file into place are noticed.
+func (r *ConfigReloader) Start() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(r.path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	r.watcher = watcher
+	r.signals = make(chan os.Signal, 1)
+	signal.Notify(r.signals, syscall.SIGHUP)
+	r.quit = make(chan struct{})
+
+	r.wg.Add(1)
+	go r.run()
+	return nil
+}
+
+func (r *ConfigReloader) run() {
+	defer r.wg.Done()
+	name := filepath.Clean(r.path)
+	var pending <-chan time.Time
+	for {
+		select {
+		case event, ok := <-r.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) == name && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				pending = time.After(configReloadDelay)
+			}
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Config watcher error: %v", err)
+		case <-pending:
+			pending = nil
+			r.reload("file change")
+		case <-r.signals:
+			r.reload("SIGHUP")
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+func (r *ConfigReloader) reload(reason string) {
+	err := r.Reload()
+	if err != nil {
+		log.Printf("Config reload after %s failed, keeping current config: %v", reason, err)
+	} else {
+		log.Printf("Config reloaded from %s after %s", r.path, reason)
+	}
+	if r.OnReload != nil {
+		r.OnReload(err)
+	}
+}
+
+// Close stops watching for changes.
+func (r *ConfigReloader) Close() {
+	if r.quit == nil {
+		return
+	}
+	signal.Stop(r.signals)
+	close(r.quit)
+	r.watcher.Close()
+	r.wg.Wait()
+	r.quit = nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthCheckConfig configures active health checks for an upstream pool.
+type HealthCheckConfig struct {
+	Interval           time.Duration `yaml:"interval"`
+	Timeout            time.Duration `yaml:"timeout"`
+	Path               string        `yaml:"path"`
+	ExpectedStatus     int           `yaml:"expected_status"`
+	HealthyThreshold   int           `yaml:"healthy_threshold"`
+	UnhealthyThreshold int           `yaml:"unhealthy_threshold"`
+}
+
+// OutlierConfig configures passive outlier detection for an upstream pool.
+// A target is ejected after ConsecutiveFailures 5xx responses or connection
+// errors in a row. Each ejection lasts twice as long as the previous one,
+// starting at BaseEjection and capped at MaxEjection.
+type OutlierConfig struct {
+	ConsecutiveFailures int           `yaml:"consecutive_failures"`
+	BaseEjection        time.Duration `yaml:"base_ejection"`
+	MaxEjection         time.Duration `yaml:"max_ejection"`
+}
+
+func (c HealthCheckConfig) withDefaults() HealthCheckConfig {
+	if c.Interval <= 0 {
+		c.Interval = 10 * time.Second
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 2 * time.Second
+	}
+	if c.Path == "" {
+		c.Path = "/health"
+	}
+	if c.ExpectedStatus == 0 {
+		c.ExpectedStatus = http.StatusOK
+	}
+	if c.HealthyThreshold <= 0 {
+		c.HealthyThreshold = 2
+	}
+	if c.UnhealthyThreshold <= 0 {
+		c.UnhealthyThreshold = 3
+	}
+	return c
+}
+
+func (c OutlierConfig) withDefaults() OutlierConfig {
+	if c.ConsecutiveFailures <= 0 {
+		c.ConsecutiveFailures = 5
+	}
+	if c.BaseEjection <= 0 {
+		c.BaseEjection = 30 * time.Second
+	}
+	if c.MaxEjection < c.BaseEjection {
+		c.MaxEjection = 10 * c.BaseEjection
+	}
+	return c
+}
+
+// targetHealth is the active and passive health state of a target.
+type targetHealth struct {
+	mu sync.Mutex
+	// Active checks; targets start out healthy
+	unhealthy      bool
+	checkSuccesses int
+	checkFailures  int
+	lastCheckError string
+	// Passive outlier detection
+	responseFailures int
+	ejections        int
+	ejectedUntil     time.Time
+}
+
+// TargetStatus is a snapshot of a target's health, as reported by the admin endpoint.
+type TargetStatus struct {
+	URL                 string     `json:"url"`
+	Weight              int        `json:"weight"`
+	Healthy             bool       `json:"healthy"`
+	Ejected             bool       `json:"ejected"`
+	EjectedUntil        *time.Time `json:"ejected_until,omitempty"`
+	Ejections           int        `json:"ejections"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastCheckError      string     `json:"last_check_error,omitempty"`
+	ActiveRequests      int64      `json:"active_requests"`
+}
+
+// Available reports whether the target passes its health checks and is not ejected.
+func (t *Target) Available(now time.Time) bool {
+	t.health.mu.Lock()
+	defer t.health.mu.Unlock()
+	return !t.health.unhealthy && !now.Before(t.health.ejectedUntil)
+}
+
+// Status returns a snapshot of the target's health.
+func (t *Target) Status(now time.Time) TargetStatus {
+	t.health.mu.Lock()
+	defer t.health.mu.Unlock()
+	status := TargetStatus{
+		URL:                 t.URL.String(),
+		Weight:              t.Weight,
+		Healthy:             !t.health.unhealthy,
+		Ejected:             now.Before(t.health.ejectedUntil),
+		Ejections:           t.health.ejections,
+		ConsecutiveFailures: t.health.responseFailures,
+		LastCheckError:      t.health.lastCheckError,
+		ActiveRequests:      t.ActiveRequests(),
+	}
+	if status.Ejected {
+		until := t.health.ejectedUntil
+		status.EjectedUntil = &until
+	}
+	return status
+}
+
+// recordCheck applies an active health check result against the pool's thresholds.
+func (t *Target) recordCheck(config HealthCheckConfig, ok bool, errMsg string) {
+	t.health.mu.Lock()
+	defer t.health.mu.Unlock()
+	t.health.lastCheckError = errMsg
+	if ok {
+		t.health.checkFailures = 0
+		t.health.checkSuccesses++
+		if t.health.unhealthy && t.health.checkSuccesses >= config.HealthyThreshold {
+			t.health.unhealthy = false
+		}
+		return
+	}
+	t.health.checkSuccesses = 0
+	t.health.checkFailures++
+	if !t.health.unhealthy && t.health.checkFailures >= config.UnhealthyThreshold {
+		t.health.unhealthy = true
+	}
+}
+
+// recordResponse feeds a proxied response into passive outlier detection.
+func (t *Target) recordResponse(config OutlierConfig, failed bool, now time.Time) {
+	t.health.mu.Lock()
+	defer t.health.mu.Unlock()
+	if !failed {
+		t.health.responseFailures = 0
+		// Forget earlier ejections once the target has stayed in for a while
+		if t.health.ejections > 0 && now.Sub(t.health.ejectedUntil) > config.MaxEjection {
+			t.health.ejections = 0
+		}
+		return
+	}
+
+	t.health.responseFailures++
+	if t.health.responseFailures < config.ConsecutiveFailures {
+		return
+	}
+	t.health.responseFailures = 0
+	t.health.ejections++
+	ejection := config.BaseEjection
+	for i := 1; i < t.health.ejections && ejection < config.MaxEjection; i++ {
+		ejection *= 2
+	}
+	if ejection > config.MaxEjection {
+		ejection = config.MaxEjection
+	}
+	t.health.ejectedUntil = now.Add(ejection)
+}
+
+// EnableHealthChecks turns on active health checks for the pool. They run
+// once StartHealthChecks is called.
+func (p *UpstreamPool) EnableHealthChecks(config HealthCheckConfig) {
+	c := config.withDefaults()
+	p.HealthCheck = &c
+}
+
+// EnableOutlierDetection turns on passive ejection of failing targets.
+func (p *UpstreamPool) EnableOutlierDetection(config OutlierConfig) {
+	c := config.withDefaults()
+	p.Outlier = &c
+}
+
+// availableTargets returns the targets that may receive traffic right now.
+func (p *UpstreamPool) availableTargets(now time.Time) []*Target {
+	available := make([]*Target, 0, len(p.Targets))
+	for _, t := range p.Targets {
+		if t.Available(now) {
+			available = append(available, t)
+		}
+	}
+	return available
+}
+
+// StartHealthChecks begins probing every target at the configured interval.
+// It does nothing if active checks are not enabled.
+func (p *UpstreamPool) StartHealthChecks() {
+	if p.HealthCheck == nil || p.quit != nil {
+		return
+	}
+	p.quit = make(chan struct{})
+	client := &http.Client{Timeout: p.HealthCheck.Timeout}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.HealthCheck.Interval)
+		defer ticker.Stop()
+		for {
+			p.checkTargets(client)
+			select {
+			case <-ticker.C:
+			case <-p.quit:
+				return
+			}
+		}
+	}()
+}
+
+// StopHealthChecks stops active checks and waits for in-flight probes to finish.
+func (p *UpstreamPool) StopHealthChecks() {
+	if p.quit == nil {
+		return
+	}
+	close(p.quit)
+	p.wg.Wait()
+	p.quit = nil
+}
+
+// checkTargets probes all targets concurrently.
+func (p *UpstreamPool) checkTargets(client *http.Client) {
+	var wg sync.WaitGroup
+	for _, t := range p.Targets {
+		wg.Add(1)
+		go func(t *Target) {
+			defer wg.Done()
+			ok, errMsg := p.probe(client, t)
+			t.recordCheck(*p.HealthCheck, ok, errMsg)
+		}(t)
+	}
+	wg.Wait()
+}
+
+func (p *UpstreamPool) probe(client *http.Client, t *Target) (bool, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.HealthCheck.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.URL.JoinPath(p.HealthCheck.Path).String(), nil)
+	if err != nil {
+		return false, err.Error()
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err.Error()
+	}
+	resp.Body.Close()
+	if resp.StatusCode != p.HealthCheck.ExpectedStatus {
+		return false, "unexpected status " + resp.Status
+	}
+	return true, ""
+}
+
+// statusRecorder captures the status code written by the proxy. Unwrap lets
+// the proxy still flush and hijack the underlying writer.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// StartHealthChecks starts active health checks for every upstream pool,
+// including pools added later.
+func (g *Gateway) StartHealthChecks() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.healthChecks = true
+	for _, pool := range g.Snapshot().Upstreams {
+		pool.StartHealthChecks()
+	}
+}
+
+// Close stops background work such as health checks.
+func (g *Gateway) Close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.healthChecks = false
+	for _, pool := range g.Snapshot().Upstreams {
+		pool.StopHealthChecks()
+	}
+}
+
+// HealthHandler is the admin endpoint reporting the health of every upstream target.
+func (g *Gateway) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		upstreams := g.Snapshot().Upstreams
+		report := make(map[string][]TargetStatus, len(upstreams))
+		for name, pool := range upstreams {
+			statuses := make([]TargetStatus, 0, len(pool.Targets))
+			for _, t := range pool.Targets {
+				statuses = append(statuses, t.Status(now))
+			}
+			report[name] = statuses
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"upstreams": report})
+	})
+}
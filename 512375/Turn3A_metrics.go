@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// unmatchedRoute labels requests that matched no route.
+const unmatchedRoute = "unmatched"
+
+// Metrics are the gateway's Prometheus metrics. Each gateway has its own
+// registry, so several gateways can live in one process.
+type Metrics struct {
+	registry       *prometheus.Registry
+	requests       *prometheus.CounterVec
+	latency        *prometheus.HistogramVec
+	upstreamErrors *prometheus.CounterVec
+	rateLimited    *prometheus.CounterVec
+}
+
+// NewMetrics creates the gateway metrics, along with Go runtime and process metrics.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gateway_requests_total",
+			Help: "Requests handled, by route, method and status class.",
+		}, []string{"route", "method", "status_class"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gateway_request_duration_seconds",
+			Help:    "Time taken to answer requests, by route.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route"}),
+		upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gateway_upstream_errors_total",
+			Help: "Upstream calls that failed without a response, by upstream and reason.",
+		}, []string{"upstream", "reason"}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gateway_rate_limit_rejections_total",
+			Help: "Requests rejected by rate limiting, by route.",
+		}, []string{"route"}),
+	}
+	m.registry.MustRegister(
+		m.requests, m.latency, m.upstreamErrors, m.rateLimited,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) observeRequest(route, method string, status int, elapsed time.Duration) {
+	m.requests.WithLabelValues(route, methodLabel(method), statusClass(status)).Inc()
+	m.latency.WithLabelValues(route).Observe(elapsed.Seconds())
+}
+
+func (m *Metrics) observeRateLimited(route string) {
+	m.rateLimited.WithLabelValues(route).Inc()
+}
+
+// observeAttempt counts an upstream call that failed before getting a response.
+func (m *Metrics) observeAttempt(upstream string, state *attemptState) {
+	switch {
+	case state.breakerRejected:
+		m.upstreamErrors.WithLabelValues(upstream, "circuit_open").Inc()
+	case state.err != nil:
+		m.upstreamErrors.WithLabelValues(upstream, upstreamErrorReason(state.err)).Inc()
+	}
+}
+
+func upstreamErrorReason(err error) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case isConnectError(err):
+		return "connect"
+	default:
+		return "proxy"
+	}
+}
+
+// methodLabel keeps the method label's cardinality bounded whatever clients send.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "OTHER"
+	}
+}
+
+func statusClass(status int) string {
+	if status == 0 {
+		// Nothing was written, so the server answers 200
+		status = http.StatusOK
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Rate limiting algorithms
+const (
+	SlidingWindowAlgorithm = "sliding-window"
+	TokenBucketAlgorithm   = "token-bucket"
+)
+
+// RateLimitDecision is the outcome of taking one request from a quota.
+type RateLimitDecision struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the quota is fully restored.
+	Reset time.Duration
+	// RetryAfter is how long a rejected client should wait before the next request is allowed.
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps rate limit state. A shared store such as Redis lets
+// several gateway instances enforce one quota.
+type RateLimitStore interface {
+	// SlidingWindow allows at most limit requests per key in any window-long period.
+	SlidingWindow(ctx context.Context, key string, limit int, window time.Duration, now time.Time) (RateLimitDecision, error)
+	// TokenBucket allows bursts of up to capacity requests per key, refilled at rate tokens per second.
+	TokenBucket(ctx context.Context, key string, capacity int, rate float64, now time.Time) (RateLimitDecision, error)
+}
+
+// RateLimitCounter is the current state of one consumer's quota.
+type RateLimitCounter struct {
+	Key       string
+	Limit     int
+	Remaining int
+	Reset     time.Duration
+}
+
+// RateLimitInspector is implemented by stores that can list their counters.
+type RateLimitInspector interface {
+	// Counters returns the live counters whose keys start with prefix, without consuming quota.
+	Counters(prefix string, now time.Time) []RateLimitCounter
+}
+
+// KeyExtractor identifies the consumer a request is counted against. It
+// returns false if the request carries no such identity.
+type KeyExtractor func(r *http.Request) (string, bool)
+
+// RateLimiter enforces a route's RateLimitConfig per consumer.
+type RateLimiter struct {
+	config    RateLimitConfig
+	extractor KeyExtractor
+	prefix    string
+}
+
+// NewRateLimiter validates config and builds a limiter for it.
+func NewRateLimiter(config RateLimitConfig) (*RateLimiter, error) {
+	if config.MaxRequests <= 0 || config.WindowPeriod <= 0 {
+		return nil, fmt.Errorf("max_requests and window must be positive")
+	}
+	switch config.Algorithm {
+	case "":
+		config.Algorithm = SlidingWindowAlgorithm
+	case SlidingWindowAlgorithm, TokenBucketAlgorithm:
+	default:
+		return nil, fmt.Errorf("unknown rate limit algorithm '%s'", config.Algorithm)
+	}
+	if config.Burst < 0 {
+		return nil, fmt.Errorf("burst must not be negative")
+	}
+	if config.Burst > 0 && config.Algorithm != TokenBucketAlgorithm {
+		return nil, fmt.Errorf("burst only applies to the token-bucket algorithm")
+	}
+	if config.Burst == 0 {
+		config.Burst = config.MaxRequests
+	}
+	if config.Key == "" {
+		config.Key = "route"
+	}
+	extractor, err := NewKeyExtractor(config.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &RateLimiter{config: config, extractor: extractor}, nil
+}
+
+// NewKeyExtractor returns the extractor for a key spec: "route" (one quota
+// shared by all clients), "ip", "api-key" (the X-API-Key header), "jwt-sub"
+// (the subject of a token verified by the route's authentication) or
+// "header:<name>".
+func NewKeyExtractor(spec string) (KeyExtractor, error) {
+	switch {
+	case spec == "route":
+		return func(*http.Request) (string, bool) { return "", true }, nil
+	case spec == "ip":
+		return func(r *http.Request) (string, bool) { return clientIP(r), true }, nil
+	case spec == "api-key":
+		return headerExtractor("X-API-Key"), nil
+	case spec == "jwt-sub":
+		return jwtSubject, nil
+	case strings.HasPrefix(spec, "header:") && len(spec) > len("header:"):
+		return headerExtractor(strings.TrimPrefix(spec, "header:")), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit key '%s'", spec)
+	}
+}
+
+func headerExtractor(name string) KeyExtractor {
+	return func(r *http.Request) (string, bool) {
+		value := r.Header.Get(name)
+		return value, value != ""
+	}
+}
+
+// jwtSubject reads the subject of the claims verified by authentication,
+// which runs before rate limiting. Unverified tokens are ignored, since a
+// client could otherwise mint a new subject, and a new quota, per request.
+func jwtSubject(r *http.Request) (string, bool) {
+	claims, ok := Claims(r)
+	if !ok {
+		return "", false
+	}
+	sub, _ := claims["sub"].(string)
+	return sub, sub != ""
+}
+
+// key returns the store key for the request. Requests without the configured
+// identity are counted by client IP, so they cannot bypass the limit.
+func (l *RateLimiter) key(r *http.Request) string {
+	kind := l.config.Key
+	id, ok := l.extractor(r)
+	if !ok {
+		kind, id = "ip", clientIP(r)
+	}
+	return l.prefix + kind + ":" + id
+}
+
+// Allow takes one request from the consumer's quota. If the store fails the
+// request is allowed, so a store outage does not take the gateway down.
+func (l *RateLimiter) Allow(ctx context.Context, store RateLimitStore, r *http.Request) RateLimitDecision {
+	now := time.Now()
+	key := l.key(r)
+	var decision RateLimitDecision
+	var err error
+	if l.config.Algorithm == TokenBucketAlgorithm {
+		rate := float64(l.config.MaxRequests) / l.config.WindowPeriod.Seconds()
+		decision, err = store.TokenBucket(ctx, key, l.config.Burst, rate, now)
+	} else {
+		decision, err = store.SlidingWindow(ctx, key, l.config.MaxRequests, l.config.WindowPeriod, now)
+	}
+	if err != nil {
+		log.Printf("Rate limit store error for %s, allowing request: %v", key, err)
+		return RateLimitDecision{Allowed: true, Limit: l.config.MaxRequests, Remaining: l.config.MaxRequests}
+	}
+	return decision
+}
+
+// WriteHeaders sets the RateLimit-* headers, plus Retry-After when the request was rejected.
+func (l *RateLimiter) WriteHeaders(h http.Header, d RateLimitDecision) {
+	h.Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", l.config.MaxRequests, ceilSeconds(l.config.WindowPeriod)))
+	if !d.Allowed {
+		h.Set("Retry-After", strconv.Itoa(ceilSeconds(d.RetryAfter)))
+	}
+}
+
+// Counters lists the limiter's live counters in store, keyed by consumer.
+// It returns false if the store cannot be inspected.
+func (l *RateLimiter) Counters(store RateLimitStore, now time.Time) ([]RateLimitCounter, bool) {
+	inspector, ok := store.(RateLimitInspector)
+	if !ok {
+		return nil, false
+	}
+	counters := inspector.Counters(l.prefix, now)
+	for i := range counters {
+		counters[i].Key = strings.TrimPrefix(counters[i].Key, l.prefix)
+	}
+	sort.Slice(counters, func(i, j int) bool { return counters[i].Key < counters[j].Key })
+	return counters, true
+}
+
+func ceilSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.Seconds()))
+}
+
+// slidingWindowDecision builds a decision from the number of requests in the
+// window and the age of the oldest one.
+func slidingWindowDecision(allowed bool, count, limit int, oldestAge, window time.Duration) RateLimitDecision {
+	d := RateLimitDecision{Allowed: allowed, Limit: limit, Remaining: limit - count}
+	if count > 0 {
+		d.Reset = window - oldestAge
+	}
+	if !allowed {
+		d.RetryAfter = d.Reset
+	}
+	return d
+}
+
+// tokenBucketDecision builds a decision from the tokens left after the request.
+func tokenBucketDecision(allowed bool, tokens float64, capacity int, rate float64) RateLimitDecision {
+	d := RateLimitDecision{
+		Allowed:   allowed,
+		Limit:     capacity,
+		Remaining: int(tokens),
+		Reset:     time.Duration((float64(capacity) - tokens) / rate * float64(time.Second)),
+	}
+	if !allowed {
+		d.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	return d
+}
+
+// MemoryRateLimitStore keeps rate limit state in process. Idle keys are swept periodically.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	windows   map[string]*slidingWindowEntry
+	buckets   map[string]*tokenBucketEntry
+	nextSweep time.Time
+}
+
+type slidingWindowEntry struct {
+	requests []time.Time
+	limit    int
+	window   time.Duration
+	expires  time.Time
+}
+
+type tokenBucketEntry struct {
+	tokens   float64
+	capacity int
+	rate     float64
+	last     time.Time
+	expires  time.Time
+}
+
+// rateLimitSweepInterval is how often the memory store drops idle keys.
+const rateLimitSweepInterval = time.Minute
+
+// NewMemoryRateLimitStore creates an empty in-process store.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		windows: make(map[string]*slidingWindowEntry),
+		buckets: make(map[string]*tokenBucketEntry),
+	}
+}
+
+func (s *MemoryRateLimitStore) SlidingWindow(ctx context.Context, key string, limit int, window time.Duration, now time.Time) (RateLimitDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+
+	entry, ok := s.windows[key]
+	if !ok {
+		entry = &slidingWindowEntry{}
+		s.windows[key] = entry
+	}
+	// Drop requests that have left the window
+	cutoff := now.Add(-window)
+	i := 0
+	for i < len(entry.requests) && !entry.requests[i].After(cutoff) {
+		i++
+	}
+	entry.requests = entry.requests[i:]
+
+	allowed := len(entry.requests) < limit
+	if allowed {
+		entry.requests = append(entry.requests, now)
+	}
+	entry.limit, entry.window = limit, window
+	entry.expires = now.Add(window)
+	var oldestAge time.Duration
+	if len(entry.requests) > 0 {
+		oldestAge = now.Sub(entry.requests[0])
+	}
+	return slidingWindowDecision(allowed, len(entry.requests), limit, oldestAge, window), nil
+}
+
+func (s *MemoryRateLimitStore) TokenBucket(ctx context.Context, key string, capacity int, rate float64, now time.Time) (RateLimitDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+
+	entry, ok := s.buckets[key]
+	if !ok {
+		entry = &tokenBucketEntry{tokens: float64(capacity), last: now}
+		s.buckets[key] = entry
+	}
+	if now.After(entry.last) {
+		entry.tokens = math.Min(float64(capacity), entry.tokens+now.Sub(entry.last).Seconds()*rate)
+		entry.last = now
+	}
+	allowed := entry.tokens >= 1
+	if allowed {
+		entry.tokens--
+	}
+	entry.capacity, entry.rate = capacity, rate
+	// A bucket that has refilled completely is the same as no bucket at all
+	entry.expires = now.Add(time.Duration((float64(capacity) - entry.tokens) / rate * float64(time.Second)))
+	return tokenBucketDecision(allowed, entry.tokens, capacity, rate), nil
+}
+
+func (s *MemoryRateLimitStore) Counters(prefix string, now time.Time) []RateLimitCounter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var counters []RateLimitCounter
+	for key, entry := range s.windows {
+		if !strings.HasPrefix(key, prefix) || now.After(entry.expires) {
+			continue
+		}
+		cutoff := now.Add(-entry.window)
+		count := 0
+		var oldestAge time.Duration
+		for _, t := range entry.requests {
+			if t.After(cutoff) {
+				if count == 0 {
+					oldestAge = now.Sub(t)
+				}
+				count++
+			}
+		}
+		d := slidingWindowDecision(true, count, entry.limit, oldestAge, entry.window)
+		counters = append(counters, RateLimitCounter{Key: key, Limit: d.Limit, Remaining: d.Remaining, Reset: d.Reset})
+	}
+	for key, entry := range s.buckets {
+		if !strings.HasPrefix(key, prefix) || now.After(entry.expires) {
+			continue
+		}
+		tokens := entry.tokens
+		if now.After(entry.last) {
+			tokens = math.Min(float64(entry.capacity), tokens+now.Sub(entry.last).Seconds()*entry.rate)
+		}
+		d := tokenBucketDecision(true, tokens, entry.capacity, entry.rate)
+		counters = append(counters, RateLimitCounter{Key: key, Limit: d.Limit, Remaining: d.Remaining, Reset: d.Reset})
+	}
+	return counters
+}
+
+// sweep drops idle keys at most once per interval. Callers hold s.mu.
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Before(s.nextSweep) {
+		return
+	}
+	s.nextSweep = now.Add(rateLimitSweepInterval)
+	for key, entry := range s.windows {
+		if now.After(entry.expires) {
+			delete(s.windows, key)
+		}
+	}
+	for key, entry := range s.buckets {
+		if now.After(entry.expires) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// slidingWindowScript keeps a sorted set of request timestamps per key.
+// It returns {allowed, count, oldest timestamp or -1}.
+var slidingWindowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if count < limit then
+  redis.call('ZADD', KEYS[1], now, ARGV[4])
+  count = count + 1
+  allowed = 1
+end
+redis.call('PEXPIRE', KEYS[1], window)
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+local oldestScore = -1
+if oldest[2] then
+  oldestScore = tonumber(oldest[2])
+end
+return {allowed, count, oldestScore}
+`)
+
+// tokenBucketScript keeps the token count and last refill time per key.
+// Redis truncates Lua numbers to integers, so the token count is returned as a string.
+var tokenBucketScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local capacity = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or capacity
+local ts = tonumber(state[2]) or now
+if now > ts then
+  tokens = math.min(capacity, tokens + (now - ts) * rate)
+  ts = now
+end
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'ts', ts)
+redis.call('PEXPIRE', KEYS[1], math.ceil((capacity - tokens) / rate) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+// RedisRateLimitStore keeps rate limit state in Redis so several gateway
+// instances share quotas. Each decision is a single atomic script call.
+// Timestamps come from the gateway, so instances need roughly synchronised clocks.
+type RedisRateLimitStore struct {
+	client redis.Scripter
+	prefix string
+}
+
+// NewRedisRateLimitStore creates a store whose keys are namespaced by prefix.
+func NewRedisRateLimitStore(client redis.Scripter, prefix string) *RedisRateLimitStore {
+	return &RedisRateLimitStore{client: client, prefix: prefix}
+}
+
+func (s *RedisRateLimitStore) SlidingWindow(ctx context.Context, key string, limit int, window time.Duration, now time.Time) (RateLimitDecision, error) {
+	nowMs := now.UnixMilli()
+	// Members must be unique, or two requests in the same millisecond would count once
+	member := strconv.FormatInt(nowMs, 10) + "-" + randomSuffix()
+	result, err := slidingWindowScript.Run(ctx, s.client, []string{s.prefix + "sw:" + key},
+		nowMs, window.Milliseconds(), limit, member).Slice()
+	if err != nil {
+		return RateLimitDecision{}, err
+	}
+	if len(result) != 3 {
+		return RateLimitDecision{}, fmt.Errorf("unexpected sliding window script result %v", result)
+	}
+	allowed, count, oldest := result[0].(int64) == 1, result[1].(int64), result[2].(int64)
+	var oldestAge time.Duration
+	if oldest >= 0 {
+		oldestAge = time.Duration(nowMs-oldest) * time.Millisecond
+	}
+	return slidingWindowDecision(allowed, int(count), limit, oldestAge, window), nil
+}
+
+func (s *RedisRateLimitStore) TokenBucket(ctx context.Context, key string, capacity int, rate float64, now time.Time) (RateLimitDecision, error) {
+	result, err := tokenBucketScript.Run(ctx, s.client, []string{s.prefix + "tb:" + key},
+		now.UnixMilli(), strconv.FormatFloat(rate/1000, 'g', -1, 64), capacity).Slice()
+	if err != nil {
+		return RateLimitDecision{}, err
+	}
+	if len(result) != 2 {
+		return RateLimitDecision{}, fmt.Errorf("unexpected token bucket script result %v", result)
+	}
+	tokens, err := strconv.ParseFloat(result[1].(string), 64)
+	if err != nil {
+		return RateLimitDecision{}, fmt.Errorf("unexpected token count %v: %v", result[1], err)
+	}
+	return tokenBucketDecision(result[0].(int64) == 1, tokens, capacity, rate), nil
+}
+
+func randomSuffix() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sony/gobreaker"
+)
+
+// RetryConfig configures retries of a route's upstream calls. Only requests
+// using one of Methods are retried, and only when an attempt fails with one
+// of the RetryOn conditions: "connect-error" or a 5xx status code. Retries
+// wait BaseBackoff doubled per attempt, capped at MaxBackoff, with full
+// jitter. The retry budget keeps retries below BudgetRatio of requests over
+// the last ten seconds, plus MinRetriesPerSecond, so a failing upstream is
+// not hammered.
+type RetryConfig struct {
+	Attempts            int           `yaml:"attempts"`
+	RetryOn             []string      `yaml:"retry_on"`
+	Methods             []string      `yaml:"methods"`
+	BaseBackoff         time.Duration `yaml:"base_backoff"`
+	MaxBackoff          time.Duration `yaml:"max_backoff"`
+	BudgetRatio         float64       `yaml:"budget_ratio"`
+	MinRetriesPerSecond int           `yaml:"min_retries_per_second"`
+}
+
+// BreakerConfig configures an upstream's circuit breaker. It opens after
+// ConsecutiveFailures failed calls (5xx responses or proxy errors), rejects
+// calls for OpenTimeout, then lets HalfOpenRequests through to probe.
+type BreakerConfig struct {
+	ConsecutiveFailures uint32        `yaml:"consecutive_failures"`
+	OpenTimeout         time.Duration `yaml:"open_timeout"`
+	HalfOpenRequests    uint32        `yaml:"half_open_requests"`
+}
+
+const (
+	connectErrorCondition = "connect-error"
+	// maxRetryBodyBytes is the largest request body buffered so it can be replayed
+	maxRetryBodyBytes = 1 << 20
+	retryBudgetWindow = 10 // seconds
+)
+
+var defaultRetryMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodTrace}
+
+func (c BreakerConfig) withDefaults() BreakerConfig {
+	if c.ConsecutiveFailures == 0 {
+		c.ConsecutiveFailures = 5
+	}
+	if c.OpenTimeout <= 0 {
+		c.OpenTimeout = 30 * time.Second
+	}
+	if c.HalfOpenRequests == 0 {
+		c.HalfOpenRequests = 1
+	}
+	return c
+}
+
+// retryPolicy is a validated RetryConfig.
+type retryPolicy struct {
+	attempts     int
+	connectError bool
+	statuses     map[int]bool
+	methods      map[string]bool
+	baseBackoff  time.Duration
+	maxBackoff   time.Duration
+	budget       *retryBudget
+}
+
+func newRetryPolicy(c RetryConfig) (*retryPolicy, error) {
+	if c.Attempts < 0 || c.BaseBackoff < 0 || c.MaxBackoff < 0 || c.BudgetRatio < 0 || c.MinRetriesPerSecond < 0 {
+		return nil, fmt.Errorf("retry settings must not be negative")
+	}
+	p := &retryPolicy{
+		attempts:    c.Attempts,
+		statuses:    make(map[int]bool),
+		methods:     make(map[string]bool),
+		baseBackoff: c.BaseBackoff,
+		maxBackoff:  c.MaxBackoff,
+	}
+	if p.baseBackoff == 0 {
+		p.baseBackoff = 25 * time.Millisecond
+	}
+	if p.maxBackoff == 0 {
+		p.maxBackoff = time.Second
+	}
+	if p.maxBackoff < p.baseBackoff {
+		return nil, fmt.Errorf("max_backoff must not be less than base_backoff")
+	}
+
+	retryOn := c.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = []string{connectErrorCondition, "502", "503"}
+	}
+	for _, condition := range retryOn {
+		if condition == connectErrorCondition {
+			p.connectError = true
+			continue
+		}
+		status, err := strconv.Atoi(condition)
+		if err != nil || status < 500 || status > 599 {
+			return nil, fmt.Errorf("unknown retry condition %q, expected %q or a 5xx status", condition, connectErrorCondition)
+		}
+		p.statuses[status] = true
+	}
+
+	methods := c.Methods
+	if len(methods) == 0 {
+		methods = defaultRetryMethods
+	}
+	for _, method := range methods {
+		p.methods[method] = true
+	}
+
+	ratio, minimum := c.BudgetRatio, c.MinRetriesPerSecond
+	if ratio == 0 {
+		ratio = 0.2
+	}
+	if minimum == 0 {
+		minimum = 10
+	}
+	p.budget = &retryBudget{ratio: ratio, minPerSecond: minimum}
+	return p, nil
+}
+
+// backoff returns a fully jittered delay before the given retry (1 for the first).
+func (p *retryPolicy) backoff(retry int) time.Duration {
+	d := p.baseBackoff
+	for i := 1; i < retry && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// retryBudget counts requests and retries in one-second buckets over a rolling window.
+type retryBudget struct {
+	mu           sync.Mutex
+	ratio        float64
+	minPerSecond int
+	buckets      [retryBudgetWindow]budgetBucket
+}
+
+type budgetBucket struct {
+	second            int64
+	requests, retries int
+}
+
+func (b *retryBudget) bucket(now time.Time) *budgetBucket {
+	second := now.Unix()
+	bucket := &b.buckets[second%retryBudgetWindow]
+	if bucket.second != second {
+		*bucket = budgetBucket{second: second}
+	}
+	return bucket
+}
+
+func (b *retryBudget) recordRequest(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bucket(now).requests++
+}
+
+// withdraw takes one retry from the budget if it has room.
+func (b *retryBudget) withdraw(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	current := b.bucket(now)
+	requests, retries := 0, 0
+	for _, bucket := range b.buckets {
+		if bucket.second > now.Unix()-retryBudgetWindow {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+	if float64(retries) >= b.ratio*float64(requests)+float64(b.minPerSecond*retryBudgetWindow) {
+		return false
+	}
+	current.retries++
+	return true
+}
+
+// RouteStats are counters for a route's upstream calls.
+type RouteStats struct {
+	Requests        uint64 `json:"requests"`
+	Retries         uint64 `json:"retries"`
+	BudgetExhausted uint64 `json:"retry_budget_exhausted"`
+	Timeouts        uint64 `json:"timeouts"`
+	BreakerRejected uint64 `json:"breaker_rejected"`
+}
+
+func (s *RouteStats) snapshot() RouteStats {
+	return RouteStats{
+		Requests:        atomic.LoadUint64(&s.Requests),
+		Retries:         atomic.LoadUint64(&s.Retries),
+		BudgetExhausted: atomic.LoadUint64(&s.BudgetExhausted),
+		Timeouts:        atomic.LoadUint64(&s.Timeouts),
+		BreakerRejected: atomic.LoadUint64(&s.BreakerRejected),
+	}
+}
+
+// attemptKey carries an attemptState in the context of each upstream attempt,
+// so the proxy's error handler can report why an attempt failed.
+type attemptKey struct{}
+
+type attemptState struct {
+	err             error
+	breakerRejected bool
+}
+
+func recordAttemptError(r *http.Request, err error) {
+	if state, ok := r.Context().Value(attemptKey{}).(*attemptState); ok {
+		state.err = err
+	}
+}
+
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	return (errors.As(err, &opErr) && opErr.Op == "dial") || errors.As(err, &dnsErr)
+}
+
+// EnableCircuitBreaker wraps calls to the pool's targets in a circuit breaker.
+func (p *UpstreamPool) EnableCircuitBreaker(config BreakerConfig) {
+	c := config.withDefaults()
+	p.Breaker = gobreaker.NewTwoStepCircuitBreaker(gobreaker.Settings{
+		Name:        p.Name,
+		MaxRequests: c.HalfOpenRequests,
+		Timeout:     c.OpenTimeout,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= c.ConsecutiveFailures
+		},
+		OnStateChange: func(name string, from, to gobreaker.State) {
+			log.Printf("Circuit breaker for upstream '%s' changed from %s to %s", name, from, to)
+		},
+	})
+}
+
+// BreakerState returns the state of the pool's circuit breaker, or "disabled".
+func (p *UpstreamPool) BreakerState() string {
+	if p.Breaker == nil {
+		return "disabled"
+	}
+	return p.Breaker.State().String()
+}
+
+// routeHandler proxies to the route's upstream pool, applying the route's
+// timeout and retries. Failed upstream calls are counted in metrics.
+func (route *Route) routeHandler(pool *UpstreamPool, metrics *Metrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&route.stats.Requests, 1)
+		if route.Policy.Timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), route.Policy.Timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+
+		retry := route.retry
+		// Upgrades hand the connection over, so they can never be replayed
+		if retry == nil || retry.attempts == 0 || !retry.methods[r.Method] || r.Header.Get("Upgrade") != "" {
+			route.serveAttempt(w, r, pool, metrics)
+			return
+		}
+		retry.budget.recordRequest(time.Now())
+
+		body, ok := bufferBody(r)
+		if !ok {
+			route.serveAttempt(w, r, pool, metrics)
+			return
+		}
+		for attempt := 0; ; attempt++ {
+			if body != nil {
+				r.Body = io.NopCloser(bytes.NewReader(body))
+			}
+			state := &attemptState{}
+			rw := &retryWriter{w: w, header: make(http.Header)}
+			rw.retry = func(status int) bool {
+				retryable := retry.statuses[status] || (retry.connectError && state.err != nil && isConnectError(state.err))
+				if !retryable || state.breakerRejected || attempt >= retry.attempts || r.Context().Err() != nil {
+					return false
+				}
+				if !retry.budget.withdraw(time.Now()) {
+					atomic.AddUint64(&route.stats.BudgetExhausted, 1)
+					return false
+				}
+				return true
+			}
+			route.serveAttempt(rw, r.WithContext(context.WithValue(r.Context(), attemptKey{}, state)), pool, metrics)
+			if !rw.discarded {
+				return
+			}
+
+			atomic.AddUint64(&route.stats.Retries, 1)
+			timer := time.NewTimer(retry.backoff(attempt + 1))
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+					atomic.AddUint64(&route.stats.Timeouts, 1)
+				}
+				http.Error(w, "Upstream request timed out", http.StatusGatewayTimeout)
+				return
+			}
+		}
+	})
+}
+
+// serveAttempt makes one call to the pool and counts its timeouts and rejections.
+func (route *Route) serveAttempt(w http.ResponseWriter, r *http.Request, pool *UpstreamPool, metrics *Metrics) {
+	state, ok := r.Context().Value(attemptKey{}).(*attemptState)
+	if !ok {
+		state = &attemptState{}
+		r = r.WithContext(context.WithValue(r.Context(), attemptKey{}, state))
+	}
+	pool.ServeHTTP(w, r)
+	metrics.observeAttempt(pool.Name, state)
+	if state.breakerRejected {
+		atomic.AddUint64(&route.stats.BreakerRejected, 1)
+	}
+	if state.err != nil && errors.Is(state.err, context.DeadlineExceeded) {
+		atomic.AddUint64(&route.stats.Timeouts, 1)
+	}
+}
+
+// bufferBody reads the request body into memory so it can be replayed. It
+// returns false if the body is too large or of unknown length.
+func bufferBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return nil, true
+	}
+	if r.ContentLength < 0 || r.ContentLength > maxRetryBodyBytes {
+		return nil, false
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, false
+	}
+	return body, true
+}
+
+// retryWriter holds back a response until its status is known, so that a
+// retryable failure can be discarded instead of reaching the client. Other
+// responses are passed straight through and still stream.
+type retryWriter struct {
+	w           http.ResponseWriter
+	header      http.Header
+	retry       func(status int) bool
+	wroteHeader bool
+	discarded   bool
+}
+
+func (rw *retryWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *retryWriter) WriteHeader(status int) {
+	if rw.wroteHeader {
+		return
+	}
+	if status >= 200 && rw.retry(status) {
+		rw.wroteHeader, rw.discarded = true, true
+		return
+	}
+	dst := rw.w.Header()
+	for k, v := range rw.header {
+		dst[k] = v
+	}
+	rw.w.WriteHeader(status)
+	// Informational responses are followed by the final one
+	rw.wroteHeader = status >= 200
+}
+
+func (rw *retryWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.discarded {
+		return len(b), nil
+	}
+	return rw.w.Write(b)
+}
+
+// Flush is defined so the proxy never flushes an undecided or discarded response.
+func (rw *retryWriter) Flush() {
+	if rw.wroteHeader && !rw.discarded {
+		http.NewResponseController(rw.w).Flush()
+	}
+}
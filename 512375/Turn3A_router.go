@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// segmentKind orders path segments by how specific they are.
+type segmentKind int
+
+const (
+	wildcardSegment segmentKind = iota // {name...}, matches the rest of the path
+	paramSegment                       // {name}, matches any single segment
+	literalSegment                     // matches itself only
+)
+
+type segment struct {
+	kind  segmentKind
+	value string // literal text or parameter name
+}
+
+// Route is a compiled routing policy.
+//
+// When several routes match a request the most specific one wins, comparing in order:
+//  1. Host: an exact host beats a "*.example.com" wildcard, which beats no host.
+//  2. Path, segment by segment: a literal beats a {param}, which beats a {tail...}.
+//     If one path runs out first, the longer one wins; for equal paths an exact
+//     route beats a prefix route.
+//  3. A route that lists methods beats one that accepts any method.
+//  4. The route with more header and query predicates wins.
+//  5. The route registered first wins.
+type Route struct {
+	Pattern  string
+	Policy   RoutingPolicy
+	segments []segment
+	methods  map[string]bool
+	host     string
+	limiter  *RateLimiter
+	retry    *retryPolicy
+	stats    *RouteStats
+	order    int
+}
+
+type routeParamsKey struct{}
+
+// RouteParams returns the path parameters captured for the request's route.
+func RouteParams(r *http.Request) map[string]string {
+	params, _ := r.Context().Value(routeParamsKey{}).(map[string]string)
+	return params
+}
+
+// PathParam returns a single path parameter captured for the request's route.
+func PathParam(r *http.Request, name string) string {
+	return RouteParams(r)[name]
+}
+
+func withRouteParams(r *http.Request, params map[string]string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), routeParamsKey{}, params))
+}
+
+// Router matches requests against registered routes.
+type Router struct {
+	routes []*Route
+	added  int
+}
+
+// NewRouter creates an empty router.
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// parsePattern splits a path pattern into segments. Patterns start with "/",
+// may contain {param} segments and may end in a {name...} wildcard.
+func parsePattern(pattern string) ([]segment, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("pattern %q must start with '/'", pattern)
+	}
+	parts := splitPath(pattern)
+	segments := make([]segment, 0, len(parts))
+	seen := make(map[string]bool)
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "{") || !strings.HasSuffix(part, "}") {
+			if strings.ContainsAny(part, "{}") {
+				return nil, fmt.Errorf("pattern %q: malformed segment %q", pattern, part)
+			}
+			segments = append(segments, segment{kind: literalSegment, value: part})
+			continue
+		}
+
+		name := part[1 : len(part)-1]
+		kind := paramSegment
+		if strings.HasSuffix(name, "...") {
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("pattern %q: wildcard %q must be the last segment", pattern, part)
+			}
+			name = strings.TrimSuffix(name, "...")
+			kind = wildcardSegment
+		}
+		if name == "" {
+			return nil, fmt.Errorf("pattern %q: empty parameter name", pattern)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("pattern %q: duplicate parameter %q", pattern, name)
+		}
+		seen[name] = true
+		segments = append(segments, segment{kind: kind, value: name})
+	}
+	return segments, nil
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func compileRoute(pattern string, policy RoutingPolicy) (*Route, error) {
+	segments, err := parsePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if policy.PathPrefix && len(segments) > 0 && segments[len(segments)-1].kind == wildcardSegment {
+		return nil, fmt.Errorf("pattern %q: a wildcard route cannot also be a prefix route", pattern)
+	}
+
+	route := &Route{
+		Pattern:  pattern,
+		Policy:   policy,
+		segments: segments,
+		methods:  make(map[string]bool),
+		host:     strings.ToLower(policy.Host),
+		stats:    &RouteStats{},
+	}
+	for _, method := range policy.Methods {
+		route.methods[strings.ToUpper(method)] = true
+	}
+	if strings.Contains(strings.TrimPrefix(route.host, "*."), "*") {
+		return nil, fmt.Errorf("host %q: only a leading '*.' wildcard is supported", policy.Host)
+	}
+	if policy.RateLimit != nil {
+		limiter, err := NewRateLimiter(*policy.RateLimit)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: rate limit: %v", route, err)
+		}
+		// Quotas are per route, so they survive config reloads that keep the route
+		limiter.prefix = "route:" + route.String() + ":"
+		route.limiter = limiter
+	}
+	if policy.Timeout < 0 {
+		return nil, fmt.Errorf("route %s: timeout must not be negative", route)
+	}
+	if policy.Retry != nil {
+		retry, err := newRetryPolicy(*policy.Retry)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: retry: %v", route, err)
+		}
+		route.retry = retry
+	}
+	return route, nil
+}
+
+// RouteConflictError reports a route that could match the same requests as
+// an existing one without either being more specific.
+type RouteConflictError struct {
+	Route    *Route
+	Existing *Route
+	// Duplicate is set when the routes have the same pattern, host, methods
+	// and predicates, rather than only overlapping.
+	Duplicate bool
+}
+
+func (e *RouteConflictError) Error() string {
+	if e.Duplicate {
+		return fmt.Sprintf("route %s duplicates existing route %s", e.Route, e.Existing)
+	}
+	return fmt.Sprintf("route %s conflicts with existing route %s", e.Route, e.Existing)
+}
+
+// Add registers a route. A route with the same pattern, host, methods and
+// predicates as an existing one replaces it. A route that could match the
+// same requests as an existing one without either being more specific, such
+// as one whose methods only partly overlap, is rejected with a
+// *RouteConflictError and nothing changes.
+func (rt *Router) Add(pattern string, policy RoutingPolicy) (*Route, error) {
+	return rt.add(pattern, policy, true)
+}
+
+// AddNew registers a route like Add, but rejects a duplicate of an existing
+// route instead of replacing it.
+func (rt *Router) AddNew(pattern string, policy RoutingPolicy) (*Route, error) {
+	return rt.add(pattern, policy, false)
+}
+
+func (rt *Router) add(pattern string, policy RoutingPolicy, replaceDuplicate bool) (*Route, error) {
+	route, err := compileRoute(pattern, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	replace := -1
+	for i, existing := range rt.routes {
+		if !route.ambiguousWith(existing) {
+			continue
+		}
+		duplicate := existing.Pattern == route.Pattern && sameMethods(route.methods, existing.methods)
+		if !duplicate || !replaceDuplicate {
+			return nil, &RouteConflictError{Route: route, Existing: existing, Duplicate: duplicate}
+		}
+		replace = i
+	}
+	if replace >= 0 {
+		route.order = rt.routes[replace].order
+		rt.routes[replace] = route
+		return route, nil
+	}
+
+	route.order = rt.added
+	rt.added++
+	rt.routes = append(rt.routes, route)
+	sort.SliceStable(rt.routes, func(i, j int) bool {
+		return rt.routes[i].moreSpecificThan(rt.routes[j])
+	})
+	return route, nil
+}
+
+// Remove unregisters every route with the given pattern and reports whether any existed.
+func (rt *Router) Remove(pattern string) bool {
+	kept := rt.routes[:0]
+	for _, route := range rt.routes {
+		if route.Pattern != pattern {
+			kept = append(kept, route)
+		}
+	}
+	removed := len(kept) != len(rt.routes)
+	rt.routes = kept
+	return removed
+}
+
+// Routes returns the registered routes in precedence order.
+func (rt *Router) Routes() []*Route {
+	return append([]*Route(nil), rt.routes...)
+}
+
+// Match finds the most specific route for the request and its captured path
+// parameters. If no route matches but some would with a different method,
+// those methods are returned so the caller can answer 405.
+func (rt *Router) Match(r *http.Request) (*Route, map[string]string, []string) {
+	host := requestHost(r)
+	path := splitPath(r.URL.Path)
+	allowed := make(map[string]bool)
+
+	// Routes are kept in precedence order, so the first full match wins
+	for _, route := range rt.routes {
+		if !route.matchesHost(host) || !route.matchesPredicates(r) {
+			continue
+		}
+		params, ok := route.matchPath(path)
+		if !ok {
+			continue
+		}
+		if len(route.methods) > 0 && !route.methods[r.Method] {
+			for method := range route.methods {
+				allowed[method] = true
+			}
+			continue
+		}
+		return route, params, nil
+	}
+
+	methods := make([]string, 0, len(allowed))
+	for method := range allowed {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return nil, nil, methods
+}
+
+func (route *Route) matchPath(path []string) (map[string]string, bool) {
+	params := make(map[string]string)
+	for i, seg := range route.segments {
+		if seg.kind == wildcardSegment {
+			params[seg.value] = strings.Join(path[i:], "/")
+			return params, true
+		}
+		if i >= len(path) {
+			return nil, false
+		}
+		switch seg.kind {
+		case literalSegment:
+			if path[i] != seg.value {
+				return nil, false
+			}
+		case paramSegment:
+			params[seg.value] = path[i]
+		}
+	}
+	if len(path) > len(route.segments) && !route.Policy.PathPrefix {
+		return nil, false
+	}
+	return params, true
+}
+
+func (route *Route) matchesHost(host string) bool {
+	switch {
+	case route.host == "":
+		return true
+	case strings.HasPrefix(route.host, "*."):
+		return strings.HasSuffix(host, route.host[1:])
+	default:
+		return host == route.host
+	}
+}
+
+func (route *Route) matchesPredicates(r *http.Request) bool {
+	for name, want := range route.Policy.Headers {
+		values, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok || (want != "" && !contains(values, want)) {
+			return false
+		}
+	}
+	query := r.URL.Query()
+	for name, want := range route.Policy.Query {
+		values, ok := query[name]
+		if !ok || (want != "" && !contains(values, want)) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
+
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+func (route *Route) hostRank() int {
+	switch {
+	case route.host == "":
+		return 0
+	case strings.HasPrefix(route.host, "*."):
+		return 1
+	default:
+		return 2
+	}
+}
+
+func (route *Route) predicateCount() int {
+	return len(route.Policy.Headers) + len(route.Policy.Query)
+}
+
+// moreSpecificThan implements the precedence rules documented on Route.
+func (route *Route) moreSpecificThan(other *Route) bool {
+	if a, b := route.hostRank(), other.hostRank(); a != b {
+		return a > b
+	}
+	if c := comparePaths(route, other); c != 0 {
+		return c > 0
+	}
+	if a, b := len(route.methods) > 0, len(other.methods) > 0; a != b {
+		return a
+	}
+	if a, b := route.predicateCount(), other.predicateCount(); a != b {
+		return a > b
+	}
+	return route.order < other.order
+}
+
+// comparePaths returns 1 if a's path is more specific than b's, -1 if less and 0 if equal.
+func comparePaths(a, b *Route) int {
+	for i := 0; i < len(a.segments) && i < len(b.segments); i++ {
+		if ka, kb := a.segments[i].kind, b.segments[i].kind; ka != kb {
+			if ka > kb {
+				return 1
+			}
+			return -1
+		}
+	}
+	if la, lb := len(a.segments), len(b.segments); la != lb {
+		if la > lb {
+			return 1
+		}
+		return -1
+	}
+	if a.Policy.PathPrefix != b.Policy.PathPrefix {
+		if b.Policy.PathPrefix {
+			return 1
+		}
+		return -1
+	}
+	return 0
+}
+
+// ambiguousWith reports whether both routes would match the same requests
+// with equal precedence, so neither could ever be chosen reliably.
+func (route *Route) ambiguousWith(other *Route) bool {
+	if route.host != other.host || route.Policy.PathPrefix != other.Policy.PathPrefix {
+		return false
+	}
+	if len(route.segments) != len(other.segments) {
+		return false
+	}
+	for i, seg := range route.segments {
+		o := other.segments[i]
+		if seg.kind != o.kind || (seg.kind == literalSegment && seg.value != o.value) {
+			return false
+		}
+	}
+	if !sameStringMap(route.Policy.Headers, other.Policy.Headers) || !sameStringMap(route.Policy.Query, other.Policy.Query) {
+		return false
+	}
+	if len(route.methods) == 0 || len(other.methods) == 0 {
+		return len(route.methods) == len(other.methods)
+	}
+	for method := range route.methods {
+		if other.methods[method] {
+			return true
+		}
+	}
+	return false
+}
+
+func sameMethods(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for method := range a {
+		if !b[method] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameStringMap(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// String describes the route for logs and error messages.
+func (route *Route) String() string {
+	var b strings.Builder
+	if len(route.methods) > 0 {
+		methods := make([]string, 0, len(route.methods))
+		for method := range route.methods {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+		b.WriteString(strings.Join(methods, ","))
+		b.WriteString(" ")
+	}
+	b.WriteString(route.host)
+	b.WriteString(route.Pattern)
+	if route.Policy.PathPrefix {
+		b.WriteString(" (prefix)")
+	}
+	return b.String()
+}
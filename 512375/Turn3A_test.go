@@ -0,0 +1,2117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/websocket"
+)
+
+// newBackend starts a backend that answers with its name
+func newBackend(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, name)
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func newTestTarget(t *testing.T, rawURL string, weight int) *Target {
+	t.Helper()
+	target, err := NewTarget(rawURL, weight)
+	if err != nil {
+		t.Fatalf("NewTarget: %v", err)
+	}
+	return target
+}
+
+// newTestGateway routes /api to the given pool and serves it over HTTP
+func newTestGateway(t *testing.T, pool *UpstreamPool) *httptest.Server {
+	t.Helper()
+	gateway := NewGateway()
+	gateway.AddUpstream(pool)
+	gateway.AddRoutingPolicy("/api", RoutingPolicy{Upstream: pool.Name})
+	server := httptest.NewServer(http.HandlerFunc(gateway.HandleRequest))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func get(t *testing.T, url string, header http.Header) string {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestProxyForwardsRequestWithForwardedHeaders(t *testing.T) {
+	var got *http.Request
+	var gotBody string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got, gotBody = r, string(body)
+		w.Header().Set("X-Backend", "yes")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, "created")
+	}))
+	defer backend.Close()
+
+	gw := newTestGateway(t, NewUpstreamPool("api", nil, newTestTarget(t, backend.URL, 1)))
+	resp, err := http.Post(gw.URL+"/api?x=1", "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusCreated || string(body) != "created" || resp.Header.Get("X-Backend") != "yes" {
+		t.Fatalf("unexpected response %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+	if got.URL.Path != "/api" || got.URL.RawQuery != "x=1" || gotBody != "payload" {
+		t.Fatalf("backend got %s %s?%s body %q", got.Method, got.URL.Path, got.URL.RawQuery, gotBody)
+	}
+	gwHost := strings.TrimPrefix(gw.URL, "http://")
+	if got.Header.Get("X-Forwarded-Host") != gwHost || got.Header.Get("X-Forwarded-Proto") != "http" {
+		t.Fatalf("missing forwarded headers: %v", got.Header)
+	}
+	if got.Header.Get("X-Forwarded-For") != "127.0.0.1" {
+		t.Fatalf("expected X-Forwarded-For 127.0.0.1, got %q", got.Header.Get("X-Forwarded-For"))
+	}
+}
+
+func TestUnknownUpstreamIsBadGateway(t *testing.T) {
+	gateway := NewGateway()
+	gateway.AddRoutingPolicy("/api", RoutingPolicy{Upstream: "missing"})
+	rec := httptest.NewRecorder()
+	gateway.HandleRequest(rec, httptest.NewRequest(http.MethodGet, "/api", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", rec.Code)
+	}
+}
+
+func TestRoundRobinBalancing(t *testing.T) {
+	a, b := newBackend(t, "a"), newBackend(t, "b")
+	gw := newTestGateway(t, NewUpstreamPool("api", &RoundRobinBalancer{},
+		newTestTarget(t, a.URL, 1), newTestTarget(t, b.URL, 1)))
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, get(t, gw.URL+"/api", nil))
+	}
+	if strings.Join(got, "") != "abab" {
+		t.Fatalf("expected abab, got %v", got)
+	}
+}
+
+func TestWeightedBalancing(t *testing.T) {
+	a, b := newBackend(t, "a"), newBackend(t, "b")
+	gw := newTestGateway(t, NewUpstreamPool("api", &WeightedBalancer{},
+		newTestTarget(t, a.URL, 3), newTestTarget(t, b.URL, 1)))
+
+	counts := map[string]int{}
+	for i := 0; i < 8; i++ {
+		counts[get(t, gw.URL+"/api", nil)]++
+	}
+	if counts["a"] != 6 || counts["b"] != 2 {
+		t.Fatalf("expected a 3:1 split, got %v", counts)
+	}
+}
+
+func TestLeastConnectionsBalancing(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprint(w, "slow")
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := newBackend(t, "fast")
+
+	slowTarget := newTestTarget(t, slow.URL, 1)
+	pool := NewUpstreamPool("api", &LeastConnectionsBalancer{}, slowTarget, newTestTarget(t, fast.URL, 1))
+	gw := newTestGateway(t, pool)
+
+	// Tie up the slow target, then every further request should avoid it
+	deadline := time.Now().Add(2 * time.Second)
+	for slowTarget.ActiveRequests() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("slow target never received a request")
+		}
+		go http.Get(gw.URL + "/api")
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	for i := 0; i < 5; i++ {
+		if body := get(t, gw.URL+"/api", nil); body != "fast" {
+			t.Fatalf("expected the idle target, got %q", body)
+		}
+	}
+}
+
+func TestConsistentHashBalancing(t *testing.T) {
+	backends := []*httptest.Server{newBackend(t, "a"), newBackend(t, "b"), newBackend(t, "c")}
+	var targets []*Target
+	for _, b := range backends {
+		targets = append(targets, newTestTarget(t, b.URL, 1))
+	}
+	gw := newTestGateway(t, NewUpstreamPool("api", &ConsistentHashBalancer{Header: "X-User"}, targets...))
+
+	seen := map[string]bool{}
+	for i := 0; i < 30; i++ {
+		header := http.Header{"X-User": {fmt.Sprintf("user-%d", i)}}
+		first := get(t, gw.URL+"/api", header)
+		if again := get(t, gw.URL+"/api", header); again != first {
+			t.Fatalf("user-%d moved from %s to %s", i, first, again)
+		}
+		seen[first] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("expected keys to spread over all targets, got %v", seen)
+	}
+}
+
+func TestConsistentHashOnlyMovesRemovedTargetKeys(t *testing.T) {
+	var targets []*Target
+	for i := 0; i < 4; i++ {
+		targets = append(targets, newTestTarget(t, fmt.Sprintf("http://backend-%d", i), 1))
+	}
+	balancer := &ConsistentHashBalancer{Header: "X-User"}
+	removed := targets[3]
+
+	for i := 0; i < 200; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-User", fmt.Sprintf("user-%d", i))
+		before := balancer.Next(req, targets)
+		after := balancer.Next(req, targets[:3])
+		if before != removed && before != after {
+			t.Fatalf("user-%d moved although its target was not removed", i)
+		}
+	}
+}
+
+func TestProxyStreamsResponses(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "first")
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprintln(w, "second")
+	}))
+	defer backend.Close()
+
+	gw := newTestGateway(t, NewUpstreamPool("api", nil, newTestTarget(t, backend.URL, 1)))
+	resp, err := http.Get(gw.URL + "/api")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	if err != nil || line != "first\n" {
+		t.Fatalf("expected the first chunk before the backend finished, got %q, %v", line, err)
+	}
+	close(release)
+	if line, _ := reader.ReadString('\n'); line != "second\n" {
+		t.Fatalf("expected the second chunk, got %q", line)
+	}
+}
+
+func TestProxyPassesWebSocketsThrough(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(messageType, append([]byte("echo: "), message...))
+		}
+	}))
+	defer backend.Close()
+
+	gw := newTestGateway(t, NewUpstreamPool("api", nil, newTestTarget(t, backend.URL, 1)))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(gw.URL, "http")+"/api", nil)
+	if err != nil {
+		t.Fatalf("dial through gateway: %v", err)
+	}
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, message, err := conn.ReadMessage()
+	if err != nil || string(message) != "echo: hello" {
+		t.Fatalf("expected echo through the gateway, got %q, %v", message, err)
+	}
+}
+
+func TestNewBalancer(t *testing.T) {
+	for _, strategy := range []string{"", "round-robin", "weighted", "least-connections"} {
+		if _, err := NewBalancer(strategy, ""); err != nil {
+			t.Fatalf("NewBalancer(%q): %v", strategy, err)
+		}
+	}
+	if _, err := NewBalancer("consistent-hash", ""); err == nil {
+		t.Fatal("expected consistent-hash without a header to fail")
+	}
+	if _, err := NewBalancer("random", ""); err == nil {
+		t.Fatal("expected an unknown strategy to fail")
+	}
+}
+
+// waitFor polls cond until it holds or the deadline passes
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestActiveHealthChecks(t *testing.T) {
+	var healthy int32 = 1
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "flaky")
+	}))
+	defer flaky.Close()
+	steady := newBackend(t, "steady")
+
+	flakyTarget := newTestTarget(t, flaky.URL, 1)
+	pool := NewUpstreamPool("api", &RoundRobinBalancer{}, flakyTarget, newTestTarget(t, steady.URL, 1))
+	pool.EnableHealthChecks(HealthCheckConfig{
+		Interval:           10 * time.Millisecond,
+		Path:               "/healthz",
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 2,
+	})
+	pool.StartHealthChecks()
+	defer pool.StopHealthChecks()
+	gw := newTestGateway(t, pool)
+
+	atomic.StoreInt32(&healthy, 0)
+	waitFor(t, "the flaky target to be marked unhealthy", func() bool { return !flakyTarget.Available(time.Now()) })
+	for i := 0; i < 4; i++ {
+		if body := get(t, gw.URL+"/api", nil); body != "steady" {
+			t.Fatalf("expected traffic to avoid the unhealthy target, got %q", body)
+		}
+	}
+	if status := flakyTarget.Status(time.Now()); !strings.Contains(status.LastCheckError, "503") {
+		t.Fatalf("expected the failed check to be reported, got %+v", status)
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	waitFor(t, "the flaky target to recover", func() bool { return flakyTarget.Available(time.Now()) })
+}
+
+func TestOutlierEjectionAndReinstatement(t *testing.T) {
+	var failing int32 = 1
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "broken")
+	}))
+	defer broken.Close()
+	steady := newBackend(t, "steady")
+
+	brokenTarget := newTestTarget(t, broken.URL, 1)
+	pool := NewUpstreamPool("api", &RoundRobinBalancer{}, brokenTarget, newTestTarget(t, steady.URL, 1))
+	pool.EnableOutlierDetection(OutlierConfig{ConsecutiveFailures: 2, BaseEjection: 100 * time.Millisecond})
+	gw := newTestGateway(t, pool)
+
+	// Round-robin sends every other request to the broken target
+	for i := 0; i < 4; i++ {
+		get(t, gw.URL+"/api", nil)
+	}
+	if brokenTarget.Available(time.Now()) {
+		t.Fatal("expected the broken target to be ejected after 2 consecutive 5xx responses")
+	}
+	for i := 0; i < 4; i++ {
+		if body := get(t, gw.URL+"/api", nil); body != "steady" {
+			t.Fatalf("expected traffic to avoid the ejected target, got %q", body)
+		}
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	waitFor(t, "the ejected target to be reinstated", func() bool { return brokenTarget.Available(time.Now()) })
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		seen[get(t, gw.URL+"/api", nil)] = true
+	}
+	if !seen["broken"] {
+		t.Fatal("expected the reinstated target to receive traffic again")
+	}
+}
+
+func TestOutlierEjectionOnConnectionErrors(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadTarget := newTestTarget(t, dead.URL, 1)
+	dead.Close()
+
+	pool := NewUpstreamPool("api", nil, deadTarget)
+	pool.EnableOutlierDetection(OutlierConfig{ConsecutiveFailures: 3, BaseEjection: time.Minute})
+	gw := newTestGateway(t, pool)
+
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(gw.URL + "/api")
+		if err != nil {
+			t.Fatalf("GET: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("expected 502 from a dead target, got %d", resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Get(gw.URL + "/api")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 once the only target is ejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestEjectionBackoff(t *testing.T) {
+	target := newTestTarget(t, "http://backend", 1)
+	config := OutlierConfig{ConsecutiveFailures: 1, BaseEjection: time.Second, MaxEjection: 3 * time.Second}
+	now := time.Now()
+
+	var durations []time.Duration
+	for i := 0; i < 4; i++ {
+		target.recordResponse(config, true, now)
+		durations = append(durations, target.health.ejectedUntil.Sub(now))
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}
+	for i := range want {
+		if durations[i] != want[i] {
+			t.Fatalf("expected ejections %v, got %v", want, durations)
+		}
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	gateway := NewGateway()
+	target := newTestTarget(t, "http://backend:8080", 2)
+	pool := NewUpstreamPool("users", nil, target)
+	pool.EnableOutlierDetection(OutlierConfig{ConsecutiveFailures: 1})
+	gateway.AddUpstream(pool)
+	target.recordResponse(*pool.Outlier, true, time.Now())
+
+	rec := httptest.NewRecorder()
+	gateway.HealthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/health", nil))
+
+	var report struct {
+		Upstreams map[string][]TargetStatus `json:"upstreams"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	statuses := report.Upstreams["users"]
+	if len(statuses) != 1 {
+		t.Fatalf("expected one target, got %+v", report)
+	}
+	s := statuses[0]
+	if s.URL != "http://backend:8080" || s.Weight != 2 || !s.Healthy || !s.Ejected || s.EjectedUntil == nil {
+		t.Fatalf("unexpected status %+v", s)
+	}
+}
+
+func mustAddRoute(t *testing.T, router *Router, pattern string, policy RoutingPolicy) {
+	t.Helper()
+	if _, err := router.Add(pattern, policy); err != nil {
+		t.Fatalf("Add(%q): %v", pattern, err)
+	}
+}
+
+func TestRouterPrecedence(t *testing.T) {
+	router := NewRouter()
+	mustAddRoute(t, router, "/", RoutingPolicy{Upstream: "prefix", PathPrefix: true})
+	mustAddRoute(t, router, "/api/{rest...}", RoutingPolicy{Upstream: "wildcard"})
+	mustAddRoute(t, router, "/api/users/{id}", RoutingPolicy{Upstream: "param"})
+	mustAddRoute(t, router, "/api/users/me", RoutingPolicy{Upstream: "literal"})
+	mustAddRoute(t, router, "/api/users/{id}", RoutingPolicy{Upstream: "get-param", Methods: []string{"GET"}})
+	mustAddRoute(t, router, "/api/users/{id}", RoutingPolicy{Upstream: "beta", Methods: []string{"GET"}, Headers: map[string]string{"X-Beta": ""}})
+	mustAddRoute(t, router, "/{rest...}", RoutingPolicy{Upstream: "host", Host: "admin.example.com"})
+	mustAddRoute(t, router, "/{rest...}", RoutingPolicy{Upstream: "wildcard-host", Host: "*.example.com"})
+
+	tests := []struct {
+		method, target, host string
+		header               http.Header
+		want                 string
+	}{
+		{"GET", "/api/users/me", "", nil, "literal"},
+		{"GET", "/api/users/42", "", nil, "get-param"},
+		{"POST", "/api/users/42", "", nil, "param"},
+		{"GET", "/api/users/42", "", http.Header{"X-Beta": {"1"}}, "beta"},
+		{"GET", "/api/orders/1", "", nil, "wildcard"},
+		{"GET", "/api", "", nil, "wildcard"},
+		{"GET", "/orders", "", nil, "prefix"},
+		{"GET", "/api/users/42", "admin.example.com", nil, "host"},
+		{"GET", "/api/users/42", "shop.example.com:8080", nil, "wildcard-host"},
+		{"GET", "/api/users/42", "example.com", nil, "get-param"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.host != "" {
+			req.Host = tt.host
+		}
+		for k, v := range tt.header {
+			req.Header[k] = v
+		}
+		route, _, _ := router.Match(req)
+		if route == nil || route.Policy.Upstream != tt.want {
+			t.Errorf("%s %s%s: expected %s, got %v", tt.method, tt.host, tt.target, tt.want, route)
+		}
+	}
+}
+
+func TestRouterCapturesParams(t *testing.T) {
+	router := NewRouter()
+	mustAddRoute(t, router, "/users/{user}/posts/{post}", RoutingPolicy{})
+	mustAddRoute(t, router, "/static/{path...}", RoutingPolicy{})
+
+	_, params, _ := router.Match(httptest.NewRequest("GET", "/users/ann/posts/7", nil))
+	if params["user"] != "ann" || params["post"] != "7" {
+		t.Fatalf("unexpected params %v", params)
+	}
+	_, params, _ = router.Match(httptest.NewRequest("GET", "/static/css/site.css", nil))
+	if params["path"] != "css/site.css" {
+		t.Fatalf("unexpected wildcard capture %v", params)
+	}
+	route, params, _ := router.Match(httptest.NewRequest("GET", "/static", nil))
+	if route == nil || params["path"] != "" {
+		t.Fatalf("expected empty wildcard match, got %v %v", route, params)
+	}
+	if route, _, _ := router.Match(httptest.NewRequest("GET", "/users/ann/posts", nil)); route != nil {
+		t.Fatalf("expected no match for a short path, got %v", route)
+	}
+}
+
+func TestRouterPrefixMatchesWholeSegments(t *testing.T) {
+	router := NewRouter()
+	mustAddRoute(t, router, "/api", RoutingPolicy{PathPrefix: true})
+	for path, want := range map[string]bool{"/api": true, "/api/": true, "/api/v1/users": true, "/apix": false, "/": false} {
+		route, _, _ := router.Match(httptest.NewRequest("GET", path, nil))
+		if (route != nil) != want {
+			t.Errorf("%s: expected match %v", path, want)
+		}
+	}
+}
+
+func TestRouterPredicates(t *testing.T) {
+	router := NewRouter()
+	mustAddRoute(t, router, "/search", RoutingPolicy{Upstream: "v2", Query: map[string]string{"version": "2"}})
+	mustAddRoute(t, router, "/search", RoutingPolicy{Upstream: "json", Headers: map[string]string{"Accept": "application/json"}})
+
+	for target, want := range map[string]string{"/search?version=2": "v2", "/search?version=1": "", "/search": ""} {
+		route, _, _ := router.Match(httptest.NewRequest("GET", target, nil))
+		if got := ""; route != nil {
+			got = route.Policy.Upstream
+			if got != want {
+				t.Errorf("%s: expected %q, got %q", target, want, got)
+			}
+		} else if want != "" {
+			t.Errorf("%s: expected %q, got no match", target, want)
+		}
+	}
+	req := httptest.NewRequest("GET", "/search", nil)
+	req.Header.Set("Accept", "application/json")
+	if route, _, _ := router.Match(req); route == nil || route.Policy.Upstream != "json" {
+		t.Fatalf("expected header predicate to match, got %v", route)
+	}
+}
+
+func TestRouterConflicts(t *testing.T) {
+	router := NewRouter()
+	mustAddRoute(t, router, "/users/{id}", RoutingPolicy{Methods: []string{"GET", "PUT"}})
+	mustAddRoute(t, router, "/users/{id}", RoutingPolicy{Methods: []string{"POST"}})
+	mustAddRoute(t, router, "/users/{id}", RoutingPolicy{Host: "api.example.com", Methods: []string{"GET"}})
+
+	conflicts := []struct {
+		pattern string
+		policy  RoutingPolicy
+	}{
+		{"/users/{name}", RoutingPolicy{Methods: []string{"put"}}},
+		{"/users/{name}", RoutingPolicy{Methods: []string{"POST", "DELETE"}}},
+		// Same pattern, but the methods only partly overlap an existing route
+		{"/users/{id}", RoutingPolicy{Methods: []string{"GET", "POST"}, Upstream: "overlap"}},
+		{"/users/{id}", RoutingPolicy{Methods: []string{"PUT"}, Upstream: "overlap"}},
+		{"/users/{id}", RoutingPolicy{Methods: []string{"POST", "PATCH"}, Upstream: "overlap"}},
+	}
+	for _, c := range conflicts {
+		if _, err := router.Add(c.pattern, c.policy); err == nil || !strings.Contains(err.Error(), "conflicts") {
+			t.Errorf("%s %v: expected conflict, got %v", c.pattern, c.policy.Methods, err)
+		}
+	}
+	if route, _, _ := router.Match(httptest.NewRequest("POST", "/users/1", nil)); len(router.Routes()) != 3 || route.Policy.Upstream == "overlap" {
+		t.Fatalf("expected rejected routes to leave the router unchanged, got %v of %d", route, len(router.Routes()))
+	}
+
+	// Re-registering the same route updates it in place
+	mustAddRoute(t, router, "/users/{id}", RoutingPolicy{Methods: []string{"POST"}, Upstream: "updated"})
+	route, _, _ := router.Match(httptest.NewRequest("POST", "/users/1", nil))
+	if route == nil || route.Policy.Upstream != "updated" || len(router.Routes()) != 3 {
+		t.Fatalf("expected route to be updated, got %v of %d", route, len(router.Routes()))
+	}
+
+	for _, pattern := range []string{"users", "/a/{x...}/b", "/a/{}", "/a/{x}/{x}", "/a/b{c}"} {
+		if _, err := router.Add(pattern, RoutingPolicy{}); err == nil {
+			t.Errorf("%s: expected invalid pattern error", pattern)
+		}
+	}
+}
+
+func TestGatewayRouting(t *testing.T) {
+	var gotID, gotPath string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+	}))
+	defer backend.Close()
+
+	gateway := NewGateway()
+	gateway.AddUpstream(NewUpstreamPool("users", nil, newTestTarget(t, backend.URL, 1)))
+	gateway.AddMiddleware("capture", func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotID = PathParam(r, "id")
+			next.ServeHTTP(w, r)
+		})
+	})
+	err := gateway.AddRoutingPolicy("/users/{id}", RoutingPolicy{
+		Upstream:   "users",
+		Middleware: []string{"capture"},
+		Methods:    []string{http.MethodGet, http.MethodDelete},
+	})
+	if err != nil {
+		t.Fatalf("AddRoutingPolicy: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	gateway.HandleRequest(rec, httptest.NewRequest(http.MethodGet, "/users/42", nil))
+	if rec.Code != http.StatusOK || gotID != "42" || gotPath != "/users/42" {
+		t.Fatalf("expected proxied request with id 42, got %d id %q path %q", rec.Code, gotID, gotPath)
+	}
+
+	rec = httptest.NewRecorder()
+	gateway.HandleRequest(rec, httptest.NewRequest(http.MethodPost, "/users/42", nil))
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "DELETE, GET" {
+		t.Fatalf("expected 405 with Allow header, got %d %q", rec.Code, rec.Header().Get("Allow"))
+	}
+
+	rec = httptest.NewRecorder()
+	gateway.HandleRequest(rec, httptest.NewRequest(http.MethodGet, "/orders/42", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rec.Code)
+	}
+}
+
+func mustApplyConfig(t *testing.T, gateway *Gateway, data string) {
+	t.Helper()
+	config, err := ParseConfig("test.yaml", []byte(data))
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	if err := gateway.ApplyConfig(config); err != nil {
+		t.Fatalf("ApplyConfig: %v", err)
+	}
+}
+
+func TestShippedConfigIsValid(t *testing.T) {
+	t.Setenv("GATEWAY_JWT_SECRET", "test-secret")
+	config, err := LoadConfigFile("gateway.yaml")
+	if err != nil {
+		t.Fatalf("LoadConfigFile: %v", err)
+	}
+	gateway := NewGateway()
+	gateway.AddMiddleware("logger", loggerMiddleware)
+	if err := gateway.ApplyConfig(config); err != nil {
+		t.Fatalf("ApplyConfig: %v", err)
+	}
+	if _, ok := gateway.GetUpstream("users"); !ok || len(gateway.Snapshot().Router.Routes()) != 2 {
+		t.Fatalf("expected the users upstream and two routes")
+	}
+}
+
+func TestConfigRoutesRequests(t *testing.T) {
+	backend := newBackend(t, "users")
+	gateway := NewGateway()
+	mustApplyConfig(t, gateway, fmt.Sprintf(`
+upstreams:
+  users:
+    targets: [{url: %s}]
+middleware:
+  audit:
+    type: logger
+    params: {prefix: audit}
+routes:
+  - path: /users/{id}
+    methods: [GET]
+    upstream: users
+    middleware: [audit]
+    rate_limit: {max_requests: 1, window: 1m}
+`, backend.URL))
+
+	rec := httptest.NewRecorder()
+	gateway.HandleRequest(rec, httptest.NewRequest(http.MethodGet, "/users/1", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "users" {
+		t.Fatalf("expected proxied response, got %d %q", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	gateway.HandleRequest(rec, httptest.NewRequest(http.MethodGet, "/users/1", nil))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected configured rate limit to apply, got %d", rec.Code)
+	}
+}
+
+func TestConfigAcceptsJSON(t *testing.T) {
+	config, err := ParseConfig("gateway.json", []byte(`{
+  "upstreams": {"users": {"strategy": "weighted", "targets": [{"url": "http://localhost:9001", "weight": 3}]}},
+  "routes": [{"path": "/users", "prefix": true, "upstream": "users", "rate_limit": {"max_requests": 5, "window": "10s"}}]
+}`))
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	if config.Routes[0].RateLimit.WindowPeriod != 10*time.Second || config.Upstreams["users"].Targets[0].Weight != 3 {
+		t.Fatalf("unexpected config %+v", config)
+	}
+	if err := NewGateway().ApplyConfig(config); err != nil {
+		t.Fatalf("ApplyConfig: %v", err)
+	}
+}
+
+func configProblems(t *testing.T, err error) []ConfigProblem {
+	t.Helper()
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("expected a ConfigError, got %v", err)
+	}
+	return configErr.Problems
+}
+
+func TestConfigParseErrorsHaveLines(t *testing.T) {
+	tests := map[string]struct {
+		data string
+		line int
+	}{
+		"syntax":        {"routes:\n  - path: /a\n    upstream: users: api\n", 3},
+		"unknown field": {"routes:\n  - path: /a\n    upstrem: users\n", 3},
+		"wrong type":    {"upstreams:\n  users:\n    targets:\n      - url: http://a\n        weight: heavy\n", 5},
+		"bad duration":  {"routes:\n  - path: /a\n    rate_limit:\n      window: soon\n", 4},
+	}
+	for name, tt := range tests {
+		_, err := ParseConfig("test.yaml", []byte(tt.data))
+		problems := configProblems(t, err)
+		if problems[0].Line != tt.line {
+			t.Errorf("%s: expected line %d, got %+v", name, tt.line, problems)
+		}
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	config, err := ParseConfig("test.yaml", []byte(`upstreams:
+  users:
+    strategy: fastest
+    targets:
+      - url: not a url
+  empty:
+    targets: []
+middleware:
+  audit:
+    type: tracer
+  loud:
+    type: logger
+    params: {prefix: 3}
+routes:
+  - path: /users/{id}
+    upstream: users
+  - path: /users/{name}
+    upstream: missing
+    middleware: [audit, nope]
+  - upstream: users
+    rate_limit: {max_requests: 0, window: 1s}
+`))
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	gateway := NewGateway()
+	err = gateway.ApplyConfig(config)
+	problems := configProblems(t, err)
+
+	want := []struct {
+		line int
+		path string
+	}{
+		{3, "upstreams.users.strategy"},
+		{5, "upstreams.users.targets[0].url"},
+		{7, "upstreams.empty.targets"},
+		{10, "middleware.audit.type"},
+		{13, "middleware.loud.params"},
+		{17, "routes[1].path"},
+		{18, "routes[1].upstream"},
+		{19, "routes[1].middleware[1]"},
+		{20, "routes[2].path"},
+		{21, "routes[2].rate_limit"},
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("expected %d problems, got %d:\n%v", len(want), len(problems), err)
+	}
+	for i, w := range want {
+		if problems[i].Line != w.line || problems[i].Path != w.path {
+			t.Errorf("problem %d: expected %s at line %d, got %+v", i, w.path, w.line, problems[i])
+		}
+	}
+	if !strings.Contains(err.Error(), "test.yaml:18: routes[1].upstream: unknown upstream \"missing\"") {
+		t.Fatalf("unexpected error text:\n%v", err)
+	}
+	if len(gateway.Snapshot().Router.Routes()) != 0 {
+		t.Fatalf("an invalid config must not be applied")
+	}
+}
+
+func TestConfigRejectsDuplicateRoutes(t *testing.T) {
+	config, err := ParseConfig("test.yaml", []byte(`upstreams:
+  users:
+    targets: [{url: http://users}]
+routes:
+  - path: /users/{id}
+    upstream: users
+    methods: [GET]
+  - path: /users/{id}
+    upstream: users
+    methods: [GET]
+  - path: /users/{id}
+    upstream: users
+    methods: [GET, POST]
+`))
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	gateway := NewGateway()
+	err = gateway.ApplyConfig(config)
+	problems := configProblems(t, err)
+	want := []struct {
+		line    int
+		path    string
+		message string
+	}{
+		{8, "routes[1].path", "route GET /users/{id} duplicates route GET /users/{id} at routes[0] (line 5)"},
+		{11, "routes[2].path", "route GET,POST /users/{id} overlaps route GET /users/{id} at routes[0] (line 5)"},
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("expected %d problems, got %d:\n%v", len(want), len(problems), err)
+	}
+	for i, w := range want {
+		if problems[i].Line != w.line || problems[i].Path != w.path || problems[i].Message != w.message {
+			t.Errorf("problem %d: expected %s at line %d: %s, got %+v", i, w.path, w.line, w.message, problems[i])
+		}
+	}
+	if len(gateway.Snapshot().Router.Routes()) != 0 {
+		t.Fatalf("an invalid config must not be applied")
+	}
+}
+
+func TestConfigSwapKeepsInFlightRequests(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		fmt.Fprint(w, "old")
+	}))
+	defer slow.Close()
+	fresh := newBackend(t, "new")
+
+	gateway := NewGateway()
+	config := `
+upstreams:
+  api:
+    targets: [{url: %s}]
+routes:
+  - path: /api
+    upstream: api
+`
+	mustApplyConfig(t, gateway, fmt.Sprintf(config, slow.URL))
+	oldPool, _ := gateway.GetUpstream("api")
+
+	done := make(chan string)
+	go func() {
+		rec := httptest.NewRecorder()
+		gateway.HandleRequest(rec, httptest.NewRequest(http.MethodGet, "/api", nil))
+		done <- rec.Body.String()
+	}()
+	<-started
+
+	mustApplyConfig(t, gateway, fmt.Sprintf(config, fresh.URL))
+	rec := httptest.NewRecorder()
+	gateway.HandleRequest(rec, httptest.NewRequest(http.MethodGet, "/api", nil))
+	if rec.Body.String() != "new" {
+		t.Fatalf("expected new requests to use the new config, got %q", rec.Body.String())
+	}
+	close(release)
+	if body := <-done; body != "old" {
+		t.Fatalf("expected the in-flight request to finish on the old config, got %q", body)
+	}
+
+	// Reapplying an unchanged upstream keeps the same pool and its health state
+	mustApplyConfig(t, gateway, fmt.Sprintf(config, fresh.URL))
+	pool, _ := gateway.GetUpstream("api")
+	mustApplyConfig(t, gateway, fmt.Sprintf(config, fresh.URL))
+	if again, _ := gateway.GetUpstream("api"); again != pool || again == oldPool {
+		t.Fatalf("expected an unchanged upstream to be reused")
+	}
+}
+
+func writeConfig(t *testing.T, path, data string) {
+	t.Helper()
+	// Write then rename, as editors do, so the reloader never sees a half-written file
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(data), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatalf("rename config: %v", err)
+	}
+}
+
+func TestConfigReloader(t *testing.T) {
+	a, b := newBackend(t, "a"), newBackend(t, "b")
+	config := "upstreams:\n  api:\n    targets: [{url: %s}]\nroutes:\n  - path: /api\n    upstream: api\n"
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	writeConfig(t, path, fmt.Sprintf(config, a.URL))
+
+	gateway := NewGateway()
+	reloader := NewConfigReloader(gateway, path)
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	reloads := make(chan error, 10)
+	reloader.OnReload = func(err error) { reloads <- err }
+	if err := reloader.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer reloader.Close()
+
+	body := func() string {
+		rec := httptest.NewRecorder()
+		gateway.HandleRequest(rec, httptest.NewRequest(http.MethodGet, "/api", nil))
+		return rec.Body.String()
+	}
+	awaitReload := func(wantErr bool) {
+		t.Helper()
+		select {
+		case err := <-reloads:
+			if (err != nil) != wantErr {
+				t.Fatalf("unexpected reload result: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for reload")
+		}
+	}
+
+	writeConfig(t, path, fmt.Sprintf(config, b.URL))
+	awaitReload(false)
+	if got := body(); got != "b" {
+		t.Fatalf("expected reload on file change, got %q", got)
+	}
+
+	// A broken file is rejected and the last good config keeps serving
+	writeConfig(t, path, "routes:\n  - path: /api\n    upstream: nowhere\n")
+	awaitReload(true)
+	if got := body(); got != "b" {
+		t.Fatalf("expected previous config after a failed reload, got %q", got)
+	}
+
+	// SIGHUP reloads even without a file event
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(config, a.URL)), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	awaitReload(false)
+	writeConfig(t, path, fmt.Sprintf(config, b.URL))
+	awaitReload(false)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("kill: %v", err)
+	}
+	awaitReload(false)
+	if got := body(); got != "b" {
+		t.Fatalf("expected config after SIGHUP, got %q", got)
+	}
+}
+
+func checkDecision(t *testing.T, what string, d RateLimitDecision, err error, allowed bool, remaining int, retryAfter time.Duration) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+	if d.Allowed != allowed || d.Remaining != remaining {
+		t.Fatalf("%s: expected allowed=%v remaining=%d, got %+v", what, allowed, remaining, d)
+	}
+	if diff := d.RetryAfter - retryAfter; diff < -5*time.Millisecond || diff > 5*time.Millisecond {
+		t.Fatalf("%s: expected retry after %v, got %v", what, retryAfter, d.RetryAfter)
+	}
+}
+
+// testSlidingWindow checks that the window slides rather than resetting at fixed boundaries
+func testSlidingWindow(t *testing.T, store RateLimitStore, key string) {
+	ctx := context.Background()
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+
+	d, err := store.SlidingWindow(ctx, key, 3, time.Second, at(0))
+	checkDecision(t, "first", d, err, true, 2, 0)
+	d, err = store.SlidingWindow(ctx, key, 3, time.Second, at(500))
+	checkDecision(t, "second", d, err, true, 1, 0)
+	d, err = store.SlidingWindow(ctx, key, 3, time.Second, at(900))
+	checkDecision(t, "third", d, err, true, 0, 0)
+	d, err = store.SlidingWindow(ctx, key, 3, time.Second, at(950))
+	checkDecision(t, "over limit", d, err, false, 0, 50*time.Millisecond)
+
+	// Only the request at 0ms has left the window
+	d, err = store.SlidingWindow(ctx, key, 3, time.Second, at(1001))
+	checkDecision(t, "after oldest expires", d, err, true, 0, 0)
+	d, err = store.SlidingWindow(ctx, key, 3, time.Second, at(1100))
+	checkDecision(t, "still full", d, err, false, 0, 400*time.Millisecond)
+	if d.Reset != 400*time.Millisecond {
+		t.Fatalf("expected reset in 400ms, got %v", d.Reset)
+	}
+}
+
+// testTokenBucket checks bursts and fractional refill
+func testTokenBucket(t *testing.T, store RateLimitStore, key string) {
+	ctx := context.Background()
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+
+	d, err := store.TokenBucket(ctx, key, 2, 2, at(0))
+	checkDecision(t, "first", d, err, true, 1, 0)
+	d, err = store.TokenBucket(ctx, key, 2, 2, at(0))
+	checkDecision(t, "burst", d, err, true, 0, 0)
+	d, err = store.TokenBucket(ctx, key, 2, 2, at(100))
+	checkDecision(t, "empty", d, err, false, 0, 400*time.Millisecond)
+	d, err = store.TokenBucket(ctx, key, 2, 2, at(500))
+	checkDecision(t, "refilled one", d, err, true, 0, 0)
+	if d.Reset != time.Second {
+		t.Fatalf("expected bucket to be full in 1s, got %v", d.Reset)
+	}
+	d, err = store.TokenBucket(ctx, key, 2, 2, at(5000))
+	checkDecision(t, "capped at capacity", d, err, true, 1, 0)
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	testSlidingWindow(t, store, "sw")
+	testTokenBucket(t, store, "tb")
+
+	// Idle keys are swept once they have fully recovered
+	store.SlidingWindow(context.Background(), "idle", 1, time.Second, time.Now().Add(2*rateLimitSweepInterval))
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.windows) != 1 || len(store.buckets) != 0 {
+		t.Fatalf("expected only the fresh key to remain, got %d windows %d buckets", len(store.windows), len(store.buckets))
+	}
+}
+
+// TestRedisRateLimitStore runs against a real Redis when REDIS_ADDR is set
+func TestRedisRateLimitStore(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR not set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	defer client.Close()
+	store := NewRedisRateLimitStore(client, "gateway-test-"+time.Now().Format("150405.000000")+":")
+	testSlidingWindow(t, store, "sw")
+	testTokenBucket(t, store, "tb")
+}
+
+func TestNewRateLimiterValidation(t *testing.T) {
+	valid := []RateLimitConfig{
+		{MaxRequests: 1, WindowPeriod: time.Second},
+		{MaxRequests: 1, WindowPeriod: time.Second, Algorithm: TokenBucketAlgorithm, Burst: 5, Key: "jwt-sub"},
+		{MaxRequests: 1, WindowPeriod: time.Second, Key: "header:X-Tenant"},
+	}
+	for _, c := range valid {
+		if _, err := NewRateLimiter(c); err != nil {
+			t.Errorf("%+v: unexpected error %v", c, err)
+		}
+	}
+	invalid := []RateLimitConfig{
+		{MaxRequests: 0, WindowPeriod: time.Second},
+		{MaxRequests: 1, WindowPeriod: time.Second, Algorithm: "leaky"},
+		{MaxRequests: 1, WindowPeriod: time.Second, Burst: 5},
+		{MaxRequests: 1, WindowPeriod: time.Second, Key: "cookie"},
+		{MaxRequests: 1, WindowPeriod: time.Second, Key: "header:"},
+	}
+	for _, c := range invalid {
+		if _, err := NewRateLimiter(c); err == nil {
+			t.Errorf("%+v: expected an error", c)
+		}
+	}
+}
+
+func TestRateLimitPerConsumer(t *testing.T) {
+	backend := newBackend(t, "ok")
+	gateway := NewGateway()
+	gateway.AddUpstream(NewUpstreamPool("api", nil, newTestTarget(t, backend.URL, 1)))
+	err := gateway.AddRoutingPolicy("/api", RoutingPolicy{
+		Upstream:  "api",
+		RateLimit: &RateLimitConfig{MaxRequests: 2, WindowPeriod: time.Minute, Key: "api-key"},
+	})
+	if err != nil {
+		t.Fatalf("AddRoutingPolicy: %v", err)
+	}
+	send := func(apiKey, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api", nil)
+		req.RemoteAddr = remoteAddr
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		rec := httptest.NewRecorder()
+		gateway.HandleRequest(rec, req)
+		return rec
+	}
+
+	rec := send("alice", "10.0.0.1:1000")
+	if rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Limit") != "2" || rec.Header().Get("RateLimit-Remaining") != "1" ||
+		rec.Header().Get("RateLimit-Policy") != "2;w=60" {
+		t.Fatalf("unexpected first response %d %v", rec.Code, rec.Header())
+	}
+	send("alice", "10.0.0.2:1000")
+	rec = send("alice", "10.0.0.3:1000")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" || rec.Header().Get("RateLimit-Reset") != "60" {
+		t.Fatalf("expected alice to be limited across IPs, got %d %v", rec.Code, rec.Header())
+	}
+	if rec := send("bob", "10.0.0.1:1000"); rec.Code != http.StatusOK {
+		t.Fatalf("expected bob to have his own quota, got %d", rec.Code)
+	}
+
+	// Requests without a key are counted per client IP
+	send("", "10.0.0.9:1000")
+	send("", "10.0.0.9:2000")
+	if rec := send("", "10.0.0.9:3000"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected anonymous client to be limited by IP, got %d", rec.Code)
+	}
+	if rec := send("", "10.0.0.10:1000"); rec.Code != http.StatusOK {
+		t.Fatalf("expected another IP to have its own quota, got %d", rec.Code)
+	}
+}
+
+func TestRateLimitKeyExtractors(t *testing.T) {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user-7"}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.1:5555"
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Tenant", "acme")
+	if _, ok := jwtSubject(req); ok {
+		t.Fatalf("expected an unverified token's subject to be ignored")
+	}
+	req = withClaims(req, jwt.MapClaims{"sub": "user-7"})
+
+	for spec, want := range map[string]string{"route": "", "ip": "192.0.2.1", "jwt-sub": "user-7", "header:X-Tenant": "acme"} {
+		extractor, err := NewKeyExtractor(spec)
+		if err != nil {
+			t.Fatalf("%s: %v", spec, err)
+		}
+		if got, ok := extractor(req); !ok || got != want {
+			t.Errorf("%s: expected %q, got %q (%v)", spec, want, got, ok)
+		}
+	}
+	extractor, _ := NewKeyExtractor("api-key")
+	if _, ok := extractor(req); ok {
+		t.Fatalf("expected no API key")
+	}
+}
+
+func TestRateLimitIgnoresForgedSubjects(t *testing.T) {
+	backend := newBackend(t, "ok")
+	gateway := NewGateway()
+	gateway.AddUpstream(NewUpstreamPool("api", nil, newTestTarget(t, backend.URL, 1)))
+	err := gateway.AddRoutingPolicy("/api", RoutingPolicy{
+		Upstream:  "api",
+		RateLimit: &RateLimitConfig{MaxRequests: 1, WindowPeriod: time.Minute, Key: "jwt-sub"},
+	})
+	if err != nil {
+		t.Fatalf("AddRoutingPolicy: %v", err)
+	}
+	send := func(sub string) int {
+		token := signToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", jwt.MapClaims{"sub": sub})
+		req := httptest.NewRequest(http.MethodGet, "/api", nil)
+		req.RemoteAddr = "10.0.0.1:1000"
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		gateway.HandleRequest(rec, req)
+		return rec.Code
+	}
+	if code := send("forged-1"); code != http.StatusOK {
+		t.Fatalf("expected the first request to pass, got %d", code)
+	}
+	if code := send("forged-2"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected forged subjects to share the client's IP quota, got %d", code)
+	}
+}
+
+func TestRateLimitQuotaSurvivesReload(t *testing.T) {
+	backend := newBackend(t, "ok")
+	gateway := NewGateway()
+	config := fmt.Sprintf(`
+upstreams:
+  api:
+    targets: [{url: %s}]
+routes:
+  - path: /api
+    upstream: api
+    rate_limit: {algorithm: token-bucket, max_requests: 1, window: 1m}
+`, backend.URL)
+	mustApplyConfig(t, gateway, config)
+	send := func() int {
+		rec := httptest.NewRecorder()
+		gateway.HandleRequest(rec, httptest.NewRequest(http.MethodGet, "/api", nil))
+		return rec.Code
+	}
+	send()
+	mustApplyConfig(t, gateway, config)
+	if code := send(); code != http.StatusTooManyRequests {
+		t.Fatalf("expected the quota to carry over a reload, got %d", code)
+	}
+}
+
+const testIssuer, testAudience = "https://auth.test", "gateway"
+
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return signed
+}
+
+func validClaims(overrides jwt.MapClaims) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"sub":   "user-1",
+		"iss":   testIssuer,
+		"aud":   []string{"other", testAudience},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "users:read users:write",
+		"roles": []string{"admin"},
+		"email": "user-1@example.com",
+	}
+	for k, v := range overrides {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	return claims
+}
+
+// newAuthGateway routes /secure with the given policy and /open without
+// authentication to a backend that echoes the claim headers it receives
+func newAuthGateway(t *testing.T, auth AuthConfig, policy RoutingPolicy) *Gateway {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"subject": r.Header.Get(subjectHeader),
+			"scopes":  r.Header.Get(scopesHeader),
+			"roles":   r.Header.Get(rolesHeader),
+			"email":   r.Header.Get("X-User-Email"),
+		})
+	}))
+	t.Cleanup(backend.Close)
+
+	authenticator, err := NewAuthenticator(auth)
+	if err != nil {
+		t.Fatalf("NewAuthenticator: %v", err)
+	}
+	gateway := NewGateway()
+	gateway.SetAuthenticator(authenticator)
+	t.Cleanup(func() { authenticator.Stop() })
+	gateway.AddUpstream(NewUpstreamPool("api", nil, newTestTarget(t, backend.URL, 1)))
+	policy.Upstream = "api"
+	if err := gateway.AddRoutingPolicy("/secure", policy); err != nil {
+		t.Fatalf("AddRoutingPolicy: %v", err)
+	}
+	gateway.AddRoutingPolicy("/open", RoutingPolicy{Upstream: "api"})
+	return gateway
+}
+
+func sendWithToken(gateway *Gateway, path, authorization string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	rec := httptest.NewRecorder()
+	gateway.HandleRequest(rec, req)
+	return rec
+}
+
+func TestJWTAuthForwardsClaims(t *testing.T) {
+	secret := []byte("s3cret")
+	gateway := newAuthGateway(t, AuthConfig{
+		Issuer:        testIssuer,
+		Audience:      testAudience,
+		Keys:          []KeyConfig{{ID: "hs", Algorithm: "HS256", Secret: string(secret)}},
+		ForwardClaims: map[string]string{"email": "X-User-Email"},
+	}, RoutingPolicy{Scopes: []string{"users:read"}, Roles: []string{"admin", "support"}})
+
+	token := signToken(t, jwt.SigningMethodHS256, secret, "hs", validClaims(nil))
+	spoofed := http.Header{subjectHeader: {"admin"}, "X-User-Email": {"evil@example.com"}}
+	rec := sendWithToken(gateway, "/secure", "Bearer "+token, spoofed)
+	var got map[string]string
+	json.NewDecoder(rec.Body).Decode(&got)
+	if rec.Code != http.StatusOK || got["subject"] != "user-1" || got["email"] != "user-1@example.com" ||
+		got["scopes"] != "users:read users:write" || got["roles"] != "admin" {
+		t.Fatalf("unexpected response %d %v", rec.Code, got)
+	}
+
+	// Claim headers sent by clients never reach upstreams, even on open routes
+	rec = sendWithToken(gateway, "/open", "", spoofed)
+	got = nil
+	json.NewDecoder(rec.Body).Decode(&got)
+	if got["subject"] != "" || got["email"] != "" {
+		t.Fatalf("expected spoofed claim headers to be stripped, got %v", got)
+	}
+}
+
+func TestJWTAuthFailures(t *testing.T) {
+	secret := []byte("s3cret")
+	gateway := newAuthGateway(t, AuthConfig{
+		Issuer:   testIssuer,
+		Audience: testAudience,
+		Leeway:   30 * time.Second,
+		Keys:     []KeyConfig{{ID: "hs", Algorithm: "HS256", Secret: string(secret)}},
+	}, RoutingPolicy{Scopes: []string{"users:read"}, Roles: []string{"support"}})
+	hs := func(claims jwt.MapClaims) string {
+		return "Bearer " + signToken(t, jwt.SigningMethodHS256, secret, "hs", claims)
+	}
+	adminOK := jwt.MapClaims{"roles": "support"}
+
+	tests := []struct {
+		name, authorization string
+		status              int
+		code                string
+	}{
+		{"missing", "", 401, "missing_token"},
+		{"not bearer", "Basic dXNlcjpwYXNz", 401, "malformed_token"},
+		{"garbage", "Bearer not.a.jwt", 401, "malformed_token"},
+		{"wrong secret", "Bearer " + signToken(t, jwt.SigningMethodHS256, []byte("other"), "hs", validClaims(adminOK)), 401, "invalid_signature"},
+		{"unknown kid", "Bearer " + signToken(t, jwt.SigningMethodHS256, secret, "nope", validClaims(adminOK)), 401, "unknown_key"},
+		{"HS384", "Bearer " + signToken(t, jwt.SigningMethodHS384, secret, "hs", validClaims(adminOK)), 401, "unsupported_algorithm"},
+		{"none", "Bearer " + signToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "hs", validClaims(adminOK)), 401, "unsupported_algorithm"},
+		{"expired", hs(validClaims(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix(), "roles": "support"})), 401, "token_expired"},
+		{"no exp", hs(validClaims(jwt.MapClaims{"exp": nil, "roles": "support"})), 401, "token_expired"},
+		{"not yet valid", hs(validClaims(jwt.MapClaims{"nbf": time.Now().Add(time.Minute).Unix(), "roles": "support"})), 401, "token_not_yet_valid"},
+		{"wrong issuer", hs(validClaims(jwt.MapClaims{"iss": "https://evil", "roles": "support"})), 401, "invalid_issuer"},
+		{"wrong audience", hs(validClaims(jwt.MapClaims{"aud": "other", "roles": "support"})), 401, "invalid_audience"},
+		{"missing scope", hs(validClaims(jwt.MapClaims{"scope": "users:write", "roles": "support"})), 403, "insufficient_scope"},
+		{"missing role", hs(validClaims(nil)), 403, "insufficient_role"},
+		{"within leeway", hs(validClaims(jwt.MapClaims{"exp": time.Now().Add(-10 * time.Second).Unix(), "roles": "support"})), 200, ""},
+		{"scp list", hs(validClaims(jwt.MapClaims{"scope": nil, "scp": []string{"users:read"}, "roles": "support"})), 200, ""},
+	}
+	for _, tt := range tests {
+		rec := sendWithToken(gateway, "/secure", tt.authorization, nil)
+		if rec.Code != tt.status {
+			t.Errorf("%s: expected %d, got %d %s", tt.name, tt.status, rec.Code, rec.Body.String())
+			continue
+		}
+		if tt.code == "" {
+			continue
+		}
+		var body map[string]string
+		json.NewDecoder(rec.Body).Decode(&body)
+		if body["error"] != tt.code || body["message"] == "" {
+			t.Errorf("%s: expected error %q, got %v", tt.name, tt.code, body)
+		}
+		if rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: missing WWW-Authenticate header", tt.name)
+		}
+	}
+}
+
+func rsaJWK(kid string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"alg": "RS256",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func writeJWKS(t *testing.T, path string, keys ...map[string]string) {
+	t.Helper()
+	data, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		t.Fatalf("write jwks: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatalf("rename jwks: %v", err)
+	}
+}
+
+func TestJWKSRotation(t *testing.T) {
+	key1, _ := rsa.GenerateKey(cryptorand.Reader, 2048)
+	key2, _ := rsa.GenerateKey(cryptorand.Reader, 2048)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, rsaJWK("k1", key1))
+
+	gateway := newAuthGateway(t, AuthConfig{JWKSFile: path, JWKSRefresh: 20 * time.Millisecond}, RoutingPolicy{Authenticate: true})
+	rs := func(kid string, key *rsa.PrivateKey) string {
+		return "Bearer " + signToken(t, jwt.SigningMethodRS256, key, kid, validClaims(nil))
+	}
+	if rec := sendWithToken(gateway, "/secure", rs("k1", key1), nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected k1 to verify, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := sendWithToken(gateway, "/secure", rs("k2", key2), nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected unknown k2 to be rejected, got %d", rec.Code)
+	}
+
+	// An HS256 token "signed" with the RSA public key must not verify
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: mustMarshalPKIX(t, &key1.PublicKey)})
+	confused := "Bearer " + signToken(t, jwt.SigningMethodHS256, publicPEM, "k1", validClaims(nil))
+	if rec := sendWithToken(gateway, "/secure", confused, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected algorithm confusion to be rejected, got %d", rec.Code)
+	}
+
+	writeJWKS(t, path, rsaJWK("k2", key2))
+	waitFor(t, "JWKS reload", func() bool {
+		return sendWithToken(gateway, "/secure", rs("k2", key2), nil).Code == http.StatusOK
+	})
+	if rec := sendWithToken(gateway, "/secure", rs("k1", key1), nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected rotated-out k1 to be rejected, got %d", rec.Code)
+	}
+
+	// A broken JWKS file keeps the last good keys
+	os.WriteFile(path, []byte("{"), 0o644)
+	time.Sleep(100 * time.Millisecond)
+	if rec := sendWithToken(gateway, "/secure", rs("k2", key2), nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected last good keys after a failed reload, got %d", rec.Code)
+	}
+}
+
+func mustMarshalPKIX(t *testing.T, key *rsa.PublicKey) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	return der
+}
+
+func TestStaticRSAKeyFromConfig(t *testing.T) {
+	key, _ := rsa.GenerateKey(cryptorand.Reader, 2048)
+	dir := t.TempDir()
+	pemFile := filepath.Join(dir, "public.pem")
+	os.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: mustMarshalPKIX(t, &key.PublicKey)}), 0o644)
+	backend := newBackend(t, "ok")
+
+	gateway := NewGateway()
+	config := fmt.Sprintf(`
+upstreams:
+  api:
+    targets: [{url: %s}]
+routes:
+  - path: /admin
+    upstream: api
+    roles: [admin]
+auth:
+  keys:
+    - {alg: RS256, public_key_file: %s}
+`, backend.URL, pemFile)
+	mustApplyConfig(t, gateway, config)
+
+	token := signToken(t, jwt.SigningMethodRS256, key, "", validClaims(nil))
+	if rec := sendWithToken(gateway, "/admin", "Bearer "+token, nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected RS256 token to verify, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Routes that need authentication require an auth section
+	parsed, _ := ParseConfig("test.yaml", []byte(strings.Split(config, "auth:")[0]))
+	if err := NewGateway().ApplyConfig(parsed); err == nil || !strings.Contains(err.Error(), "no auth section") {
+		t.Fatalf("expected missing auth section error, got %v", err)
+	}
+	parsed, _ = ParseConfig("test.yaml", []byte(config+"    - {alg: RS256}\n"))
+	if err := NewGateway().ApplyConfig(parsed); err == nil || !strings.Contains(err.Error(), "public_key_file") {
+		t.Fatalf("expected invalid key error, got %v", err)
+	}
+}
+
+// newRetryGateway routes /api to pool with the given timeout and retries
+func newRetryGateway(t *testing.T, pool *UpstreamPool, timeout time.Duration, retry *RetryConfig) (*Gateway, *httptest.Server) {
+	t.Helper()
+	gateway := NewGateway()
+	gateway.AddUpstream(pool)
+	if err := gateway.AddRoutingPolicy("/api", RoutingPolicy{Upstream: pool.Name, Timeout: timeout, Retry: retry}); err != nil {
+		t.Fatalf("AddRoutingPolicy: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(gateway.HandleRequest))
+	t.Cleanup(server.Close)
+	return gateway, server
+}
+
+func routeStats(t *testing.T, gateway *Gateway) RouteStatus {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	gateway.RoutesHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/routes", nil))
+	var report struct {
+		Routes []RouteStatus `json:"routes"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil || len(report.Routes) != 1 {
+		t.Fatalf("unexpected routes report %q: %v", rec.Body.String(), err)
+	}
+	return report.Routes[0]
+}
+
+func TestRetriesRetryableStatuses(t *testing.T) {
+	var calls int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if atomic.AddInt64(&calls, 1)%3 != 0 {
+			w.Header().Set("X-Failed", "yes")
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "%s %s", r.Method, body)
+	}))
+	defer backend.Close()
+	pool := NewUpstreamPool("api", nil, newTestTarget(t, backend.URL, 1))
+	gateway, gw := newRetryGateway(t, pool, 0, &RetryConfig{Attempts: 2, BaseBackoff: time.Millisecond})
+
+	// The body is replayed and headers of discarded attempts are dropped
+	req, _ := http.NewRequest(http.MethodPut, gw.URL+"/api", strings.NewReader("payload"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PUT: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "PUT payload" || resp.Header.Get("X-Failed") != "" {
+		t.Fatalf("expected the third attempt's response, got %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+
+	// POST is not idempotent, so its failure is returned as is
+	resp, err = http.Post(gw.URL+"/api", "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || atomic.LoadInt64(&calls) != 4 {
+		t.Fatalf("expected one unretried POST, got %d after %d calls", resp.StatusCode, calls)
+	}
+
+	if stats := routeStats(t, gateway); stats.Requests != 2 || stats.Retries != 2 || stats.Breaker != "disabled" {
+		t.Fatalf("unexpected route stats %+v", stats)
+	}
+}
+
+func TestRetriesConnectErrors(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadTarget := newTestTarget(t, dead.URL, 1)
+	dead.Close()
+	live := newBackend(t, "live")
+	pool := NewUpstreamPool("api", nil, deadTarget, newTestTarget(t, live.URL, 1))
+	_, gw := newRetryGateway(t, pool, 0, &RetryConfig{Attempts: 1, RetryOn: []string{"connect-error"}, BaseBackoff: time.Millisecond})
+
+	for i := 0; i < 4; i++ {
+		if body := get(t, gw.URL+"/api", nil); body != "live" {
+			t.Fatalf("request %d: expected the retry to reach the live target, got %q", i, body)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget := &retryBudget{ratio: 0.5}
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		budget.recordRequest(now)
+	}
+	for i := 0; i < 5; i++ {
+		if !budget.withdraw(now) {
+			t.Fatalf("retry %d should fit in the budget", i)
+		}
+	}
+	if budget.withdraw(now) {
+		t.Fatalf("expected the budget to be exhausted")
+	}
+	// Requests and retries roll out of the window, leaving no budget at all
+	later := now.Add(retryBudgetWindow * time.Second)
+	budget.recordRequest(later)
+	budget.recordRequest(later)
+	if !budget.withdraw(later) || budget.withdraw(later) {
+		t.Fatalf("expected the budget to be counted over a rolling window")
+	}
+
+	var calls int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer backend.Close()
+	pool := NewUpstreamPool("api", nil, newTestTarget(t, backend.URL, 1))
+	gateway, gw := newRetryGateway(t, pool, 0, &RetryConfig{Attempts: 3, BaseBackoff: time.Millisecond, BudgetRatio: 0.01, MinRetriesPerSecond: 1})
+	for i := 0; i < 5; i++ {
+		get(t, gw.URL+"/api", nil)
+	}
+	// One retry per second over the window, plus 1% of 5 requests, is allowed
+	if stats := routeStats(t, gateway); stats.Retries != retryBudgetWindow+1 || stats.BudgetExhausted == 0 || atomic.LoadInt64(&calls) != 5+retryBudgetWindow+1 {
+		t.Fatalf("expected retries to stop at the budget, got %+v after %d calls", stats, calls)
+	}
+}
+
+func TestRouteTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer backend.Close()
+	pool := NewUpstreamPool("api", nil, newTestTarget(t, backend.URL, 1))
+	gateway, gw := newRetryGateway(t, pool, 50*time.Millisecond, &RetryConfig{Attempts: 3})
+
+	start := time.Now()
+	resp, err := http.Get(gw.URL + "/api")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout || time.Since(start) > 2*time.Second {
+		t.Fatalf("expected 504 after the route timeout, got %d after %v", resp.StatusCode, time.Since(start))
+	}
+	if stats := routeStats(t, gateway); stats.Timeouts != 1 || stats.Retries != 0 {
+		t.Fatalf("unexpected route stats %+v", stats)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var failing atomic.Bool
+	var calls int64
+	failing.Store(true)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+	pool := NewUpstreamPool("api", nil, newTestTarget(t, backend.URL, 1))
+	pool.EnableCircuitBreaker(BreakerConfig{ConsecutiveFailures: 2, OpenTimeout: 100 * time.Millisecond})
+	gateway, gw := newRetryGateway(t, pool, 0, &RetryConfig{Attempts: 2, RetryOn: []string{"503"}, BaseBackoff: time.Millisecond})
+
+	status := func() int {
+		resp, err := http.Get(gw.URL + "/api")
+		if err != nil {
+			t.Fatalf("GET: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	status()
+	status()
+	// Rejections by an open breaker are not retried
+	if code := status(); code != http.StatusServiceUnavailable || atomic.LoadInt64(&calls) != 2 {
+		t.Fatalf("expected the open breaker to reject without calling the backend, got %d after %d calls", code, calls)
+	}
+	if stats := routeStats(t, gateway); stats.Breaker != "open" || stats.BreakerRejected != 1 || stats.Retries != 0 {
+		t.Fatalf("unexpected route stats %+v", stats)
+	}
+
+	failing.Store(false)
+	time.Sleep(150 * time.Millisecond)
+	if stats := routeStats(t, gateway); stats.Breaker != "half-open" {
+		t.Fatalf("expected half-open breaker after the timeout, got %+v", stats)
+	}
+	if code := status(); code != http.StatusOK {
+		t.Fatalf("expected the probe to succeed, got %d", code)
+	}
+	if stats := routeStats(t, gateway); stats.Breaker != "closed" {
+		t.Fatalf("expected a successful probe to close the breaker, got %+v", stats)
+	}
+}
+
+// brokenWriter is a client connection that fails once the response body is written
+type brokenWriter struct {
+	header http.Header
+}
+
+func (w *brokenWriter) Header() http.Header       { return w.header }
+func (w *brokenWriter) WriteHeader(int)           {}
+func (w *brokenWriter) Write([]byte) (int, error) { return 0, errors.New("client went away") }
+
+func TestCircuitBreakerCountsAbortedRequests(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+	pool := NewUpstreamPool("api", nil, newTestTarget(t, backend.URL, 1))
+	pool.EnableCircuitBreaker(BreakerConfig{ConsecutiveFailures: 1, OpenTimeout: 50 * time.Millisecond})
+	serve := func(w http.ResponseWriter) {
+		// The proxy only panics on copy errors when served by an http.Server
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), http.ServerContextKey, &http.Server{}))
+		pool.ServeHTTP(w, r)
+	}
+
+	serve(httptest.NewRecorder())
+	failing.Store(false)
+	time.Sleep(60 * time.Millisecond)
+	if state := pool.BreakerState(); state != "half-open" {
+		t.Fatalf("expected a half-open breaker, got %s", state)
+	}
+
+	// The client disconnects while the probe's body is copied
+	func() {
+		defer func() {
+			if p := recover(); p != http.ErrAbortHandler {
+				t.Fatalf("expected the proxy to abort the handler, got %v", p)
+			}
+		}()
+		serve(&brokenWriter{header: make(http.Header)})
+	}()
+	if state := pool.BreakerState(); state != "open" {
+		t.Fatalf("expected the aborted probe to count as a failure, got %s", state)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	rec := httptest.NewRecorder()
+	serve(rec)
+	if rec.Code != http.StatusOK || pool.BreakerState() != "closed" {
+		t.Fatalf("expected the next probe to close the breaker, got %d and %s", rec.Code, pool.BreakerState())
+	}
+}
+
+func TestResilienceConfig(t *testing.T) {
+	config, err := ParseConfig("test.yaml", []byte(`upstreams:
+  users:
+    targets: [{url: http://localhost:9001}]
+    circuit_breaker: {consecutive_failures: 3, open_timeout: -1s}
+routes:
+  - path: /users
+    upstream: users
+    timeout: -1s
+  - path: /orders
+    upstream: users
+    retry: {attempts: 2, retry_on: [connect-error, "404"]}
+`))
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	problems := configProblems(t, NewGateway().ApplyConfig(config))
+	want := []string{"upstreams.users.circuit_breaker.open_timeout", "routes[0].timeout", "routes[1].retry"}
+	if len(problems) != len(want) {
+		t.Fatalf("expected %d problems, got %+v", len(want), problems)
+	}
+	for i, path := range want {
+		if problems[i].Path != path {
+			t.Errorf("problem %d: expected %s, got %+v", i, path, problems[i])
+		}
+	}
+}
+
+func adminRequest(t *testing.T, admin http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rec
+}
+
+func TestAdminRouteCRUD(t *testing.T) {
+	gateway := NewGateway()
+	gateway.AddUpstream(NewUpstreamPool("v1", nil, newTestTarget(t, newBackend(t, "v1").URL, 1)))
+	gateway.AddUpstream(NewUpstreamPool("v2", nil, newTestTarget(t, newBackend(t, "v2").URL, 1)))
+	gateway.AddMiddleware("logger", loggerMiddleware)
+	admin := gateway.AdminHandler()
+	gw := httptest.NewServer(http.HandlerFunc(gateway.HandleRequest))
+	defer gw.Close()
+
+	if rec := adminRequest(t, admin, http.MethodPost, "/admin/routes", `{"path": "/api/{id}", "upstream": "v1", "middleware": ["logger"], "timeout": "2s"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d %s", rec.Code, rec.Body.String())
+	}
+	if body := get(t, gw.URL+"/api/7", nil); body != "v1" {
+		t.Fatalf("expected the added route to serve, got %q", body)
+	}
+
+	rejected := []struct {
+		method, body string
+		status       int
+	}{
+		{http.MethodPost, `{"path": "/api/{name}", "upstream": "v1"}`, http.StatusConflict},
+		{http.MethodPost, `{"path": "/api/{id}", "upstream": "v2"}`, http.StatusConflict},
+		{http.MethodPost, `{"path": "/other", "upstream": "missing"}`, http.StatusBadRequest},
+		{http.MethodPost, `{"path": "/other", "upstream": "v1", "middleware": ["nope"]}`, http.StatusBadRequest},
+		{http.MethodPost, `{"path": "/other", "upstream": "v1", "upstrem": "v2"}`, http.StatusBadRequest},
+		{http.MethodPost, `{"path": "/other", "upstream": "v1", "scopes": ["read"]}`, http.StatusBadRequest},
+		{http.MethodPut, `{"path": "/missing", "upstream": "v1"}`, http.StatusNotFound},
+	}
+	for _, tc := range rejected {
+		if rec := adminRequest(t, admin, tc.method, "/admin/routes", tc.body); rec.Code != tc.status || !strings.Contains(rec.Body.String(), `"error"`) {
+			t.Errorf("%s %s: expected %d with an error, got %d %s", tc.method, tc.body, tc.status, rec.Code, rec.Body.String())
+		}
+	}
+
+	if rec := adminRequest(t, admin, http.MethodPut, "/admin/routes", "path: /api/{id}\nupstream: v2\n"); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d %s", rec.Code, rec.Body.String())
+	}
+	if body := get(t, gw.URL+"/api/7", nil); body != "v2" {
+		t.Fatalf("expected the updated route to serve, got %q", body)
+	}
+
+	var report struct {
+		Routes []RouteStatus `json:"routes"`
+	}
+	rec := adminRequest(t, admin, http.MethodGet, "/admin/routes", "")
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil || len(report.Routes) != 1 {
+		t.Fatalf("unexpected routes report: %v %+v", err, report)
+	}
+	if r := report.Routes[0]; r.Path != "/api/{id}" || r.Upstream != "v2" || len(r.Middleware) != 0 || r.Requests != 1 {
+		t.Fatalf("unexpected route status %+v", r)
+	}
+
+	if rec := adminRequest(t, admin, http.MethodDelete, "/admin/routes?path=/api/{id}", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	if rec := adminRequest(t, admin, http.MethodDelete, "/admin/routes?path=/api/{id}", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a deleted route, got %d", rec.Code)
+	}
+	if body := get(t, gw.URL+"/api/7", nil); !strings.Contains(body, "No matching route") {
+		t.Fatalf("expected the deleted route to be gone, got %q", body)
+	}
+}
+
+func TestAdminRateLimitCounters(t *testing.T) {
+	gateway := NewGateway()
+	gateway.AddUpstream(NewUpstreamPool("api", nil, newTestTarget(t, newBackend(t, "ok").URL, 1)))
+	gateway.AddRoutingPolicy("/api", RoutingPolicy{Upstream: "api", RateLimit: &RateLimitConfig{MaxRequests: 3, WindowPeriod: time.Minute, Key: "api-key"}})
+	gateway.AddRoutingPolicy("/bucket", RoutingPolicy{Upstream: "api", RateLimit: &RateLimitConfig{MaxRequests: 1, WindowPeriod: time.Hour, Algorithm: TokenBucketAlgorithm, Burst: 5}})
+	for _, key := range []string{"alice", "alice", "bob"} {
+		req := httptest.NewRequest(http.MethodGet, "/api", nil)
+		req.Header.Set("X-API-Key", key)
+		gateway.HandleRequest(httptest.NewRecorder(), req)
+	}
+	gateway.HandleRequest(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/bucket", nil))
+
+	var report struct {
+		Routes []RateLimitStatus `json:"routes"`
+	}
+	rec := adminRequest(t, gateway.AdminHandler(), http.MethodGet, "/admin/ratelimits", "")
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil || len(report.Routes) != 2 {
+		t.Fatalf("unexpected rate limit report %q: %v", rec.Body.String(), err)
+	}
+	byRoute := make(map[string]RateLimitStatus)
+	for _, r := range report.Routes {
+		byRoute[r.Route] = r
+	}
+	api := byRoute["/api"]
+	want := []RateLimitCounterStatus{{Key: "api-key:alice", Limit: 3, Remaining: 1, ResetSeconds: 60}, {Key: "api-key:bob", Limit: 3, Remaining: 2, ResetSeconds: 60}}
+	if api.Algorithm != SlidingWindowAlgorithm || api.Window != "1m0s" || len(api.Counters) != 2 || api.Counters[0] != want[0] || api.Counters[1] != want[1] {
+		t.Fatalf("unexpected sliding window counters %+v", api)
+	}
+	bucket := byRoute["/bucket"]
+	if len(bucket.Counters) != 1 || bucket.Counters[0].Remaining != 4 || bucket.Counters[0].Limit != 5 || !strings.HasPrefix(bucket.Counters[0].Key, "route:") {
+		t.Fatalf("unexpected token bucket counters %+v", bucket)
+	}
+
+	// Stores that cannot list counters are reported as such
+	gateway.SetRateLimitStore(NewRedisRateLimitStore(redis.NewClient(&redis.Options{Addr: "127.0.0.1:0"}), "test:"))
+	if rec := adminRequest(t, gateway.AdminHandler(), http.MethodGet, "/admin/ratelimits", ""); rec.Code != http.StatusNotImplemented {
+		t.Fatalf("expected 501 for a store without inspection, got %d", rec.Code)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadTarget := newTestTarget(t, dead.URL, 1)
+	dead.Close()
+	gateway := NewGateway()
+	gateway.AddUpstream(NewUpstreamPool("api", nil, newTestTarget(t, newBackend(t, "ok").URL, 1)))
+	gateway.AddUpstream(NewUpstreamPool("dead", nil, deadTarget))
+	gateway.AddRoutingPolicy("/api", RoutingPolicy{Upstream: "api", Methods: []string{"GET"}, RateLimit: &RateLimitConfig{MaxRequests: 2, WindowPeriod: time.Minute}})
+	gateway.AddRoutingPolicy("/dead", RoutingPolicy{Upstream: "dead"})
+
+	for i := 0; i < 3; i++ {
+		gateway.HandleRequest(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api", nil))
+	}
+	gateway.HandleRequest(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/dead", nil))
+	gateway.HandleRequest(httptest.NewRecorder(), httptest.NewRequest("BREW", "/nowhere", nil))
+
+	rec := adminRequest(t, gateway.AdminHandler(), http.MethodGet, "/metrics", "")
+	metrics := rec.Body.String()
+	for _, want := range []string{
+		`gateway_requests_total{method="GET",route="GET /api",status_class="2xx"} 2`,
+		`gateway_requests_total{method="GET",route="GET /api",status_class="4xx"} 1`,
+		`gateway_requests_total{method="GET",route="/dead",status_class="5xx"} 1`,
+		`gateway_requests_total{method="OTHER",route="unmatched",status_class="4xx"} 1`,
+		`gateway_request_duration_seconds_count{route="GET /api"} 3`,
+		`gateway_rate_limit_rejections_total{route="GET /api"} 1`,
+		`gateway_upstream_errors_total{reason="connect",upstream="dead"} 1`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("expected metrics to contain %s", want)
+		}
+	}
+	if t.Failed() {
+		t.Log(metrics)
+	}
+}
+
+// newTransformGateway routes /{path...} to backend through middleware built from config
+func newTransformGateway(t *testing.T, backend *httptest.Server, middleware string) *Gateway {
+	t.Helper()
+	gateway := NewGateway()
+	mustApplyConfig(t, gateway, fmt.Sprintf(`
+upstreams:
+  api:
+    targets: [{url: %s}]
+middleware:
+%s
+routes:
+  - path: /{path...}
+    upstream: api
+    middleware: [transform]
+`, backend.URL, middleware))
+	return gateway
+}
+
+func TestHeadersMiddleware(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "legacy/1.0")
+		w.Header().Set("X-Seen", r.Header.Get("X-Client")+"|"+r.Header.Get("X-Debug")+"|"+strings.Join(r.Header.Values("X-Tag"), ","))
+	}))
+	defer backend.Close()
+	gateway := newTransformGateway(t, backend, `  transform:
+    type: headers
+    params:
+      request_set: {X-Client: gateway}
+      request_add: {X-Tag: added}
+      request_remove: [X-Debug]
+      response_set: {X-Frame-Options: DENY}
+      response_remove: [Server]`)
+
+	req := httptest.NewRequest(http.MethodGet, "/users", nil)
+	req.Header.Set("X-Client", "spoofed")
+	req.Header.Set("X-Debug", "1")
+	req.Header.Set("X-Tag", "original")
+	rec := httptest.NewRecorder()
+	gateway.HandleRequest(rec, req)
+
+	if seen := rec.Header().Get("X-Seen"); seen != "gateway||original,added" {
+		t.Fatalf("unexpected request headers at the backend: %q", seen)
+	}
+	if rec.Header().Get("Server") != "" || rec.Header().Get("X-Frame-Options") != "DENY" {
+		t.Fatalf("unexpected response headers %v", rec.Header())
+	}
+	if req.Header.Get("X-Client") != "spoofed" {
+		t.Fatalf("the caller's request must not be modified")
+	}
+}
+
+func TestPathAndQueryMiddleware(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.RequestURI())
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		params, target, want string
+	}{
+		{`{strip_prefix: /legacy/}`, "/legacy/users/7", "/users/7"},
+		{`{strip_prefix: /legacy}`, "/legacy", "/"},
+		{`{strip_prefix: /legacy}`, "/legacyusers", "/legacyusers"},
+		{`{regex: "^/v1/users/([0-9]+)$", replacement: "/users/$1/profile"}`, "/v1/users/42", "/users/42/profile"},
+		{`{strip_prefix: /api, regex: "^/old/", replacement: "/new/"}`, "/api/old/x", "/new/x"},
+	}
+	for _, tc := range tests {
+		gateway := newTransformGateway(t, backend, "  transform:\n    type: path-rewrite\n    params: "+tc.params)
+		rec := httptest.NewRecorder()
+		gateway.HandleRequest(rec, httptest.NewRequest(http.MethodGet, tc.target, nil))
+		if rec.Body.String() != tc.want {
+			t.Errorf("%s on %s: expected %s, got %s", tc.params, tc.target, tc.want, rec.Body.String())
+		}
+	}
+
+	gateway := newTransformGateway(t, backend, `  transform:
+    type: query-map
+    params:
+      rename: {q: search, p: page}
+      set: {format: json}
+      remove: [debug]`)
+	rec := httptest.NewRecorder()
+	gateway.HandleRequest(rec, httptest.NewRequest(http.MethodGet, "/find?q=go&p=2&debug=1&format=xml", nil))
+	if want := "/find?format=json&page=2&search=go"; rec.Body.String() != want {
+		t.Fatalf("expected %s, got %s", want, rec.Body.String())
+	}
+}
+
+func TestJSONBodyMiddleware(t *testing.T) {
+	var received atomic.Value
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received.Store(fmt.Sprintf("%d %s", r.ContentLength, body))
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("ETag", `"v1"`)
+		response := `{"full_name": "Ada Lovelace", "internal_id": 12345678901234567890, "address": {"zip": "N1"}}`
+		if r.URL.Path == "/list" {
+			response = "[" + response + ", " + response + "]"
+		}
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			io.WriteString(zw, response)
+			zw.Close()
+			return
+		}
+		io.WriteString(w, response)
+	}))
+	defer backend.Close()
+	gateway := newTransformGateway(t, backend, `  transform:
+    type: json-body
+    params:
+      request_rename: {userName: user.name}
+      request_remove: [password]
+      response_rename: {full_name: name, address.zip: postcode}
+      response_remove: [internal_id]`)
+	server := httptest.NewServer(http.HandlerFunc(gateway.HandleRequest))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/users", strings.NewReader(`{"userName": "ada", "password": "secret", "age": 36}`))
+	req.Header.Set("Content-Type", "application/json")
+	// Ask for an unencoded response; the transport would otherwise request gzip and hide it
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	wantRequest := `{"age":36,"user":{"name":"ada"}}`
+	if got := received.Load().(string); got != fmt.Sprintf("%d %s", len(wantRequest), wantRequest) {
+		t.Fatalf("unexpected request at the backend: %s", got)
+	}
+	wantResponse := `{"address":{},"name":"Ada Lovelace","postcode":"N1"}`
+	if string(body) != wantResponse || resp.ContentLength != int64(len(wantResponse)) || resp.Header.Get("ETag") != "" {
+		t.Fatalf("unexpected response %d %q %v", resp.ContentLength, body, resp.Header)
+	}
+
+	// Gzip-encoded arrays are decompressed, rewritten and compressed again
+	req, _ = http.NewRequest(http.MethodGet, server.URL+"/list", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	compressed, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" || resp.ContentLength != int64(len(compressed)) {
+		t.Fatalf("expected a gzip response with a matching length, got %d bytes and %v", len(compressed), resp.Header)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	plain, _ := io.ReadAll(zr)
+	if want := "[" + wantResponse + "," + wantResponse + "]"; string(plain) != want {
+		t.Fatalf("expected %s, got %s", want, plain)
+	}
+
+	// Bodies that are not JSON are left alone
+	req, _ = http.NewRequest(http.MethodPost, server.URL+"/users", strings.NewReader(`{"password": "x"}`))
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	resp.Body.Close()
+	if got := received.Load().(string); got != `17 {"password": "x"}` {
+		t.Fatalf("expected a text body to pass through, got %s", got)
+	}
+}
+
+func TestTransformMiddlewareValidation(t *testing.T) {
+	tests := []struct {
+		middleware, want string
+	}{
+		{"{type: headers, params: {request_sett: {A: b}}}", "unknown parameters request_sett"},
+		{"{type: headers, params: {request_remove: X-A}}", "must be a list of strings"},
+		{"{type: path-rewrite, params: {}}", "strip_prefix"},
+		{"{type: path-rewrite, params: {regex: '('}}", "regex"},
+		{"{type: path-rewrite, params: {replacement: /x}}", "requires \"regex\""},
+		{"{type: query-map, params: {rename: {a: 1}}}", "must be a map of strings"},
+		{"{type: json-body, params: {}}", "at least one"},
+	}
+	for _, tc := range tests {
+		config, err := ParseConfig("test.yaml", []byte("upstreams:\n  api:\n    targets: [{url: http://localhost:9001}]\nmiddleware:\n  transform: "+tc.middleware+"\n"))
+		if err != nil {
+			t.Fatalf("ParseConfig: %v", err)
+		}
+		err = NewGateway().ApplyConfig(config)
+		if err == nil || !strings.Contains(err.Error(), "middleware.transform.params") || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected an error mentioning %q, got %v", tc.middleware, tc.want, err)
+		}
+	}
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxTransformBodyBytes is the largest body the json-body middleware buffers.
+// Larger bodies are passed through unchanged.
+const maxTransformBodyBytes = 10 << 20
+
+// checkParams rejects parameters a middleware type does not know, so typos
+// in the config file are reported instead of silently ignored.
+func checkParams(params map[string]interface{}, known ...string) error {
+	var unknown []string
+	for name := range params {
+		if !contains(known, name) {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return fmt.Errorf("unknown parameters %s, expected some of %s", strings.Join(unknown, ", "), strings.Join(known, ", "))
+}
+
+// headerRules add, set and remove headers. Removal runs first, so a header
+// can be replaced by removing it and adding it back.
+type headerRules struct {
+	set    map[string]string
+	add    map[string]string
+	remove []string
+}
+
+func (h headerRules) empty() bool {
+	return len(h.set) == 0 && len(h.add) == 0 && len(h.remove) == 0
+}
+
+func (h headerRules) apply(header http.Header) {
+	for _, name := range h.remove {
+		header.Del(name)
+	}
+	for name, value := range h.set {
+		header.Set(name, value)
+	}
+	for name, value := range h.add {
+		header.Add(name, value)
+	}
+}
+
+func headerRulesParams(params map[string]interface{}, prefix string) (headerRules, error) {
+	var rules headerRules
+	var err error
+	if rules.set, err = stringMapParam(params, prefix+"_set"); err != nil {
+		return rules, err
+	}
+	if rules.add, err = stringMapParam(params, prefix+"_add"); err != nil {
+		return rules, err
+	}
+	rules.remove, err = stringListParam(params, prefix+"_remove")
+	return rules, err
+}
+
+// newHeadersMiddleware builds the "headers" middleware type. The parameters
+// request_set, request_add, response_set and response_add map header names
+// to values; request_remove and response_remove list headers to drop.
+func newHeadersMiddleware(params map[string]interface{}) (Middleware, error) {
+	if err := checkParams(params, "request_set", "request_add", "request_remove", "response_set", "response_add", "response_remove"); err != nil {
+		return nil, err
+	}
+	request, err := headerRulesParams(params, "request")
+	if err != nil {
+		return nil, err
+	}
+	response, err := headerRulesParams(params, "response")
+	if err != nil {
+		return nil, err
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !request.empty() {
+				r = r.Clone(r.Context())
+				request.apply(r.Header)
+			}
+			if !response.empty() {
+				w = &headerWriter{ResponseWriter: w, rules: response}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// headerWriter applies header rules just before the response header is sent.
+type headerWriter struct {
+	http.ResponseWriter
+	rules       headerRules
+	wroteHeader bool
+}
+
+func (w *headerWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status >= 200 {
+		w.wroteHeader = true
+		w.rules.apply(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// newPathRewriteMiddleware builds the "path-rewrite" middleware type.
+// strip_prefix removes a leading path prefix; regex and replacement then
+// rewrite the path with regexp.ReplaceAllString, so replacement may use $1.
+func newPathRewriteMiddleware(params map[string]interface{}) (Middleware, error) {
+	if err := checkParams(params, "strip_prefix", "regex", "replacement"); err != nil {
+		return nil, err
+	}
+	stripPrefix, err := stringParam(params, "strip_prefix")
+	if err != nil {
+		return nil, err
+	}
+	expr, err := stringParam(params, "regex")
+	if err != nil {
+		return nil, err
+	}
+	replacement, err := stringParam(params, "replacement")
+	if err != nil {
+		return nil, err
+	}
+	var pattern *regexp.Regexp
+	if expr != "" {
+		if pattern, err = regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("parameter \"regex\": %v", err)
+		}
+	} else if _, ok := params["replacement"]; ok {
+		return nil, fmt.Errorf("parameter \"replacement\" requires \"regex\"")
+	}
+	if stripPrefix == "" && pattern == nil {
+		return nil, fmt.Errorf("one of \"strip_prefix\" or \"regex\" is required")
+	}
+	stripPrefix = strings.TrimSuffix(stripPrefix, "/")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path := r.URL.Path
+			// Only strip whole segments, so /api does not strip /apiary
+			if stripPrefix != "" && (path == stripPrefix || strings.HasPrefix(path, stripPrefix+"/")) {
+				path = strings.TrimPrefix(path, stripPrefix)
+			}
+			if pattern != nil {
+				path = pattern.ReplaceAllString(path, replacement)
+			}
+			if !strings.HasPrefix(path, "/") {
+				path = "/" + path
+			}
+			if path != r.URL.Path {
+				r = r.Clone(r.Context())
+				r.URL.Path, r.URL.RawPath = path, ""
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// newQueryMapMiddleware builds the "query-map" middleware type. rename maps
+// old parameter names to new ones, set gives parameters fixed values and
+// remove lists parameters to drop. They are applied in that order.
+func newQueryMapMiddleware(params map[string]interface{}) (Middleware, error) {
+	if err := checkParams(params, "rename", "set", "remove"); err != nil {
+		return nil, err
+	}
+	rename, err := stringMapParam(params, "rename")
+	if err != nil {
+		return nil, err
+	}
+	set, err := stringMapParam(params, "set")
+	if err != nil {
+		return nil, err
+	}
+	remove, err := stringListParam(params, "remove")
+	if err != nil {
+		return nil, err
+	}
+	if len(rename) == 0 && len(set) == 0 && len(remove) == 0 {
+		return nil, fmt.Errorf("one of \"rename\", \"set\" or \"remove\" is required")
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query := r.URL.Query()
+			for from, to := range rename {
+				if values, ok := query[from]; ok {
+					delete(query, from)
+					query[to] = append(query[to], values...)
+				}
+			}
+			for name, value := range set {
+				query.Set(name, value)
+			}
+			for _, name := range remove {
+				query.Del(name)
+			}
+			r = r.Clone(r.Context())
+			r.URL.RawQuery = query.Encode()
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// jsonRules rename and remove fields of JSON objects. Field names are dotted
+// paths into nested objects, such as "user.name". Renames run first and may
+// move a field to another path. A top-level array has the rules applied to
+// each of its objects.
+type jsonRules struct {
+	rename map[string]string
+	remove []string
+}
+
+func (j jsonRules) empty() bool {
+	return len(j.rename) == 0 && len(j.remove) == 0
+}
+
+func jsonRulesParams(params map[string]interface{}, prefix string) (jsonRules, error) {
+	var rules jsonRules
+	var err error
+	if rules.rename, err = stringMapParam(params, prefix+"_rename"); err != nil {
+		return rules, err
+	}
+	rules.remove, err = stringListParam(params, prefix+"_remove")
+	return rules, err
+}
+
+// transform rewrites a JSON document. It returns false if the document is
+// not JSON or nothing changed, in which case the original should be kept.
+func (j jsonRules) transform(body []byte) ([]byte, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	// Keep numbers exactly as they were sent
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil || decoder.More() {
+		return nil, false
+	}
+
+	changed := false
+	objects := []interface{}{doc}
+	if list, ok := doc.([]interface{}); ok {
+		objects = list
+	}
+	for _, item := range objects {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		// Sorted so that renames chaining through each other are deterministic
+		for _, from := range sortedKeys(j.rename) {
+			if value, ok := removeField(obj, from); ok {
+				setField(obj, j.rename[from], value)
+				changed = true
+			}
+		}
+		for _, path := range j.remove {
+			if _, ok := removeField(obj, path); ok {
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return nil, false
+	}
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return nil, false
+	}
+	return out, true
+}
+
+func removeField(obj map[string]interface{}, path string) (interface{}, bool) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := obj[part].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		obj = child
+	}
+	last := parts[len(parts)-1]
+	value, ok := obj[last]
+	delete(obj, last)
+	return value, ok
+}
+
+func setField(obj map[string]interface{}, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := obj[part].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			obj[part] = child
+		}
+		obj = child
+	}
+	obj[parts[len(parts)-1]] = value
+}
+
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// newJSONBodyMiddleware builds the "json-body" middleware type.
+// request_rename and response_rename map field paths to new paths;
+// request_remove and response_remove list field paths to drop. Only bodies
+// with a JSON content type are rewritten, and Content-Length is updated to
+// match. Gzip-encoded responses are decompressed, rewritten and compressed
+// again; bodies with other encodings are passed through unchanged.
+func newJSONBodyMiddleware(params map[string]interface{}) (Middleware, error) {
+	if err := checkParams(params, "request_rename", "request_remove", "response_rename", "response_remove"); err != nil {
+		return nil, err
+	}
+	request, err := jsonRulesParams(params, "request")
+	if err != nil {
+		return nil, err
+	}
+	response, err := jsonRulesParams(params, "response")
+	if err != nil {
+		return nil, err
+	}
+	if request.empty() && response.empty() {
+		return nil, fmt.Errorf("at least one rename or remove rule is required")
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !request.empty() {
+				var err error
+				if r, err = transformRequestBody(r, request); err != nil {
+					http.Error(w, "Could not read request body", http.StatusBadRequest)
+					return
+				}
+			}
+			if response.empty() || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+			bw := &bodyWriter{w: w, rules: response}
+			next.ServeHTTP(bw, r)
+			bw.finish()
+		})
+	}, nil
+}
+
+// transformRequestBody rewrites an unencoded JSON request body of known,
+// bounded size. Chunked bodies are passed through unchanged.
+func transformRequestBody(r *http.Request, rules jsonRules) (*http.Request, error) {
+	if !isJSON(r.Header.Get("Content-Type")) || r.Header.Get("Content-Encoding") != "" ||
+		r.ContentLength <= 0 || r.ContentLength > maxTransformBodyBytes {
+		return r, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if out, ok := rules.transform(body); ok {
+		body = out
+	}
+	r = r.Clone(r.Context())
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return r, nil
+}
+
+// bodyWriter holds back JSON responses so their body can be rewritten and
+// Content-Length set to match. Other responses, and JSON responses that grow
+// beyond maxTransformBodyBytes, are passed through as they are written.
+type bodyWriter struct {
+	w           http.ResponseWriter
+	rules       jsonRules
+	status      int
+	buffering   bool
+	wroteHeader bool
+	buf         bytes.Buffer
+}
+
+func (bw *bodyWriter) Header() http.Header {
+	return bw.w.Header()
+}
+
+func (bw *bodyWriter) WriteHeader(status int) {
+	if bw.wroteHeader {
+		return
+	}
+	if status < 200 {
+		bw.w.WriteHeader(status)
+		return
+	}
+	bw.wroteHeader, bw.status = true, status
+	encoding := bw.Header().Get("Content-Encoding")
+	bw.buffering = isJSON(bw.Header().Get("Content-Type")) &&
+		status != http.StatusNoContent && status != http.StatusNotModified &&
+		(encoding == "" || encoding == "gzip")
+	if !bw.buffering {
+		bw.w.WriteHeader(status)
+	}
+}
+
+func (bw *bodyWriter) Write(b []byte) (int, error) {
+	if !bw.wroteHeader {
+		bw.WriteHeader(http.StatusOK)
+	}
+	if !bw.buffering {
+		return bw.w.Write(b)
+	}
+	bw.buf.Write(b)
+	if bw.buf.Len() > maxTransformBodyBytes {
+		// Too large to rewrite, so send what we have and stream the rest
+		bw.buffering = false
+		bw.w.WriteHeader(bw.status)
+		if _, err := bw.w.Write(bw.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		bw.buf = bytes.Buffer{}
+	}
+	return len(b), nil
+}
+
+// Flush is defined so the proxy never flushes a response being held back.
+func (bw *bodyWriter) Flush() {
+	if bw.wroteHeader && !bw.buffering {
+		http.NewResponseController(bw.w).Flush()
+	}
+}
+
+func (bw *bodyWriter) Unwrap() http.ResponseWriter {
+	return bw.w
+}
+
+// finish rewrites and sends a held back response.
+func (bw *bodyWriter) finish() {
+	if !bw.buffering {
+		return
+	}
+	body := bw.buf.Bytes()
+	if out, ok := bw.transform(body); ok {
+		body = out
+		// The upstream's validator no longer describes this body
+		bw.Header().Del("ETag")
+	}
+	bw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	bw.w.WriteHeader(bw.status)
+	bw.w.Write(body)
+}
+
+func (bw *bodyWriter) transform(body []byte) ([]byte, bool) {
+	if bw.Header().Get("Content-Encoding") != "gzip" {
+		return bw.rules.transform(body)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, false
+	}
+	plain, err := io.ReadAll(io.LimitReader(reader, maxTransformBodyBytes+1))
+	if err != nil || len(plain) > maxTransformBodyBytes {
+		return nil, false
+	}
+	out, ok := bw.rules.transform(plain)
+	if !ok {
+		return nil, false
+	}
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(out)
+	if err := zw.Close(); err != nil {
+		return nil, false
+	}
+	return compressed.Bytes(), true
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sony/gobreaker"
+)
+
+// Target is a single backend in an upstream pool.
+type Target struct {
+	URL    *url.URL
+	Weight int
+	active int64
+	proxy  *httputil.ReverseProxy
+	health targetHealth
+}
+
+// NewTarget parses rawURL into a target with the given weight. Weights below 1 are treated as 1.
+func NewTarget(rawURL string, weight int) (*Target, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target URL %q: %v", rawURL, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid target URL %q: scheme and host are required", rawURL)
+	}
+	if weight < 1 {
+		weight = 1
+	}
+
+	t := &Target{URL: u, Weight: weight}
+	t.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(t.URL)
+			pr.SetXForwarded()
+		},
+		// Flush immediately so streamed responses reach the client as they arrive
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Proxy error for %s: %v", t.URL, err)
+			recordAttemptError(r, err)
+			if errors.Is(err, context.DeadlineExceeded) {
+				http.Error(w, "Upstream request timed out", http.StatusGatewayTimeout)
+				return
+			}
+			http.Error(w, "Bad gateway", http.StatusBadGateway)
+		},
+	}
+	return t, nil
+}
+
+// ActiveRequests returns the number of requests currently proxied to this target.
+func (t *Target) ActiveRequests() int64 {
+	return atomic.LoadInt64(&t.active)
+}
+
+// Balancer picks a target for a request from the targets available to it.
+type Balancer interface {
+	Next(r *http.Request, targets []*Target) *Target
+}
+
+// UpstreamPool is a named group of backend targets sharing a balancing strategy.
+// Targets that fail health checks or are ejected as outliers get no traffic,
+// and an open circuit breaker rejects calls to the whole pool.
+type UpstreamPool struct {
+	Name        string
+	Targets     []*Target
+	Balancer    Balancer
+	HealthCheck *HealthCheckConfig
+	Outlier     *OutlierConfig
+	Breaker     *gobreaker.TwoStepCircuitBreaker
+	quit        chan struct{}
+	wg          sync.WaitGroup
+}
+
+// NewUpstreamPool creates a pool. A nil balancer defaults to round-robin.
+func NewUpstreamPool(name string, balancer Balancer, targets ...*Target) *UpstreamPool {
+	if balancer == nil {
+		balancer = &RoundRobinBalancer{}
+	}
+	return &UpstreamPool{Name: name, Targets: targets, Balancer: balancer}
+}
+
+// ServeHTTP proxies the request to the target chosen by the pool's balancer.
+// Request and response bodies are streamed, and WebSocket upgrades are passed through.
+func (p *UpstreamPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var done func(success bool)
+	if p.Breaker != nil {
+		var err error
+		if done, err = p.Breaker.Allow(); err != nil {
+			if state, ok := r.Context().Value(attemptKey{}).(*attemptState); ok {
+				state.breakerRejected = true
+			}
+			http.Error(w, fmt.Sprintf("Upstream '%s' is unavailable: %v", p.Name, err), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	target := p.Balancer.Next(r, p.availableTargets(time.Now()))
+	if target == nil {
+		if done != nil {
+			done(false)
+		}
+		http.Error(w, fmt.Sprintf("No healthy targets available in upstream '%s'", p.Name), http.StatusServiceUnavailable)
+		return
+	}
+
+	atomic.AddInt64(&target.active, 1)
+	defer atomic.AddInt64(&target.active, -1)
+	if p.Outlier == nil && done == nil {
+		target.proxy.ServeHTTP(w, r)
+		return
+	}
+
+	// Connection errors surface as 502 from the proxy's error handler. The
+	// proxy panics with http.ErrAbortHandler if the client goes away while the
+	// body is copied; the breaker is still told the call failed, or a
+	// half-open breaker would wait for the result forever. The outlier
+	// detector is not, since the target is not to blame.
+	rec := &statusRecorder{ResponseWriter: w}
+	defer func() {
+		aborted := recover()
+		failed := aborted != nil || rec.status >= 500
+		if p.Outlier != nil && aborted == nil {
+			target.recordResponse(*p.Outlier, failed, time.Now())
+		}
+		if done != nil {
+			done(!failed)
+		}
+		if aborted != nil {
+			panic(aborted)
+		}
+	}()
+	target.proxy.ServeHTTP(rec, r)
+}
+
+// RoundRobinBalancer cycles through targets in order.
+type RoundRobinBalancer struct {
+	next uint64
+}
+
+func (b *RoundRobinBalancer) Next(r *http.Request, targets []*Target) *Target {
+	if len(targets) == 0 {
+		return nil
+	}
+	n := atomic.AddUint64(&b.next, 1) - 1
+	return targets[n%uint64(len(targets))]
+}
+
+// WeightedBalancer spreads requests in proportion to target weights using
+// smooth weighted round-robin, so heavy targets are interleaved rather than
+// picked in bursts.
+type WeightedBalancer struct {
+	mu      sync.Mutex
+	current map[*Target]int
+}
+
+func (b *WeightedBalancer) Next(r *http.Request, targets []*Target) *Target {
+	if len(targets) == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.current == nil {
+		b.current = make(map[*Target]int)
+	}
+
+	total := 0
+	var best *Target
+	for _, t := range targets {
+		b.current[t] += t.Weight
+		total += t.Weight
+		if best == nil || b.current[t] > b.current[best] {
+			best = t
+		}
+	}
+	b.current[best] -= total
+	return best
+}
+
+// LeastConnectionsBalancer picks the target with the fewest in-flight
+// requests relative to its weight.
+type LeastConnectionsBalancer struct {
+	next uint64
+}
+
+func (b *LeastConnectionsBalancer) Next(r *http.Request, targets []*Target) *Target {
+	if len(targets) == 0 {
+		return nil
+	}
+	// Start at a rotating offset so ties don't always favour the first target
+	start := int(atomic.AddUint64(&b.next, 1) % uint64(len(targets)))
+	var best *Target
+	bestLoad := math.MaxFloat64
+	for i := range targets {
+		t := targets[(start+i)%len(targets)]
+		load := float64(t.ActiveRequests()) / float64(t.Weight)
+		if load < bestLoad {
+			best, bestLoad = t, load
+		}
+	}
+	return best
+}
+
+// ConsistentHashBalancer sends requests with the same header value to the
+// same target. It uses rendezvous hashing, so adding or removing a target
+// only moves the keys that belonged to it. Requests without the header are
+// keyed by client IP.
+type ConsistentHashBalancer struct {
+	Header string
+}
+
+func (b *ConsistentHashBalancer) Next(r *http.Request, targets []*Target) *Target {
+	if len(targets) == 0 {
+		return nil
+	}
+	key := r.Header.Get(b.Header)
+	if key == "" {
+		key = clientIP(r)
+	}
+
+	var best *Target
+	var bestScore uint64
+	for _, t := range targets {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(t.URL.String()))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = t, score
+		}
+	}
+	return best
+}
+
+// clientIP returns the host part of the request's remote address.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// NewBalancer returns the balancing strategy with the given name. hashHeader
+// is only used by the "consistent-hash" strategy.
+func NewBalancer(strategy, hashHeader string) (Balancer, error) {
+	switch strategy {
+	case "", "round-robin":
+		return &RoundRobinBalancer{}, nil
+	case "weighted":
+		return &WeightedBalancer{}, nil
+	case "least-connections":
+		return &LeastConnectionsBalancer{}, nil
+	case "consistent-hash":
+		if hashHeader == "" {
+			return nil, fmt.Errorf("consistent-hash balancing requires a header")
+		}
+		return &ConsistentHashBalancer{Header: hashHeader}, nil
+	default:
+		return nil, fmt.Errorf("unknown balancing strategy '%s'", strategy)
+	}
+}
@@ -1,196 +1,472 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"net/http"
+	"slices"
 	"sync"
 	"time"
-
-	"github.com/hashicorp/consul/api"
 )
 
-// Node represents a node in the doubly linked list
+// Node represents an item in a cache node's local cache
 type Node struct {
-	key        string
-	value      interface{}
-	expiry     time.Time
-	prev, next *Node
+	key     string
+	value   interface{}
+	stale   time.Time // when the item should be reloaded
+	expiry  time.Time // when the item is dropped
+	size    int64
+	written uint64 // number of the write that stored the value
+	index   int    // position in its shard's expiry heap
 }
 
-// DistributedLRUCache represents the LRU cache
+// DistributedLRUCache represents one node of the distributed cache. Each key
+// is owned by one node: keys owned by this node live in its local LRU, and
+// operations on other keys are forwarded to their owner over the peer protocol
+// served by Handler.
+//
+// Keys are assigned to nodes with a consistent hash ring, so a membership
+// change only moves the keys next to the added or removed node's points.
+// Membership can change at runtime: SetNodes, usually called by a Discovery
+// watch, updates the nodes, notifies OnMembershipChange listeners and hands
+// keys this node no longer owns over to their new owners.
+//
+// The owner of a key can also load it on a miss and persist writes to it,
+// as configured by LocalCacheConfig's Loader and Store.
 type DistributedLRUCache struct {
-	mu         sync.RWMutex
-	capacity   int
-	data       map[string]*Node
-	head, tail *Node
-	ttl        time.Duration
-	consul     *api.Client
-	cacheNodes []string
-	quit       chan struct{}
-	wg         sync.WaitGroup
-}
-
-// NewDistributedLRUCache creates a new LRU cache with a given capacity and TTL for items
-func NewDistributedLRUCache(capacity int, ttl time.Duration, consulAddr string) (*DistributedLRUCache, error) {
-	config := api.DefaultConfig()
-	config.Address = consulAddr
-	consulClient, err := api.NewClient(config)
-	if err != nil {
-		return nil, err
-	}
+	local  *localCache
+	loader *readThrough
+	store  *storeWriter
+	self   string
+	quit   chan struct{}
+	wg     sync.WaitGroup
+
+	membershipMu sync.RWMutex
+	cacheNodes   []string
+	ringConfig   RingConfig
+	ring         *HashRing
+	peers        map[string]*peerClient
+	listeners    []func(MembershipEvent)
+	stopWatch    context.CancelFunc
+}
+
+// discoveryTimeout bounds the initial lookup of the cluster's nodes
+const discoveryTimeout = 10 * time.Second
 
-	kvPairs, _, err := consulClient.KV().List("cache_nodes", nil)
+// closeTimeout bounds persisting queued writes when the cache is closed
+const closeTimeout = 30 * time.Second
+
+// NewDistributedLRUCache creates a cache node that finds its peers through
+// discovery and follows membership changes until closed. self is this node's
+// address as discovery reports it
+func NewDistributedLRUCache(capacity int, ttl time.Duration, self string, discovery Discovery) (*DistributedLRUCache, error) {
+	return NewDistributedCacheWithConfig(LocalCacheConfig{Capacity: capacity, TTL: ttl}, self, discovery)
+}
+
+// NewDistributedCacheWithConfig is NewDistributedLRUCache with the local
+// cache configured by config
+func NewDistributedCacheWithConfig(config LocalCacheConfig, self string, discovery Discovery) (*DistributedLRUCache, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+	defer cancel()
+	nodes, err := discovery.Nodes(ctx)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("discovering cache nodes: %v", err)
 	}
 
-	cacheNodes := make([]string, len(kvPairs))
-	for i, kv := range kvPairs {
-		cacheNodes[i] = string(kv.Value)
-	}
+	cache := NewCacheNodeWithConfig(config, self, nodes)
+	cache.Watch(discovery)
+	return cache, nil
+}
 
+// NewCacheNode creates a cache node for a fixed set of node addresses
+// ("host:port"). self is this node's own address in nodes. The node holds
+// up to capacity of the keys it owns, each for ttl unless set with its own TTL
+func NewCacheNode(capacity int, ttl time.Duration, self string, nodes []string) *DistributedLRUCache {
+	return NewCacheNodeWithConfig(LocalCacheConfig{Capacity: capacity, TTL: ttl}, self, nodes)
+}
+
+// NewCacheNodeWithConfig is NewCacheNode with the local cache configured by config
+func NewCacheNodeWithConfig(config LocalCacheConfig, self string, nodes []string) *DistributedLRUCache {
 	cache := &DistributedLRUCache{
-		capacity:   capacity,
-		data:       make(map[string]*Node),
-		ttl:        ttl,
-		consul:     consulClient,
-		cacheNodes: cacheNodes,
-		quit:       make(chan struct{}),
-	}
-	cache.head = &Node{}
-	cache.tail = &Node{}
-	cache.head.next = cache.tail
-	cache.tail.prev = cache.head
+		local: newLocalCache(config),
+		self:  self,
+		ring:  NewHashRing(nil, RingConfig{}),
+		peers: make(map[string]*peerClient),
+		quit:  make(chan struct{}),
+	}
+	if config.Loader.Loader != nil {
+		cache.loader = newReadThrough(config.Loader, cache.local)
+	}
+	if config.Store.Store != nil {
+		cache.store = newStoreWriter(config.Store)
+	}
+	cache.SetNodes(nodes)
 	cache.wg.Add(1)
-	go cache.expire()
-	return cache, nil
+	go cache.expire(expiryInterval(config.TTL))
+	return cache
 }
 
-// getCacheNode retrieves the appropriate cache node using consistent hashing
-func (c *DistributedLRUCache) getCacheNode(key string) (string, error) {
-	if len(c.cacheNodes) == 0 {
-		return "", fmt.Errorf("no cache nodes available")
+// Nodes returns the addresses of the cluster's nodes
+func (c *DistributedLRUCache) Nodes() []string {
+	c.membershipMu.RLock()
+	defer c.membershipMu.RUnlock()
+	return append([]string(nil), c.cacheNodes...)
+}
+
+// OnMembershipChange registers a listener called after each change in the
+// cluster's nodes, from the goroutine that applied the change
+func (c *DistributedLRUCache) OnMembershipChange(listener func(MembershipEvent)) {
+	c.membershipMu.Lock()
+	defer c.membershipMu.Unlock()
+	c.listeners = append(c.listeners, listener)
+}
+
+// OnEvict registers a listener called after an item this node owns is
+// evicted, because its shard was full or its TTL passed. Listeners run on the
+// goroutine that evicted the item, without the cache's locks held
+func (c *DistributedLRUCache) OnEvict(listener EvictionFunc) {
+	c.local.onEvict(listener)
+}
+
+// LocalStats returns the counters of this node's local cache
+func (c *DistributedLRUCache) LocalStats() CacheStats {
+	return c.local.stats()
+}
+
+// Watch follows membership changes reported by discovery until the cache is
+// closed or Watch is called again
+func (c *DistributedLRUCache) Watch(discovery Discovery) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.membershipMu.Lock()
+	if c.stopWatch != nil {
+		c.stopWatch()
 	}
-	index := int(hashKey(key)) % len(c.cacheNodes)
-	return c.cacheNodes[index], nil
+	c.stopWatch = cancel
+	c.membershipMu.Unlock()
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		if err := discovery.Watch(ctx, c.SetNodes); err != nil {
+			fmt.Println("Error watching cache nodes:", err)
+		}
+	}()
 }
 
-// hashKey provides a simple hash function for consistency
-func hashKey(key string) uint64 {
-	hash := 0
-	for _, b := range key {
-		hash = 31*hash + int(b)
+// SetNodes replaces the cluster's nodes. If they changed, listeners are
+// notified and local keys now owned by another node are moved to it
+func (c *DistributedLRUCache) SetNodes(nodes []string) {
+	nodes = normalizeNodes(nodes)
+	c.membershipMu.Lock()
+	if slices.Equal(nodes, c.cacheNodes) {
+		c.membershipMu.Unlock()
+		return
 	}
-	return uint64(hash)
+	event := MembershipEvent{Nodes: nodes}
+	for _, addr := range nodes {
+		if !slices.Contains(c.cacheNodes, addr) {
+			event.Added = append(event.Added, addr)
+		}
+	}
+	for _, addr := range c.cacheNodes {
+		if !slices.Contains(nodes, addr) {
+			event.Removed = append(event.Removed, addr)
+		}
+	}
+	// Peers are replaced rather than updated, as requests may be using the old map
+	peers := make(map[string]*peerClient, len(nodes))
+	for _, addr := range nodes {
+		if peer, ok := c.peers[addr]; ok {
+			peers[addr] = peer
+		} else if addr != c.self {
+			peers[addr] = newPeerClient(addr)
+		}
+	}
+	c.cacheNodes, c.peers = nodes, peers
+	c.ring = NewHashRing(nodes, c.ringConfig)
+	listeners := append([]func(MembershipEvent){}, c.listeners...)
+	c.membershipMu.Unlock()
+
+	for _, listener := range listeners {
+		listener(event)
+	}
+	c.handOff()
 }
 
-// Set adds an item to the cache
-func (c *DistributedLRUCache) Set(key string, value interface{}) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// ConfigureRing changes the virtual node count and node weights of the hash
+// ring, moving local keys now owned by another node to it
+func (c *DistributedLRUCache) ConfigureRing(config RingConfig) {
+	c.membershipMu.Lock()
+	c.ringConfig = config
+	c.ring = NewHashRing(c.cacheNodes, config)
+	c.membershipMu.Unlock()
+	c.handOff()
+}
 
-	node, ok := c.data[key]
-	if ok {
-		// Move the existing node to the head
-		c.moveToHead(node)
-	} else {
-		// Add a new node
-		newNode := &Node{
-			key:    key,
-			value:  value,
-			expiry: time.Now().Add(c.ttl),
-			next:   c.head.next,
-			prev:   c.head,
+// handOff moves local keys owned by other nodes to their owners. Keys that
+// cannot be moved stay in the local LRU until evicted
+func (c *DistributedLRUCache) handOff() {
+	for _, entry := range c.local.entries() {
+		if _, ok := entry.value.(notFound); ok {
+			// Keys cached as missing are not worth moving
+			c.local.delete(entry.key)
+			continue
+		}
+		peer, err := c.owner(entry.key)
+		if err != nil || peer == nil {
+			continue
 		}
-		c.data[key] = newNode
-		c.head.next.prev = newNode
-		c.head.next = newNode
+		// Keys keep the rest of their TTL on their new owner
+		ttl := time.Until(entry.freshUntil)
+		if ttl <= 0 {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), peerTimeout)
+		err = peer.Set(ctx, entry.key, entry.value, ttl)
+		cancel()
+		if err != nil {
+			fmt.Println("Error handing off key", entry.key, err)
+			continue
+		}
+		c.local.delete(entry.key)
+	}
+}
+
+// getCacheNode retrieves the appropriate cache node using consistent hashing
+func (c *DistributedLRUCache) getCacheNode(key string) (string, error) {
+	c.membershipMu.RLock()
+	defer c.membershipMu.RUnlock()
+	return c.nodeFor(key)
+}
+
+// nodeFor returns the node that owns key. Callers hold membershipMu
+func (c *DistributedLRUCache) nodeFor(key string) (string, error) {
+	node, ok := c.ring.Lookup(key)
+	if !ok {
+		return "", fmt.Errorf("no cache nodes available")
 	}
+	return node, nil
+}
 
-	// Evict the least recently used item if the cache exceeds capacity
-	if len(c.data) > c.capacity {
-		oldestNode := c.tail.prev
-		delete(c.data, oldestNode.key)
-		c.remove(oldestNode)
+// ReplicaNodes returns up to n distinct nodes for key, starting with its
+// owner, on which replicas of the key belong
+func (c *DistributedLRUCache) ReplicaNodes(key string, n int) []string {
+	c.membershipMu.RLock()
+	defer c.membershipMu.RUnlock()
+	return c.ring.LookupN(key, n)
+}
+
+// owner returns the peer that owns key, or nil if this node owns it
+func (c *DistributedLRUCache) owner(key string) (*peerClient, error) {
+	c.membershipMu.RLock()
+	defer c.membershipMu.RUnlock()
+	cacheNode, err := c.nodeFor(key)
+	if err != nil {
+		return nil, err
 	}
+	if cacheNode == c.self {
+		return nil, nil
+	}
+	peer, ok := c.peers[cacheNode]
+	if !ok {
+		return nil, fmt.Errorf("unknown cache node %s", cacheNode)
+	}
+	return peer, nil
+}
 
-	// Store the value in the appropriate distributed cache node
-	cacheNode, err := c.getCacheNode(key)
+// Set stores an item on the node that owns its key, for the owner's default TTL
+func (c *DistributedLRUCache) Set(key string, value interface{}) error {
+	return c.SetWithTTL(key, value, 0)
+}
+
+// SetWithTTL stores an item on the node that owns its key, expiring after
+// ttl. A ttl of 0 or less uses the owner's default TTL
+func (c *DistributedLRUCache) SetWithTTL(key string, value interface{}, ttl time.Duration) error {
+	peer, err := c.owner(key)
 	if err != nil {
-		fmt.Println("Error retrieving cache node for key", key)
-		return
+		return err
 	}
-	// Here, we would store the value in the remote cache node `cacheNode`.
-	fmt.Printf("Caching key %s in node %s\n", key, cacheNode)
+	ctx, cancel := context.WithTimeout(context.Background(), peerTimeout)
+	defer cancel()
+	if peer == nil {
+		return c.setOwned(ctx, key, value, ttl)
+	}
+	return peer.Set(ctx, key, value, ttl)
 }
 
-// Get retrieves an item from the cache
+// Get retrieves an item from the node that owns its key. Errors, such as an
+// unreachable owner or a failed load, are reported as a cache miss
 func (c *DistributedLRUCache) Get(key string) (interface{}, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	timeout := peerTimeout
+	if c.loader != nil {
+		timeout += c.loader.config.Timeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	value, err := c.Load(ctx, key)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			fmt.Println("Error reading key", key, err)
+		}
+		return nil, false
+	}
+	return value, true
+}
 
-	node, ok := c.data[key]
+// Load retrieves an item from the node that owns its key, which loads it if
+// it is missing and the node has a loader. It returns ErrNotFound for a
+// missing key
+func (c *DistributedLRUCache) Load(ctx context.Context, key string) (interface{}, error) {
+	peer, err := c.owner(key)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving cache node for key %s: %v", key, err)
+	}
+	if peer == nil {
+		return c.getOwned(ctx, key)
+	}
+	value, ok, err := peer.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
 	if !ok {
-		return nil, false
+		return nil, ErrNotFound
 	}
+	return value, nil
+}
 
-	// Check if the item has expired
-	if time.Now().After(node.expiry) {
-		// Remove expired item
-		delete(c.data, key)
-		c.remove(node)
-		return nil, false
+// Delete removes an item from the node that owns its key
+func (c *DistributedLRUCache) Delete(key string) error {
+	peer, err := c.owner(key)
+	if err != nil {
+		return err
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), peerTimeout)
+	defer cancel()
+	if peer == nil {
+		return c.deleteOwned(ctx, key)
+	}
+	return peer.Delete(ctx, key)
+}
 
-	// Move the accessed item to the head to mark it as recently used
-	c.moveToHead(node)
-	return node.value, true
+// getOwned reads a key this node owns, loading it through the loader if any
+func (c *DistributedLRUCache) getOwned(ctx context.Context, key string) (interface{}, error) {
+	if c.loader != nil {
+		return c.loader.get(ctx, key)
+	}
+	value, ok := c.local.get(key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return value, nil
 }
 
-// remove removes a node from the linked list
-func (c *DistributedLRUCache) remove(node *Node) {
-	node.prev.next = node.next
-	node.next.prev = node.prev
+// setOwned stores a key this node owns, persisting it first if there is a store
+func (c *DistributedLRUCache) setOwned(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	if c.store != nil {
+		if err := c.store.write(ctx, StoreWrite{Key: key, Value: value}); err != nil {
+			return err
+		}
+	}
+	c.local.set(key, value, ttl)
+	return nil
 }
 
-// moveToHead moves a node to the head of the linked list (most recently used)
-func (c *DistributedLRUCache) moveToHead(node *Node) {
-	c.remove(node)
-	node.next = c.head.next
-	node.prev = c.head
-	c.head.next.prev = node
-	c.head.next = node
+// deleteOwned removes a key this node owns, from the store too if there is one
+func (c *DistributedLRUCache) deleteOwned(ctx context.Context, key string) error {
+	if c.store != nil {
+		if err := c.store.write(ctx, StoreWrite{Key: key, Delete: true}); err != nil {
+			return err
+		}
+	}
+	c.local.delete(key)
+	return nil
 }
 
-// expire periodically checks and removes expired items from the cache
-func (c *DistributedLRUCache) expire() {
+// expire reclaims expired items from the local cache every interval
+func (c *DistributedLRUCache) expire(interval time.Duration) {
 	defer c.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
 		select {
-		case <-time.After(c.ttl / 2):
-			// Expiration logic is already handled in Get and Set.
+		case now := <-ticker.C:
+			c.local.reclaim(now)
 		case <-c.quit:
 			return
 		}
 	}
 }
 
-// Close shuts down the cache and waits for any cleanup tasks to finish
+// Close shuts down the cache and waits for any cleanup tasks to finish,
+// including loads in progress and persisting writes still queued
 func (c *DistributedLRUCache) Close() {
+	c.membershipMu.Lock()
+	if c.stopWatch != nil {
+		c.stopWatch()
+	}
+	c.membershipMu.Unlock()
 	close(c.quit)
 	c.wg.Wait()
+	if c.loader != nil {
+		c.loader.wait()
+	}
+	if c.store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+		defer cancel()
+		if err := c.store.close(ctx); err != nil {
+			fmt.Println("Error persisting queued writes:", err)
+		}
+	}
 }
 
 func main() {
-	cache, err := NewDistributedLRUCache(2, time.Second*2, "127.0.0.1:8500")
+	listen := flag.String("listen", "127.0.0.1:7000", "address this node serves the peer protocol on, as listed in cache_nodes")
+	consulAddr := flag.String("consul", "127.0.0.1:8500", "address of the Consul agent listing cache_nodes")
+	nodesFile := flag.String("nodes-file", "", "file listing cache nodes, one per line, used instead of Consul")
+	srvName := flag.String("srv", "", "DNS name whose _cache._tcp SRV records list cache nodes, used instead of Consul")
+	flag.Parse()
+
+	var discovery Discovery
+	switch {
+	case *nodesFile != "":
+		discovery = FileDiscovery{Path: *nodesFile}
+	case *srvName != "":
+		discovery = DNSSRVDiscovery{Service: "cache", Proto: "tcp", Name: *srvName}
+	default:
+		consul, err := NewConsulDiscovery(*consulAddr, "cache_nodes")
+		if err != nil {
+			fmt.Println("Error connecting to Consul:", err)
+			return
+		}
+		discovery = consul
+	}
+
+	cache, err := NewDistributedLRUCache(2, time.Second*2, *listen, discovery)
 	if err != nil {
 		fmt.Println("Error initializing distributed cache:", err)
 		return
 	}
 	defer cache.Close()
+	cache.OnMembershipChange(func(event MembershipEvent) {
+		fmt.Printf("Cache nodes changed: added %v, removed %v\n", event.Added, event.Removed)
+	})
+
+	// Serve the keys this node owns to its peers
+	go func() {
+		if err := http.ListenAndServe(*listen, cache.Handler()); err != nil {
+			fmt.Println("Error serving cache node:", err)
+		}
+	}()
 
 	// Set items in the cache
-	cache.Set("mykey1", "Hello World!")
-	cache.Set("mykey2", "Another Value")
+	if err := cache.Set("mykey1", "Hello World!"); err != nil {
+		fmt.Println("Error caching mykey1:", err)
+	}
+	if err := cache.Set("mykey2", "Another Value"); err != nil {
+		fmt.Println("Error caching mykey2:", err)
+	}
 
 	// Get items from the cache
 	value, found := cache.Get("mykey1")
@@ -209,7 +485,9 @@ func main() {
 	}
 
 	// Set a third item to trigger eviction
-	cache.Set("mykey3", "New Value")
+	if err := cache.Set("mykey3", "New Value"); err != nil {
+		fmt.Println("Error caching mykey3:", err)
+	}
 
 	// The first item should be evicted and not found
 	value, found = cache.Get("mykey1")
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/hashicorp/consul/api"
+)
+
+// Discovery finds the addresses ("host:port") of the nodes in the cache cluster
+type Discovery interface {
+	// Nodes returns the current node addresses
+	Nodes(ctx context.Context) ([]string, error)
+	// Watch calls update with the full list of node addresses whenever it may
+	// have changed, until ctx is done. Lists may repeat; the cache ignores
+	// updates that change nothing
+	Watch(ctx context.Context, update func(nodes []string)) error
+}
+
+// MembershipEvent describes a change in the cluster's nodes
+type MembershipEvent struct {
+	Nodes   []string
+	Added   []string
+	Removed []string
+}
+
+// discoveryRetryDelay is how long watches wait before retrying a failed lookup
+const discoveryRetryDelay = time.Second
+
+// normalizeNodes sorts and deduplicates addresses, dropping empty ones
+func normalizeNodes(nodes []string) []string {
+	seen := make(map[string]bool, len(nodes))
+	out := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		node = strings.TrimSpace(node)
+		if node != "" && !seen[node] {
+			seen[node] = true
+			out = append(out, node)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// sleepContext waits for d, returning false if ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// StaticDiscovery is a fixed list of nodes
+type StaticDiscovery []string
+
+func (d StaticDiscovery) Nodes(ctx context.Context) ([]string, error) {
+	return normalizeNodes(d), nil
+}
+
+func (d StaticDiscovery) Watch(ctx context.Context, update func(nodes []string)) error {
+	update(normalizeNodes(d))
+	<-ctx.Done()
+	return nil
+}
+
+// FileDiscovery reads nodes from a file with one address per line. Blank
+// lines and lines starting with # are ignored. The file is re-read whenever
+// it changes, including when it is replaced by a rename
+type FileDiscovery struct {
+	Path string
+}
+
+func (d FileDiscovery) Nodes(ctx context.Context) ([]string, error) {
+	data, err := os.ReadFile(d.Path)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			nodes = append(nodes, line)
+		}
+	}
+	return normalizeNodes(nodes), scanner.Err()
+}
+
+func (d FileDiscovery) Watch(ctx context.Context, update func(nodes []string)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	// Watch the directory, as editors and config management replace the file
+	if err := watcher.Add(filepath.Dir(d.Path)); err != nil {
+		return err
+	}
+
+	reload := func() {
+		nodes, err := d.Nodes(ctx)
+		if err != nil {
+			fmt.Println("Error reading cache nodes file:", err)
+			return
+		}
+		update(nodes)
+	}
+	reload()
+	name := filepath.Clean(d.Path)
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(event.Name) == name && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				reload()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Println("Error watching cache nodes file:", err)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// SRVResolver looks up DNS SRV records. *net.Resolver implements it
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSSRVDiscovery finds nodes from the SRV records of _service._proto.name,
+// polling every Interval (30 seconds by default)
+type DNSSRVDiscovery struct {
+	Service  string
+	Proto    string
+	Name     string
+	Interval time.Duration
+	Resolver SRVResolver
+}
+
+func (d DNSSRVDiscovery) Nodes(ctx context.Context) ([]string, error) {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	_, records, err := resolver.LookupSRV(ctx, d.Service, d.Proto, d.Name)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]string, 0, len(records))
+	for _, srv := range records {
+		host := strings.TrimSuffix(srv.Target, ".")
+		nodes = append(nodes, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+	}
+	return normalizeNodes(nodes), nil
+}
+
+func (d DNSSRVDiscovery) Watch(ctx context.Context, update func(nodes []string)) error {
+	interval := d.Interval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	for {
+		nodes, err := d.Nodes(ctx)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			fmt.Println("Error looking up cache nodes:", err)
+		case err == nil:
+			update(nodes)
+		}
+		if !sleepContext(ctx, interval) {
+			return nil
+		}
+	}
+}
+
+// ConsulDiscovery reads node addresses from the values of the Consul KV keys
+// under Prefix, watching them with blocking queries
+type ConsulDiscovery struct {
+	Client *api.Client
+	Prefix string
+	// WaitTime is how long each blocking query waits for a change (5 minutes by default)
+	WaitTime time.Duration
+}
+
+// NewConsulDiscovery connects to the Consul agent at addr
+func NewConsulDiscovery(addr, prefix string) (*ConsulDiscovery, error) {
+	config := api.DefaultConfig()
+	config.Address = addr
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &ConsulDiscovery{Client: client, Prefix: prefix}, nil
+}
+
+func (d *ConsulDiscovery) Nodes(ctx context.Context) ([]string, error) {
+	nodes, _, err := d.list(ctx, 0)
+	return nodes, err
+}
+
+// list reads the nodes, blocking until they change past index if it is non-zero
+func (d *ConsulDiscovery) list(ctx context.Context, index uint64) ([]string, uint64, error) {
+	waitTime := d.WaitTime
+	if waitTime <= 0 {
+		waitTime = 5 * time.Minute
+	}
+	options := (&api.QueryOptions{WaitIndex: index, WaitTime: waitTime}).WithContext(ctx)
+	pairs, meta, err := d.Client.KV().List(d.Prefix, options)
+	if err != nil {
+		return nil, 0, err
+	}
+	nodes := make([]string, 0, len(pairs))
+	for _, kv := range pairs {
+		nodes = append(nodes, string(kv.Value))
+	}
+	return normalizeNodes(nodes), meta.LastIndex, nil
+}
+
+func (d *ConsulDiscovery) Watch(ctx context.Context, update func(nodes []string)) error {
+	var index uint64
+	delay := discoveryRetryDelay
+	for {
+		nodes, lastIndex, err := d.list(ctx, index)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			fmt.Println("Error watching cache nodes in Consul:", err)
+			if !sleepContext(ctx, delay) {
+				return nil
+			}
+			delay = min(delay*2, 30*time.Second)
+			continue
+		}
+		delay = discoveryRetryDelay
+		update(nodes)
+		switch {
+		case lastIndex < index:
+			// Consul reset its index, so the watch starts over
+			index = 0
+		case lastIndex == 0:
+			// A query at index 0 never blocks, so pace the watch instead
+			if !sleepContext(ctx, discoveryRetryDelay) {
+				return nil
+			}
+		default:
+			index = lastIndex
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrNotFound reports a key that is neither cached nor known to the loader.
+// Loaders return it for keys that do not exist, so they can be cached as
+// missing
+var ErrNotFound = errors.New("key not found")
+
+// defaultLoadTimeout bounds each load unless LoaderConfig says otherwise
+const defaultLoadTimeout = 10 * time.Second
+
+// Loader loads the value of a key missing from the cache, usually from a database
+type Loader interface {
+	Load(ctx context.Context, key string) (interface{}, error)
+}
+
+// LoaderFunc adapts a function to a Loader
+type LoaderFunc func(ctx context.Context, key string) (interface{}, error)
+
+func (f LoaderFunc) Load(ctx context.Context, key string) (interface{}, error) {
+	return f(ctx, key)
+}
+
+// LoaderConfig configures read-through loading. Keys are loaded by the node
+// that owns them, and concurrent loads of a key on that node share one call
+// to the loader, so a hot key expiring causes one load for the whole cluster.
+// A load racing with a Delete of the same key may store the loaded value
+type LoaderConfig struct {
+	Loader Loader
+	// StaleWhileRevalidate keeps serving a value for this long after its TTL
+	// passes, while one background load refreshes it
+	StaleWhileRevalidate time.Duration
+	// NegativeTTL is how long keys the loader reports as ErrNotFound are
+	// remembered as missing. Misses are not cached if it is 0
+	NegativeTTL time.Duration
+	// Timeout bounds each load (10 seconds by default). Loads run on their own
+	// deadline, so one caller giving up does not fail the others
+	Timeout time.Duration
+}
+
+// notFound is cached for keys the loader reported as ErrNotFound
+type notFound struct{}
+
+// flight is a load in progress that callers wait on
+type flight struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// readThrough loads missing keys into a local cache, coalescing concurrent
+// loads of the same key
+type readThrough struct {
+	config LoaderConfig
+	local  *localCache
+
+	mu      sync.Mutex
+	flights map[string]*flight
+	wg      sync.WaitGroup
+}
+
+func newReadThrough(config LoaderConfig, local *localCache) *readThrough {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultLoadTimeout
+	}
+	return &readThrough{config: config, local: local, flights: make(map[string]*flight)}
+}
+
+// get reads a key from the local cache, loading it if it is missing and
+// refreshing it in the background if it is stale
+func (r *readThrough) get(ctx context.Context, key string) (interface{}, error) {
+	value, stale, ok := r.local.lookup(key)
+	if ok {
+		if stale {
+			r.start(key)
+		}
+		return cachedValue(value)
+	}
+	f := r.start(key)
+	select {
+	case <-f.done:
+		return f.value, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// start returns the load of key in progress, starting one if there is none
+func (r *readThrough) start(key string) *flight {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.flights[key]; ok {
+		return f
+	}
+	f := &flight{done: make(chan struct{})}
+	r.flights[key] = f
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		f.value, f.err = r.load(key)
+		r.mu.Lock()
+		delete(r.flights, key)
+		r.mu.Unlock()
+		close(f.done)
+	}()
+	return f
+}
+
+// load calls the loader and caches what it returns
+func (r *readThrough) load(key string) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.config.Timeout)
+	defer cancel()
+	version := r.local.version()
+	value, err := r.config.Loader.Load(ctx, key)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		if r.config.NegativeTTL > 0 {
+			r.local.setIfUnchanged(key, notFound{}, r.config.NegativeTTL, version)
+		}
+		return nil, ErrNotFound
+	case err != nil:
+		return nil, fmt.Errorf("loading key %s: %v", key, err)
+	}
+	r.local.setIfUnchanged(key, value, 0, version)
+	return value, nil
+}
+
+// wait waits for loads in progress, including background refreshes
+func (r *readThrough) wait() {
+	r.wg.Wait()
+}
+
+// cachedValue turns a cached value into a lookup result, reporting keys
+// cached as missing as ErrNotFound
+func cachedValue(value interface{}) (interface{}, error) {
+	if _, ok := value.(notFound); ok {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// maxShards bounds the number of independently locked shards in a node's local cache
+const maxShards = 16
+
+// minShardCapacity and minShardBytes are the smallest capacities worth a
+// shard of their own, for caches bounded by count and by size
+const (
+	minShardCapacity = 64
+	minShardBytes    = 1 << 20
+)
+
+// maxExpiryInterval bounds how long expired items wait to be reclaimed
+const maxExpiryInterval = time.Second
+
+// EvictionReason says why an item was evicted from a node's local cache
+type EvictionReason int
+
+const (
+	// EvictedCapacity means the eviction policy chose the item to make room,
+	// or declined to admit it
+	EvictedCapacity EvictionReason = iota
+	// EvictedExpired means the item's TTL passed
+	EvictedExpired
+)
+
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictedCapacity:
+		return "capacity"
+	case EvictedExpired:
+		return "expired"
+	default:
+		return "unknown"
+	}
+}
+
+// EvictionFunc is called after an item is evicted from a node's local cache.
+// It is not called for items that are deleted, replaced or handed off
+type EvictionFunc func(key string, value interface{}, reason EvictionReason)
+
+// eviction is an evicted item waiting for the eviction listeners
+type eviction struct {
+	key    string
+	value  interface{}
+	reason EvictionReason
+}
+
+// localEntry is a snapshot of an item in the local cache
+type localEntry struct {
+	key        string
+	value      interface{}
+	freshUntil time.Time
+}
+
+// Sizer measures an item for a cache bounded by size, usually in bytes
+type Sizer func(key string, value interface{}) int64
+
+// LocalCacheConfig configures the local cache of a node, which holds the keys
+// the node owns
+type LocalCacheConfig struct {
+	// Capacity is the maximum number of items. It is ignored if MaxBytes is set
+	Capacity int
+	// MaxBytes bounds the total size of the items, as measured by Sizer
+	MaxBytes int64
+	// Sizer measures items when MaxBytes is set (ApproximateSize by default)
+	Sizer Sizer
+	// TTL is how long items last unless set with their own TTL
+	TTL time.Duration
+	// Policy creates each shard's eviction policy (NewLRUPolicy by default)
+	Policy PolicyFactory
+	// Shards is the number of independently locked shards. By default small
+	// caches get fewer shards, so they evict in close to exact policy order
+	Shards int
+	// Loader loads keys this node owns when they are missing
+	Loader LoaderConfig
+	// Store persists writes to keys this node owns
+	Store StoreConfig
+}
+
+// ApproximateSize estimates the memory used by an item: the length of the key
+// plus the length of a string or []byte value, or of other values' JSON form
+func ApproximateSize(key string, value interface{}) int64 {
+	size := int64(len(key))
+	switch v := value.(type) {
+	case string:
+		return size + int64(len(v))
+	case []byte:
+		return size + int64(len(v))
+	case nil, bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return size + 8
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return size
+	}
+	return size + int64(len(data))
+}
+
+// CacheStats are the counters of a node's local cache. Size and Capacity are
+// in items, or in the units of the sizer for a cache bounded by size
+type CacheStats struct {
+	Policy      string `json:"policy"`
+	Hits        int64  `json:"hits"`
+	Misses      int64  `json:"misses"`
+	Evictions   int64  `json:"evictions"`
+	Expirations int64  `json:"expirations"`
+	Items       int    `json:"items"`
+	Size        int64  `json:"size"`
+	Capacity    int64  `json:"capacity"`
+}
+
+// HitRatio is the fraction of lookups that found their key
+func (s CacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// localCache holds the keys a node owns. Keys are spread over shards that are
+// locked independently, so operations on different keys rarely contend. Each
+// shard has a share of the capacity and its own eviction policy, and a heap
+// of expiry times that lets reclaim drop expired items without scanning
+// every item
+type localCache struct {
+	shards        []*cacheShard
+	ttl           time.Duration
+	sizer         Sizer
+	policy        string
+	capacity      int64
+	shardCapacity int64
+	// grace is how long items are kept once stale, so they can be served
+	// while they are reloaded
+	grace time.Duration
+	// writes numbers every write, so loads can tell if a key changed under them
+	writes atomic.Uint64
+
+	hits, misses, evictions, expirations atomic.Int64
+
+	listenersMu sync.RWMutex
+	listeners   []EvictionFunc
+}
+
+// cacheShard is one independently locked part of a localCache
+type cacheShard struct {
+	mu       sync.Mutex
+	policy   EvictionPolicy
+	data     map[string]*Node
+	size     int64
+	expiries expiryHeap
+}
+
+// newLocalCache creates a local cache as configured
+func newLocalCache(config LocalCacheConfig) *localCache {
+	capacity, unit, sizer := int64(config.Capacity), int64(minShardCapacity), Sizer(nil)
+	if config.MaxBytes > 0 {
+		capacity, unit, sizer = config.MaxBytes, minShardBytes, config.Sizer
+		if sizer == nil {
+			sizer = ApproximateSize
+		}
+	}
+	shards := config.Shards
+	if shards <= 0 {
+		shards = int(min(maxShards, max(1, capacity/unit)))
+	}
+	factory := config.Policy
+	if factory == nil {
+		factory = NewLRUPolicy
+	}
+
+	c := &localCache{
+		shards:   make([]*cacheShard, shards),
+		ttl:      config.TTL,
+		grace:    max(config.Loader.StaleWhileRevalidate, 0),
+		sizer:    sizer,
+		capacity: capacity,
+		// Round up so the shards hold at least the capacity between them
+		shardCapacity: (capacity + int64(shards) - 1) / int64(shards),
+	}
+	for i := range c.shards {
+		policy := factory(c.shardCapacity)
+		c.shards[i] = &cacheShard{policy: policy, data: make(map[string]*Node)}
+		c.policy = policy.Name()
+	}
+	return c
+}
+
+func (c *localCache) shard(key string) *cacheShard {
+	return c.shards[xxhash.Sum64String(key)%uint64(len(c.shards))]
+}
+
+// size measures an item, which counts as 1 in a cache bounded by count
+func (c *localCache) size(key string, value interface{}) int64 {
+	if c.sizer == nil {
+		return 1
+	}
+	return max(c.sizer(key, value), 0)
+}
+
+// onEvict registers an eviction listener
+func (c *localCache) onEvict(listener EvictionFunc) {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	c.listeners = append(c.listeners, listener)
+}
+
+// notify calls the eviction listeners. It is called without shard locks
+// held, so listeners may use the cache
+func (c *localCache) notify(evicted []eviction) {
+	if len(evicted) == 0 {
+		return
+	}
+	c.listenersMu.RLock()
+	listeners := c.listeners
+	c.listenersMu.RUnlock()
+	for _, e := range evicted {
+		for _, listener := range listeners {
+			listener(e.key, e.value, e.reason)
+		}
+	}
+}
+
+// set stores an item that becomes stale after ttl, or after the cache's TTL
+// if ttl is 0 or less
+func (c *localCache) set(key string, value interface{}, ttl time.Duration) {
+	c.put(key, value, ttl, 0, false)
+}
+
+// version returns the number of the latest write
+func (c *localCache) version() uint64 {
+	return c.writes.Load()
+}
+
+// setIfUnchanged is set, unless key was written after the write numbered
+// version. Loads use it so a slow load cannot overwrite a newer value
+func (c *localCache) setIfUnchanged(key string, value interface{}, ttl time.Duration, version uint64) {
+	c.put(key, value, ttl, version, true)
+}
+
+func (c *localCache) put(key string, value interface{}, ttl time.Duration, version uint64, conditional bool) {
+	if ttl <= 0 {
+		ttl = c.ttl
+	}
+	stale := time.Now().Add(ttl)
+	expiry := stale.Add(c.grace)
+	size := c.size(key, value)
+	s := c.shard(key)
+	if size > c.shardCapacity {
+		// The item could never fit, so reject it rather than empty the shard
+		c.delete(key)
+		c.evictions.Add(1)
+		c.notify([]eviction{{key, value, EvictedCapacity}})
+		return
+	}
+	s.mu.Lock()
+	if node, ok := s.data[key]; ok {
+		if conditional && node.written > version {
+			s.mu.Unlock()
+			return
+		}
+		node.value = value
+		node.stale = stale
+		node.expiry = expiry
+		node.written = c.writes.Add(1)
+		s.size += size - node.size
+		node.size = size
+		heap.Fix(&s.expiries, node.index)
+	} else {
+		node := &Node{key: key, value: value, stale: stale, expiry: expiry, size: size, written: c.writes.Add(1)}
+		s.data[key] = node
+		s.size += size
+		heap.Push(&s.expiries, node)
+	}
+	var evicted []eviction
+	for _, victim := range s.policy.Add(key, size) {
+		if node, ok := s.data[victim]; ok {
+			s.forget(node)
+			evicted = append(evicted, eviction{node.key, node.value, EvictedCapacity})
+		}
+	}
+	s.mu.Unlock()
+	c.evictions.Add(int64(len(evicted)))
+	c.notify(evicted)
+}
+
+// get retrieves an item, recording the hit with the eviction policy
+func (c *localCache) get(key string) (interface{}, bool) {
+	value, _, ok := c.lookup(key)
+	return value, ok
+}
+
+// lookup is get, also reporting whether the item is stale
+func (c *localCache) lookup(key string) (value interface{}, stale bool, ok bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	node, ok := s.data[key]
+	if !ok {
+		s.mu.Unlock()
+		c.misses.Add(1)
+		return nil, false, false
+	}
+	now := time.Now()
+	if now.After(node.expiry) {
+		// Drop the item now rather than waiting for reclaim
+		s.drop(node)
+		s.mu.Unlock()
+		c.misses.Add(1)
+		c.expirations.Add(1)
+		c.notify([]eviction{{node.key, node.value, EvictedExpired}})
+		return nil, false, false
+	}
+	s.policy.Access(key)
+	value, stale = node.value, now.After(node.stale)
+	s.mu.Unlock()
+	c.hits.Add(1)
+	return value, stale, true
+}
+
+// delete removes an item
+func (c *localCache) delete(key string) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if node, ok := s.data[key]; ok {
+		s.drop(node)
+	}
+}
+
+// len returns the number of items held, including expired items not yet reclaimed
+func (c *localCache) len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		n += len(s.data)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// stats returns the cache's counters
+func (c *localCache) stats() CacheStats {
+	stats := CacheStats{
+		Policy:      c.policy,
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		Evictions:   c.evictions.Load(),
+		Expirations: c.expirations.Load(),
+		Capacity:    c.capacity,
+	}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		stats.Items += len(s.data)
+		stats.Size += s.size
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+// entries returns a snapshot of the items that are not stale
+func (c *localCache) entries() []localEntry {
+	now := time.Now()
+	var entries []localEntry
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for key, node := range s.data {
+			if now.Before(node.stale) {
+				entries = append(entries, localEntry{key, node.value, node.stale})
+			}
+		}
+		s.mu.Unlock()
+	}
+	return entries
+}
+
+// reclaim drops every item that expired by now, one shard at a time
+func (c *localCache) reclaim(now time.Time) {
+	for _, s := range c.shards {
+		var evicted []eviction
+		s.mu.Lock()
+		for len(s.expiries) > 0 && now.After(s.expiries[0].expiry) {
+			node := s.expiries[0]
+			s.drop(node)
+			evicted = append(evicted, eviction{node.key, node.value, EvictedExpired})
+		}
+		s.mu.Unlock()
+		c.expirations.Add(int64(len(evicted)))
+		c.notify(evicted)
+	}
+}
+
+// expiryInterval is how often reclaim runs for a cache whose default TTL is ttl
+func expiryInterval(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return maxExpiryInterval
+	}
+	return max(min(ttl/2, maxExpiryInterval), time.Millisecond)
+}
+
+// drop removes a node from the shard and its eviction policy
+func (s *cacheShard) drop(node *Node) {
+	s.forget(node)
+	s.policy.Remove(node.key)
+}
+
+// forget removes a node from the shard's map and expiry heap
+func (s *cacheShard) forget(node *Node) {
+	delete(s.data, node.key)
+	s.size -= node.size
+	heap.Remove(&s.expiries, node.index)
+}
+
+// expiryHeap orders nodes by expiry time, soonest first
+type expiryHeap []*Node
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiry.Before(h[j].expiry) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	node := x.(*Node)
+	node.index = len(*h)
+	*h = append(*h, node)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	node := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return node
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// peerTimeout bounds calls from one cache node to another, apart from reads
+// that may load the key on its owner
+const peerTimeout = 2 * time.Second
+
+// maxPeerValueBytes bounds the size of a value accepted from a peer
+const maxPeerValueBytes = 16 << 20
+
+// peerValue is the wire form of a cached value. Values travel as JSON, so a
+// value read from a remote node comes back as the types encoding/json decodes
+// into: strings, float64, bool, []interface{} or map[string]interface{}.
+type peerValue struct {
+	Value interface{} `json:"value"`
+	// TTL is the item's TTL in milliseconds when it is stored, or 0 for the
+	// receiving node's default
+	TTL int64 `json:"ttl_ms,omitempty"`
+}
+
+// Handler serves the peer protocol, which other nodes use to reach the keys
+// this node owns:
+//
+//	GET    /cache/{key}  200 with {"value": ...}, or 404 if missing
+//	PUT    /cache/{key}  store {"value": ..., "ttl_ms": ...}, 204
+//	DELETE /cache/{key}  204
+//
+// Requests are always served by this node, loading and persisting keys as
+// configured, and never forwarded again, so nodes with briefly different
+// views of the membership cannot loop. Failed loads and writes to the
+// store are answered with 502.
+func (c *DistributedLRUCache) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /cache/{key}", func(w http.ResponseWriter, r *http.Request) {
+		value, err := c.getOwned(r.Context(), r.PathValue("key"))
+		switch {
+		case errors.Is(err, ErrNotFound):
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(peerValue{Value: value}); err != nil {
+			fmt.Println("Error encoding cached value:", err)
+		}
+	})
+	mux.HandleFunc("PUT /cache/{key}", func(w http.ResponseWriter, r *http.Request) {
+		var body peerValue
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxPeerValueBytes)).Decode(&body); err != nil {
+			http.Error(w, "invalid value: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.TTL < 0 {
+			http.Error(w, "invalid value: negative ttl_ms", http.StatusBadRequest)
+			return
+		}
+		if err := c.setOwned(r.Context(), r.PathValue("key"), body.Value, time.Duration(body.TTL)*time.Millisecond); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("DELETE /cache/{key}", func(w http.ResponseWriter, r *http.Request) {
+		if err := c.deleteOwned(r.Context(), r.PathValue("key")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+// peerClient calls the peer protocol of one remote node
+type peerClient struct {
+	addr   string
+	client *http.Client
+}
+
+func newPeerClient(addr string) *peerClient {
+	// Calls are bounded by their context, as reads may wait for a load
+	return &peerClient{addr: addr, client: &http.Client{}}
+}
+
+func (p *peerClient) url(key string) string {
+	return "http://" + p.addr + "/cache/" + url.PathEscape(key)
+}
+
+func (p *peerClient) do(ctx context.Context, method, key string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, p.url(key), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cache node %s: %v", p.addr, err)
+	}
+	return resp, nil
+}
+
+// Get fetches a key from the peer. A missing key is not an error
+func (p *peerClient) Get(ctx context.Context, key string) (interface{}, bool, error) {
+	resp, err := p.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var body peerValue
+		if err := json.NewDecoder(io.LimitReader(resp.Body, maxPeerValueBytes)).Decode(&body); err != nil {
+			return nil, false, fmt.Errorf("cache node %s: invalid value: %v", p.addr, err)
+		}
+		return body.Value, true, nil
+	case http.StatusNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, statusError(p.addr, resp)
+	}
+}
+
+// Set stores a key on the peer, expiring after ttl, or after the peer's
+// default TTL if ttl is 0
+func (p *peerClient) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	body := peerValue{Value: value}
+	if ttl > 0 {
+		// Round up, so a short TTL does not become the peer's default
+		body.TTL = int64((ttl + time.Millisecond - 1) / time.Millisecond)
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("value for key %s cannot be sent to a peer: %v", key, err)
+	}
+	resp, err := p.do(ctx, http.MethodPut, key, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return statusError(p.addr, resp)
+	}
+	return nil
+}
+
+// Delete removes a key from the peer
+func (p *peerClient) Delete(ctx context.Context, key string) error {
+	resp, err := p.do(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return statusError(p.addr, resp)
+	}
+	return nil
+}
+
+// statusError reports an unexpected response, with the start of its body
+func statusError(addr string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if message := strings.TrimSpace(string(body)); message != "" {
+		return fmt.Errorf("cache node %s: %s: %s", addr, resp.Status, message)
+	}
+	return fmt.Errorf("cache node %s: unexpected status %s", addr, resp.Status)
+}
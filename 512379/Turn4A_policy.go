@@ -0,0 +1,516 @@
+package main
+
+import (
+	"container/list"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// EvictionPolicy decides which items a shard of the local cache evicts to
+// stay within its capacity. Capacity and sizes are in the same units: items
+// when the cache is bounded by count, or bytes when it is bounded by size.
+// The shard's lock is held for every call, so policies need no locking
+type EvictionPolicy interface {
+	// Name identifies the policy in statistics
+	Name() string
+	// Add records that key was stored with size, or resized if the policy
+	// already holds it, and returns the keys to evict to get back within
+	// capacity. The keys may include key itself if the policy rejects it.
+	// Returned keys are already forgotten by the policy
+	Add(key string, size int64) []string
+	// Access records a hit on key
+	Access(key string)
+	// Remove forgets key after it was deleted or expired
+	Remove(key string)
+}
+
+// PolicyFactory creates the eviction policy of one shard with the given capacity
+type PolicyFactory func(capacity int64) EvictionPolicy
+
+// policyEntry is an item tracked by a policy
+type policyEntry struct {
+	key  string
+	size int64
+}
+
+// sizedList is a recency list of entries with their total size. The front is
+// the most recently used entry
+type sizedList struct {
+	order *list.List
+	size  int64
+}
+
+func newSizedList() *sizedList {
+	return &sizedList{order: list.New()}
+}
+
+func (l *sizedList) pushFront(e *policyEntry) *list.Element {
+	l.size += e.size
+	return l.order.PushFront(e)
+}
+
+func (l *sizedList) remove(elem *list.Element) *policyEntry {
+	e := l.order.Remove(elem).(*policyEntry)
+	l.size -= e.size
+	return e
+}
+
+// resize changes the size of the entry at elem and moves it to the front
+func (l *sizedList) resize(elem *list.Element, size int64) {
+	e := elem.Value.(*policyEntry)
+	l.size += size - e.size
+	e.size = size
+	l.order.MoveToFront(elem)
+}
+
+func (l *sizedList) back() *list.Element {
+	return l.order.Back()
+}
+
+// lruPolicy evicts the least recently used items
+type lruPolicy struct {
+	capacity int64
+	items    map[string]*list.Element
+	recency  *sizedList
+}
+
+// NewLRUPolicy evicts the least recently used items. It is the default policy
+func NewLRUPolicy(capacity int64) EvictionPolicy {
+	return &lruPolicy{capacity: capacity, items: make(map[string]*list.Element), recency: newSizedList()}
+}
+
+func (p *lruPolicy) Name() string { return "lru" }
+
+func (p *lruPolicy) Add(key string, size int64) []string {
+	if elem, ok := p.items[key]; ok {
+		p.recency.resize(elem, size)
+	} else {
+		p.items[key] = p.recency.pushFront(&policyEntry{key: key, size: size})
+	}
+	var evicted []string
+	for p.recency.size > p.capacity {
+		e := p.recency.remove(p.recency.back())
+		delete(p.items, e.key)
+		evicted = append(evicted, e.key)
+	}
+	return evicted
+}
+
+func (p *lruPolicy) Access(key string) {
+	if elem, ok := p.items[key]; ok {
+		p.recency.order.MoveToFront(elem)
+	}
+}
+
+func (p *lruPolicy) Remove(key string) {
+	if elem, ok := p.items[key]; ok {
+		p.recency.remove(elem)
+		delete(p.items, key)
+	}
+}
+
+// lfuEntry is an item tracked by lfuPolicy
+type lfuEntry struct {
+	policyEntry
+	freq int
+	elem *list.Element
+}
+
+// lfuPolicy evicts the least frequently used items, and the least recently
+// used among equally frequent ones. Every operation is O(1) apart from
+// finding the next lowest frequency after evicting the last item of one
+type lfuPolicy struct {
+	capacity int64
+	size     int64
+	items    map[string]*lfuEntry
+	freqs    map[int]*list.List
+	minFreq  int
+}
+
+// NewLFUPolicy evicts the least frequently used items. Counts never decay,
+// so items that were popular long ago can crowd out new ones
+func NewLFUPolicy(capacity int64) EvictionPolicy {
+	return &lfuPolicy{capacity: capacity, items: make(map[string]*lfuEntry), freqs: make(map[int]*list.List)}
+}
+
+func (p *lfuPolicy) Name() string { return "lfu" }
+
+func (p *lfuPolicy) Add(key string, size int64) []string {
+	if e, ok := p.items[key]; ok {
+		p.size += size - e.size
+		e.size = size
+		p.touch(e)
+	} else {
+		e := &lfuEntry{policyEntry: policyEntry{key: key, size: size}}
+		p.items[key] = e
+		p.size += size
+		p.push(e, 1)
+		p.minFreq = 1
+	}
+	var evicted []string
+	for p.size > p.capacity {
+		for p.freqs[p.minFreq] == nil {
+			p.minFreq++
+		}
+		e := p.freqs[p.minFreq].Back().Value.(*lfuEntry)
+		p.unlink(e)
+		delete(p.items, e.key)
+		p.size -= e.size
+		evicted = append(evicted, e.key)
+	}
+	return evicted
+}
+
+func (p *lfuPolicy) Access(key string) {
+	if e, ok := p.items[key]; ok {
+		p.touch(e)
+	}
+}
+
+func (p *lfuPolicy) Remove(key string) {
+	if e, ok := p.items[key]; ok {
+		p.unlink(e)
+		delete(p.items, key)
+		p.size -= e.size
+	}
+}
+
+// touch moves an entry to the next frequency
+func (p *lfuPolicy) touch(e *lfuEntry) {
+	freq := e.freq
+	p.unlink(e)
+	if p.minFreq == freq && p.freqs[freq] == nil {
+		p.minFreq = freq + 1
+	}
+	p.push(e, freq+1)
+}
+
+func (p *lfuPolicy) push(e *lfuEntry, freq int) {
+	l := p.freqs[freq]
+	if l == nil {
+		l = list.New()
+		p.freqs[freq] = l
+	}
+	e.freq = freq
+	e.elem = l.PushFront(e)
+}
+
+// unlink removes an entry from its frequency list, dropping the list if empty
+func (p *lfuPolicy) unlink(e *lfuEntry) {
+	l := p.freqs[e.freq]
+	l.Remove(e.elem)
+	if l.Len() == 0 {
+		delete(p.freqs, e.freq)
+	}
+}
+
+// arcPolicy is the Adaptive Replacement Cache of Megiddo and Modha, measured
+// in sizes rather than pages. t1 holds items seen once recently and t2 items
+// seen at least twice; b1 and b2 remember keys recently evicted from each.
+// A hit on a remembered key shifts the target size of t1 towards the list
+// that would have kept it, so the cache adapts between recency and frequency
+// and a scan of new keys only ever displaces t1
+type arcPolicy struct {
+	capacity int64
+	target   int64
+	t1, t2   *sizedList
+	b1, b2   *sizedList
+	items    map[string]*list.Element
+	lists    map[string]*sizedList
+}
+
+// NewARCPolicy evicts with the Adaptive Replacement Cache algorithm, which
+// resists scans and adapts to the mix of recency and frequency in the workload
+func NewARCPolicy(capacity int64) EvictionPolicy {
+	return &arcPolicy{
+		capacity: capacity,
+		t1:       newSizedList(),
+		t2:       newSizedList(),
+		b1:       newSizedList(),
+		b2:       newSizedList(),
+		items:    make(map[string]*list.Element),
+		lists:    make(map[string]*sizedList),
+	}
+}
+
+func (p *arcPolicy) Name() string { return "arc" }
+
+func (p *arcPolicy) Add(key string, size int64) []string {
+	from := p.lists[key]
+	hitB2 := from == p.b2
+	switch from {
+	case p.b1:
+		// The item was evicted from t1 too soon, so grow t1's target
+		p.target = min(p.target+max(p.b2.size/max(p.b1.size, 1), 1)*size, p.capacity)
+	case p.b2:
+		// The item was evicted from t2 too soon, so shrink t1's target
+		p.target = max(p.target-max(p.b1.size/max(p.b2.size, 1), 1)*size, 0)
+	}
+	if from != nil {
+		p.forget(key)
+	}
+	if size > p.capacity {
+		return []string{key}
+	}
+	evicted := p.replace(size, hitB2)
+	if from == nil {
+		p.insert(p.t1, key, size)
+	} else {
+		// Replacing a resident item counts as a hit, as does a ghost hit
+		p.insert(p.t2, key, size)
+	}
+	p.trimGhosts()
+	return evicted
+}
+
+func (p *arcPolicy) Access(key string) {
+	if from := p.lists[key]; from == p.t1 || from == p.t2 {
+		elem := p.items[key]
+		e := from.remove(elem)
+		p.items[key] = p.t2.pushFront(e)
+		p.lists[key] = p.t2
+	}
+}
+
+func (p *arcPolicy) Remove(key string) {
+	if from := p.lists[key]; from == p.t1 || from == p.t2 {
+		p.forget(key)
+	}
+}
+
+func (p *arcPolicy) insert(l *sizedList, key string, size int64) {
+	p.items[key] = l.pushFront(&policyEntry{key: key, size: size})
+	p.lists[key] = l
+}
+
+func (p *arcPolicy) forget(key string) {
+	p.lists[key].remove(p.items[key])
+	delete(p.items, key)
+	delete(p.lists, key)
+}
+
+// replace evicts resident items into the ghost lists until an item of size
+// fits, taking from t1 while it is over its target
+func (p *arcPolicy) replace(size int64, hitB2 bool) []string {
+	var evicted []string
+	for p.t1.size+p.t2.size+size > p.capacity {
+		from, ghost := p.t2, p.b2
+		if p.t1.order.Len() > 0 && (p.t1.size > p.target || hitB2 && p.t1.size == p.target || p.t2.order.Len() == 0) {
+			from, ghost = p.t1, p.b1
+		}
+		e := from.remove(from.back())
+		p.items[e.key] = ghost.pushFront(e)
+		p.lists[e.key] = ghost
+		evicted = append(evicted, e.key)
+	}
+	return evicted
+}
+
+// trimGhosts bounds the ghost lists, so t1 and b1 together stay within the
+// capacity and all four lists within twice the capacity
+func (p *arcPolicy) trimGhosts() {
+	for p.b1.order.Len() > 0 && p.t1.size+p.b1.size > p.capacity {
+		p.forget(p.b1.back().Value.(*policyEntry).key)
+	}
+	for p.t1.size+p.t2.size+p.b1.size+p.b2.size > 2*p.capacity {
+		ghost := p.b2
+		if ghost.order.Len() == 0 {
+			ghost = p.b1
+		}
+		if ghost.order.Len() == 0 {
+			return
+		}
+		p.forget(ghost.back().Value.(*policyEntry).key)
+	}
+}
+
+// countMinSketch estimates how often keys were seen, in 4-bit counters that
+// are halved once enough samples were added, so old popularity fades
+type countMinSketch struct {
+	rows    [4][]uint8
+	mask    uint64
+	samples int
+	limit   int
+}
+
+func newCountMinSketch(width int) *countMinSketch {
+	size := 64
+	for size < width {
+		size *= 2
+	}
+	s := &countMinSketch{mask: uint64(size - 1), limit: 10 * size}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, size)
+	}
+	return s
+}
+
+// index returns the counter of key in row i, by double hashing
+func (s *countMinSketch) index(hash uint64, i int) uint64 {
+	h1, h2 := hash, hash>>32|hash<<32
+	return (h1 + uint64(i)*h2) & s.mask
+}
+
+func (s *countMinSketch) add(key string) {
+	hash := xxhash.Sum64String(key)
+	for i := range s.rows {
+		if c := &s.rows[i][s.index(hash, i)]; *c < 15 {
+			*c++
+		}
+	}
+	if s.samples++; s.samples >= s.limit {
+		s.reset()
+	}
+}
+
+func (s *countMinSketch) estimate(key string) uint8 {
+	hash := xxhash.Sum64String(key)
+	estimate := uint8(15)
+	for i := range s.rows {
+		estimate = min(estimate, s.rows[i][s.index(hash, i)])
+	}
+	return estimate
+}
+
+// reset halves every counter
+func (s *countMinSketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] /= 2
+		}
+	}
+	s.samples /= 2
+}
+
+// tinyLFUPolicy is W-TinyLFU, as in Caffeine. New items enter a small LRU
+// window. Items leaving the window only enter the main segmented LRU if the
+// frequency sketch says they are more popular than the item the main cache
+// would evict for them, so one-off keys from scans never displace hot ones
+type tinyLFUPolicy struct {
+	sketch *countMinSketch
+	items  map[string]*list.Element
+	lists  map[string]*sizedList
+
+	window, probation, protected *sizedList
+
+	windowCapacity, protectedCapacity, mainCapacity int64
+}
+
+// NewTinyLFUPolicy evicts with W-TinyLFU, which admits items by their
+// estimated frequency and keeps a small LRU window for recency bursts
+func NewTinyLFUPolicy(capacity int64) EvictionPolicy {
+	windowCapacity := max(capacity/100, 1)
+	mainCapacity := max(capacity-windowCapacity, 0)
+	// The sketch needs about one counter per item; byte capacities
+	// overestimate the item count, so the width is bounded
+	return &tinyLFUPolicy{
+		sketch:            newCountMinSketch(int(min(capacity, 1<<20))),
+		items:             make(map[string]*list.Element),
+		lists:             make(map[string]*sizedList),
+		window:            newSizedList(),
+		probation:         newSizedList(),
+		protected:         newSizedList(),
+		windowCapacity:    windowCapacity,
+		protectedCapacity: mainCapacity * 8 / 10,
+		mainCapacity:      mainCapacity,
+	}
+}
+
+func (p *tinyLFUPolicy) Name() string { return "w-tinylfu" }
+
+func (p *tinyLFUPolicy) Add(key string, size int64) []string {
+	p.sketch.add(key)
+	if elem, ok := p.items[key]; ok {
+		p.lists[key].resize(elem, size)
+		p.hit(key)
+	} else {
+		p.items[key] = p.window.pushFront(&policyEntry{key: key, size: size})
+		p.lists[key] = p.window
+	}
+	return p.evict()
+}
+
+func (p *tinyLFUPolicy) Access(key string) {
+	if _, ok := p.items[key]; ok {
+		p.sketch.add(key)
+		p.hit(key)
+	}
+}
+
+func (p *tinyLFUPolicy) Remove(key string) {
+	if elem, ok := p.items[key]; ok {
+		p.lists[key].remove(elem)
+		delete(p.items, key)
+		delete(p.lists, key)
+	}
+}
+
+// hit moves an item up: within the window, from probation to protected, or
+// within protected
+func (p *tinyLFUPolicy) hit(key string) {
+	elem, from := p.items[key], p.lists[key]
+	if from != p.probation {
+		from.order.MoveToFront(elem)
+		return
+	}
+	p.move(key, p.protected)
+	// Demote protected items beyond its share back to probation
+	for p.protected.size > p.protectedCapacity && p.protected.order.Len() > 1 {
+		p.move(p.protected.back().Value.(*policyEntry).key, p.probation)
+	}
+}
+
+func (p *tinyLFUPolicy) move(key string, to *sizedList) {
+	e := p.lists[key].remove(p.items[key])
+	p.items[key] = to.pushFront(e)
+	p.lists[key] = to
+}
+
+func (p *tinyLFUPolicy) drop(elem *list.Element) string {
+	key := p.lists[elem.Value.(*policyEntry).key].remove(elem).key
+	delete(p.items, key)
+	delete(p.lists, key)
+	return key
+}
+
+// evict moves items out of a full window into probation, then evicts from
+// the main cache until it fits, each time keeping whichever of the newest
+// candidate and the probation victim is estimated more popular
+func (p *tinyLFUPolicy) evict() []string {
+	var candidates []*list.Element
+	for p.window.size > p.windowCapacity && p.window.order.Len() > 0 {
+		key := p.window.back().Value.(*policyEntry).key
+		p.move(key, p.probation)
+		candidates = append(candidates, p.items[key])
+	}
+
+	var evicted []string
+	for p.probation.size+p.protected.size > p.mainCapacity {
+		victim := p.probation.back()
+		if victim == nil {
+			victim = p.protected.back()
+		}
+		if victim == nil {
+			break
+		}
+		if len(candidates) == 0 {
+			evicted = append(evicted, p.drop(victim))
+			continue
+		}
+		candidate := candidates[len(candidates)-1]
+		if candidate == victim {
+			candidates = candidates[:len(candidates)-1]
+			evicted = append(evicted, p.drop(victim))
+			continue
+		}
+		candidateKey := candidate.Value.(*policyEntry).key
+		victimKey := victim.Value.(*policyEntry).key
+		if p.sketch.estimate(candidateKey) > p.sketch.estimate(victimKey) {
+			evicted = append(evicted, p.drop(victim))
+		} else {
+			candidates = candidates[:len(candidates)-1]
+			evicted = append(evicted, p.drop(candidate))
+		}
+	}
+	return evicted
+}
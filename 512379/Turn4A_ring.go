@@ -0,0 +1,100 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// defaultVirtualNodes is how many points a node of weight 1 has on the ring
+const defaultVirtualNodes = 160
+
+// RingConfig configures how nodes are placed on the hash ring
+type RingConfig struct {
+	// VirtualNodes is the number of points per unit of weight (160 by default).
+	// More points spread keys more evenly at the cost of a larger ring
+	VirtualNodes int
+	// Weights gives nodes a share of the keys proportional to their weight.
+	// Nodes without a weight, or with a weight below 1, have weight 1
+	Weights map[string]int
+}
+
+// ringPoint is one virtual node: a position on the ring and the node it belongs to
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+// HashRing is a consistent hash ring. Each node is hashed onto the ring at
+// several points, and a key belongs to the node of the first point at or
+// after the key's hash. Adding or removing a node only moves the keys next to
+// its points, about 1/N of them, instead of nearly all of them as hashing
+// modulo the node count does.
+//
+// A HashRing is immutable, so it can be read without locking and replaced
+// when membership changes.
+type HashRing struct {
+	points []ringPoint
+	nodes  int
+}
+
+// NewHashRing places nodes on a ring according to config
+func NewHashRing(nodes []string, config RingConfig) *HashRing {
+	vnodes := config.VirtualNodes
+	if vnodes <= 0 {
+		vnodes = defaultVirtualNodes
+	}
+	nodes = normalizeNodes(nodes)
+	ring := &HashRing{nodes: len(nodes)}
+	for _, node := range nodes {
+		weight := max(config.Weights[node], 1)
+		for i := 0; i < vnodes*weight; i++ {
+			ring.points = append(ring.points, ringPoint{hash: xxhash.Sum64String(node + "#" + strconv.Itoa(i)), node: node})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		a, b := ring.points[i], ring.points[j]
+		// Break the rare hash collision by node, so every node builds the same ring
+		return a.hash < b.hash || a.hash == b.hash && a.node < b.node
+	})
+	return ring
+}
+
+// Lookup returns the node that owns key, or false if the ring is empty
+func (r *HashRing) Lookup(key string) (string, bool) {
+	if len(r.points) == 0 {
+		return "", false
+	}
+	return r.points[r.search(key)].node, true
+}
+
+// LookupN returns up to n distinct nodes for key, starting with its owner and
+// continuing clockwise around the ring. Replicas of a key belong on these nodes
+func (r *HashRing) LookupN(key string, n int) []string {
+	n = min(n, r.nodes)
+	if n <= 0 {
+		return nil
+	}
+	nodes := make([]string, 0, n)
+	start := r.search(key)
+	for i := 0; i < len(r.points) && len(nodes) < n; i++ {
+		node := r.points[(start+i)%len(r.points)].node
+		if !slices.Contains(nodes, node) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// search returns the index of the first point at or after key's hash,
+// wrapping around to the first point
+func (r *HashRing) search(key string) int {
+	hash := xxhash.Sum64String(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+	if i == len(r.points) {
+		return 0
+	}
+	return i
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Write-behind defaults, used where StoreConfig leaves a field zero
+const (
+	defaultBatchSize     = 100
+	defaultFlushInterval = time.Second
+	defaultStoreRetries  = 3
+	defaultRetryBackoff  = 100 * time.Millisecond
+	maxRetryBackoff      = 5 * time.Second
+)
+
+// StoreWrite is one change to persist: a value for Key, or its deletion
+type StoreWrite struct {
+	Key    string
+	Value  interface{}
+	Delete bool
+}
+
+// Store persists the writes made to the keys a node owns, usually to a
+// database. Writes in one call are for distinct keys
+type Store interface {
+	Write(ctx context.Context, writes []StoreWrite) error
+}
+
+// StoreConfig configures persistence. By default writes go through to the
+// store before Set and Delete return, and fail if the store fails. With
+// WriteBehind they are queued and persisted in batches in the background;
+// writes to a key still queued replace the earlier write
+type StoreConfig struct {
+	Store       Store
+	WriteBehind bool
+	// BatchSize is the most writes persisted in one call (100 by default)
+	BatchSize int
+	// FlushInterval is how often queued writes are persisted (1 second by default)
+	FlushInterval time.Duration
+	// Retries is how many times a failed write is retried (3 by default).
+	// Write-behind batches that still fail stay queued for the next flush
+	Retries int
+	// RetryBackoff is the delay before the first retry, doubling for each
+	// further retry (100 milliseconds by default)
+	RetryBackoff time.Duration
+}
+
+// storeWriter persists writes as configured
+type storeWriter struct {
+	config StoreConfig
+
+	mu      sync.Mutex
+	pending map[string]StoreWrite
+	order   []string // keys of pending writes, oldest first
+
+	flushNow chan struct{}
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+func newStoreWriter(config StoreConfig) *storeWriter {
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = defaultFlushInterval
+	}
+	if config.Retries <= 0 {
+		config.Retries = defaultStoreRetries
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = defaultRetryBackoff
+	}
+	w := &storeWriter{
+		config:   config,
+		pending:  make(map[string]StoreWrite),
+		flushNow: make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if config.WriteBehind {
+		go w.run()
+	} else {
+		close(w.done)
+	}
+	return w
+}
+
+// write persists a write, or queues it when writing behind
+func (w *storeWriter) write(ctx context.Context, write StoreWrite) error {
+	if !w.config.WriteBehind {
+		return w.writeBatch(ctx, []StoreWrite{write})
+	}
+	w.mu.Lock()
+	if _, ok := w.pending[write.Key]; !ok {
+		w.order = append(w.order, write.Key)
+	}
+	w.pending[write.Key] = write
+	full := len(w.pending) >= w.config.BatchSize
+	w.mu.Unlock()
+	if full {
+		select {
+		case w.flushNow <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// writeBatch calls the store, retrying failures with exponential backoff
+func (w *storeWriter) writeBatch(ctx context.Context, batch []StoreWrite) error {
+	backoff := w.config.RetryBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = w.config.Store.Write(ctx, batch); err == nil {
+			return nil
+		}
+		if attempt == w.config.Retries || !sleepContext(ctx, backoff) {
+			return fmt.Errorf("persisting %d writes: %v", len(batch), err)
+		}
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
+
+// run flushes queued writes every FlushInterval, or sooner once a batch is full
+func (w *storeWriter) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.flushNow:
+		case <-w.quit:
+			return
+		}
+		if err := w.flush(context.Background()); err != nil {
+			fmt.Println("Error writing behind to the store:", err)
+		}
+	}
+}
+
+// flush persists every queued write in batches. Batches that fail are
+// queued again, unless newer writes to their keys were queued meanwhile
+func (w *storeWriter) flush(ctx context.Context) error {
+	w.mu.Lock()
+	pending, order := w.pending, w.order
+	w.pending, w.order = make(map[string]StoreWrite), nil
+	w.mu.Unlock()
+
+	var failed []StoreWrite
+	var lastErr error
+	for start := 0; start < len(order); start += w.config.BatchSize {
+		keys := order[start:min(start+w.config.BatchSize, len(order))]
+		batch := make([]StoreWrite, len(keys))
+		for i, key := range keys {
+			batch[i] = pending[key]
+		}
+		if err := w.writeBatch(ctx, batch); err != nil {
+			failed = append(failed, batch...)
+			lastErr = err
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	requeued := make([]string, 0, len(failed)+len(w.order))
+	for _, write := range failed {
+		if _, ok := w.pending[write.Key]; !ok {
+			w.pending[write.Key] = write
+			requeued = append(requeued, write.Key)
+		}
+	}
+	w.order = append(requeued, w.order...)
+	return fmt.Errorf("%d writes left queued: %v", len(failed), lastErr)
+}
+
+// queued returns the number of writes waiting to be persisted
+func (w *storeWriter) queued() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.pending)
+}
+
+// close stops the background flushes and persists the writes still queued
+func (w *storeWriter) close(ctx context.Context) error {
+	if !w.config.WriteBehind {
+		return nil
+	}
+	close(w.quit)
+	<-w.done
+	return w.flush(ctx)
+}
@@ -0,0 +1,1237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startCluster runs n cache nodes on loopback, each knowing all the others
+func startCluster(t *testing.T, n, capacity int) []*DistributedLRUCache {
+	t.Helper()
+	return startClusterWithConfig(t, n, LocalCacheConfig{Capacity: capacity, TTL: time.Minute})
+}
+
+// startClusterWithConfig is startCluster with each node's local cache configured by config
+func startClusterWithConfig(t *testing.T, n int, config LocalCacheConfig) []*DistributedLRUCache {
+	t.Helper()
+	listeners := make([]net.Listener, n)
+	addrs := make([]string, n)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		listeners[i], addrs[i] = l, l.Addr().String()
+	}
+
+	nodes := make([]*DistributedLRUCache, n)
+	for i, l := range listeners {
+		nodes[i] = NewCacheNodeWithConfig(config, addrs[i], addrs)
+		server := &httptest.Server{Listener: l, Config: &http.Server{Handler: nodes[i].Handler()}}
+		server.Start()
+		t.Cleanup(server.Close)
+		t.Cleanup(nodes[i].Close)
+	}
+	return nodes
+}
+
+// localKeys returns the number of keys held in a node's own LRU
+func localKeys(c *DistributedLRUCache) int {
+	return c.local.len()
+}
+
+func TestClusterForwardsToOwner(t *testing.T) {
+	nodes := startCluster(t, 3, 100)
+
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key/%d with spaces", i)
+		if err := nodes[i%3].Set(key, fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatalf("Set(%q): %v", key, err)
+		}
+	}
+
+	total := 0
+	for _, node := range nodes {
+		total += localKeys(node)
+	}
+	if total != 30 {
+		t.Fatalf("expected every key to be stored once across the cluster, got %d copies", total)
+	}
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key/%d with spaces", i)
+		for j, node := range nodes {
+			value, ok := node.Get(key)
+			if !ok || value != fmt.Sprintf("value-%d", i) {
+				t.Fatalf("node %d: Get(%q) = %v, %v", j, key, value, ok)
+			}
+		}
+	}
+
+	// Keys owned by a node are served from its local LRU
+	for _, node := range nodes {
+		for _, entry := range node.local.entries() {
+			if owner, _ := node.getCacheNode(entry.key); owner != node.self {
+				t.Fatalf("node %s holds key %q owned by %s", node.self, entry.key, owner)
+			}
+		}
+	}
+
+	if err := nodes[0].Delete("key/1 with spaces"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	for j, node := range nodes {
+		if _, ok := node.Get("key/1 with spaces"); ok {
+			t.Fatalf("node %d still sees a deleted key", j)
+		}
+	}
+}
+
+func TestClusterValuesRoundTripAsJSON(t *testing.T) {
+	nodes := startCluster(t, 2, 10)
+	value := map[string]interface{}{"name": "ada", "tags": []interface{}{"a", "b"}, "age": 36.0}
+	// Find a key each node owns, so both the local and remote paths are used
+	for _, node := range nodes {
+		key := ""
+		for i := 0; key == ""; i++ {
+			if owner, _ := node.getCacheNode(fmt.Sprint(i)); owner == node.self {
+				key = fmt.Sprint(i)
+			}
+		}
+		if err := nodes[0].Set(key, value); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		got, ok := nodes[1].Get(key)
+		if !ok || fmt.Sprint(got) != fmt.Sprint(value) {
+			t.Fatalf("Get(%q) = %v, %v", key, got, ok)
+		}
+	}
+
+	// Values sent to a peer must be encodable as JSON
+	for i := 0; ; i++ {
+		key := fmt.Sprint(i)
+		if owner, _ := nodes[0].getCacheNode(key); owner == nodes[1].self {
+			if err := nodes[0].Set(key, make(chan int)); err == nil {
+				t.Fatalf("expected an error sending a value that cannot be encoded")
+			}
+			break
+		}
+	}
+}
+
+func TestClusterUnreachablePeer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+	node := NewCacheNode(10, time.Minute, "127.0.0.1:1", []string{"127.0.0.1:1", dead})
+	defer node.Close()
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprint(i)
+		owner, _ := node.getCacheNode(key)
+		if owner != dead {
+			continue
+		}
+		if err := node.Set(key, "v"); err == nil {
+			t.Fatalf("expected Set to a dead peer to fail")
+		}
+		if _, ok := node.Get(key); ok {
+			t.Fatalf("expected Get from a dead peer to miss")
+		}
+		return
+	}
+	t.Fatalf("no key owned by the dead peer")
+}
+
+func TestClusterConcurrentAccess(t *testing.T) {
+	nodes := startCluster(t, 3, 50)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			node := nodes[g%3]
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprint(i % 20)
+				node.Set(key, i)
+				node.Get(key)
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+// collectUpdates runs a discovery watch, sending each update to the returned channel
+func collectUpdates(t *testing.T, discovery Discovery) <-chan []string {
+	t.Helper()
+	updates := make(chan []string, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := discovery.Watch(ctx, func(nodes []string) { updates <- nodes }); err != nil {
+			t.Errorf("Watch: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return updates
+}
+
+// waitForNodes waits for an update listing exactly want
+func waitForNodes(t *testing.T, updates <-chan []string, want ...string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case nodes := <-updates:
+			if slices.Equal(nodes, want) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for nodes %v", want)
+		}
+	}
+}
+
+func TestStaticDiscovery(t *testing.T) {
+	discovery := StaticDiscovery{"b:1", "a:1", "b:1", ""}
+	if nodes, _ := discovery.Nodes(context.Background()); !slices.Equal(nodes, []string{"a:1", "b:1"}) {
+		t.Fatalf("unexpected nodes %v", nodes)
+	}
+	waitForNodes(t, collectUpdates(t, discovery), "a:1", "b:1")
+}
+
+func TestFileDiscovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes")
+	os.WriteFile(path, []byte("# cache nodes\n10.0.0.1:7000\n\n10.0.0.2:7000\n"), 0o644)
+	updates := collectUpdates(t, FileDiscovery{Path: path})
+	waitForNodes(t, updates, "10.0.0.1:7000", "10.0.0.2:7000")
+
+	// Replace the file the way config management does
+	tmp := path + ".tmp"
+	os.WriteFile(tmp, []byte("10.0.0.3:7000\n10.0.0.1:7000\n"), 0o644)
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	waitForNodes(t, updates, "10.0.0.1:7000", "10.0.0.3:7000")
+}
+
+type fakeSRVResolver struct {
+	mu      sync.Mutex
+	records []*net.SRV
+}
+
+func (r *fakeSRVResolver) set(records ...*net.SRV) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = records
+}
+
+func (r *fakeSRVResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if service != "cache" || proto != "tcp" || name != "cache.example.com" {
+		return "", nil, fmt.Errorf("unexpected lookup _%s._%s.%s", service, proto, name)
+	}
+	return "", r.records, nil
+}
+
+func TestDNSSRVDiscovery(t *testing.T) {
+	resolver := &fakeSRVResolver{}
+	resolver.set(&net.SRV{Target: "node1.example.com.", Port: 7000}, &net.SRV{Target: "node2.example.com.", Port: 7001})
+	updates := collectUpdates(t, DNSSRVDiscovery{Service: "cache", Proto: "tcp", Name: "cache.example.com", Interval: 10 * time.Millisecond, Resolver: resolver})
+	waitForNodes(t, updates, "node1.example.com:7000", "node2.example.com:7001")
+
+	resolver.set(&net.SRV{Target: "node2.example.com.", Port: 7001})
+	waitForNodes(t, updates, "node2.example.com:7001")
+}
+
+// fakeConsul serves the KV list endpoint with blocking queries
+type fakeConsul struct {
+	mu      sync.Mutex
+	index   uint64
+	nodes   []string
+	changed chan struct{}
+	queries int
+}
+
+func newFakeConsul(t *testing.T, nodes ...string) (*fakeConsul, *httptest.Server) {
+	f := &fakeConsul{index: 1, nodes: nodes, changed: make(chan struct{})}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/cache_nodes" {
+			http.NotFound(w, r)
+			return
+		}
+		wait, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+		f.mu.Lock()
+		f.queries++
+		if wait != 0 && wait == f.index {
+			changed := f.changed
+			f.mu.Unlock()
+			select {
+			case <-changed:
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+				return
+			}
+			f.mu.Lock()
+		}
+		pairs := make([]map[string]interface{}, len(f.nodes))
+		for i, node := range f.nodes {
+			pairs[i] = map[string]interface{}{"Key": fmt.Sprintf("cache_nodes/%d", i), "Value": []byte(node)}
+		}
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(pairs)
+	}))
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func (f *fakeConsul) set(nodes ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nodes = nodes
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func TestConsulDiscovery(t *testing.T) {
+	consul, server := newFakeConsul(t, "a:7000")
+	discovery, err := NewConsulDiscovery(strings.TrimPrefix(server.URL, "http://"), "cache_nodes")
+	if err != nil {
+		t.Fatalf("NewConsulDiscovery: %v", err)
+	}
+	updates := collectUpdates(t, discovery)
+	waitForNodes(t, updates, "a:7000")
+
+	consul.set("a:7000", "b:7000")
+	waitForNodes(t, updates, "a:7000", "b:7000")
+
+	// Watches block on the index rather than polling
+	time.Sleep(100 * time.Millisecond)
+	consul.mu.Lock()
+	queries := consul.queries
+	consul.mu.Unlock()
+	if queries > 4 {
+		t.Fatalf("expected blocking queries, got %d queries", queries)
+	}
+}
+
+func TestMembershipChangeHandsOffKeys(t *testing.T) {
+	nodes := startCluster(t, 2, 100)
+	all := nodes[0].Nodes()
+	alone := []string{nodes[0].self}
+	nodes[0].SetNodes(alone)
+	nodes[1].SetNodes(alone)
+
+	for i := 0; i < 40; i++ {
+		if err := nodes[0].Set(fmt.Sprint(i), i); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if localKeys(nodes[0]) != 40 {
+		t.Fatalf("expected a single node to own every key")
+	}
+
+	events := make(chan MembershipEvent, 1)
+	nodes[0].OnMembershipChange(func(event MembershipEvent) { events <- event })
+	nodes[1].SetNodes(all)
+	nodes[0].SetNodes(all)
+	event := <-events
+	if !slices.Equal(event.Nodes, all) || !slices.Equal(event.Added, []string{nodes[1].self}) || len(event.Removed) != 0 {
+		t.Fatalf("unexpected membership event %+v", event)
+	}
+
+	moved := localKeys(nodes[1])
+	if moved == 0 || moved+localKeys(nodes[0]) != 40 {
+		t.Fatalf("expected the new node's keys to move to it, got %d and %d", localKeys(nodes[0]), moved)
+	}
+	for i := 0; i < 40; i++ {
+		if value, ok := nodes[1].Get(fmt.Sprint(i)); !ok || value != float64(i) && value != i {
+			t.Fatalf("Get(%d) = %v, %v after hand-off", i, value, ok)
+		}
+	}
+}
+
+func TestNewDistributedLRUCacheFollowsDiscovery(t *testing.T) {
+	consul, server := newFakeConsul(t, "127.0.0.1:1")
+	discovery, _ := NewConsulDiscovery(strings.TrimPrefix(server.URL, "http://"), "cache_nodes")
+	cache, err := NewDistributedLRUCache(10, time.Minute, "127.0.0.1:1", discovery)
+	if err != nil {
+		t.Fatalf("NewDistributedLRUCache: %v", err)
+	}
+	defer cache.Close()
+
+	changed := make(chan MembershipEvent, 1)
+	cache.OnMembershipChange(func(event MembershipEvent) { changed <- event })
+	consul.set("127.0.0.1:1", "127.0.0.1:2")
+	select {
+	case event := <-changed:
+		if !slices.Equal(event.Added, []string{"127.0.0.1:2"}) {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("membership change was not applied")
+	}
+
+	server.Close()
+	if _, err := NewDistributedLRUCache(10, time.Minute, "127.0.0.1:1", discovery); err == nil {
+		t.Fatalf("expected an error when discovery is unreachable")
+	}
+}
+
+// ringNodes returns n node addresses
+func ringNodes(n int) []string {
+	nodes := make([]string, n)
+	for i := range nodes {
+		nodes[i] = fmt.Sprintf("10.0.0.%d:7000", i+1)
+	}
+	return nodes
+}
+
+// ringOwners maps keys to their owners on ring
+func ringOwners(ring *HashRing, keys int) []string {
+	owners := make([]string, keys)
+	for i := range owners {
+		owners[i], _ = ring.Lookup("key-" + strconv.Itoa(i))
+	}
+	return owners
+}
+
+func TestHashRingRemapsFewKeys(t *testing.T) {
+	const keys = 100000
+	nodes := ringNodes(10)
+	before := ringOwners(NewHashRing(nodes, RingConfig{}), keys)
+
+	added := "10.0.0.11:7000"
+	after := ringOwners(NewHashRing(append(nodes, added), RingConfig{}), keys)
+	moved := 0
+	for i := range before {
+		if before[i] != after[i] {
+			moved++
+			if after[i] != added {
+				t.Fatalf("key %d moved from %s to %s rather than to the new node", i, before[i], after[i])
+			}
+		}
+	}
+	// Ideally 1/11 of the keys move to the new node
+	if fraction := float64(moved) / keys; fraction < 0.06 || fraction > 0.13 {
+		t.Fatalf("adding a node remapped %.3f of keys, want about %.3f", fraction, 1.0/11)
+	}
+
+	removed := nodes[3]
+	after = ringOwners(NewHashRing(slices.Delete(slices.Clone(nodes), 3, 4), RingConfig{}), keys)
+	moved = 0
+	for i := range before {
+		if before[i] != after[i] {
+			moved++
+			if before[i] != removed {
+				t.Fatalf("key %d moved from %s although only %s was removed", i, before[i], removed)
+			}
+		}
+	}
+	if fraction := float64(moved) / keys; fraction < 0.06 || fraction > 0.14 {
+		t.Fatalf("removing a node remapped %.3f of keys, want about %.3f", fraction, 1.0/10)
+	}
+}
+
+func TestHashRingLoadDistribution(t *testing.T) {
+	const keys = 100000
+	nodes := ringNodes(10)
+	load := make(map[string]int)
+	for _, owner := range ringOwners(NewHashRing(nodes, RingConfig{}), keys) {
+		load[owner]++
+	}
+	mean := float64(keys) / float64(len(nodes))
+	for _, node := range nodes {
+		if deviation := float64(load[node])/mean - 1; deviation < -0.2 || deviation > 0.2 {
+			t.Errorf("node %s owns %d keys, %.0f%% off the mean of %.0f", node, load[node], deviation*100, mean)
+		}
+	}
+
+	// A node with weight 3 owns about three times the keys of the others
+	heavy := nodes[0]
+	load = make(map[string]int)
+	for _, owner := range ringOwners(NewHashRing(nodes, RingConfig{Weights: map[string]int{heavy: 3}}), keys) {
+		load[owner]++
+	}
+	if share, want := float64(load[heavy])/keys, 3.0/12; share < want*0.8 || share > want*1.2 {
+		t.Errorf("node with weight 3 owns %.3f of keys, want about %.3f", share, want)
+	}
+}
+
+func TestHashRingLookupN(t *testing.T) {
+	nodes := ringNodes(5)
+	ring := NewHashRing(nodes, RingConfig{VirtualNodes: 50})
+	for i := 0; i < 1000; i++ {
+		key := "key-" + strconv.Itoa(i)
+		replicas := ring.LookupN(key, 3)
+		owner, _ := ring.Lookup(key)
+		if len(replicas) != 3 || replicas[0] != owner {
+			t.Fatalf("LookupN(%s, 3) = %v, want 3 nodes starting with owner %s", key, replicas, owner)
+		}
+		if len(normalizeNodes(replicas)) != 3 {
+			t.Fatalf("LookupN(%s, 3) = %v repeats a node", key, replicas)
+		}
+	}
+	if replicas := ring.LookupN("key", 10); len(replicas) != len(nodes) {
+		t.Fatalf("expected every node when asking for more nodes than exist, got %v", replicas)
+	}
+	if _, ok := NewHashRing(nil, RingConfig{}).Lookup("key"); ok {
+		t.Fatalf("expected an empty ring to own no keys")
+	}
+}
+
+func TestConfigureRingMovesKeys(t *testing.T) {
+	nodes := startCluster(t, 2, 1000)
+	for i := 0; i < 200; i++ {
+		if err := nodes[0].Set(fmt.Sprint(i), i); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	config := RingConfig{Weights: map[string]int{nodes[1].self: 4}}
+	for _, node := range nodes {
+		node.ConfigureRing(config)
+	}
+	if local0, local1 := localKeys(nodes[0]), localKeys(nodes[1]); local0+local1 != 200 || local1 < 2*local0 {
+		t.Fatalf("expected the heavier node to own most keys, got %d and %d", local0, local1)
+	}
+	for i := 0; i < 200; i++ {
+		if _, ok := nodes[0].Get(fmt.Sprint(i)); !ok {
+			t.Fatalf("key %d lost when the ring changed", i)
+		}
+	}
+}
+
+func BenchmarkHashRingLookup(b *testing.B) {
+	ring := NewHashRing(ringNodes(50), RingConfig{})
+	for i := 0; i < b.N; i++ {
+		ring.Lookup("key-" + strconv.Itoa(i))
+	}
+}
+
+// evictionLog records evictions from a local cache
+type evictionLog struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *evictionLog) record(key string, value interface{}, reason EvictionReason) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, fmt.Sprintf("%s=%v:%s", key, value, reason))
+}
+
+func (l *evictionLog) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.events...)
+}
+
+func TestLocalCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newLocalCache(LocalCacheConfig{Capacity: 2, TTL: time.Minute, Shards: 1})
+	log := &evictionLog{}
+	cache.onEvict(log.record)
+
+	cache.set("a", 1, 0)
+	cache.set("b", 2, 0)
+	cache.get("a")
+	cache.set("c", 3, 0)
+	if _, ok := cache.get("b"); ok {
+		t.Fatalf("expected the least recently used key to be evicted")
+	}
+	if _, ok := cache.get("a"); !ok {
+		t.Fatalf("expected a recently used key to stay")
+	}
+	cache.delete("a")
+	cache.set("c", 4, 0)
+	if events := log.get(); !slices.Equal(events, []string{"b=2:capacity"}) {
+		t.Fatalf("unexpected evictions %v", events)
+	}
+}
+
+func TestLocalCacheShards(t *testing.T) {
+	if shards := len(newLocalCache(LocalCacheConfig{Capacity: 100, TTL: time.Minute}).shards); shards != 1 {
+		t.Fatalf("expected a small cache to use one shard, got %d", shards)
+	}
+	cache := newLocalCache(LocalCacheConfig{Capacity: 1024, TTL: time.Minute})
+	if len(cache.shards) != maxShards {
+		t.Fatalf("expected %d shards, got %d", maxShards, len(cache.shards))
+	}
+	for i := 0; i < 10000; i++ {
+		cache.set(strconv.Itoa(i), i, 0)
+	}
+	// Every shard fills up, so the cache holds its whole capacity
+	if n := cache.len(); n != 1024 {
+		t.Fatalf("expected 1024 items, got %d", n)
+	}
+}
+
+func TestLocalCachePerKeyTTL(t *testing.T) {
+	cache := newLocalCache(LocalCacheConfig{Capacity: 100, TTL: time.Minute, Shards: 4})
+	log := &evictionLog{}
+	cache.onEvict(log.record)
+
+	cache.set("short", 1, 50*time.Millisecond)
+	cache.set("long", 2, time.Hour)
+	cache.set("default", 3, 0)
+	cache.set("renewed", 4, 50*time.Millisecond)
+	cache.set("renewed", 5, 0)
+
+	cache.reclaim(time.Now().Add(time.Second))
+	if events := log.get(); !slices.Equal(events, []string{"short=1:expired"}) {
+		t.Fatalf("unexpected evictions %v", events)
+	}
+	cache.reclaim(time.Now().Add(2 * time.Minute))
+	if cache.len() != 1 {
+		t.Fatalf("expected only the key with a long TTL to remain, got %d keys", cache.len())
+	}
+	if value, ok := cache.get("long"); !ok || value != 2 {
+		t.Fatalf("Get(long) = %v, %v", value, ok)
+	}
+}
+
+func TestCacheNodeReclaimsExpiredKeys(t *testing.T) {
+	node := NewCacheNode(100, 20*time.Millisecond, "self", []string{"self"})
+	defer node.Close()
+	expired := make(chan string, 10)
+	node.OnEvict(func(key string, value interface{}, reason EvictionReason) {
+		if reason == EvictedExpired {
+			expired <- key
+		}
+	})
+	node.Set("a", 1)
+	node.SetWithTTL("b", 2, time.Hour)
+
+	// Nothing reads a, so only the background expiry can drop it
+	select {
+	case key := <-expired:
+		if key != "a" {
+			t.Fatalf("expected a to expire, got %s", key)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expired key was not reclaimed")
+	}
+	if localKeys(node) != 1 {
+		t.Fatalf("expected one key left, got %d", localKeys(node))
+	}
+}
+
+func TestClusterForwardsTTL(t *testing.T) {
+	nodes := startCluster(t, 2, 100)
+	key := ""
+	for i := 0; key == ""; i++ {
+		if owner, _ := nodes[0].getCacheNode(fmt.Sprint(i)); owner == nodes[1].self {
+			key = fmt.Sprint(i)
+		}
+	}
+	if err := nodes[0].SetWithTTL(key, "soon gone", 30*time.Millisecond); err != nil {
+		t.Fatalf("SetWithTTL: %v", err)
+	}
+	if _, ok := nodes[0].Get(key); !ok {
+		t.Fatalf("expected the key before its TTL passed")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := nodes[0].Get(key); ok {
+		t.Fatalf("expected the key's own TTL to apply on its owner")
+	}
+}
+
+func TestLocalCacheConcurrentAccess(t *testing.T) {
+	cache := newLocalCache(LocalCacheConfig{Capacity: 256, TTL: 5 * time.Millisecond, Shards: 8})
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				key := strconv.Itoa((g*31 + i) % 500)
+				switch i % 4 {
+				case 0:
+					cache.set(key, i, time.Duration(i%3)*time.Millisecond)
+				case 1:
+					cache.delete(key)
+				default:
+					cache.get(key)
+				}
+			}
+		}(g)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			cache.reclaim(time.Now())
+			cache.entries()
+		}
+	}()
+	wg.Wait()
+	if n := cache.len(); n > 256 {
+		t.Fatalf("cache holds %d items, over its capacity", n)
+	}
+}
+
+// benchmarkLocalCache runs a parallel mix of 90% reads and 10% writes
+func benchmarkLocalCache(b *testing.B, shards int) {
+	const keys = 1 << 14
+	cache := newLocalCache(LocalCacheConfig{Capacity: keys, TTL: time.Minute, Shards: shards})
+	names := make([]string, keys)
+	for i := range names {
+		names[i] = "key-" + strconv.Itoa(i)
+		cache.set(names[i], i, 0)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := names[(i*7919)%keys]
+			if i%10 == 0 {
+				cache.set(key, i, 0)
+			} else {
+				cache.get(key)
+			}
+			i++
+		}
+	})
+}
+
+// BenchmarkLocalCacheSingleMutex is the design with one lock for the whole
+// LRU, to compare with BenchmarkLocalCacheSharded
+func BenchmarkLocalCacheSingleMutex(b *testing.B) {
+	benchmarkLocalCache(b, 1)
+}
+
+func BenchmarkLocalCacheSharded(b *testing.B) {
+	benchmarkLocalCache(b, 0)
+}
+
+// policies are the eviction policies under test
+var policies = []PolicyFactory{NewLRUPolicy, NewLFUPolicy, NewARCPolicy, NewTinyLFUPolicy}
+
+func TestPoliciesStayWithinCapacity(t *testing.T) {
+	for _, factory := range policies {
+		cache := newLocalCache(LocalCacheConfig{Capacity: 50, TTL: time.Minute, Policy: factory, Shards: 1})
+		t.Run(cache.policy, func(t *testing.T) {
+			evicted := 0
+			cache.onEvict(func(key string, value interface{}, reason EvictionReason) {
+				if _, ok := cache.shards[0].data[key]; ok {
+					t.Errorf("evicted key %s is still held", key)
+				}
+				evicted++
+			})
+			rng := rand.New(rand.NewSource(1))
+			for i := 0; i < 20000; i++ {
+				key := strconv.Itoa(rng.Intn(200))
+				switch rng.Intn(10) {
+				case 0:
+					cache.delete(key)
+				case 1, 2, 3:
+					cache.set(key, i, 0)
+				default:
+					cache.get(key)
+				}
+				if n := cache.len(); n > 50 {
+					t.Fatalf("holding %d items over a capacity of 50", n)
+				}
+			}
+			stats := cache.stats()
+			if stats.Policy != cache.policy || stats.Evictions != int64(evicted) || stats.Items != cache.len() || stats.Size != int64(stats.Items) {
+				t.Fatalf("inconsistent stats %+v after %d evictions", stats, evicted)
+			}
+			if stats.Hits == 0 || stats.Misses == 0 || stats.HitRatio() <= 0 || stats.HitRatio() >= 1 {
+				t.Fatalf("unexpected hit counts %+v", stats)
+			}
+		})
+	}
+}
+
+func TestLFUPolicyKeepsFrequentKeys(t *testing.T) {
+	cache := newLocalCache(LocalCacheConfig{Capacity: 3, TTL: time.Minute, Policy: NewLFUPolicy, Shards: 1})
+	cache.set("hot", 1, 0)
+	for i := 0; i < 5; i++ {
+		cache.get("hot")
+	}
+	cache.set("warm", 2, 0)
+	cache.get("warm")
+	for i := 0; i < 10; i++ {
+		cache.set("cold-"+strconv.Itoa(i), i, 0)
+	}
+	for _, key := range []string{"hot", "warm", "cold-9"} {
+		if _, ok := cache.get(key); !ok {
+			t.Fatalf("expected %s to be kept", key)
+		}
+	}
+}
+
+func TestSizeBoundedCache(t *testing.T) {
+	log := &evictionLog{}
+	cache := newLocalCache(LocalCacheConfig{
+		MaxBytes: 100,
+		Sizer:    func(key string, value interface{}) int64 { return int64(len(value.(string))) },
+		TTL:      time.Minute,
+	})
+	cache.onEvict(log.record)
+
+	for i := 0; i < 5; i++ {
+		cache.set(strconv.Itoa(i), strings.Repeat("x", 30), 0)
+	}
+	if stats := cache.stats(); stats.Items != 3 || stats.Size != 90 || stats.Capacity != 100 {
+		t.Fatalf("expected three 30 byte items, got %+v", stats)
+	}
+	// Growing an item evicts others to make room
+	cache.set("4", strings.Repeat("x", 70), 0)
+	if stats := cache.stats(); stats.Items != 2 || stats.Size != 100 {
+		t.Fatalf("expected the grown item to evict another, got %+v", stats)
+	}
+	// An item larger than the whole cache is not kept
+	cache.set("huge", strings.Repeat("x", 101), 0)
+	if _, ok := cache.get("huge"); ok {
+		t.Fatalf("expected an item over the capacity to be rejected")
+	}
+	if events := log.get(); len(events) != 4 || !strings.HasPrefix(events[3], "huge=") {
+		t.Fatalf("unexpected evictions %v", events)
+	}
+
+	if size := ApproximateSize("key", map[string]interface{}{"a": 1}); size != 3+int64(len(`{"a":1}`)) {
+		t.Fatalf("ApproximateSize = %d", size)
+	}
+}
+
+func TestCacheNodeReportsPolicyStats(t *testing.T) {
+	node := NewCacheNodeWithConfig(LocalCacheConfig{Capacity: 1, TTL: time.Minute, Policy: NewARCPolicy}, "self", []string{"self"})
+	defer node.Close()
+	node.Set("a", 1)
+	node.Get("a")
+	node.Set("b", 2)
+	node.Get("a")
+	if stats := node.LocalStats(); stats.Policy != "arc" || stats.Hits != 1 || stats.Misses != 1 || stats.Evictions != 1 || stats.Items != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+// zipfTrace returns n accesses to keys drawn from a Zipf distribution
+func zipfTrace(rng *rand.Rand, n int, keys uint64) []string {
+	zipf := rand.NewZipf(rng, 1.1, 1, keys-1)
+	trace := make([]string, n)
+	for i := range trace {
+		trace[i] = "hot-" + strconv.FormatUint(zipf.Uint64(), 10)
+	}
+	return trace
+}
+
+// scanTrace mixes a Zipf workload with long scans of keys never read again,
+// as batch jobs and backfills do
+func scanTrace(rng *rand.Rand, n int, keys uint64) []string {
+	hot := zipfTrace(rng, n/2, keys)
+	trace := make([]string, 0, n)
+	scanned := 0
+	for i := 0; len(trace) < n; i++ {
+		trace = append(trace, hot[i%len(hot)])
+		if i%1000 == 999 {
+			for j := 0; j < 1000 && len(trace) < n; j++ {
+				trace = append(trace, "scan-"+strconv.Itoa(scanned))
+				scanned++
+			}
+		}
+	}
+	return trace
+}
+
+// hitRatio replays a trace against a cache that loads every miss
+func hitRatio(factory PolicyFactory, capacity int, trace []string) float64 {
+	cache := newLocalCache(LocalCacheConfig{Capacity: capacity, TTL: time.Hour, Policy: factory, Shards: 1})
+	for _, key := range trace {
+		if _, ok := cache.get(key); !ok {
+			cache.set(key, true, 0)
+		}
+	}
+	return cache.stats().HitRatio()
+}
+
+func TestPolicyHitRatios(t *testing.T) {
+	traces := map[string][]string{
+		"zipf": zipfTrace(rand.New(rand.NewSource(1)), 100000, 10000),
+		"scan": scanTrace(rand.New(rand.NewSource(1)), 100000, 10000),
+	}
+	ratios := make(map[string]float64)
+	for name, trace := range traces {
+		for _, factory := range policies {
+			ratio := hitRatio(factory, 500, trace)
+			ratios[name+"/"+factory(1).Name()] = ratio
+			t.Logf("%s %s: %.3f", name, factory(1).Name(), ratio)
+		}
+	}
+	// Frequency-aware policies beat LRU on skewed workloads, and the
+	// scan-resistant ones keep their hit ratio when scans are mixed in
+	for _, policy := range []string{"lfu", "arc", "w-tinylfu"} {
+		if ratios["zipf/"+policy] <= ratios["zipf/lru"] {
+			t.Errorf("%s hit ratio %.3f is no better than LRU's %.3f on the Zipf trace", policy, ratios["zipf/"+policy], ratios["zipf/lru"])
+		}
+	}
+	for _, policy := range []string{"arc", "w-tinylfu"} {
+		if ratios["scan/"+policy] <= ratios["scan/lru"] {
+			t.Errorf("%s hit ratio %.3f is no better than LRU's %.3f on the scan trace", policy, ratios["scan/"+policy], ratios["scan/lru"])
+		}
+	}
+}
+
+// BenchmarkPolicyTraces reports each policy's hit ratio on the Zipf and scan
+// traces, along with the time taken per access
+func BenchmarkPolicyTraces(b *testing.B) {
+	traces := []struct {
+		name  string
+		trace []string
+	}{
+		{"zipf", zipfTrace(rand.New(rand.NewSource(1)), 100000, 10000)},
+		{"scan", scanTrace(rand.New(rand.NewSource(1)), 100000, 10000)},
+	}
+	for _, tr := range traces {
+		for _, factory := range policies {
+			b.Run(tr.name+"/"+factory(1).Name(), func(b *testing.B) {
+				var ratio float64
+				for i := 0; i < b.N; i++ {
+					ratio = hitRatio(factory, 500, tr.trace)
+				}
+				b.ReportMetric(100*ratio, "hit%")
+				b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(tr.trace)), "ns/access")
+			})
+		}
+	}
+}
+
+// countingLoader loads "value-of-<key>", counting loads and optionally
+// blocking them until release is closed
+type countingLoader struct {
+	loads   atomic.Int64
+	release chan struct{}
+	missing map[string]bool
+	fail    bool
+}
+
+func (l *countingLoader) Load(ctx context.Context, key string) (interface{}, error) {
+	n := l.loads.Add(1)
+	if l.release != nil {
+		select {
+		case <-l.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	switch {
+	case l.fail:
+		return nil, errors.New("database unavailable")
+	case l.missing[key]:
+		return nil, ErrNotFound
+	}
+	return fmt.Sprintf("value-of-%s-%d", key, n), nil
+}
+
+// singleNode creates a cache node that owns every key
+func singleNode(t *testing.T, config LocalCacheConfig) *DistributedLRUCache {
+	t.Helper()
+	if config.Capacity == 0 {
+		config.Capacity = 100
+	}
+	if config.TTL == 0 {
+		config.TTL = time.Minute
+	}
+	node := NewCacheNodeWithConfig(config, "self", []string{"self"})
+	t.Cleanup(node.Close)
+	return node
+}
+
+func TestLoaderCoalescesConcurrentMisses(t *testing.T) {
+	loader := &countingLoader{release: make(chan struct{})}
+	node := singleNode(t, LocalCacheConfig{Loader: LoaderConfig{Loader: loader}})
+
+	var wg sync.WaitGroup
+	values := make(chan interface{}, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, ok := node.Get("hot")
+			if !ok {
+				t.Errorf("Get(hot) missed")
+			}
+			values <- value
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(loader.release)
+	wg.Wait()
+	close(values)
+	for value := range values {
+		if value != "value-of-hot-1" {
+			t.Fatalf("unexpected value %v", value)
+		}
+	}
+	if n := loader.loads.Load(); n != 1 {
+		t.Fatalf("expected one load, got %d", n)
+	}
+	if value, _ := node.Get("hot"); value != "value-of-hot-1" || loader.loads.Load() != 1 {
+		t.Fatalf("expected the loaded value to be cached")
+	}
+}
+
+func TestClusterLoadsOnOwner(t *testing.T) {
+	loader := &countingLoader{release: make(chan struct{})}
+	config := LocalCacheConfig{Capacity: 100, TTL: time.Minute, Loader: LoaderConfig{Loader: loader}}
+	nodes := startClusterWithConfig(t, 3, config)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(node *DistributedLRUCache) {
+			defer wg.Done()
+			if value, err := node.Load(context.Background(), "hot"); err != nil || value != "value-of-hot-1" {
+				t.Errorf("Load(hot) = %v, %v", value, err)
+			}
+		}(nodes[i%3])
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(loader.release)
+	wg.Wait()
+	if n := loader.loads.Load(); n != 1 {
+		t.Fatalf("expected the owner to load the key once for the cluster, got %d loads", n)
+	}
+}
+
+func TestLoaderNegativeCaching(t *testing.T) {
+	loader := &countingLoader{missing: map[string]bool{"ghost": true}}
+	node := singleNode(t, LocalCacheConfig{Loader: LoaderConfig{Loader: loader, NegativeTTL: time.Minute}})
+
+	for i := 0; i < 3; i++ {
+		if _, err := node.Load(context.Background(), "ghost"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+	}
+	if n := loader.loads.Load(); n != 1 {
+		t.Fatalf("expected the missing key to be remembered, got %d loads", n)
+	}
+	node.Set("ghost", "now here")
+	if value, ok := node.Get("ghost"); !ok || value != "now here" {
+		t.Fatalf("Get(ghost) = %v, %v after Set", value, ok)
+	}
+
+	// Without a negative TTL every lookup asks the loader
+	loader = &countingLoader{missing: map[string]bool{"ghost": true}}
+	node = singleNode(t, LocalCacheConfig{Loader: LoaderConfig{Loader: loader}})
+	node.Get("ghost")
+	node.Get("ghost")
+	if n := loader.loads.Load(); n != 2 {
+		t.Fatalf("expected misses not to be cached, got %d loads", n)
+	}
+}
+
+func TestLoaderStaleWhileRevalidate(t *testing.T) {
+	loader := &countingLoader{}
+	node := singleNode(t, LocalCacheConfig{TTL: 30 * time.Millisecond, Loader: LoaderConfig{Loader: loader, StaleWhileRevalidate: time.Minute}})
+	if value, _ := node.Get("k"); value != "value-of-k-1" {
+		t.Fatalf("unexpected value %v", value)
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	// Stale reads are answered at once while one refresh runs
+	for i := 0; i < 10; i++ {
+		if value, ok := node.Get("k"); !ok || value != "value-of-k-1" && value != "value-of-k-2" {
+			t.Fatalf("Get(k) = %v, %v while stale", value, ok)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if value, _ := node.Get("k"); value == "value-of-k-2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stale value was not refreshed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := loader.loads.Load(); n != 2 {
+		t.Fatalf("expected one refresh, got %d loads", n)
+	}
+}
+
+func TestLoaderErrors(t *testing.T) {
+	config := LocalCacheConfig{Capacity: 100, TTL: time.Minute, Loader: LoaderConfig{Loader: &countingLoader{fail: true}}}
+	nodes := startClusterWithConfig(t, 2, config)
+	for _, node := range nodes {
+		_, err := node.Load(context.Background(), "k")
+		if err == nil || errors.Is(err, ErrNotFound) || !strings.Contains(err.Error(), "database unavailable") {
+			t.Fatalf("expected the load error, got %v", err)
+		}
+		if _, ok := node.Get("k"); ok {
+			t.Fatalf("expected a failed load to miss")
+		}
+	}
+}
+
+func TestLoaderDoesNotOverwriteNewerSet(t *testing.T) {
+	loader := &countingLoader{release: make(chan struct{})}
+	node := singleNode(t, LocalCacheConfig{Loader: LoaderConfig{Loader: loader}})
+	done := make(chan interface{})
+	go func() {
+		value, _ := node.Get("k")
+		done <- value
+	}()
+	for loader.loads.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	node.Set("k", "written")
+	close(loader.release)
+	<-done
+	if value, _ := node.Get("k"); value != "written" {
+		t.Fatalf("expected the newer write to win over the slow load, got %v", value)
+	}
+}
+
+// fakeStore records the batches written to it, failing the first failures calls
+type fakeStore struct {
+	mu       sync.Mutex
+	batches  [][]StoreWrite
+	calls    int
+	failures int
+}
+
+func (s *fakeStore) Write(ctx context.Context, writes []StoreWrite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("store unavailable")
+	}
+	s.batches = append(s.batches, append([]StoreWrite(nil), writes...))
+	return nil
+}
+
+// state replays the written batches into the store's contents
+func (s *fakeStore) state() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := make(map[string]interface{})
+	for _, batch := range s.batches {
+		for _, write := range batch {
+			if write.Delete {
+				delete(state, write.Key)
+			} else {
+				state[write.Key] = write.Value
+			}
+		}
+	}
+	return state
+}
+
+func TestWriteThroughStore(t *testing.T) {
+	store := &fakeStore{failures: 2}
+	node := singleNode(t, LocalCacheConfig{Store: StoreConfig{Store: store, RetryBackoff: time.Millisecond}})
+	if err := node.Set("a", 1); err != nil {
+		t.Fatalf("expected retries to succeed, got %v", err)
+	}
+	if store.calls != 3 || store.state()["a"] != 1 {
+		t.Fatalf("expected a to be stored after 3 calls, got %d calls and %v", store.calls, store.state())
+	}
+	node.Delete("a")
+	if _, ok := store.state()["a"]; ok {
+		t.Fatalf("expected the delete to reach the store")
+	}
+
+	store.failures = 10
+	if err := node.Set("b", 2); err == nil || !strings.Contains(err.Error(), "store unavailable") {
+		t.Fatalf("expected the store error, got %v", err)
+	}
+	if _, ok := node.Get("b"); ok {
+		t.Fatalf("expected a write the store rejected not to be cached")
+	}
+}
+
+func TestClusterWriteThroughErrors(t *testing.T) {
+	store := &fakeStore{failures: 1000}
+	config := LocalCacheConfig{Capacity: 100, TTL: time.Minute, Store: StoreConfig{Store: store, Retries: 1, RetryBackoff: time.Millisecond}}
+	nodes := startClusterWithConfig(t, 2, config)
+	for i := 0; i < 10; i++ {
+		if err := nodes[0].Set(fmt.Sprint(i), i); err == nil || !strings.Contains(err.Error(), "store unavailable") {
+			t.Fatalf("Set(%d): expected the store error, got %v", i, err)
+		}
+	}
+}
+
+func TestWriteBehindStore(t *testing.T) {
+	store := &fakeStore{}
+	node := NewCacheNodeWithConfig(LocalCacheConfig{
+		Capacity: 100,
+		TTL:      time.Minute,
+		Store:    StoreConfig{Store: store, WriteBehind: true, BatchSize: 10, FlushInterval: time.Hour},
+	}, "self", []string{"self"})
+
+	for i := 0; i < 10; i++ {
+		node.Set(fmt.Sprint(i), i)
+	}
+	// A full batch is flushed without waiting for the interval
+	deadline := time.Now().Add(2 * time.Second)
+	for len(store.state()) != 10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("full batch was not flushed, store has %v", store.state())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Queued writes to the same key are coalesced, and Close flushes them
+	for i := 0; i < 5; i++ {
+		node.Set("x", i)
+	}
+	node.Delete("0")
+	node.Close()
+	state := store.state()
+	if state["x"] != 4 || len(state) != 10 {
+		t.Fatalf("unexpected store contents after Close: %v", state)
+	}
+	for _, batch := range store.batches {
+		if len(batch) > 10 {
+			t.Fatalf("batch of %d writes exceeds the batch size", len(batch))
+		}
+	}
+	if writes := len(store.batches[len(store.batches)-1]); writes != 2 {
+		t.Fatalf("expected the last batch to hold 2 coalesced writes, got %d", writes)
+	}
+}
+
+func TestWriteBehindRequeuesFailedBatches(t *testing.T) {
+	store := &fakeStore{failures: 2}
+	writer := newStoreWriter(StoreConfig{Store: store, WriteBehind: true, FlushInterval: time.Hour, Retries: 1, RetryBackoff: time.Millisecond})
+	writer.write(context.Background(), StoreWrite{Key: "a", Value: 1})
+	if err := writer.flush(context.Background()); err == nil || writer.queued() != 1 {
+		t.Fatalf("expected the failed write to stay queued, got %v with %d queued", err, writer.queued())
+	}
+	// A newer write replaces the failed one rather than being overwritten by it
+	writer.write(context.Background(), StoreWrite{Key: "a", Value: 2})
+	if err := writer.close(context.Background()); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if state := store.state(); state["a"] != 2 || writer.queued() != 0 {
+		t.Fatalf("unexpected store contents %v", state)
+	}
+}
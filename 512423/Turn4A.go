@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"maps"
+	"slices"
 	"sync"
 )
 
@@ -17,24 +19,103 @@ type Field struct {
 	Name    string
 	Type    string
 	Default interface{} `json:",omitempty"`
+	// Aliases are former names of the field, read from data written before it was renamed
+	Aliases []string `json:",omitempty"`
+	// Nullable fields accept null, and are null when missing without a default
+	Nullable bool `json:",omitempty"`
 }
 
-// Simulated schema registry
+// Simulated schema registry. New versions must be compatible with the latest
+// under its compatibility mode, BACKWARD by default
 type SchemaRegistry struct {
-	schemas map[int]Schema
-	mu      sync.RWMutex
+	schemas   map[int]Schema
+	latest    int
+	mode      CompatibilityMode
+	upcasters map[int]Upcaster // by the version they migrate from
+	mu        sync.RWMutex
 }
 
 func NewSchemaRegistry() *SchemaRegistry {
 	return &SchemaRegistry{
-		schemas: make(map[int]Schema),
+		schemas:   make(map[int]Schema),
+		mode:      CompatibilityBackward,
+		upcasters: make(map[int]Upcaster),
 	}
 }
 
-func (registry *SchemaRegistry) RegisterSchema(version int, schema Schema) {
+// SetCompatibility sets the compatibility mode checked by RegisterSchema
+func (registry *SchemaRegistry) SetCompatibility(mode CompatibilityMode) {
 	registry.mu.Lock()
 	defer registry.mu.Unlock()
+	registry.mode = mode
+}
+
+// RegisterSchema adds the next version of the schema. It fails with a
+// *CompatibilityError if the schema is incompatible with the latest version
+func (registry *SchemaRegistry) RegisterSchema(version int, schema Schema) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if schema.Version != version {
+		return fmt.Errorf("schema version %d registered as version %d", schema.Version, version)
+	}
+	if version <= registry.latest {
+		return fmt.Errorf("schema version %d is not after the latest version %d", version, registry.latest)
+	}
+	if latest, ok := registry.schemas[registry.latest]; ok {
+		if found := checkCompatibility(registry.mode, latest, schema); len(found) > 0 {
+			return &CompatibilityError{Version: version, Against: latest.Version, Mode: registry.mode, Incompatibilities: found}
+		}
+	}
 	registry.schemas[version] = schema
+	registry.latest = version
+	return nil
+}
+
+// RegisterUpcaster sets a function to migrate records from a version to the
+// next, for changes the registry cannot migrate by itself
+func (registry *SchemaRegistry) RegisterUpcaster(from int, upcaster Upcaster) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.upcasters[from] = upcaster
+}
+
+// LatestSchema returns the latest registered schema
+func (registry *SchemaRegistry) LatestSchema() (Schema, error) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	schema, ok := registry.schemas[registry.latest]
+	if !ok {
+		return Schema{}, fmt.Errorf("no schema registered")
+	}
+	return schema, nil
+}
+
+// Upcast migrates a record written with a schema version to the latest
+// version, one version at a time, and returns the latest version
+func (registry *SchemaRegistry) Upcast(record map[string]interface{}, version int) (map[string]interface{}, int, error) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	from, ok := registry.schemas[version]
+	if !ok {
+		return nil, 0, fmt.Errorf("schema not found for version %d", version)
+	}
+	for _, v := range slices.Sorted(maps.Keys(registry.schemas)) {
+		if v <= version {
+			continue
+		}
+		next := registry.schemas[v]
+		var err error
+		if upcaster, ok := registry.upcasters[from.Version]; ok {
+			if record, err = upcaster(record); err != nil {
+				return nil, 0, fmt.Errorf("upcasting from version %d: %v", from.Version, err)
+			}
+		}
+		if record, err = upcastStep(record, from, next); err != nil {
+			return nil, 0, fmt.Errorf("upcasting from version %d to %d: %v", from.Version, next.Version, err)
+		}
+		from, version = next, next.Version
+	}
+	return record, version, nil
 }
 
 func (registry *SchemaRegistry) GetSchema(version int) (Schema, error) {
@@ -71,6 +152,11 @@ func extractData(batchSize int, registry *SchemaRegistry) [][]byte {
 		[]byte(`{"id": 1, "name": "Alice", "age": 25, "schemaVersion": 1}`),
 		[]byte(`{"id": 2, "name": "Bob", "age": 30, "schemaVersion": 2}`),
 		[]byte(`{"id": 3, "name": "Charlie", "age": 18, "schemaVersion": 2}`),
+		[]byte(`{"id": "4", "name": "Dana", "age": "41", "schemaVersion": 2}`),
+		[]byte(`{"id": 5, "name": "Eve", "age": "thirty", "schemaVersion": 2}`),
+		[]byte(`{"id": 6, "name": "Frank", "age": 52, "signedUpAt": "2024-03-01T09:30:00+13:00", "schemaVersion": 3}`),
+		[]byte(`{"id": 7, "name": "Grace", "schemaVersion": 2`),
+		[]byte(`{"id": 8, "age": 60, "schemaVersion": 1}`),
 	}
 
 	batches := make([][]byte, 0)
@@ -82,10 +168,57 @@ func extractData(batchSize int, registry *SchemaRegistry) [][]byte {
 	return batches
 }
 
-// Function to transform data from the batch
-func transformData(workMessage WorkMessage, registry *SchemaRegistry) []byte {
-	var transformedRecords []map[string]interface{}
-	schema, err := registry.GetSchema(workMessage.SchemaVersion)
+// schemaVersionField is the record field naming the schema version the
+// record was written with
+const schemaVersionField = "schemaVersion"
+
+// recordVersion returns the schema version a record was written with, or
+// fallback if it does not say
+func recordVersion(record map[string]interface{}, fallback int) (int, error) {
+	value, ok := record[schemaVersionField]
+	if !ok {
+		return fallback, nil
+	}
+	version, ok := value.(float64)
+	if !ok || version != float64(int(version)) {
+		return 0, fmt.Errorf("%s %v is not a version number", schemaVersionField, value)
+	}
+	return int(version), nil
+}
+
+// transformRecord decodes a record, upcasts it from the schema version it
+// names, or fallback if it names none, to the latest schema, and validates it
+// against that schema. It returns the version the record was read with
+func transformRecord(recordBytes []byte, fallback int, schema Schema, registry *SchemaRegistry) (map[string]interface{}, int, error) {
+	var record map[string]interface{}
+	if err := json.Unmarshal(recordBytes, &record); err != nil {
+		return nil, fallback, fmt.Errorf("unmarshaling record: %v", err)
+	}
+	version, err := recordVersion(record, fallback)
+	if err != nil {
+		return nil, fallback, fmt.Errorf("detecting record schema: %v", err)
+	}
+	upcast, latest, err := registry.Upcast(record, version)
+	if err != nil {
+		return nil, version, fmt.Errorf("upcasting record: %v", err)
+	}
+	upcast[schemaVersionField] = latest
+
+	// Create transformed record based on the schema
+	transformedRecord, err := validateRecord(upcast, schema)
+	if err != nil {
+		return nil, version, fmt.Errorf("validating record against schema version %d: %v", latest, err)
+	}
+	return transformedRecord, version, nil
+}
+
+// Function to transform data from the batch. Each record is read with the
+// schema version it names, or the batch's version if it names none, upcast
+// to the latest schema and coerced to its field types. Records that fail are
+// sent to deadLetters
+func transformData(workMessage WorkMessage, registry *SchemaRegistry, deadLetters DeadLetterSink) []byte {
+	transformedRecords := []map[string]interface{}{}
+	schema, err := registry.LatestSchema()
 	if err != nil {
 		fmt.Println("Error fetching schema:", err)
 		return nil
@@ -93,23 +226,17 @@ func transformData(workMessage WorkMessage, registry *SchemaRegistry) []byte {
 
 	// Process each record in the batch
 	for _, recordBytes := range workMessage.Batch {
-		var record map[string]interface{}
-		err := json.Unmarshal(recordBytes, &record)
+		record, version, err := transformRecord(recordBytes, workMessage.SchemaVersion, schema, registry)
 		if err != nil {
-			fmt.Println("Error unmarshaling record:", err)
+			deadLetter(deadLetters, DeadLetter{
+				BatchID:       workMessage.BatchID,
+				SchemaVersion: version,
+				Record:        recordBytes,
+				Reason:        err.Error(),
+			})
 			continue
 		}
-
-		// Create transformed record based on the schema
-		transformedRecord := make(map[string]interface{})
-		for _, field := range schema.Fields {
-			value, ok := record[field.Name]
-			if !ok {
-				value = field.Default
-			}
-			transformedRecord[field.Name] = value
-		}
-		transformedRecords = append(transformedRecords, transformedRecord)
+		transformedRecords = append(transformedRecords, record)
 	}
 
 	// Marshal the array of transformed records into a JSON array
@@ -146,25 +273,31 @@ func loadData(results []byte, schemaVersion int) {
 func main() {
 	batchSize := 1
 	schemaRegistry := NewSchemaRegistry()
-	schemaRegistry.RegisterSchema(1, Schema{
+	if err := schemaRegistry.RegisterSchema(1, Schema{
 		Version: 1,
 		Fields: []Field{
-			{"id", "int", nil},
-			{"name", "string", nil},
-			{"age", "int", nil},
-			{"schemaVersion", "int", nil},
+			{Name: "id", Type: "int"},
+			{Name: "name", Type: "string"},
+			{Name: "age", Type: "int"},
+			{Name: "schemaVersion", Type: "int"},
 		},
-	})
-	schemaRegistry.RegisterSchema(2, Schema{
+	}); err != nil {
+		fmt.Println("Error registering schema:", err)
+		return
+	}
+	if err := schemaRegistry.RegisterSchema(2, Schema{
 		Version: 2,
 		Fields: []Field{
-			{"id", "int", nil},
-			{"name", "string", nil},
-			{"age", "int", nil},
-			{"schemaVersion", "int", nil},
-			{"email", "string", ""},
+			{Name: "id", Type: "int"},
+			{Name: "name", Type: "string"},
+			{Name: "age", Type: "int"},
+			{Name: "schemaVersion", Type: "int"},
+			{Name: "email", Type: "string", Default: ""},
 		},
-	})
+	}); err != nil {
+		fmt.Println("Error registering schema:", err)
+		return
+	}
 
 	batches := extractData(batchSize, schemaRegistry)
 	var wg sync.WaitGroup
@@ -198,8 +331,8 @@ func main() {
 	wg.Wait()
 	close(mq.sendChan) // Signal no more messages will be sent
 
-	// Collect results
-	var allResults []byte
+	// Collect results, loading each batch as it is transformed
+	deadLetters := NewDeadLetterQueue()
 	for {
 		msg, err := mq.Receive(ctx)
 		if err != nil {
@@ -211,12 +344,32 @@ func main() {
 		}
 
 		resultMessage := msg.(WorkMessage)
-		results := transformData(resultMessage, schemaRegistry)
-		allResults = append(allResults, results...)
+		results := transformData(resultMessage, schemaRegistry, deadLetters)
+		loadData(results, 1)
+	}
+
+	for _, letter := range deadLetters.Letters() {
+		fmt.Printf("Dead letter of batch %d (schema version %d): %s: %s\n", letter.BatchID, letter.SchemaVersion, letter.Record, letter.Reason)
 	}
 
-	// Load all transformed data
-	loadData(allResults, 1)
+	// Register the schema a producer moved to ahead of the registry, and replay
+	// the dead letters against it
+	if err := schemaRegistry.RegisterSchema(3, Schema{
+		Version: 3,
+		Fields: []Field{
+			{Name: "id", Type: "int"},
+			{Name: "name", Type: "string"},
+			{Name: "age", Type: "int"},
+			{Name: "schemaVersion", Type: "int"},
+			{Name: "email", Type: "string", Default: ""},
+			{Name: "signedUpAt", Type: "timestamp", Nullable: true},
+		},
+	}); err != nil {
+		fmt.Println("Error registering schema:", err)
+		return
+	}
+	loadData(replayDeadLetters(deadLetters, schemaRegistry), 3)
+	fmt.Printf("%d dead letters remain after replay\n", len(deadLetters.Letters()))
 }
 
 func min(a, b int) int {
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// DeadLetter is a record the transform stage could not process, kept with
+// what is needed to reprocess it
+type DeadLetter struct {
+	BatchID int
+	// SchemaVersion is the version the record was read with: the one it
+	// names, or its batch's if it names none or could not be decoded
+	SchemaVersion int
+	Record        []byte // the record's original bytes
+	Reason        string
+}
+
+// DeadLetterSink receives the records the transform stage rejects
+type DeadLetterSink interface {
+	Send(letter DeadLetter) error
+}
+
+// Simulated dead-letter queue, holding letters in memory until drained
+type DeadLetterQueue struct {
+	mu      sync.Mutex
+	letters []DeadLetter
+}
+
+func NewDeadLetterQueue() *DeadLetterQueue {
+	return &DeadLetterQueue{}
+}
+
+func (dlq *DeadLetterQueue) Send(letter DeadLetter) error {
+	dlq.mu.Lock()
+	defer dlq.mu.Unlock()
+	dlq.letters = append(dlq.letters, letter)
+	return nil
+}
+
+// Letters returns the letters in the queue, oldest first
+func (dlq *DeadLetterQueue) Letters() []DeadLetter {
+	dlq.mu.Lock()
+	defer dlq.mu.Unlock()
+	return append([]DeadLetter(nil), dlq.letters...)
+}
+
+// Drain removes and returns the letters in the queue, oldest first
+func (dlq *DeadLetterQueue) Drain() []DeadLetter {
+	dlq.mu.Lock()
+	defer dlq.mu.Unlock()
+	letters := dlq.letters
+	dlq.letters = nil
+	return letters
+}
+
+// replayDeadLetters reprocesses the letters in a queue, after the schema or
+// data that failed them has been fixed, and returns the records that now
+// transform. Letters that fail again go back to the queue with their new
+// reason
+func replayDeadLetters(dlq *DeadLetterQueue, registry *SchemaRegistry) []byte {
+	schema, err := registry.LatestSchema()
+	if err != nil {
+		fmt.Println("Error fetching schema:", err)
+		return nil
+	}
+
+	transformedRecords := []map[string]interface{}{}
+	for _, letter := range dlq.Drain() {
+		record, version, err := transformRecord(letter.Record, letter.SchemaVersion, schema, registry)
+		if err != nil {
+			deadLetter(dlq, DeadLetter{BatchID: letter.BatchID, SchemaVersion: version, Record: letter.Record, Reason: err.Error()})
+			continue
+		}
+		transformedRecords = append(transformedRecords, record)
+	}
+
+	resultBytes, err := json.Marshal(transformedRecords)
+	if err != nil {
+		fmt.Println("Error marshaling replayed records:", err)
+		return nil
+	}
+	return resultBytes
+}
+
+// deadLetter sends a letter to a sink, printing the error if it cannot
+func deadLetter(sink DeadLetterSink, letter DeadLetter) {
+	fmt.Printf("Dead-lettering record of batch %d: %s\n", letter.BatchID, letter.Reason)
+	if err := sink.Send(letter); err != nil {
+		fmt.Println("Error sending dead letter:", err)
+	}
+}
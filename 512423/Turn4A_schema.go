@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// CompatibilityMode is which way a new schema must be compatible with the
+// latest registered one, as in Avro
+type CompatibilityMode int
+
+const (
+	// CompatibilityNone accepts any new schema
+	CompatibilityNone CompatibilityMode = iota
+	// CompatibilityBackward requires the new schema to read data written with the latest one
+	CompatibilityBackward
+	// CompatibilityForward requires the latest schema to read data written with the new one
+	CompatibilityForward
+	// CompatibilityFull requires both
+	CompatibilityFull
+)
+
+func (mode CompatibilityMode) String() string {
+	switch mode {
+	case CompatibilityNone:
+		return "NONE"
+	case CompatibilityBackward:
+		return "BACKWARD"
+	case CompatibilityForward:
+		return "FORWARD"
+	case CompatibilityFull:
+		return "FULL"
+	}
+	return fmt.Sprintf("CompatibilityMode(%d)", int(mode))
+}
+
+// promotions lists the types each type can be read as, besides itself
+var promotions = map[string][]string{
+	"int":    {"long", "float", "double"},
+	"long":   {"float", "double"},
+	"float":  {"double"},
+	"string": {"bytes"},
+	"bytes":  {"string"},
+}
+
+// promotable reports whether a value written as one type can be read as another
+func promotable(from, to string) bool {
+	return from == to || slices.Contains(promotions[from], to)
+}
+
+// Incompatibility is one reason data written with one schema cannot be read
+// with another
+type Incompatibility struct {
+	Field  string
+	Reader int // version of the schema reading the data
+	Writer int // version of the schema the data was written with
+	Reason string
+}
+
+func (i Incompatibility) String() string {
+	return fmt.Sprintf("field %q: %s (reading version %d data with version %d)", i.Field, i.Reason, i.Writer, i.Reader)
+}
+
+// CompatibilityError reports a schema rejected by the registry's
+// compatibility mode, with every incompatibility found
+type CompatibilityError struct {
+	Version           int
+	Against           int
+	Mode              CompatibilityMode
+	Incompatibilities []Incompatibility
+}
+
+func (e *CompatibilityError) Error() string {
+	reasons := make([]string, len(e.Incompatibilities))
+	for i, incompatibility := range e.Incompatibilities {
+		reasons[i] = incompatibility.String()
+	}
+	return fmt.Sprintf("schema version %d is not %v compatible with version %d: %s",
+		e.Version, e.Mode, e.Against, strings.Join(reasons, "; "))
+}
+
+// writerField returns the field of the writer's schema a reader's field is
+// read from: the one with its name or, failing that, one of its aliases
+func writerField(writer Schema, field Field) (Field, bool) {
+	for _, name := range append([]string{field.Name}, field.Aliases...) {
+		for _, candidate := range writer.Fields {
+			if candidate.Name == name {
+				return candidate, true
+			}
+		}
+	}
+	return Field{}, false
+}
+
+// readIncompatibilities returns why data written with writer cannot be read
+// with reader: fields the reader needs that the writer lacks, with no default
+// to fill them and not nullable, and fields whose type cannot be promoted or
+// that may be null for a reader that does not allow it
+func readIncompatibilities(reader, writer Schema) []Incompatibility {
+	var found []Incompatibility
+	for _, field := range reader.Fields {
+		source, ok := writerField(writer, field)
+		switch {
+		case !ok && field.Default == nil && !field.Nullable:
+			found = append(found, Incompatibility{field.Name, reader.Version, writer.Version, "missing from the written data and has no default"})
+		case ok && !promotable(source.Type, field.Type):
+			reason := fmt.Sprintf("written as %s, which cannot be read as %s", source.Type, field.Type)
+			if source.Name != field.Name {
+				reason = fmt.Sprintf("written as %s %q, which cannot be read as %s", source.Type, source.Name, field.Type)
+			}
+			found = append(found, Incompatibility{field.Name, reader.Version, writer.Version, reason})
+		case ok && source.Nullable && !field.Nullable:
+			found = append(found, Incompatibility{field.Name, reader.Version, writer.Version, "written as nullable, which cannot be read as not nullable"})
+		}
+	}
+	return found
+}
+
+// checkCompatibility returns the incompatibilities of a new schema with the
+// latest one under a mode
+func checkCompatibility(mode CompatibilityMode, latest, schema Schema) []Incompatibility {
+	var found []Incompatibility
+	if mode == CompatibilityBackward || mode == CompatibilityFull {
+		found = append(found, readIncompatibilities(schema, latest)...)
+	}
+	if mode == CompatibilityForward || mode == CompatibilityFull {
+		found = append(found, readIncompatibilities(latest, schema)...)
+	}
+	return found
+}
+
+// Upcaster migrates a record from one schema version to the next. Upcasters
+// run before the registry renames aliased fields, fills defaults and widens
+// types, so they only need to handle what those cannot, such as splitting a
+// field
+type Upcaster func(record map[string]interface{}) (map[string]interface{}, error)
+
+// upcastStep migrates a record written with one schema to the next: fields
+// are read from their aliases, filled with their defaults if missing and
+// widened to their new types
+func upcastStep(record map[string]interface{}, from, to Schema) (map[string]interface{}, error) {
+	for _, field := range to.Fields {
+		source, ok := writerField(from, field)
+		value, present := record[source.Name]
+		if !ok || !present {
+			if _, set := record[field.Name]; !set && field.Default != nil {
+				record[field.Name] = field.Default
+			}
+			continue
+		}
+		widened, err := widen(value, source.Type, field.Type)
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %v", field.Name, err)
+		}
+		if source.Name != field.Name {
+			delete(record, source.Name)
+		}
+		record[field.Name] = widened
+	}
+	return record, nil
+}
+
+// widen converts a decoded JSON value of one type to a type it promotes to
+func widen(value interface{}, from, to string) (interface{}, error) {
+	if value == nil || from == to {
+		return value, nil
+	}
+	if !promotable(from, to) {
+		return nil, fmt.Errorf("cannot widen %s to %s", from, to)
+	}
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	}
+	return nil, fmt.Errorf("%v is not a %s", value, from)
+}
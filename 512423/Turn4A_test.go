@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// v1 is the first version of the test schema
+var v1 = Schema{Version: 1, Fields: []Field{
+	{Name: "id", Type: "int"},
+	{Name: "name", Type: "string"},
+	{Name: "age", Type: "int"},
+}}
+
+// newTestRegistry returns a registry in a compatibility mode holding v1
+func newTestRegistry(t *testing.T, mode CompatibilityMode) *SchemaRegistry {
+	t.Helper()
+	registry := NewSchemaRegistry()
+	registry.SetCompatibility(mode)
+	if err := registry.RegisterSchema(1, v1); err != nil {
+		t.Fatal(err)
+	}
+	return registry
+}
+
+// withFields returns a schema version with v1's fields changed by change
+func withFields(version int, change func([]Field) []Field) Schema {
+	return Schema{Version: version, Fields: change(append([]Field(nil), v1.Fields...))}
+}
+
+func TestRegisterSchemaCompatibility(t *testing.T) {
+	addEmail := func(fields []Field) []Field { return append(fields, Field{Name: "email", Type: "string"}) }
+	addEmailDefault := func(fields []Field) []Field {
+		return append(fields, Field{Name: "email", Type: "string", Default: ""})
+	}
+	dropAge := func(fields []Field) []Field { return fields[:2] }
+	widenAge := func(fields []Field) []Field { fields[2].Type = "long"; return fields }
+	narrowAge := func(fields []Field) []Field { fields[2].Type = "string"; return fields }
+	renameName := func(fields []Field) []Field {
+		fields[1] = Field{Name: "fullName", Type: "string", Aliases: []string{"name"}}
+		return fields
+	}
+
+	tests := []struct {
+		name   string
+		mode   CompatibilityMode
+		change func([]Field) []Field
+		ok     bool
+	}{
+		{"backward add without default", CompatibilityBackward, addEmail, false},
+		{"backward add with default", CompatibilityBackward, addEmailDefault, true},
+		{"backward drop", CompatibilityBackward, dropAge, true},
+		{"backward widen", CompatibilityBackward, widenAge, true},
+		{"backward narrow", CompatibilityBackward, narrowAge, false},
+		{"backward rename with alias", CompatibilityBackward, renameName, true},
+		{"forward add without default", CompatibilityForward, addEmail, true},
+		{"forward drop", CompatibilityForward, dropAge, false},
+		{"forward widen", CompatibilityForward, widenAge, false},
+		{"forward rename with alias", CompatibilityForward, renameName, false},
+		{"full add with default", CompatibilityFull, addEmailDefault, true},
+		{"full widen", CompatibilityFull, widenAge, false},
+		{"none narrow", CompatibilityNone, narrowAge, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := newTestRegistry(t, tt.mode)
+			err := registry.RegisterSchema(2, withFields(2, tt.change))
+			if tt.ok && err != nil {
+				t.Fatalf("RegisterSchema: %v", err)
+			}
+			if !tt.ok {
+				var compatibilityErr *CompatibilityError
+				if !errors.As(err, &compatibilityErr) {
+					t.Fatalf("RegisterSchema error = %v, want a *CompatibilityError", err)
+				}
+				if latest, _ := registry.LatestSchema(); latest.Version != 1 {
+					t.Fatalf("latest version = %d after a rejected schema, want 1", latest.Version)
+				}
+			}
+		})
+	}
+}
+
+func TestCompatibilityErrorListsEveryIncompatibility(t *testing.T) {
+	registry := newTestRegistry(t, CompatibilityFull)
+	err := registry.RegisterSchema(2, withFields(2, func(fields []Field) []Field {
+		fields[2].Type = "string"
+		return append(fields, Field{Name: "email", Type: "string"})
+	}))
+	var compatibilityErr *CompatibilityError
+	if !errors.As(err, &compatibilityErr) {
+		t.Fatalf("RegisterSchema error = %v, want a *CompatibilityError", err)
+	}
+	want := []Incompatibility{
+		{Field: "age", Reader: 2, Writer: 1, Reason: "written as int, which cannot be read as string"},
+		{Field: "email", Reader: 2, Writer: 1, Reason: "missing from the written data and has no default"},
+		{Field: "age", Reader: 1, Writer: 2, Reason: "written as string, which cannot be read as int"},
+	}
+	if len(compatibilityErr.Incompatibilities) != len(want) {
+		t.Fatalf("incompatibilities = %v, want %v", compatibilityErr.Incompatibilities, want)
+	}
+	for i := range want {
+		if compatibilityErr.Incompatibilities[i] != want[i] {
+			t.Errorf("incompatibility %d = %v, want %v", i, compatibilityErr.Incompatibilities[i], want[i])
+		}
+	}
+	if !strings.Contains(err.Error(), "not FULL compatible with version 1") {
+		t.Errorf("error %q does not name the mode and version", err)
+	}
+}
+
+func TestRegisterSchemaVersions(t *testing.T) {
+	registry := newTestRegistry(t, CompatibilityBackward)
+	if err := registry.RegisterSchema(1, v1); err == nil {
+		t.Error("registering version 1 twice succeeded")
+	}
+	if err := registry.RegisterSchema(3, withFields(2, func(fields []Field) []Field { return fields })); err == nil {
+		t.Error("registering a version 2 schema as version 3 succeeded")
+	}
+	if err := registry.RegisterSchema(3, withFields(3, func(fields []Field) []Field { return fields })); err != nil {
+		t.Fatalf("registering version 3 after 1: %v", err)
+	}
+	if err := registry.RegisterSchema(2, withFields(2, func(fields []Field) []Field { return fields })); err == nil {
+		t.Error("registering version 2 after 3 succeeded")
+	}
+}
+
+// newEvolvedRegistry returns a registry holding v1, a v2 that renames name to
+// fullName and adds email, and a v3 that widens age and splits fullName with
+// an upcaster
+func newEvolvedRegistry(t *testing.T) *SchemaRegistry {
+	t.Helper()
+	registry := newTestRegistry(t, CompatibilityBackward)
+	v2 := Schema{Version: 2, Fields: []Field{
+		{Name: "id", Type: "int"},
+		{Name: "fullName", Type: "string", Aliases: []string{"name"}},
+		{Name: "age", Type: "int"},
+		{Name: "email", Type: "string", Default: ""},
+	}}
+	v3 := Schema{Version: 3, Fields: []Field{
+		{Name: "id", Type: "int"},
+		{Name: "firstName", Type: "string", Default: ""},
+		{Name: "lastName", Type: "string", Default: ""},
+		{Name: "age", Type: "double"},
+		{Name: "email", Type: "string", Default: ""},
+	}}
+	for _, schema := range []Schema{v2, v3} {
+		if err := registry.RegisterSchema(schema.Version, schema); err != nil {
+			t.Fatal(err)
+		}
+	}
+	registry.RegisterUpcaster(2, func(record map[string]interface{}) (map[string]interface{}, error) {
+		first, last, _ := strings.Cut(record["fullName"].(string), " ")
+		delete(record, "fullName")
+		record["firstName"], record["lastName"] = first, last
+		return record, nil
+	})
+	return registry
+}
+
+func TestUpcastChainsVersions(t *testing.T) {
+	registry := newEvolvedRegistry(t)
+	record, version, err := registry.Upcast(map[string]interface{}{"id": 1.0, "name": "Ada Lovelace", "age": 36.0}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 3 {
+		t.Errorf("version = %d, want 3", version)
+	}
+	want := map[string]interface{}{"id": 1.0, "firstName": "Ada", "lastName": "Lovelace", "age": 36.0, "email": ""}
+	if len(record) != len(want) {
+		t.Fatalf("record = %v, want %v", record, want)
+	}
+	for field, value := range want {
+		if record[field] != value {
+			t.Errorf("%s = %v, want %v", field, record[field], value)
+		}
+	}
+
+	if _, _, err := registry.Upcast(map[string]interface{}{"id": 1.0}, 9); err == nil {
+		t.Error("upcasting from an unknown version succeeded")
+	}
+}
+
+func TestTransformDataUpcastsMixedBatch(t *testing.T) {
+	registry := newEvolvedRegistry(t)
+	batch := [][]byte{
+		[]byte(`{"id": 1, "name": "Ada Lovelace", "age": 36}`),
+		[]byte(`{"id": 2, "fullName": "Alan Turing", "age": 41, "email": "alan@example.com", "schemaVersion": 2}`),
+		[]byte(`{"id": 3, "firstName": "Grace", "lastName": "Hopper", "age": 85.5, "schemaVersion": 3}`),
+		[]byte(`{"id": 4, "schemaVersion": "two"}`),
+	}
+	deadLetters := NewDeadLetterQueue()
+	var records []map[string]interface{}
+	if err := json.Unmarshal(transformData(WorkMessage{BatchID: 1, Batch: batch, SchemaVersion: 1}, registry, deadLetters), &records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("got %d records, want 3 without the one with an invalid version: %v", len(records), records)
+	}
+	if letters := deadLetters.Letters(); len(letters) != 1 || string(letters[0].Record) != string(batch[3]) {
+		t.Errorf("dead letters = %v, want the record with an invalid version", letters)
+	}
+	wantFirst := []string{"Ada", "Alan", "Grace"}
+	wantEmail := []string{"", "alan@example.com", ""}
+	for i, record := range records {
+		if record["firstName"] != wantFirst[i] || record["email"] != wantEmail[i] {
+			t.Errorf("record %d = %v, want firstName %q and email %q", i, record, wantFirst[i], wantEmail[i])
+		}
+		if _, ok := record["fullName"]; ok {
+			t.Errorf("record %d kept fullName: %v", i, record)
+		}
+	}
+}
+
+func TestValidateRecordCoercesTypes(t *testing.T) {
+	schema := Schema{Version: 1, Fields: []Field{
+		{Name: "id", Type: "int"},
+		{Name: "score", Type: "float"},
+		{Name: "name", Type: "string"},
+		{Name: "active", Type: "bool"},
+		{Name: "seen", Type: "timestamp"},
+		{Name: "note", Type: "string", Nullable: true},
+		{Name: "tier", Type: "string", Default: "free"},
+	}}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(`{"id": "42", "score": "9.5", "name": 7, "active": "true", "seen": "2024-03-01T09:30:00+13:00", "extra": 1}`), &record); err != nil {
+		t.Fatal(err)
+	}
+	got, err := validateRecord(record, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"id": int64(42), "score": 9.5, "name": "7", "active": true,
+		"seen": "2024-02-29T20:30:00Z", "note": nil, "tier": "free",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("record = %v, want %v", got, want)
+	}
+	for field, value := range want {
+		if got[field] != value {
+			t.Errorf("%s = %#v, want %#v", field, got[field], value)
+		}
+	}
+}
+
+func TestValidateRecordRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		field  Field
+		record string
+		reason string
+	}{
+		{"word as int", Field{Name: "age", Type: "int"}, `{"age": "thirty"}`, `field "age": "thirty" is not an int`},
+		{"fraction as int", Field{Name: "age", Type: "int"}, `{"age": 30.5}`, `field "age": 30.5 is not an int`},
+		{"word as float", Field{Name: "score", Type: "float"}, `{"score": "high"}`, `field "score": "high" is not a float`},
+		{"object as string", Field{Name: "name", Type: "string"}, `{"name": {"first": "Ada"}}`, `field "name": map[first:Ada] is not a string`},
+		{"number as bool", Field{Name: "active", Type: "bool"}, `{"active": 1}`, `field "active": 1 is not a bool`},
+		{"bad timestamp", Field{Name: "seen", Type: "timestamp"}, `{"seen": "yesterday"}`, `field "seen": "yesterday" is not an RFC 3339 timestamp`},
+		{"null", Field{Name: "name", Type: "string"}, `{"name": null}`, `field "name": null is not allowed for string`},
+		{"missing", Field{Name: "name", Type: "string"}, `{}`, `field "name": required field missing`},
+		{"unknown type", Field{Name: "tags", Type: "array"}, `{"tags": []}`, `field "tags": unknown type array`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var record map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.record), &record); err != nil {
+				t.Fatal(err)
+			}
+			_, err := validateRecord(record, Schema{Version: 1, Fields: []Field{tt.field}})
+			if err == nil || err.Error() != tt.reason {
+				t.Errorf("error = %v, want %s", err, tt.reason)
+			}
+		})
+	}
+}
+
+func TestNullableFieldCompatibility(t *testing.T) {
+	registry := newTestRegistry(t, CompatibilityFull)
+	if err := registry.RegisterSchema(2, withFields(2, func(fields []Field) []Field {
+		return append(fields, Field{Name: "email", Type: "string", Nullable: true})
+	})); err != nil {
+		t.Fatalf("adding a nullable field: %v", err)
+	}
+	err := registry.RegisterSchema(3, withFields(3, func(fields []Field) []Field {
+		return append(fields, Field{Name: "email", Type: "string", Default: ""})
+	}))
+	var compatibilityErr *CompatibilityError
+	if !errors.As(err, &compatibilityErr) || len(compatibilityErr.Incompatibilities) != 1 || compatibilityErr.Incompatibilities[0].Field != "email" {
+		t.Fatalf("making a nullable field not nullable: error = %v, want one incompatibility on email", err)
+	}
+}
+
+func TestTransformDataDeadLettersAndReplay(t *testing.T) {
+	registry := newTestRegistry(t, CompatibilityBackward)
+	batch := [][]byte{
+		[]byte(`{"id": 1, "name": "Ada", "age": "36"}`),
+		[]byte(`{"id": 2, "name": "Alan", "age": "thirty"}`),
+		[]byte(`{"id": 3, "name": "Grace"`),
+		[]byte(`{"id": 4, "age": 85}`),
+		[]byte(`{"id": 5, "name": "Edsger", "age": 72, "schemaVersion": 2}`),
+	}
+	deadLetters := NewDeadLetterQueue()
+	var records []map[string]interface{}
+	if err := json.Unmarshal(transformData(WorkMessage{BatchID: 7, Batch: batch, SchemaVersion: 1}, registry, deadLetters), &records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0]["age"] != 36.0 {
+		t.Fatalf("records = %v, want only Ada with her age coerced", records)
+	}
+
+	letters := deadLetters.Letters()
+	wantReasons := []string{
+		`validating record against schema version 1: field "age": "thirty" is not an int`,
+		"unmarshaling record: unexpected end of JSON input",
+		`validating record against schema version 1: field "name": required field missing`,
+		"upcasting record: schema not found for version 2",
+	}
+	wantVersions := []int{1, 1, 1, 2}
+	if len(letters) != len(wantReasons) {
+		t.Fatalf("dead letters = %v, want %d", letters, len(wantReasons))
+	}
+	for i, letter := range letters {
+		if string(letter.Record) != string(batch[i+1]) || letter.BatchID != 7 ||
+			letter.SchemaVersion != wantVersions[i] || letter.Reason != wantReasons[i] {
+			t.Errorf("dead letter %d = %+v, want record %s of batch 7 at version %d: %s",
+				i, letter, batch[i+1], wantVersions[i], wantReasons[i])
+		}
+	}
+
+	// Registering the version the last record was written with fixes it alone
+	if err := registry.RegisterSchema(2, withFields(2, func(fields []Field) []Field {
+		return append(fields, Field{Name: "email", Type: "string", Nullable: true})
+	})); err != nil {
+		t.Fatal(err)
+	}
+	records = nil
+	if err := json.Unmarshal(replayDeadLetters(deadLetters, registry), &records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0]["name"] != "Edsger" || records[0]["email"] != nil {
+		t.Fatalf("replayed records = %v, want only Edsger with a null email", records)
+	}
+	letters = deadLetters.Letters()
+	if len(letters) != 3 {
+		t.Fatalf("dead letters after replay = %v, want the 3 still failing", letters)
+	}
+	if want := `validating record against schema version 2: field "age": "thirty" is not an int`; letters[0].Reason != want {
+		t.Errorf("reason after replay = %q, want %q", letters[0].Reason, want)
+	}
+}
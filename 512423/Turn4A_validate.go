@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// validateRecord checks a record against a schema and returns it with only
+// the schema's fields, each coerced to its declared type. Missing fields take
+// their defaults, or null if they are nullable; a missing field with neither
+// is required and fails the record
+func validateRecord(record map[string]interface{}, schema Schema) (map[string]interface{}, error) {
+	validated := make(map[string]interface{}, len(schema.Fields))
+	for _, field := range schema.Fields {
+		value, ok := record[field.Name]
+		if !ok {
+			if field.Default == nil && !field.Nullable {
+				return nil, fmt.Errorf("field %q: required field missing", field.Name)
+			}
+			value = field.Default
+		}
+		coerced, err := coerce(value, field)
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %v", field.Name, err)
+		}
+		validated[field.Name] = coerced
+	}
+	return validated, nil
+}
+
+// coerce converts a decoded JSON value to a field's type. Numbers and
+// booleans written as strings are parsed, numbers are formatted as strings,
+// and timestamps are read from RFC 3339 strings or Unix seconds and written
+// as RFC 3339 in UTC
+func coerce(value interface{}, field Field) (interface{}, error) {
+	if value == nil {
+		if !field.Nullable {
+			return nil, fmt.Errorf("null is not allowed for %s", field.Type)
+		}
+		return nil, nil
+	}
+	switch field.Type {
+	case "int", "long":
+		return coerceInt(value)
+	case "float", "double":
+		return coerceFloat(value)
+	case "string", "bytes":
+		return coerceString(value)
+	case "bool":
+		return coerceBool(value)
+	case "timestamp":
+		return coerceTimestamp(value)
+	}
+	return nil, fmt.Errorf("unknown type %s", field.Type)
+}
+
+func coerceInt(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case float64:
+		if v != math.Trunc(v) || math.Abs(v) > 1<<53 {
+			return nil, fmt.Errorf("%v is not an int", v)
+		}
+		return int64(v), nil
+	case string:
+		n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an int", v)
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("%v is not an int", value)
+}
+
+func coerceFloat(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("%q is not a float", v)
+		}
+		return f, nil
+	}
+	return nil, fmt.Errorf("%v is not a float", value)
+}
+
+func coerceString(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return nil, fmt.Errorf("%v is not a string", value)
+}
+
+func coerceBool(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a bool", v)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("%v is not a bool", value)
+}
+
+func coerceTimestamp(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an RFC 3339 timestamp", v)
+		}
+		return t.UTC().Format(time.RFC3339Nano), nil
+	case float64:
+		seconds, fraction := math.Modf(v)
+		return time.Unix(int64(seconds), int64(fraction*1e9)).UTC().Format(time.RFC3339Nano), nil
+	case int:
+		return time.Unix(int64(v), 0).UTC().Format(time.RFC3339Nano), nil
+	case int64:
+		return time.Unix(v, 0).UTC().Format(time.RFC3339Nano), nil
+	}
+	return nil, fmt.Errorf("%v is not a timestamp", value)
+}